@@ -130,3 +130,262 @@ Feature: Podmon Main
       | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value3.yaml"             | "error with configuration parameters"    |
       | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value4.yaml"             | "error with configuration parameters"    |
       | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value5.yaml"             | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value6.yaml"             | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value7.yaml"             | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value8.yaml"             | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value9.yaml"             | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value10.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value11.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value12.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value13.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value14.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value15.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value16.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value17.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value18.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value19.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value20.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value21.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value22.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value23.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value24.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value25.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value26.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value27.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value28.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value29.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value30.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value31.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value32.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value33.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value34.yaml"            | "error with configuration parameters"    |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-bad-value35.yaml"            | "error with configuration parameters"    |
+
+  Scenario Outline: Test the metrics endpoint
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the metrics server is started on <address>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                        | address |
+      | "localhost"  | "1234"  | "--mode=controller --metricsAddress=:9100"                  | ":9100" |
+      | "localhost"  | "1234"  | "--mode=node --leaderelection=false --metricsAddress=:9101" | ":9101" |
+      | "localhost"  | "1234"  | "--mode=controller"                                         | "none"  |
+
+  Scenario Outline: Test the status API
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the status server is started on <address>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                       | address |
+      | "localhost"  | "1234"  | "--mode=controller --statusAddress=:9102"                  | ":9102" |
+      | "localhost"  | "1234"  | "--mode=node --leaderelection=false --statusAddress=:9103" | ":9103" |
+      | "localhost"  | "1234"  | "--mode=controller"                                        | "none"  |
+
+  Scenario Outline: Test resuming unfinished cleanups when becoming the leader
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the unfinished cleanups are resumed <resumed>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                       | resumed |
+      | "localhost"  | "1234"  | "--mode=controller --leaderelection=false" | "true"  |
+      | "localhost"  | "1234"  | "--mode=node --leaderelection=false"       | "false" |
+
+  Scenario Outline: Test enabling dry-run mode
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then dry-run mode is <enabled>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                | enabled |
+      | "localhost"  | "1234"  | "--mode=controller"                                                 | "false" |
+      | "localhost"  | "1234"  | "--mode=controller --dryRun=true"                                   | "true"  |
+      | "localhost"  | "1234"  | "--mode=node --dryRun=true"                                         | "true"  |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-dry-run.yaml" | "true"  |
+
+  Scenario Outline: Test setting the failover limits
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the failover limits are <nodes> nodes <percent> percent <window> seconds
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                                      | nodes | percent | window |
+      | "localhost"  | "1234"  | "--mode=controller"                                                                       | 0     | 0       | 300    |
+      | "localhost"  | "1234"  | "--mode=controller --maxFailoverNodes=2 --maxFailoverNodesPercent=10 --failoverWindow=60" | 2     | 10      | 60     |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-failover.yaml"                     | 3     | 20      | 600    |
+
+  Scenario Outline: Test setting the fencing and cleanup limits
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the fencing limits are <concurrency> volumes <deadline> seconds
+    And the cleanup concurrency is <cleanups>
+    And the fencing mode is <fencing>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                                                               | concurrency | deadline | cleanups | fencing          |
+      | "localhost"  | "1234"  | "--mode=controller"                                                                                                | 10          | 300      | 10       | "podmon"         |
+      | "localhost"  | "1234"  | "--mode=controller --fencingConcurrency=2 --cleanupDeadline=60 --cleanupConcurrency=3 --fencingMode=out-of-service" | 2           | 60       | 3        | "out-of-service" |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-fencing.yaml"                                               | 4           | 120      | 6        | "out-of-service" |
+
+  Scenario Outline: Test setting the recovery stable period
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the recovery stable period is <period> seconds
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                   | period |
+      | "localhost"  | "1234"  | "--mode=controller"                                                    | 300    |
+      | "localhost"  | "1234"  | "--mode=controller --recoveryStablePeriod=0"                           | 0      |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-recovery.yaml" | 600    |
+
+  Scenario Outline: Test setting the max force delete grace period
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the max force delete grace period is <period> seconds
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                      | period |
+      | "localhost"  | "1234"  | "--mode=controller"                                                       | 600    |
+      | "localhost"  | "1234"  | "--mode=controller --maxForceDeleteGracePeriod=60"                        | 60     |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-force-delete.yaml" | 1800   |
+
+  Scenario Outline: Test setting the CrashLoopBackOff limits
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the CrashLoopBackOff limits are <retries> retries backoff <backoff> window <window> storage errors only <storage>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                                                                                                  | retries | backoff | window | storage |
+      | "localhost"  | "1234"  | "--mode=controller"                                                                                                                                   | 5       | 0       | 0      | "false" |
+      | "localhost"  | "1234"  | "--mode=controller --crashLoopBackOffMaxRetries=2 --crashLoopBackOffBackoff=10 --crashLoopBackOffWindow=600 --crashLoopBackOffStorageErrorsOnly=true" | 2       | 10      | 600    | "true"  |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-crashloop.yaml"                                                                                | 3       | 30      | 3600   | "true"  |
+
+  Scenario Outline: Test setting the orphaned VolumeAttachment reconciler
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the orphaned VolumeAttachment mode is <mode> NotReady period <period> seconds
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                        | mode       | period |
+      | "localhost"  | "1234"  | "--mode=controller"                                                         | "report"   | 600    |
+      | "localhost"  | "1234"  | "--mode=controller --orphanedVAMode=disabled --orphanedVANotReadyPeriod=60" | "disabled" | 60     |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-orphaned-va.yaml"    | "delete"   | 1800   |
+
+  Scenario Outline: Test setting the driver node pod limits
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the driver pod limits are grace <grace> escalation <escalation> flaps <flaps> window <window>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                                                                            | grace | escalation | flaps | window |
+      | "localhost"  | "1234"  | "--mode=controller"                                                                                                             | 0     | 0          | 0     | 600    |
+      | "localhost"  | "1234"  | "--mode=controller --driverPodGracePeriod=60 --driverPodEscalationPeriod=600 --driverPodFlapLimit=4 --driverPodFlapWindow=1200" | 60    | 600        | 4     | 1200   |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-driver-pod.yaml"                                                         | 30    | 300        | 3     | 900    |
+
+  Scenario Outline: Test setting the node connectivity report interval
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the node connectivity report interval is <interval> seconds
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                                   | interval |
+      | "localhost"  | "1234"  | "--mode=controller"                                                                    | 0        |
+      | "localhost"  | "1234"  | "--mode=node --csisock=unix:/var/run/csi/csi.sock --nodeConnectivityReportInterval=60" | 60       |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-node-connectivity.yaml"         | 30       |
+
+  Scenario Outline: Test setting the array connectivity hysteresis and flap detection
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the array connectivity recovery threshold is <recovery> flaps <flaps> window <window> policy <policy>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                                                                                                             | recovery | flaps | window | policy   |
+      | "localhost"  | "1234"  | "--mode=controller"                                                                                                                                              | 1        | 4     | 10     | "report" |
+      | "localhost"  | "1234"  | "--mode=controller --arrayConnectivityRecoveryThreshold=2 --arrayConnectivityFlapThreshold=3 --arrayConnectivityFlapWindow=8 --arrayConnectivityFlapPolicy=loss" | 2        | 3     | 8      | "loss"   |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-array-flap.yaml"                                                                                          | 3        | 5     | 12     | "loss"   |
+
+  Scenario Outline: Test setting the array connectivity poll limits
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the array connectivity poll concurrency is <concurrency> deadline <deadline> seconds
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                                        | concurrency | deadline |
+      | "localhost"  | "1234"  | "--mode=controller"                                                                         | 10          | 0        |
+      | "localhost"  | "1234"  | "--mode=controller --arrayConnectivityPollConcurrency=25 --arrayConnectivityPollDeadline=5" | 25          | 5        |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-array-poll.yaml"                     | 50          | 12       |
+
+  Scenario Outline: Test setting the array connectivity publishing
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then publishing the array connectivity is <publish>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                 | publish |
+      | "localhost"  | "1234"  | "--mode=controller"                                                  | "true"  |
+      | "localhost"  | "1234"  | "--mode=controller --publishArrayConnectivity=false"                 | "false" |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-publish.yaml" | "false" |
+
+  Scenario Outline: Test setting the array outage nodes percent
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the array outage nodes percent is <percent>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                      | percent |
+      | "localhost"  | "1234"  | "--mode=controller"                                                       | 0       |
+      | "localhost"  | "1234"  | "--mode=controller --arrayOutageNodesPercent=60"                          | 60      |
+      | "localhost"  | "1234"  | "--driver-config-params=resources/driver-config-params-array-outage.yaml" | 75      |
+
+  Scenario Outline: Test managing additional drivers
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the last log message contains <message>
+    And the additional drivers are <drivers>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                                                                                                                                                                                                                           | message                       | drivers                                                                                                             |
+      | "localhost"  | "1234"  | "--mode=controller"                                                                                                                                                                                                                                                            | "leader election: true"       | "none"                                                                                                              |
+      | "localhost"  | "1234"  | "--mode=controller --additionalDrivers=driverPath=csi-powerstore.dellemc.com,csisock=unix:/var/run/csi/powerstore.sock,labelvalue=csi-powerstore"                                                                                                                              | "leader election: true"       | "csi-powerstore.dellemc.com=powerstore.podmon.storage.dell.com"                                                     |
+      | "localhost"  | "1234"  | "--mode=controller --additionalDrivers=driverPath=csi-powerstore.dellemc.com,csisock=unix:/var/run/csi/powerstore.sock,labelvalue=csi-powerstore;driverPath=csi-unity.dellemc.com,csisock=unix:/var/run/csi/unity.sock,labelkey=podmon.dellemc.com/unity,labelvalue=csi-unity" | "leader election: true"       | "csi-powerstore.dellemc.com=powerstore.podmon.storage.dell.com,csi-unity.dellemc.com=unity.podmon.storage.dell.com" |
+      | "localhost"  | "1234"  | "--mode=node --additionalDrivers=driverPath=csi-powerstore.dellemc.com,csisock=unix:/var/run/csi/powerstore.sock,labelvalue=csi-powerstore"                                                                                                                                    | "leader election: true"       | "none"                                                                                                              |
+      # Error cases
+      | "localhost"  | "1234"  | "--mode=controller --additionalDrivers=driverPath=csi-powerstore.dellemc.com,labelvalue=csi-powerstore"                                                                                                                                                                        | "invalid --additionalDrivers" | "none"                                                                                                              |
+      | "localhost"  | "1234"  | "--mode=controller --additionalDrivers=driverPath=csi-powerstore.dellemc.com,socket=unix:/var/run/csi/powerstore.sock"                                                                                                                                                         | "invalid --additionalDrivers" | "none"                                                                                                              |
+      | "localhost"  | "1234"  | "--mode=controller --additionalDrivers=driverPath=csi-vxflexos.dellemc.com,csisock=unix:/var/run/csi/vxflexos.sock,labelvalue=csi-vxflexos"                                                                                                                                    | "invalid --additionalDrivers" | "none"                                                                                                              |
+
+  Scenario Outline: Test loading generic drivers from the driver types file
+    Given a podmon instance
+    And Podmon env vars set to <k8sHostValue>:<k8sPort>
+    And I invoke main with arguments <args>
+    Then the last log message contains <message>
+    And the driver name is <name>
+
+    Examples:
+      | k8sHostValue | k8sPort | args                                                                                                                                                                                                    | message                           | name         |
+      | "localhost"  | "1234"  | "--driverPath=csi-powerstore.dellemc.com"                                                                                                                                                               | "leader election: true"           | "powerstore" |
+      | "localhost"  | "1234"  | "--driverTypesFile=resources/driver-types.yaml --driverPath=csi-example.dell.com"                                                                                                                       | "leader election: true"           | "example"    |
+      | "localhost"  | "1234"  | "--driverTypesFile=resources/driver-types.yaml --driverPath=csi-unity.dellemc.com"                                                                                                                      | "leader election: true"           | "unity"      |
+      | "localhost"  | "1234"  | "--driverTypesFile=resources/driver-types.yaml --driverPath=csi-vxflexos.dellemc.com --additionalDrivers=driverPath=csi-example.dell.com,csisock=unix:/var/run/csi/example.sock,labelvalue=csi-example" | "leader election: true"           | "vxflexos"   |
+      # Error cases
+      | "localhost"  | "1234"  | "--driverTypesFile=resources/fake.yaml"                                                                                                                                                                 | "couldn't load --driverTypesFile" | "vxflexos"   |
+      | "localhost"  | "1234"  | "--driverTypesFile=resources/driver-types-bad.yaml"                                                                                                                                                     | "driverBlockDev is required"      | "vxflexos"   |
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"podmon/internal/csiapi"
 	"podmon/internal/k8sapi"
+	"podmon/internal/metrics"
 	"podmon/internal/monitor"
 	"strconv"
 	"strings"
@@ -50,6 +51,39 @@ const (
 	driverPath                               = "csi-vxflexos.dellemc.com"
 	driverConfigParamsDefault                = "resources/driver-config-params.yaml"
 	ignoreVolumelessPods                     = false
+	metricsAddress                           = ""
+	statusAddress                            = ""
+	dryRun                                   = false
+	maxFailoverNodes                         = 0
+	maxFailoverNodesPercent                  = 0
+	failoverWindow                           = 300
+	fencingConcurrency                       = 10
+	cleanupDeadline                          = 300
+	cleanupConcurrency                       = 10
+	fencingMode                              = monitor.FencingModePodmon
+	recoveryStablePeriod                     = 300
+	maxForceDeleteGracePeriod                = 600
+	crashLoopBackOffMaxRetries               = monitor.MaxCrashLoopBackOffRetry
+	crashLoopBackOffBackoff                  = 0
+	crashLoopBackOffWindow                   = 0
+	crashLoopBackOffStorageErrorsOnly        = false
+	orphanedVAMode                           = monitor.OrphanedVAModeReport
+	orphanedVANotReadyPeriod                 = 600
+	driverPodGracePeriod                     = 0
+	driverPodEscalationPeriod                = 0
+	driverPodFlapLimit                       = 0
+	driverPodFlapWindow                      = 600
+	additionalDrivers                        = ""
+	driverTypesFile                          = ""
+	nodeConnectivityReportInterval           = 0
+	arrayConnectivityRecoveryThreshold       = 1
+	arrayConnectivityFlapThreshold           = 4
+	arrayConnectivityFlapWindow              = 10
+	arrayConnectivityFlapPolicy              = monitor.ArrayConnectivityFlapPolicyReport
+	arrayConnectivityPollConcurrency         = 10
+	arrayConnectivityPollDeadline            = 0
+	publishArrayConnectivity                 = true
+	arrayOutageNodesPercent                  = 0
 	// -- Below are constants for dynamic configuration --
 	defaultLogLevel                                = log.DebugLevel
 	podmonArrayConnectivityPollRate                = "PODMON_ARRAY_CONNECTIVITY_POLL_RATE"
@@ -59,6 +93,35 @@ const (
 	podmonNodeLogFormat                            = "PODMON_NODE_LOG_FORMAT"
 	podmonNodeLogLevel                             = "PODMON_NODE_LOG_LEVEL"
 	podmonSkipArrayConnectionValidation            = "PODMON_SKIP_ARRAY_CONNECTION_VALIDATION"
+	podmonDryRun                                   = "PODMON_DRY_RUN"
+	podmonMaxFailoverNodes                         = "PODMON_MAX_FAILOVER_NODES"
+	podmonMaxFailoverNodesPercent                  = "PODMON_MAX_FAILOVER_NODES_PERCENT"
+	podmonFailoverWindow                           = "PODMON_FAILOVER_WINDOW"
+	podmonFencingConcurrency                       = "PODMON_FENCING_CONCURRENCY"
+	podmonCleanupDeadline                          = "PODMON_CLEANUP_DEADLINE"
+	podmonCleanupConcurrency                       = "PODMON_CLEANUP_CONCURRENCY"
+	podmonFencingMode                              = "PODMON_FENCING_MODE"
+	podmonRecoveryStablePeriod                     = "PODMON_RECOVERY_STABLE_PERIOD"
+	podmonMaxForceDeleteGracePeriod                = "PODMON_MAX_FORCE_DELETE_GRACE_PERIOD"
+	podmonCrashLoopBackOffMaxRetries               = "PODMON_CRASHLOOPBACKOFF_MAX_RETRIES"
+	podmonCrashLoopBackOffBackoff                  = "PODMON_CRASHLOOPBACKOFF_BACKOFF"
+	podmonCrashLoopBackOffWindow                   = "PODMON_CRASHLOOPBACKOFF_WINDOW"
+	podmonCrashLoopBackOffStorageErrorsOnly        = "PODMON_CRASHLOOPBACKOFF_STORAGE_ERRORS_ONLY"
+	podmonOrphanedVAMode                           = "PODMON_ORPHANED_VA_MODE"
+	podmonOrphanedVANotReadyPeriod                 = "PODMON_ORPHANED_VA_NOT_READY_PERIOD"
+	podmonDriverPodGracePeriod                     = "PODMON_DRIVER_POD_GRACE_PERIOD"
+	podmonDriverPodEscalationPeriod                = "PODMON_DRIVER_POD_ESCALATION_PERIOD"
+	podmonDriverPodFlapLimit                       = "PODMON_DRIVER_POD_FLAP_LIMIT"
+	podmonDriverPodFlapWindow                      = "PODMON_DRIVER_POD_FLAP_WINDOW"
+	podmonNodeConnectivityReportInterval           = "PODMON_NODE_CONNECTIVITY_REPORT_INTERVAL"
+	podmonArrayConnectivityRecoveryThreshold       = "PODMON_ARRAY_CONNECTIVITY_RECOVERY_THRESHOLD"
+	podmonArrayConnectivityFlapThreshold           = "PODMON_ARRAY_CONNECTIVITY_FLAP_THRESHOLD"
+	podmonArrayConnectivityFlapWindow              = "PODMON_ARRAY_CONNECTIVITY_FLAP_WINDOW"
+	podmonArrayConnectivityFlapPolicy              = "PODMON_ARRAY_CONNECTIVITY_FLAP_POLICY"
+	podmonArrayConnectivityPollConcurrency         = "PODMON_ARRAY_CONNECTIVITY_POLL_CONCURRENCY"
+	podmonArrayConnectivityPollDeadline            = "PODMON_ARRAY_CONNECTIVITY_POLL_DEADLINE"
+	podmonPublishArrayConnectivity                 = "PODMON_PUBLISH_ARRAY_CONNECTIVITY"
+	podmonArrayOutageNodesPercent                  = "PODMON_ARRAY_OUTAGE_NODES_PERCENT"
 	driverPodLabelKey                              = "driver.dellemc.com"
 	driverPodLabelValue                            = "dell-storage"
 )
@@ -78,9 +141,33 @@ var StartPodMonitorFn = monitor.StartPodMonitor
 // StartNodeMonitorFn is are reference to the function that initiates the NodeMonitor
 var StartNodeMonitorFn = monitor.StartNodeMonitor
 
+// StartMultiAttachMonitorFn is a reference to the function that initiates the repair of Multi-Attach errors
+var StartMultiAttachMonitorFn = monitor.StartMultiAttachMonitor
+
 // ArrayConnMonitorFc is are reference to the function that initiates the ArrayConnectivityMonitor
 var ArrayConnMonitorFc = monitor.PodMonitor.ArrayConnectivityMonitor
 
+// ResumeCleanupsFn is a reference to the function that resumes or rolls back unfinished cleanups recorded in the cleanup ledger
+var ResumeCleanupsFn = monitor.PodMonitor.ResumeCleanups
+
+// NodeRecoveryFn is a reference to the function that removes the podmon taint from nodes that have recovered
+var NodeRecoveryFn = monitor.PodMonitor.NodeRecoveryReconciler
+
+// OrphanedVAFn is a reference to the function that fences and deletes, or reports, orphaned VolumeAttachments
+var OrphanedVAFn = monitor.PodMonitor.OrphanedVolumeAttachmentReconciler
+
+// DriverPodFn is a reference to the function that taints, untaints, or cleans up the nodes whose driver node pod is down
+var DriverPodFn = monitor.PodMonitor.DriverPodReconciler
+
+// NodeConnectivityFn is a reference to the function that publishes the node's own view of its array connectivity
+var NodeConnectivityFn = monitor.PodMonitor.NodeConnectivityReporter
+
+// StartMetricsServerFn is a reference to the function that serves the Prometheus metrics endpoint
+var StartMetricsServerFn = metrics.ListenAndServe
+
+// StartStatusServerFn is a reference to the function that serves the status API
+var StartStatusServerFn = monitor.PodMonitor.ListenAndServeStatus
+
 // PodMonWait is reference to a function that handles podmon monitoring loop
 var PodMonWait = podMonWait
 
@@ -115,44 +202,42 @@ func main() {
 		return
 	}
 	log.Infof("Running in %s mode", monitor.PodMonitor.Mode)
-	switch {
-	case strings.Contains(*args.driverPath, "unity"):
-		log.Infof("CSI Driver for Unity")
-		monitor.Driver = new(monitor.UnityDriver)
-	case strings.Contains(*args.driverPath, "isilon"):
-		// added condition to create instance of PowerScale driver
-		log.Infof("CSI Driver for PowerScale")
-		monitor.Driver = new(monitor.PScaleDriver)
-	case strings.Contains(*args.driverPath, "powerstore"):
-		log.Infof("CSI Driver for PowerStore")
-		monitor.Driver = new(monitor.PStoreDriver)
-	case strings.Contains(*args.driverPath, "powermax"):
-		log.Infof("CSI Driver for PowerMax")
-		monitor.Driver = new(monitor.PMaxDriver)
-	default:
-		log.Infof("CSI Driver for VxFlex OS")
-		monitor.Driver = new(monitor.VxflexDriver)
+	if *args.metricsAddress != "" {
+		go func() {
+			_ = StartMetricsServerFn(*args.metricsAddress)
+		}()
+	}
+	if *args.statusAddress != "" {
+		go func() {
+			_ = StartStatusServerFn(*args.statusAddress)
+		}()
+	}
+	if *args.driverTypesFile != "" {
+		if err := monitor.LoadDriverTypes(*args.driverTypesFile); err != nil {
+			log.Errorf("couldn't load --driverTypesFile: %s", err)
+			return
+		}
+	}
+	monitor.Driver = monitor.GetDriverType(*args.driverPath)
+	additionalDrivers, err := parseAdditionalDrivers(*args.additionalDrivers)
+	if err != nil {
+		log.Errorf("invalid --additionalDrivers: %s", err)
+		return
 	}
 
 	monitor.PodmonTaintKey = fmt.Sprintf("%s.%s", monitor.Driver.GetDriverName(), monitor.PodmonTaintKeySuffix)
 	monitor.SetArrayConnectivityPollRate(time.Duration(*args.arrayConnectivityPollRate) * time.Second)
 	monitor.ArrayConnectivityConnectionLossThreshold = *args.arrayConnectivityConnectionLossThreshold
 	monitor.IgnoreVolumelessPods = *args.ignoreVolumelessPods
-	err := K8sAPI.Connect(args.kubeconfig)
+	err = K8sAPI.Connect(args.kubeconfig)
 	if err != nil {
 		log.Errorf("kubernetes connection error: %s", err)
 		return
 	}
 	monitor.K8sAPI = K8sAPI
 	if *args.csisock != "" {
-		clientOpts := []grpc.DialOption{
-			grpc.WithInsecure(),
-			grpc.WithBackoffMaxDelay(time.Second),
-			grpc.WithBlock(),
-			grpc.WithTimeout(10 * time.Second),
-		}
 		log.Infof("Attempting driver connection at: %s", *args.csisock)
-		monitor.CSIApi, err = GetCSIClient(*args.csisock, clientOpts...)
+		monitor.CSIApi, err = GetCSIClient(*args.csisock, csiClientOptions()...)
 		defer monitor.CSIApi.Close()
 		if monitor.PodMonitor.SkipArrayConnectionValidation {
 			log.Infof("Skipping array connection validation")
@@ -168,6 +253,17 @@ func main() {
 	}
 	monitor.PodMonitor.DriverPathStr = *args.driverPath
 	log.Infof("PodMonitor.DriverPathStr = %s", monitor.PodMonitor.DriverPathStr)
+	if len(additionalDrivers) > 0 && *args.mode == "node" {
+		log.Infof("Ignoring --additionalDrivers in node mode, each driver has its own node sidecar")
+		additionalDrivers = nil
+	}
+	for _, driver := range additionalDrivers {
+		if err = connectAdditionalDriver(driver); err != nil {
+			log.Errorf("Couldn't connect to driver %s at %s: %s", driver.Path, driver.csisock, err)
+			return
+		}
+		defer driver.API.Close()
+	}
 	run := func(context.Context) {
 		if *args.mode == "node" {
 			err := StartAPIMonitorFn(K8sAPI, monitor.APICheckFirstTryTimeout, monitor.APICheckRetryTimeout, monitor.APICheckInterval, monitor.APIMonitorWait)
@@ -175,19 +271,44 @@ func main() {
 				log.Errorf("Couldn't start API monitor: %s", err.Error())
 				return
 			}
-		} else if *args.mode == "controller" {
 			if monitor.PodMonitor.CSIExtensionsPresent {
+				// report the node's connectivity to its arrays as a second signal for the controller
+				go NodeConnectivityFn()
+			}
+		} else if *args.mode == "controller" {
+			// cache the nodes, PVs, PVCs and VolumeAttachments, the API server is used if this fails
+			if err := K8sAPI.StartInformers(context.Background(), monitor.InformerResyncPeriod); err != nil {
+				log.Errorf("Couldn't start informers: %s", err.Error())
+			}
+			// finish or roll back any cleanups the previous leader left unfinished, without holding up the monitors
+			go ResumeCleanupsFn()
+			if monitor.PodMonitor.HasCSIExtensions() {
 				go ArrayConnMonitorFc()
+				// the recovery checks need ValidateVolumeHostConnectivity
+				go NodeRecoveryFn()
 			}
+			// clean up the VolumeAttachments left behind on gone, NotReady or tainted nodes
+			go OrphanedVAFn()
 			// monitor all the nodes with no label required
-			go StartNodeMonitorFn(K8sAPI, k8sapi.K8sClient.Client, "", "", monitor.MonitorRestartTimeDelay)
+			go StartNodeMonitorFn(K8sAPI, monitor.MonitorRestartTimeDelay)
+
+			// repair the Multi-Attach errors of replacement pods for the pods with the designated label key/value
+			go StartMultiAttachMonitorFn(K8sAPI, *args.labelKey, *args.labelValue, monitor.MonitorRestartTimeDelay)
+			for _, driver := range additionalDrivers {
+				go StartMultiAttachMonitorFn(K8sAPI, driver.LabelKey, driver.LabelValue, monitor.MonitorRestartTimeDelay)
+			}
 
 			// monitor the driver node pods
-			go StartPodMonitorFn(K8sAPI, k8sapi.K8sClient.Client, *args.driverPodLabelKey, *args.driverPodLabelValue, monitor.MonitorRestartTimeDelay)
+			go StartPodMonitorFn(K8sAPI, *args.driverPodLabelKey, *args.driverPodLabelValue, monitor.MonitorRestartTimeDelay)
+			go DriverPodFn()
 		}
 
 		// monitor the pods with the designated label key/value
-		go StartPodMonitorFn(K8sAPI, k8sapi.K8sClient.Client, *args.labelKey, *args.labelValue, monitor.MonitorRestartTimeDelay)
+		go StartPodMonitorFn(K8sAPI, *args.labelKey, *args.labelValue, monitor.MonitorRestartTimeDelay)
+		// and the pods with the label key/value of each additional driver
+		for _, driver := range additionalDrivers {
+			go StartPodMonitorFn(K8sAPI, driver.LabelKey, driver.LabelValue, monitor.MonitorRestartTimeDelay)
+		}
 
 		for {
 			log.Printf("podmon alive...")
@@ -207,6 +328,79 @@ func main() {
 	}
 }
 
+// csiClientOptions returns the dial options for connecting to a driver's CSI socket.
+func csiClientOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithBackoffMaxDelay(time.Second),
+		grpc.WithBlock(),
+		grpc.WithTimeout(10 * time.Second),
+	}
+}
+
+// additionalDriver is a CSI driver given by --additionalDrivers, along with the socket of its controller plugin.
+type additionalDriver struct {
+	*monitor.CSIDriver
+	csisock string
+}
+
+// parseAdditionalDrivers parses the --additionalDrivers value. The drivers are separated by ';', each given as
+// comma separated key=value pairs. The driverPath, csisock and labelvalue are required, the labelkey defaults to --labelkey.
+func parseAdditionalDrivers(value string) ([]*additionalDriver, error) {
+	drivers := make([]*additionalDriver, 0)
+	for _, spec := range strings.Split(value, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		driver := &additionalDriver{CSIDriver: &monitor.CSIDriver{LabelKey: *args.labelKey}}
+		for _, pair := range strings.Split(spec, ",") {
+			key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				return nil, fmt.Errorf("expected key=value but was %s", pair)
+			}
+			switch key {
+			case "driverPath":
+				driver.Path = val
+			case "csisock":
+				driver.csisock = val
+			case "labelkey":
+				driver.LabelKey = val
+			case "labelvalue":
+				driver.LabelValue = val
+			default:
+				return nil, fmt.Errorf("unknown key %s", key)
+			}
+		}
+		if driver.Path == "" || driver.csisock == "" || driver.LabelValue == "" {
+			return nil, fmt.Errorf("driverPath, csisock and labelvalue are required but were %s", spec)
+		}
+		if driver.Path == *args.driverPath {
+			return nil, fmt.Errorf("driver %s is already the --driverPath driver", driver.Path)
+		}
+		drivers = append(drivers, driver)
+	}
+	return drivers, nil
+}
+
+// connectAdditionalDriver connects to the driver's CSI socket, checks for the CSI extensions, and registers the driver with the PodMonitor.
+func connectAdditionalDriver(driver *additionalDriver) error {
+	var err error
+	driver.Type = monitor.GetDriverType(driver.Path)
+	log.Infof("Attempting driver connection at: %s", driver.csisock)
+	if driver.API, err = GetCSIClient(driver.csisock, csiClientOptions()...); err != nil {
+		return err
+	}
+	req := &csiext.ValidateVolumeHostConnectivityRequest{}
+	if _, err = driver.API.ValidateVolumeHostConnectivity(context.Background(), req); err != nil {
+		log.Errorf("Error checking presence of ValidateVolumeHostConnectivity for driver %s: %s", driver.Path, err.Error())
+	} else {
+		driver.ExtensionsPresent = true
+	}
+	monitor.PodMonitor.RegisterCSIDriver(driver.CSIDriver)
+	log.Infof("Managing driver %s with taint key %s for the pods with label %s=%s", driver.Path, driver.TaintKey, driver.LabelKey, driver.LabelValue)
+	return nil
+}
+
 // PodmonArgs is structure holding the podmon command arguments
 type PodmonArgs struct {
 	arrayConnectivityPollRate                *int    // time in seconds
@@ -223,6 +417,39 @@ type PodmonArgs struct {
 	driverPodLabelKey                        *string // driverPodLabelKey for annotating driver node pods to be watched/processed
 	driverPodLabelValue                      *string // driverPodLabelValue value for annotating driver node pods to be watched/processed
 	ignoreVolumelessPods                     *bool   // Ignore volumeless pods even if those has Resiliency label
+	metricsAddress                           *string // address (host:port) to serve Prometheus metrics on, disabled if empty
+	statusAddress                            *string // address (host:port) to serve the status API on, disabled if empty
+	dryRun                                   *bool   // report the actions that would be taken without taking them
+	maxFailoverNodes                         *int    // maximum number of nodes failed over within the failover window, 0 is unlimited
+	maxFailoverNodesPercent                  *int    // maximum percentage of cluster nodes failed over within the failover window, 0 is unlimited
+	failoverWindow                           *int    // time in seconds the failover limits apply to
+	fencingConcurrency                       *int    // maximum number of volumes fenced concurrently when cleaning up a pod
+	cleanupDeadline                          *int    // time in seconds from the start of a pod cleanup to finish fencing its volumes
+	cleanupConcurrency                       *int    // maximum number of pod cleanups run at the same time
+	fencingMode                              *string // how a failed node's volumes are released after fencing, podmon or out-of-service
+	recoveryStablePeriod                     *int    // time in seconds a tainted node must be stable before the controller untaints it, 0 disables
+	maxForceDeleteGracePeriod                *int    // largest time in seconds a pod's force delete grace period annotation may request
+	crashLoopBackOffMaxRetries               *int    // maximum number of times a pod in CrashLoopBackOff is deleted within the window
+	crashLoopBackOffBackoff                  *int    // time in seconds after the first CrashLoopBackOff deletion before the next, doubled after each one
+	crashLoopBackOffWindow                   *int    // time in seconds the CrashLoopBackOff deletions are counted in, 0 counts them until the pod is Ready
+	crashLoopBackOffStorageErrorsOnly        *bool   // only delete a pod in CrashLoopBackOff if its Warning Events or termination message show a storage error
+	orphanedVAMode                           *string // what to do with orphaned VolumeAttachments: delete, report, or disabled
+	orphanedVANotReadyPeriod                 *int    // time in seconds a node must be NotReady before its VolumeAttachments are orphans
+	driverPodGracePeriod                     *int    // time in seconds a driver node pod must be not Ready before its node is tainted
+	driverPodEscalationPeriod                *int    // time in seconds a driver node pod must be not Ready before the node's protected pods are cleaned up, 0 disables
+	driverPodFlapLimit                       *int    // number of times a driver node pod stops being Ready within the flap window to be flapping, 0 disables
+	driverPodFlapWindow                      *int    // time in seconds the driver node pod outages are counted in
+	additionalDrivers                        *string // CSI drivers managed by the controller in addition to the driverPath driver
+	driverTypesFile                          *string // YAML file of the generic drivers to register, disabled if empty
+	nodeConnectivityReportInterval           *int    // time in seconds between the node agent's array connectivity reports, 0 disables
+	arrayConnectivityRecoveryThreshold       *int    // number of consecutive connected polls that clear the connection loss count
+	arrayConnectivityFlapThreshold           *int    // number of connectivity changes within the flap window to be flapping, 0 disables
+	arrayConnectivityFlapWindow              *int    // number of connectivity polls the changes are counted in
+	arrayConnectivityFlapPolicy              *string // what is done about flapping connectivity, report or loss
+	arrayConnectivityPollConcurrency         *int    // maximum number of node:array pairs sampled concurrently in a connectivity poll
+	arrayConnectivityPollDeadline            *int    // time in seconds to sample all the node:array pairs in a connectivity poll, 0 is the poll rate
+	publishArrayConnectivity                 *bool   // publish the array connectivity as node conditions and annotations
+	arrayOutageNodesPercent                  *int    // percentage of the nodes using an array that must lose it for an array outage, 0 disables
 }
 
 var args PodmonArgs
@@ -244,6 +471,39 @@ func getArgs() {
 		args.driverPodLabelKey = flag.String("driverPodLabelKey", driverPodLabelKey, "label key for pods or other objects to be monitored")
 		args.driverPodLabelValue = flag.String("driverPodLabelValue", driverPodLabelValue, "label value for pods or other objects to be monitored")
 		args.ignoreVolumelessPods = flag.Bool("ignoreVolumelessPods", ignoreVolumelessPods, "ingnore volumeless pods even though they have podmon label")
+		args.metricsAddress = flag.String("metricsAddress", metricsAddress, "address like :9100 to serve Prometheus metrics at /metrics; disabled if empty")
+		args.statusAddress = flag.String("statusAddress", statusAddress, "address like :9102 to serve a read-only JSON snapshot of podmon's state at /status; disabled if empty")
+		args.dryRun = flag.Bool("dryRun", dryRun, "report the fencing, tainting, and pod deletions that would be done without doing them")
+		args.maxFailoverNodes = flag.Int("maxFailoverNodes", maxFailoverNodes, "maximum number of nodes to taint or clean up within the failover window before pausing; 0 is unlimited")
+		args.maxFailoverNodesPercent = flag.Int("maxFailoverNodesPercent", maxFailoverNodesPercent, "maximum percentage of cluster nodes to taint or clean up within the failover window before pausing; 0 is unlimited")
+		args.failoverWindow = flag.Int("failoverWindow", failoverWindow, "time in seconds the failover limits apply to")
+		args.fencingConcurrency = flag.Int("fencingConcurrency", fencingConcurrency, "maximum number of volumes fenced concurrently when cleaning up a pod")
+		args.cleanupDeadline = flag.Int("cleanupDeadline", cleanupDeadline, "time in seconds from the start of a pod cleanup to finish fencing its volumes")
+		args.cleanupConcurrency = flag.Int("cleanupConcurrency", cleanupConcurrency, "maximum number of pod cleanups run at the same time, highest priority pods first")
+		args.fencingMode = flag.String("fencingMode", fencingMode, "how a failed node's volumes are released after fencing: podmon (delete VolumeAttachments and pods) or out-of-service (apply the out-of-service taint)")
+		args.recoveryStablePeriod = flag.Int("recoveryStablePeriod", recoveryStablePeriod, "time in seconds a tainted node's UID and bootID must be unchanged before the controller removes the podmon taint, 0 disables")
+		args.maxForceDeleteGracePeriod = flag.Int("maxForceDeleteGracePeriod", maxForceDeleteGracePeriod, "largest time in seconds the podmon.dellemc.com/force-delete-grace-period annotation of a pod may request before it is force deleted, larger values are ignored")
+		args.crashLoopBackOffMaxRetries = flag.Int("crashLoopBackOffMaxRetries", crashLoopBackOffMaxRetries, "maximum number of times a pod in CrashLoopBackOff is deleted within the CrashLoopBackOff window")
+		args.crashLoopBackOffBackoff = flag.Int("crashLoopBackOffBackoff", crashLoopBackOffBackoff, "time in seconds after the first deletion of a pod in CrashLoopBackOff before it is deleted again, doubled after each deletion")
+		args.crashLoopBackOffWindow = flag.Int("crashLoopBackOffWindow", crashLoopBackOffWindow, "time in seconds the deletions of a pod in CrashLoopBackOff are counted in; 0 counts them until the pod is Ready")
+		args.crashLoopBackOffStorageErrorsOnly = flag.Bool("crashLoopBackOffStorageErrorsOnly", crashLoopBackOffStorageErrorsOnly, "only delete a pod in CrashLoopBackOff if its Warning Events or last termination message show a mount, I/O, or stale file handle error")
+		args.orphanedVAMode = flag.String("orphanedVAMode", orphanedVAMode, "what to do with the VolumeAttachments left on gone, long NotReady, or podmon tainted nodes: report (send an Event on the PV), delete (fence and delete them, those on gone nodes can't be fenced and are only reported), or disabled")
+		args.driverPodGracePeriod = flag.Int("driverPodGracePeriod", driverPodGracePeriod, "time in seconds a driver node pod must be not Ready before its node is tainted")
+		args.driverPodEscalationPeriod = flag.Int("driverPodEscalationPeriod", driverPodEscalationPeriod, "time in seconds a driver node pod must be not Ready before the protected pods on its node are cleaned up; 0 disables")
+		args.driverPodFlapLimit = flag.Int("driverPodFlapLimit", driverPodFlapLimit, "number of times a driver node pod must stop being Ready within the flap window to be flapping, keeping its node tainted until it is Ready for the window; 0 disables")
+		args.driverPodFlapWindow = flag.Int("driverPodFlapWindow", driverPodFlapWindow, "time in seconds the times a driver node pod stopped being Ready are counted in")
+		args.additionalDrivers = flag.String("additionalDrivers", additionalDrivers, "CSI drivers managed by the controller in addition to the driverPath driver, separated by ';', each given as driverPath=<name>,csisock=<socket>,labelvalue=<value>[,labelkey=<key>]")
+		args.driverTypesFile = flag.String("driverTypesFile", driverTypesFile, "YAML file describing the path templates and excluded errors of drivers to support without rebuilding podmon; disabled if empty")
+		args.orphanedVANotReadyPeriod = flag.Int("orphanedVANotReadyPeriod", orphanedVANotReadyPeriod, "time in seconds a node must be NotReady before its VolumeAttachments are considered orphaned")
+		args.arrayConnectivityRecoveryThreshold = flag.Int("arrayConnectivityRecoveryThreshold", arrayConnectivityRecoveryThreshold, "number of consecutive connected polls needed to clear the failed connection polls of a node and array")
+		args.arrayConnectivityFlapThreshold = flag.Int("arrayConnectivityFlapThreshold", arrayConnectivityFlapThreshold, "number of times the connectivity of a node to an array must change within the flap window to be flapping; 0 disables")
+		args.arrayConnectivityFlapWindow = flag.Int("arrayConnectivityFlapWindow", arrayConnectivityFlapWindow, "number of connectivity polls the connectivity changes of a node to an array are counted in")
+		args.arrayConnectivityFlapPolicy = flag.String("arrayConnectivityFlapPolicy", arrayConnectivityFlapPolicy, "what is done about flapping node to array connectivity: report (Event and metric only) or loss (treat flapping for arrayConnectivityConnectionLossThreshold polls as a connection loss)")
+		args.arrayConnectivityPollConcurrency = flag.Int("arrayConnectivityPollConcurrency", arrayConnectivityPollConcurrency, "maximum number of node and array pairs whose connectivity is checked concurrently in each poll")
+		args.arrayConnectivityPollDeadline = flag.Int("arrayConnectivityPollDeadline", arrayConnectivityPollDeadline, "time in seconds to check the connectivity of all the node and array pairs in each poll, pairs not checked by then are assumed connected; 0 uses the poll rate")
+		args.publishArrayConnectivity = flag.Bool("publishArrayConnectivity", publishArrayConnectivity, "publish each node's array connectivity as a node condition and a connected arrays annotation per driver")
+		args.arrayOutageNodesPercent = flag.Int("arrayOutageNodesPercent", arrayOutageNodesPercent, "percentage of the nodes using an array that must lose connectivity to it in a poll for an array outage, which suppresses their failover until the array recovers; 0 disables")
+		args.nodeConnectivityReportInterval = flag.Int("nodeConnectivityReportInterval", nodeConnectivityReportInterval, "time in seconds between the node agent's reports of its array connectivity, which must agree with the controller before a connectivity loss is counted; 0 disables")
 	})
 
 	// -- For testing purposes. Re-default the values since main will be called multiple times --
@@ -261,6 +521,39 @@ func getArgs() {
 	*args.driverPodLabelKey = driverPodLabelKey
 	*args.driverPodLabelValue = driverPodLabelValue
 	*args.ignoreVolumelessPods = ignoreVolumelessPods
+	*args.metricsAddress = metricsAddress
+	*args.statusAddress = statusAddress
+	*args.dryRun = dryRun
+	*args.maxFailoverNodes = maxFailoverNodes
+	*args.maxFailoverNodesPercent = maxFailoverNodesPercent
+	*args.failoverWindow = failoverWindow
+	*args.fencingConcurrency = fencingConcurrency
+	*args.cleanupDeadline = cleanupDeadline
+	*args.cleanupConcurrency = cleanupConcurrency
+	*args.fencingMode = fencingMode
+	*args.recoveryStablePeriod = recoveryStablePeriod
+	*args.maxForceDeleteGracePeriod = maxForceDeleteGracePeriod
+	*args.crashLoopBackOffMaxRetries = crashLoopBackOffMaxRetries
+	*args.crashLoopBackOffBackoff = crashLoopBackOffBackoff
+	*args.crashLoopBackOffWindow = crashLoopBackOffWindow
+	*args.crashLoopBackOffStorageErrorsOnly = crashLoopBackOffStorageErrorsOnly
+	*args.orphanedVAMode = orphanedVAMode
+	*args.orphanedVANotReadyPeriod = orphanedVANotReadyPeriod
+	*args.driverPodGracePeriod = driverPodGracePeriod
+	*args.driverPodEscalationPeriod = driverPodEscalationPeriod
+	*args.driverPodFlapLimit = driverPodFlapLimit
+	*args.driverPodFlapWindow = driverPodFlapWindow
+	*args.additionalDrivers = additionalDrivers
+	*args.driverTypesFile = driverTypesFile
+	*args.nodeConnectivityReportInterval = nodeConnectivityReportInterval
+	*args.arrayConnectivityRecoveryThreshold = arrayConnectivityRecoveryThreshold
+	*args.arrayConnectivityFlapThreshold = arrayConnectivityFlapThreshold
+	*args.arrayConnectivityFlapWindow = arrayConnectivityFlapWindow
+	*args.arrayConnectivityFlapPolicy = arrayConnectivityFlapPolicy
+	*args.arrayConnectivityPollConcurrency = arrayConnectivityPollConcurrency
+	*args.arrayConnectivityPollDeadline = arrayConnectivityPollDeadline
+	*args.publishArrayConnectivity = publishArrayConnectivity
+	*args.arrayOutageNodesPercent = arrayOutageNodesPercent
 	flag.Parse()
 }
 
@@ -321,7 +614,43 @@ func updateConfiguration(vc *viper.Viper) error {
 		}
 		log.WithField("monitor.ArrayConnectivityPollRate", monitor.GetArrayConnectivityPollRate()).Info(message)
 		log.WithField("monitor.ArrayConnectivityConnectionLossThreshold", monitor.ArrayConnectivityConnectionLossThreshold).Info(message)
+		log.WithField("monitor.ArrayConnectivityRecoveryThreshold", monitor.GetArrayConnectivityRecoveryThreshold()).Info(message)
+		flapThreshold, flapWindow := monitor.GetArrayConnectivityFlapLimits()
+		log.WithField("monitor.ArrayConnectivityFlapThreshold", flapThreshold).Info(message)
+		log.WithField("monitor.ArrayConnectivityFlapWindow", flapWindow).Info(message)
+		log.WithField("monitor.ArrayConnectivityFlapPolicy", monitor.GetArrayConnectivityFlapPolicy()).Info(message)
+		pollConcurrency, pollDeadline := monitor.GetArrayConnectivityPollLimits()
+		log.WithField("monitor.ArrayConnectivityPollConcurrency", pollConcurrency).Info(message)
+		log.WithField("monitor.ArrayConnectivityPollDeadline", pollDeadline).Info(message)
+		log.WithField("monitor.PublishArrayConnectivity", monitor.GetPublishArrayConnectivity()).Info(message)
+		log.WithField("monitor.ArrayOutageNodesPercent", monitor.GetArrayOutageNodesPercent()).Info(message)
 		log.WithField("monitor.PodMonitor.SkipArrayConnectionValidation", monitor.PodMonitor.SkipArrayConnectionValidation).Info(message)
+		log.WithField("monitor.DryRun", monitor.GetDryRun()).Info(message)
+		maxNodes, maxPercent, window := monitor.GetFailoverLimits()
+		log.WithField("monitor.MaxFailoverNodes", maxNodes).Info(message)
+		log.WithField("monitor.MaxFailoverNodesPercent", maxPercent).Info(message)
+		log.WithField("monitor.FailoverWindow", window).Info(message)
+		concurrency, deadline := monitor.GetFencingLimits()
+		log.WithField("monitor.FencingConcurrency", concurrency).Info(message)
+		log.WithField("monitor.CleanupDeadline", deadline).Info(message)
+		log.WithField("monitor.CleanupConcurrency", monitor.GetCleanupConcurrency()).Info(message)
+		log.WithField("monitor.FencingMode", monitor.GetFencingMode()).Info(message)
+		log.WithField("monitor.RecoveryStablePeriod", monitor.GetRecoveryStablePeriod()).Info(message)
+		log.WithField("monitor.MaxForceDeleteGracePeriod", monitor.GetMaxForceDeleteGracePeriod()).Info(message)
+		crashLoopRetries, crashLoopBackoff, crashLoopWindow := monitor.GetCrashLoopBackOffLimits()
+		log.WithField("monitor.CrashLoopBackOffMaxRetries", crashLoopRetries).Info(message)
+		log.WithField("monitor.CrashLoopBackOffBackoff", crashLoopBackoff).Info(message)
+		log.WithField("monitor.CrashLoopBackOffWindow", crashLoopWindow).Info(message)
+		log.WithField("monitor.CrashLoopBackOffStorageErrorsOnly", monitor.GetCrashLoopBackOffStorageErrorsOnly()).Info(message)
+		log.WithField("monitor.OrphanedVAMode", monitor.GetOrphanedVAMode()).Info(message)
+		log.WithField("monitor.OrphanedVANotReadyPeriod", monitor.GetOrphanedVANotReadyPeriod()).Info(message)
+		driverPodGrace, driverPodEscalation := monitor.GetDriverPodLimits()
+		log.WithField("monitor.DriverPodGracePeriod", driverPodGrace).Info(message)
+		log.WithField("monitor.DriverPodEscalationPeriod", driverPodEscalation).Info(message)
+		driverPodFlaps, driverPodWindow := monitor.GetDriverPodFlapLimits()
+		log.WithField("monitor.DriverPodFlapLimit", driverPodFlaps).Info(message)
+		log.WithField("monitor.DriverPodFlapWindow", driverPodWindow).Info(message)
+		log.WithField("monitor.NodeConnectivityReportInterval", monitor.GetNodeConnectivityReportInterval()).Info(message)
 	}()
 
 	if *args.mode == "controller" {
@@ -368,6 +697,121 @@ func updateConfiguration(vc *viper.Viper) error {
 	}
 	monitor.ArrayConnectivityConnectionLossThreshold = lossThreshold
 
+	recoveryThreshold := *args.arrayConnectivityRecoveryThreshold
+	if vc.IsSet(podmonArrayConnectivityRecoveryThreshold) {
+		recoveryThresholdStr := vc.GetString(podmonArrayConnectivityRecoveryThreshold)
+		value, err := strconv.Atoi(recoveryThresholdStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonArrayConnectivityRecoveryThreshold, recoveryThresholdStr)
+		}
+		if value <= 0 {
+			return fmt.Errorf("%s should be greater than zero, but was %d", podmonArrayConnectivityRecoveryThreshold, value)
+		}
+		recoveryThreshold = value
+		log.WithField(podmonArrayConnectivityRecoveryThreshold, recoveryThreshold).Info("configuration has been set.")
+	}
+	monitor.SetArrayConnectivityRecoveryThreshold(recoveryThreshold)
+
+	arrayFlapThreshold := *args.arrayConnectivityFlapThreshold
+	if vc.IsSet(podmonArrayConnectivityFlapThreshold) {
+		flapThresholdStr := vc.GetString(podmonArrayConnectivityFlapThreshold)
+		value, err := strconv.Atoi(flapThresholdStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonArrayConnectivityFlapThreshold, flapThresholdStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonArrayConnectivityFlapThreshold, value)
+		}
+		arrayFlapThreshold = value
+		log.WithField(podmonArrayConnectivityFlapThreshold, arrayFlapThreshold).Info("configuration has been set.")
+	}
+
+	arrayFlapWindow := *args.arrayConnectivityFlapWindow
+	if vc.IsSet(podmonArrayConnectivityFlapWindow) {
+		flapWindowStr := vc.GetString(podmonArrayConnectivityFlapWindow)
+		value, err := strconv.Atoi(flapWindowStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonArrayConnectivityFlapWindow, flapWindowStr)
+		}
+		if value <= 0 {
+			return fmt.Errorf("%s should be greater than zero, but was %d", podmonArrayConnectivityFlapWindow, value)
+		}
+		arrayFlapWindow = value
+		log.WithField(podmonArrayConnectivityFlapWindow, arrayFlapWindow).Info("configuration has been set.")
+	}
+	if arrayFlapThreshold >= arrayFlapWindow {
+		return fmt.Errorf("%s should be less than %s (%d), but was %d", podmonArrayConnectivityFlapThreshold,
+			podmonArrayConnectivityFlapWindow, arrayFlapWindow, arrayFlapThreshold)
+	}
+	monitor.SetArrayConnectivityFlapLimits(arrayFlapThreshold, arrayFlapWindow)
+
+	flapPolicy := *args.arrayConnectivityFlapPolicy
+	if vc.IsSet(podmonArrayConnectivityFlapPolicy) {
+		flapPolicy = vc.GetString(podmonArrayConnectivityFlapPolicy)
+		log.WithField(podmonArrayConnectivityFlapPolicy, flapPolicy).Info("configuration has been set.")
+	}
+	if flapPolicy != monitor.ArrayConnectivityFlapPolicyReport && flapPolicy != monitor.ArrayConnectivityFlapPolicyLoss {
+		return fmt.Errorf("%s should be %s or %s, but was %s", podmonArrayConnectivityFlapPolicy,
+			monitor.ArrayConnectivityFlapPolicyReport, monitor.ArrayConnectivityFlapPolicyLoss, flapPolicy)
+	}
+	monitor.SetArrayConnectivityFlapPolicy(flapPolicy)
+
+	pollConcurrency := *args.arrayConnectivityPollConcurrency
+	if vc.IsSet(podmonArrayConnectivityPollConcurrency) {
+		pollConcurrencyStr := vc.GetString(podmonArrayConnectivityPollConcurrency)
+		value, err := strconv.Atoi(pollConcurrencyStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonArrayConnectivityPollConcurrency, pollConcurrencyStr)
+		}
+		if value <= 0 {
+			return fmt.Errorf("%s should be greater than zero, but was %d", podmonArrayConnectivityPollConcurrency, value)
+		}
+		pollConcurrency = value
+		log.WithField(podmonArrayConnectivityPollConcurrency, pollConcurrency).Info("configuration has been set.")
+	}
+
+	pollDeadline := *args.arrayConnectivityPollDeadline
+	if vc.IsSet(podmonArrayConnectivityPollDeadline) {
+		pollDeadlineStr := vc.GetString(podmonArrayConnectivityPollDeadline)
+		value, err := strconv.Atoi(pollDeadlineStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonArrayConnectivityPollDeadline, pollDeadlineStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonArrayConnectivityPollDeadline, value)
+		}
+		pollDeadline = value
+		log.WithField(podmonArrayConnectivityPollDeadline, pollDeadline).Info("configuration has been set.")
+	}
+	monitor.SetArrayConnectivityPollLimits(pollConcurrency, time.Duration(pollDeadline)*time.Second)
+
+	publishConnectivity := *args.publishArrayConnectivity
+	if vc.IsSet(podmonPublishArrayConnectivity) {
+		publishConnectivityStr := vc.GetString(podmonPublishArrayConnectivity)
+		value, err := strconv.ParseBool(publishConnectivityStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonPublishArrayConnectivity, publishConnectivityStr)
+		}
+		publishConnectivity = value
+		log.WithField(podmonPublishArrayConnectivity, publishConnectivity).Info("configuration has been set.")
+	}
+	monitor.SetPublishArrayConnectivity(publishConnectivity)
+
+	outagePercent := *args.arrayOutageNodesPercent
+	if vc.IsSet(podmonArrayOutageNodesPercent) {
+		outagePercentStr := vc.GetString(podmonArrayOutageNodesPercent)
+		value, err := strconv.Atoi(outagePercentStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonArrayOutageNodesPercent, outagePercentStr)
+		}
+		if value < 0 || value > 100 {
+			return fmt.Errorf("%s should be between 0 and 100, but was %d", podmonArrayOutageNodesPercent, value)
+		}
+		outagePercent = value
+		log.WithField(podmonArrayOutageNodesPercent, outagePercent).Info("configuration has been set.")
+	}
+	monitor.SetArrayOutageNodesPercent(outagePercent)
+
 	skipArrayConnectionCheck := *args.skipArrayConnectionValidation
 	if vc.IsSet(podmonSkipArrayConnectionValidation) {
 		skipArrayConnectionCheckStr := vc.GetString(podmonSkipArrayConnectionValidation)
@@ -381,6 +825,303 @@ func updateConfiguration(vc *viper.Viper) error {
 	}
 	monitor.PodMonitor.SkipArrayConnectionValidation = skipArrayConnectionCheck
 
+	dryRunEnabled := *args.dryRun
+	if vc.IsSet(podmonDryRun) {
+		dryRunStr := vc.GetString(podmonDryRun)
+		value, err := strconv.ParseBool(dryRunStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonDryRun, dryRunStr)
+		}
+		dryRunEnabled = value
+		log.WithField(podmonDryRun, dryRunEnabled).Info("configuration has been set.")
+	}
+	if dryRunEnabled {
+		log.Warn("Dry-run mode enabled: no pods will be cleaned up, only the actions that would be taken are reported")
+	}
+	monitor.SetDryRun(dryRunEnabled)
+
+	maxNodes := *args.maxFailoverNodes
+	if vc.IsSet(podmonMaxFailoverNodes) {
+		maxNodesStr := vc.GetString(podmonMaxFailoverNodes)
+		value, err := strconv.Atoi(maxNodesStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonMaxFailoverNodes, maxNodesStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonMaxFailoverNodes, value)
+		}
+		maxNodes = value
+		log.WithField(podmonMaxFailoverNodes, maxNodes).Info("configuration has been set.")
+	}
+
+	maxPercent := *args.maxFailoverNodesPercent
+	if vc.IsSet(podmonMaxFailoverNodesPercent) {
+		maxPercentStr := vc.GetString(podmonMaxFailoverNodesPercent)
+		value, err := strconv.Atoi(maxPercentStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonMaxFailoverNodesPercent, maxPercentStr)
+		}
+		if value < 0 || value > 100 {
+			return fmt.Errorf("%s should be between 0 and 100, but was %d", podmonMaxFailoverNodesPercent, value)
+		}
+		maxPercent = value
+		log.WithField(podmonMaxFailoverNodesPercent, maxPercent).Info("configuration has been set.")
+	}
+
+	window := *args.failoverWindow
+	if vc.IsSet(podmonFailoverWindow) {
+		windowStr := vc.GetString(podmonFailoverWindow)
+		value, err := strconv.Atoi(windowStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonFailoverWindow, windowStr)
+		}
+		if value <= 0 {
+			return fmt.Errorf("%s should be greater than zero, but was %d", podmonFailoverWindow, value)
+		}
+		window = value
+		log.WithField(podmonFailoverWindow, window).Info("configuration has been set.")
+	}
+	monitor.SetFailoverLimits(maxNodes, maxPercent, time.Duration(window)*time.Second)
+
+	concurrency := *args.fencingConcurrency
+	if vc.IsSet(podmonFencingConcurrency) {
+		concurrencyStr := vc.GetString(podmonFencingConcurrency)
+		value, err := strconv.Atoi(concurrencyStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonFencingConcurrency, concurrencyStr)
+		}
+		if value <= 0 {
+			return fmt.Errorf("%s should be greater than zero, but was %d", podmonFencingConcurrency, value)
+		}
+		concurrency = value
+		log.WithField(podmonFencingConcurrency, concurrency).Info("configuration has been set.")
+	}
+
+	deadline := *args.cleanupDeadline
+	if vc.IsSet(podmonCleanupDeadline) {
+		deadlineStr := vc.GetString(podmonCleanupDeadline)
+		value, err := strconv.Atoi(deadlineStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonCleanupDeadline, deadlineStr)
+		}
+		if value <= 0 {
+			return fmt.Errorf("%s should be greater than zero, but was %d", podmonCleanupDeadline, value)
+		}
+		deadline = value
+		log.WithField(podmonCleanupDeadline, deadline).Info("configuration has been set.")
+	}
+	monitor.SetFencingLimits(concurrency, time.Duration(deadline)*time.Second)
+
+	cleanups := *args.cleanupConcurrency
+	if vc.IsSet(podmonCleanupConcurrency) {
+		cleanupsStr := vc.GetString(podmonCleanupConcurrency)
+		value, err := strconv.Atoi(cleanupsStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonCleanupConcurrency, cleanupsStr)
+		}
+		if value <= 0 {
+			return fmt.Errorf("%s should be greater than zero, but was %d", podmonCleanupConcurrency, value)
+		}
+		cleanups = value
+		log.WithField(podmonCleanupConcurrency, cleanups).Info("configuration has been set.")
+	}
+	monitor.SetCleanupConcurrency(cleanups)
+
+	fencing := *args.fencingMode
+	if vc.IsSet(podmonFencingMode) {
+		fencing = vc.GetString(podmonFencingMode)
+		log.WithField(podmonFencingMode, fencing).Info("configuration has been set.")
+	}
+	if fencing != monitor.FencingModePodmon && fencing != monitor.FencingModeOutOfService {
+		return fmt.Errorf("%s should be %s or %s, but was %s", podmonFencingMode,
+			monitor.FencingModePodmon, monitor.FencingModeOutOfService, fencing)
+	}
+	monitor.SetFencingMode(fencing)
+
+	stablePeriod := *args.recoveryStablePeriod
+	if vc.IsSet(podmonRecoveryStablePeriod) {
+		stablePeriodStr := vc.GetString(podmonRecoveryStablePeriod)
+		value, err := strconv.Atoi(stablePeriodStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonRecoveryStablePeriod, stablePeriodStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonRecoveryStablePeriod, value)
+		}
+		stablePeriod = value
+		log.WithField(podmonRecoveryStablePeriod, stablePeriod).Info("configuration has been set.")
+	}
+	monitor.SetRecoveryStablePeriod(time.Duration(stablePeriod) * time.Second)
+
+	maxGracePeriod := *args.maxForceDeleteGracePeriod
+	if vc.IsSet(podmonMaxForceDeleteGracePeriod) {
+		maxGracePeriodStr := vc.GetString(podmonMaxForceDeleteGracePeriod)
+		value, err := strconv.Atoi(maxGracePeriodStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonMaxForceDeleteGracePeriod, maxGracePeriodStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonMaxForceDeleteGracePeriod, value)
+		}
+		maxGracePeriod = value
+		log.WithField(podmonMaxForceDeleteGracePeriod, maxGracePeriod).Info("configuration has been set.")
+	}
+	monitor.SetMaxForceDeleteGracePeriod(time.Duration(maxGracePeriod) * time.Second)
+
+	crashLoopRetries := *args.crashLoopBackOffMaxRetries
+	if vc.IsSet(podmonCrashLoopBackOffMaxRetries) {
+		crashLoopRetriesStr := vc.GetString(podmonCrashLoopBackOffMaxRetries)
+		value, err := strconv.Atoi(crashLoopRetriesStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonCrashLoopBackOffMaxRetries, crashLoopRetriesStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonCrashLoopBackOffMaxRetries, value)
+		}
+		crashLoopRetries = value
+		log.WithField(podmonCrashLoopBackOffMaxRetries, crashLoopRetries).Info("configuration has been set.")
+	}
+
+	crashLoopBackoff := *args.crashLoopBackOffBackoff
+	if vc.IsSet(podmonCrashLoopBackOffBackoff) {
+		crashLoopBackoffStr := vc.GetString(podmonCrashLoopBackOffBackoff)
+		value, err := strconv.Atoi(crashLoopBackoffStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonCrashLoopBackOffBackoff, crashLoopBackoffStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonCrashLoopBackOffBackoff, value)
+		}
+		crashLoopBackoff = value
+		log.WithField(podmonCrashLoopBackOffBackoff, crashLoopBackoff).Info("configuration has been set.")
+	}
+
+	crashLoopWindow := *args.crashLoopBackOffWindow
+	if vc.IsSet(podmonCrashLoopBackOffWindow) {
+		crashLoopWindowStr := vc.GetString(podmonCrashLoopBackOffWindow)
+		value, err := strconv.Atoi(crashLoopWindowStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonCrashLoopBackOffWindow, crashLoopWindowStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonCrashLoopBackOffWindow, value)
+		}
+		crashLoopWindow = value
+		log.WithField(podmonCrashLoopBackOffWindow, crashLoopWindow).Info("configuration has been set.")
+	}
+	monitor.SetCrashLoopBackOffLimits(crashLoopRetries, time.Duration(crashLoopBackoff)*time.Second, time.Duration(crashLoopWindow)*time.Second)
+
+	storageErrorsOnly := *args.crashLoopBackOffStorageErrorsOnly
+	if vc.IsSet(podmonCrashLoopBackOffStorageErrorsOnly) {
+		storageErrorsOnlyStr := vc.GetString(podmonCrashLoopBackOffStorageErrorsOnly)
+		value, err := strconv.ParseBool(storageErrorsOnlyStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonCrashLoopBackOffStorageErrorsOnly, storageErrorsOnlyStr)
+		}
+		storageErrorsOnly = value
+		log.WithField(podmonCrashLoopBackOffStorageErrorsOnly, storageErrorsOnly).Info("configuration has been set.")
+	}
+	monitor.SetCrashLoopBackOffStorageErrorsOnly(storageErrorsOnly)
+
+	orphanedMode := *args.orphanedVAMode
+	if vc.IsSet(podmonOrphanedVAMode) {
+		orphanedMode = vc.GetString(podmonOrphanedVAMode)
+		log.WithField(podmonOrphanedVAMode, orphanedMode).Info("configuration has been set.")
+	}
+	if orphanedMode != monitor.OrphanedVAModeDelete && orphanedMode != monitor.OrphanedVAModeReport && orphanedMode != monitor.OrphanedVAModeDisabled {
+		return fmt.Errorf("%s should be %s, %s or %s, but was %s", podmonOrphanedVAMode,
+			monitor.OrphanedVAModeDelete, monitor.OrphanedVAModeReport, monitor.OrphanedVAModeDisabled, orphanedMode)
+	}
+	monitor.SetOrphanedVAMode(orphanedMode)
+
+	notReadyPeriod := *args.orphanedVANotReadyPeriod
+	if vc.IsSet(podmonOrphanedVANotReadyPeriod) {
+		notReadyPeriodStr := vc.GetString(podmonOrphanedVANotReadyPeriod)
+		value, err := strconv.Atoi(notReadyPeriodStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonOrphanedVANotReadyPeriod, notReadyPeriodStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonOrphanedVANotReadyPeriod, value)
+		}
+		notReadyPeriod = value
+		log.WithField(podmonOrphanedVANotReadyPeriod, notReadyPeriod).Info("configuration has been set.")
+	}
+	monitor.SetOrphanedVANotReadyPeriod(time.Duration(notReadyPeriod) * time.Second)
+
+	grace := *args.driverPodGracePeriod
+	if vc.IsSet(podmonDriverPodGracePeriod) {
+		graceStr := vc.GetString(podmonDriverPodGracePeriod)
+		value, err := strconv.Atoi(graceStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonDriverPodGracePeriod, graceStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonDriverPodGracePeriod, value)
+		}
+		grace = value
+		log.WithField(podmonDriverPodGracePeriod, grace).Info("configuration has been set.")
+	}
+
+	escalation := *args.driverPodEscalationPeriod
+	if vc.IsSet(podmonDriverPodEscalationPeriod) {
+		escalationStr := vc.GetString(podmonDriverPodEscalationPeriod)
+		value, err := strconv.Atoi(escalationStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonDriverPodEscalationPeriod, escalationStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonDriverPodEscalationPeriod, value)
+		}
+		escalation = value
+		log.WithField(podmonDriverPodEscalationPeriod, escalation).Info("configuration has been set.")
+	}
+	monitor.SetDriverPodLimits(time.Duration(grace)*time.Second, time.Duration(escalation)*time.Second)
+
+	flapLimit := *args.driverPodFlapLimit
+	if vc.IsSet(podmonDriverPodFlapLimit) {
+		flapLimitStr := vc.GetString(podmonDriverPodFlapLimit)
+		value, err := strconv.Atoi(flapLimitStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonDriverPodFlapLimit, flapLimitStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonDriverPodFlapLimit, value)
+		}
+		flapLimit = value
+		log.WithField(podmonDriverPodFlapLimit, flapLimit).Info("configuration has been set.")
+	}
+
+	flapWindow := *args.driverPodFlapWindow
+	if vc.IsSet(podmonDriverPodFlapWindow) {
+		flapWindowStr := vc.GetString(podmonDriverPodFlapWindow)
+		value, err := strconv.Atoi(flapWindowStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonDriverPodFlapWindow, flapWindowStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonDriverPodFlapWindow, value)
+		}
+		flapWindow = value
+		log.WithField(podmonDriverPodFlapWindow, flapWindow).Info("configuration has been set.")
+	}
+	monitor.SetDriverPodFlapLimits(flapLimit, time.Duration(flapWindow)*time.Second)
+
+	reportInterval := *args.nodeConnectivityReportInterval
+	if vc.IsSet(podmonNodeConnectivityReportInterval) {
+		reportIntervalStr := vc.GetString(podmonNodeConnectivityReportInterval)
+		value, err := strconv.Atoi(reportIntervalStr)
+		if err != nil {
+			return fmt.Errorf("parsing %s failed: value was %s", podmonNodeConnectivityReportInterval, reportIntervalStr)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s should not be negative, but was %d", podmonNodeConnectivityReportInterval, value)
+		}
+		reportInterval = value
+		log.WithField(podmonNodeConnectivityReportInterval, reportInterval).Info("configuration has been set.")
+	}
+	monitor.SetNodeConnectivityReportInterval(time.Duration(reportInterval) * time.Second)
+
 	return nil
 }
 
@@ -30,7 +30,6 @@ import (
 	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
-	"k8s.io/client-go/kubernetes"
 )
 
 type mainFeature struct {
@@ -40,6 +39,9 @@ type mainFeature struct {
 	csiapiMock          *mocks.CSIMock
 	leaderElect         *mockLeaderElect
 	failStartAPIMonitor bool
+	metricsAddress      chan string
+	statusAddress       chan string
+	cleanupsResumed     chan struct{}
 }
 
 var (
@@ -54,6 +56,11 @@ func (m *mainFeature) aPodmonInstance() error {
 		fmt.Printf("loghook last-entry %+v\n", m.loghook.LastEntry())
 	}
 	monitor.PodMonitor.CSIExtensionsPresent = false
+	monitor.Driver = new(monitor.VxflexDriver)
+	monitor.PodMonitor.Drivers.Range(func(key, _ interface{}) bool {
+		monitor.PodMonitor.Drivers.Delete(key)
+		return true
+	})
 	m.csiapiMock = new(mocks.CSIMock)
 	m.k8sapiMock = new(mocks.K8sMock)
 	GetCSIClient = m.mockGetCSIClient
@@ -63,6 +70,17 @@ func (m *mainFeature) aPodmonInstance() error {
 	StartAPIMonitorFn = m.mockStartAPIMonitor
 	StartPodMonitorFn = m.mockStartPodMonitor
 	StartNodeMonitorFn = m.mockStartNodeMonitor
+	StartMultiAttachMonitorFn = m.mockStartMultiAttachMonitor
+	m.metricsAddress = make(chan string, 1)
+	StartMetricsServerFn = m.mockStartMetricsServer
+	m.statusAddress = make(chan string, 1)
+	StartStatusServerFn = m.mockStartStatusServer
+	m.cleanupsResumed = make(chan struct{}, 1)
+	ResumeCleanupsFn = m.mockResumeCleanups
+	NodeRecoveryFn = m.mockNodeRecovery
+	OrphanedVAFn = m.mockOrphanedVA
+	DriverPodFn = m.mockDriverPod
+	NodeConnectivityFn = m.mockNodeConnectivity
 	monitor.K8sAPI = m.k8sapiMock
 	gofsutil.UseMockFS()
 	PodMonWait = m.mockPodMonWait
@@ -91,10 +109,13 @@ func (m *mainFeature) mockGetCSIClient(_ string, _ ...grpc.DialOption) (csiapi.C
 	return m.csiapiMock, nil
 }
 
-func (m *mainFeature) mockStartPodMonitor(_ k8sapi.K8sAPI, _ kubernetes.Interface, _, _ string, _ time.Duration) {
+func (m *mainFeature) mockStartPodMonitor(_ k8sapi.K8sAPI, _, _ string, _ time.Duration) {
+}
+
+func (m *mainFeature) mockStartNodeMonitor(_ k8sapi.K8sAPI, _ time.Duration) {
 }
 
-func (m *mainFeature) mockStartNodeMonitor(_ k8sapi.K8sAPI, _ kubernetes.Interface, _, _ string, _ time.Duration) {
+func (m *mainFeature) mockStartMultiAttachMonitor(_ k8sapi.K8sAPI, _, _ string, _ time.Duration) {
 }
 
 func (m *mainFeature) mockStartAPIMonitor(_ k8sapi.K8sAPI, _, _, _ time.Duration, _ func(interval time.Duration) bool) error {
@@ -104,6 +125,224 @@ func (m *mainFeature) mockStartAPIMonitor(_ k8sapi.K8sAPI, _, _, _ time.Duration
 	return nil
 }
 
+func (m *mainFeature) mockStartMetricsServer(address string) error {
+	m.metricsAddress <- address
+	return nil
+}
+
+func (m *mainFeature) mockStartStatusServer(address string) error {
+	m.statusAddress <- address
+	return nil
+}
+
+func (m *mainFeature) theStatusServerIsStartedOn(address string) error {
+	select {
+	case actual := <-m.statusAddress:
+		if actual != address {
+			return fmt.Errorf("expected status server to be started on %s, but was %s", address, actual)
+		}
+	case <-time.After(time.Second):
+		if address != "none" {
+			return fmt.Errorf("expected status server to be started on %s, but it was not started", address)
+		}
+	}
+	return nil
+}
+
+func (m *mainFeature) theMetricsServerIsStartedOn(address string) error {
+	select {
+	case actual := <-m.metricsAddress:
+		if actual != address {
+			return fmt.Errorf("expected metrics server to be started on %s, but was %s", address, actual)
+		}
+	case <-time.After(time.Second):
+		if address != "none" {
+			return fmt.Errorf("expected metrics server to be started on %s, but it was not started", address)
+		}
+	}
+	return nil
+}
+
+func (m *mainFeature) mockResumeCleanups() {
+	m.cleanupsResumed <- struct{}{}
+}
+
+func (m *mainFeature) mockNodeRecovery() {
+}
+
+func (m *mainFeature) mockOrphanedVA() {
+}
+
+func (m *mainFeature) mockDriverPod() {
+}
+
+func (m *mainFeature) mockNodeConnectivity() {
+}
+
+func (m *mainFeature) theUnfinishedCleanupsAreResumed(value string) error {
+	select {
+	case <-m.cleanupsResumed:
+		if value != "true" {
+			return fmt.Errorf("expected unfinished cleanups resumed to be %s, but they were resumed", value)
+		}
+	case <-time.After(time.Second):
+		if value == "true" {
+			return fmt.Errorf("expected unfinished cleanups resumed to be %s, but they were not resumed", value)
+		}
+	}
+	return nil
+}
+
+func (m *mainFeature) dryRunModeIs(value string) error {
+	expected := value == "true"
+	if monitor.GetDryRun() != expected {
+		return fmt.Errorf("expected dry-run mode to be %t, but was %t", expected, monitor.GetDryRun())
+	}
+	return nil
+}
+
+func (m *mainFeature) theFailoverLimitsAre(nodes, percent, window int) error {
+	maxNodes, maxPercent, failoverWindow := monitor.GetFailoverLimits()
+	if maxNodes != nodes || maxPercent != percent || failoverWindow != time.Duration(window)*time.Second {
+		return fmt.Errorf("expected failover limits %d nodes %d percent %ds, but were %d nodes %d percent %v",
+			nodes, percent, window, maxNodes, maxPercent, failoverWindow)
+	}
+	return nil
+}
+
+func (m *mainFeature) theFencingLimitsAre(concurrency, deadline int) error {
+	fencingConcurrency, cleanupDeadline := monitor.GetFencingLimits()
+	if fencingConcurrency != concurrency || cleanupDeadline != time.Duration(deadline)*time.Second {
+		return fmt.Errorf("expected fencing limits %d volumes %ds, but were %d volumes %v",
+			concurrency, deadline, fencingConcurrency, cleanupDeadline)
+	}
+	return nil
+}
+
+func (m *mainFeature) theCleanupConcurrencyIs(concurrency int) error {
+	if monitor.GetCleanupConcurrency() != concurrency {
+		return fmt.Errorf("expected cleanup concurrency %d, but was %d", concurrency, monitor.GetCleanupConcurrency())
+	}
+	return nil
+}
+
+func (m *mainFeature) theFencingModeIs(mode string) error {
+	if monitor.GetFencingMode() != mode {
+		return fmt.Errorf("expected fencing mode %s, but was %s", mode, monitor.GetFencingMode())
+	}
+	return nil
+}
+
+func (m *mainFeature) theRecoveryStablePeriodIs(seconds int) error {
+	if monitor.GetRecoveryStablePeriod() != time.Duration(seconds)*time.Second {
+		return fmt.Errorf("expected recovery stable period %ds, but was %v", seconds, monitor.GetRecoveryStablePeriod())
+	}
+	return nil
+}
+
+func (m *mainFeature) theMaxForceDeleteGracePeriodIs(seconds int) error {
+	if monitor.GetMaxForceDeleteGracePeriod() != time.Duration(seconds)*time.Second {
+		return fmt.Errorf("expected max force delete grace period %ds, but was %v", seconds, monitor.GetMaxForceDeleteGracePeriod())
+	}
+	return nil
+}
+
+func (m *mainFeature) theOrphanedVAModeIs(mode string, period int) error {
+	if monitor.GetOrphanedVAMode() != mode || monitor.GetOrphanedVANotReadyPeriod() != time.Duration(period)*time.Second {
+		return fmt.Errorf("expected orphaned VolumeAttachment mode %s NotReady period %ds, but were %s %v",
+			mode, period, monitor.GetOrphanedVAMode(), monitor.GetOrphanedVANotReadyPeriod())
+	}
+	return nil
+}
+
+func (m *mainFeature) theDriverPodLimitsAre(grace, escalation, flapLimit, flapWindow int) error {
+	actualGrace, actualEscalation := monitor.GetDriverPodLimits()
+	actualFlapLimit, actualFlapWindow := monitor.GetDriverPodFlapLimits()
+	if actualGrace != time.Duration(grace)*time.Second || actualEscalation != time.Duration(escalation)*time.Second ||
+		actualFlapLimit != flapLimit || actualFlapWindow != time.Duration(flapWindow)*time.Second {
+		return fmt.Errorf("expected driver pod limits grace %ds escalation %ds flaps %d window %ds, but were %v %v %d %v",
+			grace, escalation, flapLimit, flapWindow, actualGrace, actualEscalation, actualFlapLimit, actualFlapWindow)
+	}
+	return nil
+}
+
+func (m *mainFeature) theNodeConnectivityReportIntervalIs(interval int) error {
+	if monitor.GetNodeConnectivityReportInterval() != time.Duration(interval)*time.Second {
+		return fmt.Errorf("expected node connectivity report interval %ds, but was %v", interval, monitor.GetNodeConnectivityReportInterval())
+	}
+	return nil
+}
+
+func (m *mainFeature) theArrayConnectivityRecoveryThresholdIs(recovery, flaps, window int, policy string) error {
+	if monitor.GetArrayConnectivityRecoveryThreshold() != recovery {
+		return fmt.Errorf("expected array connectivity recovery threshold %d, but was %d", recovery, monitor.GetArrayConnectivityRecoveryThreshold())
+	}
+	actualFlaps, actualWindow := monitor.GetArrayConnectivityFlapLimits()
+	if actualFlaps != flaps || actualWindow != window {
+		return fmt.Errorf("expected array connectivity flaps %d window %d, but were %d and %d", flaps, window, actualFlaps, actualWindow)
+	}
+	if monitor.GetArrayConnectivityFlapPolicy() != policy {
+		return fmt.Errorf("expected array connectivity flap policy %s, but was %s", policy, monitor.GetArrayConnectivityFlapPolicy())
+	}
+	return nil
+}
+
+func (m *mainFeature) theArrayConnectivityPollConcurrencyIs(concurrency, deadline int) error {
+	actualConcurrency, actualDeadline := monitor.GetArrayConnectivityPollLimits()
+	if actualConcurrency != concurrency || actualDeadline != time.Duration(deadline)*time.Second {
+		return fmt.Errorf("expected array connectivity poll concurrency %d deadline %ds, but were %d and %v", concurrency, deadline, actualConcurrency, actualDeadline)
+	}
+	return nil
+}
+
+func (m *mainFeature) publishingTheArrayConnectivityIs(expected string) error {
+	if fmt.Sprintf("%t", monitor.GetPublishArrayConnectivity()) != expected {
+		return fmt.Errorf("expected publishing the array connectivity to be %s, but was %t", expected, monitor.GetPublishArrayConnectivity())
+	}
+	return nil
+}
+
+func (m *mainFeature) theArrayOutageNodesPercentIs(percent int) error {
+	if monitor.GetArrayOutageNodesPercent() != percent {
+		return fmt.Errorf("expected array outage nodes percent %d, but was %d", percent, monitor.GetArrayOutageNodesPercent())
+	}
+	return nil
+}
+
+func (m *mainFeature) theAdditionalDriversAre(expected string) error {
+	drivers := make([]string, 0)
+	for _, driver := range monitor.PodMonitor.AdditionalCSIDrivers() {
+		drivers = append(drivers, fmt.Sprintf("%s=%s", driver.Path, driver.TaintKey))
+	}
+	actual := strings.Join(drivers, ",")
+	if len(drivers) == 0 {
+		actual = "none"
+	}
+	if actual != expected {
+		return fmt.Errorf("expected additional drivers %s, but were %s", expected, actual)
+	}
+	return nil
+}
+
+func (m *mainFeature) theDriverNameIs(expected string) error {
+	if actual := monitor.Driver.GetDriverName(); actual != expected {
+		return fmt.Errorf("expected driver name %s, but was %s", expected, actual)
+	}
+	return nil
+}
+
+func (m *mainFeature) theCrashLoopBackOffLimitsAre(maxRetries, backoff, window int, storageErrorsOnly string) error {
+	actualRetries, actualBackoff, actualWindow := monitor.GetCrashLoopBackOffLimits()
+	if actualRetries != maxRetries || actualBackoff != time.Duration(backoff)*time.Second || actualWindow != time.Duration(window)*time.Second {
+		return fmt.Errorf("expected CrashLoopBackOff limits %d retries backoff %ds window %ds, but were %d retries backoff %v window %v",
+			maxRetries, backoff, window, actualRetries, actualBackoff, actualWindow)
+	}
+	if fmt.Sprintf("%t", monitor.GetCrashLoopBackOffStorageErrorsOnly()) != storageErrorsOnly {
+		return fmt.Errorf("expected CrashLoopBackOff storage errors only %s, but was %t", storageErrorsOnly, monitor.GetCrashLoopBackOffStorageErrorsOnly())
+	}
+	return nil
+}
+
 func (m *mainFeature) mockPodMonWait() bool {
 	return true
 }
@@ -217,4 +456,24 @@ func ScenarioInit(context *godog.ScenarioContext) {
 	context.Step(`^the last log message contains "([^"]*)"$`, m.theLastLogMessageContains)
 	context.Step(`^I induce error "([^"]*)"$`, m.iInduceError)
 	context.Step(`^CSIExtensionsPresent is "([^"]*)"`, m.csiExtensionsPresentIsFalse)
+	context.Step(`^the metrics server is started on "([^"]*)"$`, m.theMetricsServerIsStartedOn)
+	context.Step(`^the status server is started on "([^"]*)"$`, m.theStatusServerIsStartedOn)
+	context.Step(`^the unfinished cleanups are resumed "([^"]*)"$`, m.theUnfinishedCleanupsAreResumed)
+	context.Step(`^dry-run mode is "([^"]*)"$`, m.dryRunModeIs)
+	context.Step(`^the failover limits are (\d+) nodes (\d+) percent (\d+) seconds$`, m.theFailoverLimitsAre)
+	context.Step(`^the fencing limits are (\d+) volumes (\d+) seconds$`, m.theFencingLimitsAre)
+	context.Step(`^the cleanup concurrency is (\d+)$`, m.theCleanupConcurrencyIs)
+	context.Step(`^the fencing mode is "([^"]*)"$`, m.theFencingModeIs)
+	context.Step(`^the recovery stable period is (\d+) seconds$`, m.theRecoveryStablePeriodIs)
+	context.Step(`^the max force delete grace period is (\d+) seconds$`, m.theMaxForceDeleteGracePeriodIs)
+	context.Step(`^the orphaned VolumeAttachment mode is "([^"]*)" NotReady period (\d+) seconds$`, m.theOrphanedVAModeIs)
+	context.Step(`^the driver pod limits are grace (\d+) escalation (\d+) flaps (\d+) window (\d+)$`, m.theDriverPodLimitsAre)
+	context.Step(`^the node connectivity report interval is (\d+) seconds$`, m.theNodeConnectivityReportIntervalIs)
+	context.Step(`^the array connectivity recovery threshold is (\d+) flaps (\d+) window (\d+) policy "([^"]*)"$`, m.theArrayConnectivityRecoveryThresholdIs)
+	context.Step(`^the array connectivity poll concurrency is (\d+) deadline (\d+) seconds$`, m.theArrayConnectivityPollConcurrencyIs)
+	context.Step(`^publishing the array connectivity is "([^"]*)"$`, m.publishingTheArrayConnectivityIs)
+	context.Step(`^the array outage nodes percent is (\d+)$`, m.theArrayOutageNodesPercentIs)
+	context.Step(`^the additional drivers are "([^"]*)"$`, m.theAdditionalDriversAre)
+	context.Step(`^the driver name is "([^"]*)"$`, m.theDriverNameIs)
+	context.Step(`^the CrashLoopBackOff limits are (\d+) retries backoff (\d+) window (\d+) storage errors only "([^"]*)"$`, m.theCrashLoopBackOffLimitsAre)
 }
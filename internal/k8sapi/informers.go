@@ -0,0 +1,381 @@
+/*
+* Copyright (c) 2021-2023 Dell Inc., or its subsidiaries. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package k8sapi
+
+// The shared informers keep local caches of the pods, nodes, PVs, PVCs and VolumeAttachments podmon reads,
+// so that handling an event does not require calls to the API server. Once an informer has synced, the Get
+// methods read from its lister, falling back to the API server if the object is not in the cache (it may
+// not have been delivered to the informer yet).
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// volumeAttachmentPVNodeIndex indexes the VolumeAttachments by "pvName/nodeName", and volumeAttachmentPVIndex by pvName.
+const (
+	volumeAttachmentPVNodeIndex = "pvNode"
+	volumeAttachmentPVIndex     = "pv"
+)
+
+// informerSyncTimeout bounds the wait for an informer cache to sync, which never finishes if listing is forbidden.
+var informerSyncTimeout = 2 * time.Minute
+
+// informerCaches are the shared informer factories and the listers reading from their caches.
+type informerCaches struct {
+	factory        informers.SharedInformerFactory            // nodes, PVs, PVCs and VolumeAttachments
+	podFactories   map[string]informers.SharedInformerFactory // pods, by label selector
+	podListers     map[string]corelisters.PodLister           // the synced pod caches, by label selector
+	eventFactories map[string]informers.SharedInformerFactory // Events about pods, by field selector
+	nodeLister     corelisters.NodeLister
+	pvLister       corelisters.PersistentVolumeLister
+	pvcLister      corelisters.PersistentVolumeClaimLister
+	vaLister       storagelisters.VolumeAttachmentLister
+	vaIndexer      cache.Indexer
+}
+
+// eventHandler adapts fn to the informer event handler, passing the watch event type for each event.
+// Resyncs are delivered as Modified events.
+func eventHandler(fn EventHandlerFunc) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			fn(watch.Added, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			fn(watch.Modified, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			fn(watch.Deleted, obj)
+		},
+	}
+}
+
+// sharedFactory returns the informer factory for nodes, PVs, PVCs and VolumeAttachments, creating it if needed.
+// The informerLock must be held.
+func (api *Client) sharedFactory(resyncPeriod time.Duration) informers.SharedInformerFactory {
+	if api.informers.factory == nil {
+		api.informers.factory = informers.NewSharedInformerFactory(api.Client, resyncPeriod)
+	}
+	return api.informers.factory
+}
+
+// waitForSync waits up to the informer sync timeout for the informers started by the factory to sync.
+// The informerLock must not be held, so the caches can still be read while waiting.
+func waitForSync(ctx context.Context, factory informers.SharedInformerFactory) error {
+	ctx, cancel := context.WithTimeout(ctx, informerSyncTimeout)
+	defer cancel()
+	for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("informer cache for %v did not sync", informerType)
+		}
+	}
+	return nil
+}
+
+// StartInformers starts the shared informers for nodes, PVs, PVCs and VolumeAttachments, which resync every
+// resyncPeriod, and waits for their caches to sync. The informers run until ctx is done.
+func (api *Client) StartInformers(ctx context.Context, resyncPeriod time.Duration) error {
+	if api.Client == nil {
+		return errors.New("No connection")
+	}
+	api.informerLock.Lock()
+	factory := api.sharedFactory(resyncPeriod)
+	nodeInformer := factory.Core().V1().Nodes()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	pvcInformer := factory.Core().V1().PersistentVolumeClaims()
+	vaInformer := factory.Storage().V1().VolumeAttachments()
+	// The indexes are already there if an earlier attempt started the informer but didn't sync.
+	if _, ok := vaInformer.Informer().GetIndexer().GetIndexers()[volumeAttachmentPVNodeIndex]; !ok {
+		err := vaInformer.Informer().AddIndexers(cache.Indexers{
+			volumeAttachmentPVNodeIndex: func(obj interface{}) ([]string, error) {
+				va, ok := obj.(*storagev1.VolumeAttachment)
+				if !ok || va.Spec.Source.PersistentVolumeName == nil {
+					return []string{}, nil
+				}
+				return []string{fmt.Sprintf("%s/%s", *va.Spec.Source.PersistentVolumeName, va.Spec.NodeName)}, nil
+			},
+			volumeAttachmentPVIndex: func(obj interface{}) ([]string, error) {
+				va, ok := obj.(*storagev1.VolumeAttachment)
+				if !ok || va.Spec.Source.PersistentVolumeName == nil {
+					return []string{}, nil
+				}
+				return []string{*va.Spec.Source.PersistentVolumeName}, nil
+			},
+		})
+		if err != nil {
+			api.informerLock.Unlock()
+			return err
+		}
+	}
+	pvInformer.Informer()
+	pvcInformer.Informer()
+	nodeInformer.Informer()
+	api.informerLock.Unlock()
+	factory.Start(ctx.Done())
+	if err := waitForSync(ctx, factory); err != nil {
+		return err
+	}
+	api.informerLock.Lock()
+	defer api.informerLock.Unlock()
+	api.informers.nodeLister = nodeInformer.Lister()
+	api.informers.pvLister = pvInformer.Lister()
+	api.informers.pvcLister = pvcInformer.Lister()
+	api.informers.vaLister = vaInformer.Lister()
+	api.informers.vaIndexer = vaInformer.Informer().GetIndexer()
+	log.Infof("Informer caches synced for nodes, PersistentVolumes, PersistentVolumeClaims and VolumeAttachments")
+	return nil
+}
+
+// AddPodEventHandler calls fn for the events on pods matching the labelSelector, using a shared informer
+// that resyncs every resyncPeriod. The pods are then read from the informer cache.
+func (api *Client) AddPodEventHandler(ctx context.Context, labelSelector string, resyncPeriod time.Duration, fn EventHandlerFunc) error {
+	if api.Client == nil {
+		return errors.New("No connection")
+	}
+	api.informerLock.Lock()
+	if api.informers.podFactories == nil {
+		api.informers.podFactories = make(map[string]informers.SharedInformerFactory)
+		api.informers.podListers = make(map[string]corelisters.PodLister)
+	}
+	factory, ok := api.informers.podFactories[labelSelector]
+	if !ok {
+		factory = informers.NewSharedInformerFactoryWithOptions(api.Client, resyncPeriod,
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = labelSelector
+			}))
+		api.informers.podFactories[labelSelector] = factory
+	}
+	podInformer := factory.Core().V1().Pods()
+	registration, err := podInformer.Informer().AddEventHandlerWithResyncPeriod(eventHandler(fn), resyncPeriod)
+	api.informerLock.Unlock()
+	if err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	if err = waitForSync(ctx, factory); err != nil {
+		// Don't leave the handler behind, or a retry would deliver each event twice.
+		_ = podInformer.Informer().RemoveEventHandler(registration)
+		return err
+	}
+	api.informerLock.Lock()
+	defer api.informerLock.Unlock()
+	api.informers.podListers[labelSelector] = podInformer.Lister()
+	log.Infof("Pod informer cache synced for labelSelector %q", labelSelector)
+	return nil
+}
+
+// AddNodeEventHandler calls fn for the events on nodes, using a shared informer that resyncs every resyncPeriod.
+func (api *Client) AddNodeEventHandler(ctx context.Context, resyncPeriod time.Duration, fn EventHandlerFunc) error {
+	if api.Client == nil {
+		return errors.New("No connection")
+	}
+	api.informerLock.Lock()
+	factory := api.sharedFactory(resyncPeriod)
+	nodeInformer := factory.Core().V1().Nodes()
+	registration, err := nodeInformer.Informer().AddEventHandlerWithResyncPeriod(eventHandler(fn), resyncPeriod)
+	api.informerLock.Unlock()
+	if err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	if err = waitForSync(ctx, factory); err != nil {
+		_ = nodeInformer.Informer().RemoveEventHandler(registration)
+		return err
+	}
+	api.informerLock.Lock()
+	defer api.informerLock.Unlock()
+	api.informers.nodeLister = nodeInformer.Lister()
+	log.Infof("Node informer cache synced")
+	return nil
+}
+
+// AddPodEventsHandler calls fn for the Kubernetes Events about pods matching the fieldSelector, using the shared
+// informer for that fieldSelector, which resyncs every resyncPeriod.
+func (api *Client) AddPodEventsHandler(ctx context.Context, fieldSelector string, resyncPeriod time.Duration, fn EventHandlerFunc) error {
+	if api.Client == nil {
+		return errors.New("No connection")
+	}
+	api.informerLock.Lock()
+	if api.informers.eventFactories == nil {
+		api.informers.eventFactories = make(map[string]informers.SharedInformerFactory)
+	}
+	factory, ok := api.informers.eventFactories[fieldSelector]
+	if !ok {
+		factory = informers.NewSharedInformerFactoryWithOptions(api.Client, resyncPeriod,
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fieldSelector
+			}))
+		api.informers.eventFactories[fieldSelector] = factory
+	}
+	eventInformer := factory.Core().V1().Events()
+	registration, err := eventInformer.Informer().AddEventHandlerWithResyncPeriod(eventHandler(fn), resyncPeriod)
+	api.informerLock.Unlock()
+	if err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	if err = waitForSync(ctx, factory); err != nil {
+		_ = eventInformer.Informer().RemoveEventHandler(registration)
+		return err
+	}
+	log.Infof("Event informer cache synced for fieldSelector %q", fieldSelector)
+	return nil
+}
+
+// getCachedPod returns a copy of the pod from the pod informer caches, or nil if not found.
+func (api *Client) getCachedPod(namespace, name string) *v1.Pod {
+	api.informerLock.RLock()
+	defer api.informerLock.RUnlock()
+	for _, lister := range api.informers.podListers {
+		if pod, err := lister.Pods(namespace).Get(name); err == nil {
+			return pod.DeepCopy()
+		}
+	}
+	return nil
+}
+
+// getCachedNode returns a copy of the node from the node informer cache, or nil if not found.
+func (api *Client) getCachedNode(name string) *v1.Node {
+	api.informerLock.RLock()
+	defer api.informerLock.RUnlock()
+	if api.informers.nodeLister == nil {
+		return nil
+	}
+	if node, err := api.informers.nodeLister.Get(name); err == nil {
+		return node.DeepCopy()
+	}
+	return nil
+}
+
+// getCachedPersistentVolume returns a copy of the PV from the PV informer cache, or nil if not found.
+func (api *Client) getCachedPersistentVolume(name string) *v1.PersistentVolume {
+	api.informerLock.RLock()
+	defer api.informerLock.RUnlock()
+	if api.informers.pvLister == nil {
+		return nil
+	}
+	if pv, err := api.informers.pvLister.Get(name); err == nil {
+		return pv.DeepCopy()
+	}
+	return nil
+}
+
+// getCachedPersistentVolumeClaim returns a copy of the PVC from the PVC informer cache, or nil if not found.
+func (api *Client) getCachedPersistentVolumeClaim(namespace, name string) *v1.PersistentVolumeClaim {
+	api.informerLock.RLock()
+	defer api.informerLock.RUnlock()
+	if api.informers.pvcLister == nil {
+		return nil
+	}
+	if pvc, err := api.informers.pvcLister.PersistentVolumeClaims(namespace).Get(name); err == nil {
+		return pvc.DeepCopy()
+	}
+	return nil
+}
+
+// listCachedPersistentVolumeClaims returns the PVCs in the namespace from the PVC informer cache.
+// The bool is false if the cache is not available.
+func (api *Client) listCachedPersistentVolumeClaims(namespace string) (*v1.PersistentVolumeClaimList, bool) {
+	api.informerLock.RLock()
+	defer api.informerLock.RUnlock()
+	if api.informers.pvcLister == nil {
+		return nil, false
+	}
+	pvcs, err := api.informers.pvcLister.PersistentVolumeClaims(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, false
+	}
+	list := &v1.PersistentVolumeClaimList{}
+	for _, pvc := range pvcs {
+		list.Items = append(list.Items, *pvc.DeepCopy())
+	}
+	return list, true
+}
+
+// listCachedVolumeAttachments returns the VolumeAttachments from the VolumeAttachment informer cache.
+// The bool is false if the cache is not available.
+func (api *Client) listCachedVolumeAttachments() (*storagev1.VolumeAttachmentList, bool) {
+	api.informerLock.RLock()
+	defer api.informerLock.RUnlock()
+	if api.informers.vaLister == nil {
+		return nil, false
+	}
+	vas, err := api.informers.vaLister.List(labels.Everything())
+	if err != nil {
+		return nil, false
+	}
+	list := &storagev1.VolumeAttachmentList{}
+	for _, va := range vas {
+		list.Items = append(list.Items, *va.DeepCopy())
+	}
+	return list, true
+}
+
+// listCachedVolumeAttachmentsByPV returns the VolumeAttachments of the PV from the VolumeAttachment informer cache.
+// The bool is false if the cache is not available.
+func (api *Client) listCachedVolumeAttachmentsByPV(pvName string) (*storagev1.VolumeAttachmentList, bool) {
+	api.informerLock.RLock()
+	defer api.informerLock.RUnlock()
+	if api.informers.vaIndexer == nil {
+		return nil, false
+	}
+	objs, err := api.informers.vaIndexer.ByIndex(volumeAttachmentPVIndex, pvName)
+	if err != nil {
+		return nil, false
+	}
+	list := &storagev1.VolumeAttachmentList{}
+	for _, obj := range objs {
+		if va, ok := obj.(*storagev1.VolumeAttachment); ok {
+			list.Items = append(list.Items, *va.DeepCopy())
+		}
+	}
+	return list, true
+}
+
+// getCachedVolumeAttachmentByPVNode returns a copy of the VolumeAttachment for the PV and node from the
+// VolumeAttachment informer cache, or nil if not found.
+func (api *Client) getCachedVolumeAttachmentByPVNode(pvName, nodeName string) *storagev1.VolumeAttachment {
+	api.informerLock.RLock()
+	defer api.informerLock.RUnlock()
+	if api.informers.vaIndexer == nil {
+		return nil
+	}
+	objs, err := api.informers.vaIndexer.ByIndex(volumeAttachmentPVNodeIndex, fmt.Sprintf("%s/%s", pvName, nodeName))
+	if err != nil || len(objs) == 0 {
+		return nil
+	}
+	if va, ok := objs[0].(*storagev1.VolumeAttachment); ok {
+		return va.DeepCopy()
+	}
+	return nil
+}
@@ -26,7 +26,6 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
@@ -57,6 +56,9 @@ type K8sAPI interface {
 	// GetVolumeAttachments gets all the volume attachments in the K8S system
 	GetVolumeAttachments(ctx context.Context) (*storagev1.VolumeAttachmentList, error)
 
+	// GetVolumeAttachmentsForPV gets the volume attachments of the persistent volume on any node
+	GetVolumeAttachmentsForPV(ctx context.Context, pvName string) (*storagev1.VolumeAttachmentList, error)
+
 	// DeleteVolumeAttachment deletes a volume attachment by name.
 	DeleteVolumeAttachment(ctx context.Context, va string) error
 
@@ -82,6 +84,12 @@ type K8sAPI interface {
 	// GetPersistentVolumeClaim returns the PVC of the given namespace/pvcName.
 	GetPersistentVolumeClaim(ctx context.Context, namespace, pvcName string) (*v1.PersistentVolumeClaim, error)
 
+	// GetPodsOnNode returns the pods scheduled on the node.
+	GetPodsOnNode(ctx context.Context, nodeName string) (*v1.PodList, error)
+
+	// GetPodEvents returns the events whose involved object is the pod.
+	GetPodEvents(ctx context.Context, pod *v1.Pod) (*v1.EventList, error)
+
 	// GetNode returns the node with the specified nodeName.
 	GetNode(ctx context.Context, nodeName string) (*v1.Node, error)
 
@@ -94,24 +102,52 @@ type K8sAPI interface {
 	// GetPVNameFromVA returns the PVCName from a specified volume attachment.
 	GetPVNameFromVA(va *storagev1.VolumeAttachment) (string, error)
 
-	// SetupPodWatch setups up a pod watch.
-	SetupPodWatch(ctx context.Context, namespace string, listOptions metav1.ListOptions) (watch.Interface, error)
+	// StartInformers starts the shared informers for nodes, PVs, PVCs and VolumeAttachments, which resync every
+	// resyncPeriod, and waits for their caches to sync. Afterwards those objects are read from the informer caches.
+	StartInformers(ctx context.Context, resyncPeriod time.Duration) error
 
-	// SetupNodeWatch setups up a node watch.
-	SetupNodeWatch(ctx context.Context, listOptions metav1.ListOptions) (watch.Interface, error)
+	// AddPodEventHandler calls fn for the events on pods matching the labelSelector, using a shared informer
+	// that resyncs every resyncPeriod. The pods are then read from the informer cache.
+	AddPodEventHandler(ctx context.Context, labelSelector string, resyncPeriod time.Duration, fn EventHandlerFunc) error
+
+	// AddNodeEventHandler calls fn for the events on nodes, using a shared informer that resyncs every resyncPeriod.
+	AddNodeEventHandler(ctx context.Context, resyncPeriod time.Duration, fn EventHandlerFunc) error
+
+	// AddPodEventsHandler calls fn for the Kubernetes Events about pods matching the fieldSelector, using the shared
+	// informer for that fieldSelector, which resyncs every resyncPeriod.
+	AddPodEventsHandler(ctx context.Context, fieldSelector string, resyncPeriod time.Duration, fn EventHandlerFunc) error
 
 	// TaintNode applies the specified 'taintKey' string and 'effect' to the node with 'nodeName'
 	// The 'remove' flag indicates if the taint should be removed from the node, if it exists.
 	TaintNode(ctx context.Context, nodeName, taintKey string, effect v1.TaintEffect, remove bool) error
 
+	// AnnotateNode sets the annotation 'key' to 'value' on the node with 'nodeName'.
+	AnnotateNode(ctx context.Context, nodeName, key, value string) error
+
+	// SetNodeCondition sets the condition on the node with 'nodeName', replacing the condition of the same type.
+	// The node is only patched if the status, reason, or message changed.
+	SetNodeCondition(ctx context.Context, nodeName string, condition v1.NodeCondition) error
+
 	// CreateEvent creates an event on a runtime object.
 	// sourceComponent is name of component producing event, e.g. "podmon"
 	// eventType is the type of this event (Normal, Warning)
 	// reason is why the action was taken. It is human-readable.
 	// messageFmt and args for a human readable description of the status of this operation
 	CreateEvent(sourceComponent string, object runtime.Object, eventType, reason, messageFmt string, args ...interface{}) error
+
+	// GetConfigMaps returns the configmaps in the namespace matching the labelSelector.
+	GetConfigMaps(ctx context.Context, namespace, labelSelector string) (*v1.ConfigMapList, error)
+
+	// CreateOrUpdateConfigMap creates the configmap, or replaces it if it already exists.
+	CreateOrUpdateConfigMap(ctx context.Context, configMap *v1.ConfigMap) error
+
+	// DeleteConfigMap deletes the configmap of the given namespace and name.
+	DeleteConfigMap(ctx context.Context, namespace, name string) error
 }
 
+// EventHandlerFunc is called for each informer event. eventType is Added, Modified (including resyncs), or Deleted.
+type EventHandlerFunc func(eventType watch.EventType, object interface{})
+
 const (
 	// EventTypeNormal will log a "Normal" event.
 	EventTypeNormal = "Normal"
@@ -24,23 +24,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"podmon/internal/metrics"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/strategicpatch"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 )
 
 // Client holds a reference to a Kubernetes client
@@ -50,6 +52,8 @@ type Client struct {
 	eventRecorder             record.EventRecorder
 	volumeAttachmentCache     map[string]*storagev1.VolumeAttachment
 	volumeAttachmentNameToKey map[string]string
+	informerLock              sync.RWMutex
+	informers                 informerCaches
 }
 
 const (
@@ -93,6 +97,9 @@ func (api *Client) DeletePod(ctx context.Context, namespace, name string, podUID
 
 // GetPod returns a Pod object referenced by the namespace and name
 func (api *Client) GetPod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	if pod := api.getCachedPod(namespace, name); pod != nil {
+		return pod, nil
+	}
 	getopt := metav1.GetOptions{}
 	pod, err := api.Client.CoreV1().Pods(namespace).Get(ctx, name, getopt)
 	if err != nil {
@@ -101,8 +108,6 @@ func (api *Client) GetPod(ctx context.Context, namespace, name string) (*v1.Pod,
 	return pod, err
 }
 
-var vacachehit, vacachemiss int
-
 // GetCachedVolumeAttachment will try to load the volumeattachment select by the persistent volume name and node name.
 // If found it is returned from the cache. If not found, the cache is reloaded and the result returned from the reloaded data.
 func (api *Client) GetCachedVolumeAttachment(ctx context.Context, pvName, nodeName string) (*storagev1.VolumeAttachment, error) {
@@ -110,9 +115,15 @@ func (api *Client) GetCachedVolumeAttachment(ctx context.Context, pvName, nodeNa
 	defer api.Lock.Unlock()
 	key := fmt.Sprintf("%s/%s", pvName, nodeName)
 	log.Debugf("Looking for volume attachment %s", key)
+	if va := api.getCachedVolumeAttachmentByPVNode(pvName, nodeName); va != nil {
+		// Informer cache hit - return the VA from the informer cache.
+		metrics.RecordVACacheHit()
+		return va, nil
+	}
 	if api.volumeAttachmentCache != nil && api.volumeAttachmentCache[key] != nil {
 		// Cache hit - return cached VA.
-		vacachehit++
+		metrics.RecordVACacheHit()
+		vacachehit, vacachemiss := metrics.VACacheCounts()
 		log.Debugf("VA Cache Hit %d / Miss %d", vacachehit, vacachemiss)
 		return api.volumeAttachmentCache[key], nil
 	}
@@ -122,7 +133,8 @@ func (api *Client) GetCachedVolumeAttachment(ctx context.Context, pvName, nodeNa
 		return nil, err
 	}
 	// Rebuild the cache
-	vacachemiss++
+	metrics.RecordVACacheMiss()
+	vacachehit, vacachemiss := metrics.VACacheCounts()
 	log.Debugf("VA Cache Miss %d / %d", vacachemiss, vacachehit)
 	api.volumeAttachmentCache = make(map[string]*storagev1.VolumeAttachment)
 	api.volumeAttachmentNameToKey = make(map[string]string)
@@ -141,6 +153,9 @@ func (api *Client) GetCachedVolumeAttachment(ctx context.Context, pvName, nodeNa
 
 // GetVolumeAttachments retrieves all the volume attachments
 func (api *Client) GetVolumeAttachments(ctx context.Context) (*storagev1.VolumeAttachmentList, error) {
+	if volumeAttachments, ok := api.listCachedVolumeAttachments(); ok {
+		return volumeAttachments, nil
+	}
 	volumeAttachments, err := api.Client.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
@@ -148,6 +163,24 @@ func (api *Client) GetVolumeAttachments(ctx context.Context) (*storagev1.VolumeA
 	return volumeAttachments, nil
 }
 
+// GetVolumeAttachmentsForPV retrieves the volume attachments of the persistent volume on any node
+func (api *Client) GetVolumeAttachmentsForPV(ctx context.Context, pvName string) (*storagev1.VolumeAttachmentList, error) {
+	if volumeAttachments, ok := api.listCachedVolumeAttachmentsByPV(pvName); ok {
+		return volumeAttachments, nil
+	}
+	volumeAttachments, err := api.Client.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	result := &storagev1.VolumeAttachmentList{}
+	for _, va := range volumeAttachments.Items {
+		if va.Spec.Source.PersistentVolumeName != nil && *va.Spec.Source.PersistentVolumeName == pvName {
+			result.Items = append(result.Items, va)
+		}
+	}
+	return result, nil
+}
+
 // DeleteVolumeAttachment deletes a volume attachment by name.
 func (api *Client) DeleteVolumeAttachment(ctx context.Context, vaname string) error {
 	deleteOptions := metav1.DeleteOptions{}
@@ -172,6 +205,9 @@ func (api *Client) DeleteVolumeAttachment(ctx context.Context, vaname string) er
 
 // GetPersistentVolumeClaimsInNamespace returns all the pvcs in a namespace.
 func (api *Client) GetPersistentVolumeClaimsInNamespace(ctx context.Context, namespace string) (*v1.PersistentVolumeClaimList, error) {
+	if persistentVolumeClaims, ok := api.listCachedPersistentVolumeClaims(namespace); ok {
+		return persistentVolumeClaims, nil
+	}
 	persistentVolumes, err := api.Client.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
@@ -265,6 +301,9 @@ func (api *Client) GetPersistentVolume(ctx context.Context, pvName string) (*v1.
 	if api.Client == nil {
 		return nil, errors.New("No connection")
 	}
+	if pv := api.getCachedPersistentVolume(pvName); pv != nil {
+		return pv, nil
+	}
 	getopt := metav1.GetOptions{}
 	pv, err := api.Client.CoreV1().PersistentVolumes().Get(ctx, pvName, getopt)
 	if err != nil {
@@ -279,6 +318,9 @@ func (api *Client) GetPersistentVolumeClaim(ctx context.Context, namespace, pvcN
 	if api.Client == nil {
 		return nil, errors.New("No connection")
 	}
+	if pvc := api.getCachedPersistentVolumeClaim(namespace, pvcName); pvc != nil {
+		return pvc, nil
+	}
 	pvcinterface := api.Client.CoreV1().PersistentVolumeClaims(namespace)
 	getopt := metav1.GetOptions{}
 	pvc, err := pvcinterface.Get(ctx, pvcName, getopt)
@@ -288,8 +330,31 @@ func (api *Client) GetPersistentVolumeClaim(ctx context.Context, namespace, pvcN
 	return pvc, err
 }
 
+// GetPodsOnNode returns the pods scheduled on the node.
+func (api *Client) GetPodsOnNode(ctx context.Context, nodeName string) (*v1.PodList, error) {
+	selector := fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+	pods, err := api.Client.CoreV1().Pods(v1.NamespaceAll).List(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		log.Errorf("error listing pods on node %s: %s", nodeName, err)
+	}
+	return pods, err
+}
+
+// GetPodEvents returns the events whose involved object is the pod.
+func (api *Client) GetPodEvents(ctx context.Context, pod *v1.Pod) (*v1.EventList, error) {
+	selector := fields.OneTermEqualSelector("involvedObject.uid", string(pod.ObjectMeta.UID)).String()
+	events, err := api.Client.CoreV1().Events(pod.ObjectMeta.Namespace).List(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		log.Errorf("error listing events for pod %s/%s: %s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, err)
+	}
+	return events, err
+}
+
 // GetNode returns a Node object given its name
 func (api *Client) GetNode(ctx context.Context, nodeName string) (*v1.Node, error) {
+	if node := api.getCachedNode(nodeName); node != nil {
+		return node, nil
+	}
 	node, err := api.Client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
 	if err != nil {
 		log.Error("error retrieving node: " + nodeName + " : " + err.Error())
@@ -368,60 +433,94 @@ func (api *Client) GetPVNameFromVA(va *storagev1.VolumeAttachment) (string, erro
 	return "", fmt.Errorf("Could not find PersistentVolume from VolumeAttachment %s", va.ObjectMeta.Name)
 }
 
-// SetupPodWatch returns a watch.Interface given the namespace and list options
-func (api *Client) SetupPodWatch(ctx context.Context, namespace string, listOptions metav1.ListOptions) (watch.Interface, error) {
-	watcher, err := api.Client.CoreV1().Pods(namespace).Watch(ctx, listOptions)
-	return watcher, err
-}
-
-// SetupNodeWatch returns a watch.Interface given the list options
-func (api *Client) SetupNodeWatch(ctx context.Context, listOptions metav1.ListOptions) (watch.Interface, error) {
-	watcher, err := api.Client.CoreV1().Nodes().Watch(ctx, listOptions)
-	return watcher, err
-}
-
 // TaintNode applies the specified 'taintKey' string and 'effect' to the node with 'nodeName'
 // The 'remove' flag indicates if the taint should be removed from the node, if it exists.
+// The node is read from the API server rather than the informer cache, and the patch replaces the whole taints
+// list, so it is made conditional on the node's resourceVersion and retried on a conflict. That way concurrent
+// taint changes by podmon or others are never lost.
 func (api *Client) TaintNode(ctx context.Context, nodeName, taintKey string, effect v1.TaintEffect, remove bool) error {
-	node, err := api.GetNode(ctx, nodeName)
-	if err != nil {
-		return err
-	}
-
-	// Capture what the node looks like now
-	oldData, err := json.Marshal(node)
-	if err != nil {
-		return err
-	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := api.Client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
 
-	// Apply the taint request against the node and determine if it should be patched
-	// Note: node.Spec.Taints will have an updated list if 'shouldPatch' == true
-	operation, shouldPatch := updateTaint(node, taintKey, effect, remove)
-	if shouldPatch {
+		// Apply the taint request against the node and determine if it should be patched
+		// Note: node.Spec.Taints will have an updated list if 'shouldPatch' == true
+		operation, shouldPatch := updateTaint(node, taintKey, effect, remove)
+		if !shouldPatch {
+			log.Infof("%s : %s on node %s", operation, taintKey, nodeName)
+			return nil
+		}
 		log.Infof("Attempting %s : %s against node %s", operation, taintKey, nodeName)
 
-		// Should be patched, so get latest json data for node containing updated taints
-		newData, err2 := json.Marshal(node)
-		if err2 != nil {
-			return err2
+		// The resourceVersion makes the API server reject the patch with a conflict if the node changed since it was read
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": node.ObjectMeta.ResourceVersion},
+			"spec":     map[string]interface{}{"taints": node.Spec.Taints},
 		}
-
-		// Produce a patch update object
-		patchBytes, err2 := strategicpatch.CreateTwoWayMergePatch(oldData, newData, node)
-		if err2 != nil {
-			return err2
+		patchBytes, err := json.Marshal(patch)
+		if err != nil {
+			return err
 		}
 
 		// Indicate what's making the taint patch
 		patchOptions := metav1.PatchOptions{FieldManager: taintedWithPodmon}
 
 		// Request k8s to patch the node with the new taints applied
-		_, err2 = api.Client.CoreV1().Nodes().Patch(ctx, nodeName, types.StrategicMergePatchType, patchBytes, patchOptions)
-		return err2
-	}
+		_, err = api.Client.CoreV1().Nodes().Patch(ctx, nodeName, types.MergePatchType, patchBytes, patchOptions)
+		return err
+	})
+}
 
-	log.Infof("%s : %s on node %s", operation, taintKey, nodeName)
+// AnnotateNode sets the annotation 'key' to 'value' on the node with 'nodeName'.
+func (api *Client) AnnotateNode(ctx context.Context, nodeName, key, value string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	patchOptions := metav1.PatchOptions{FieldManager: taintedWithPodmon}
+	_, err = api.Client.CoreV1().Nodes().Patch(ctx, nodeName, types.MergePatchType, patchBytes, patchOptions)
+	return err
+}
 
+// SetNodeCondition sets the condition on the node with 'nodeName', replacing the condition of the same type.
+// The node is only patched if the status, reason, or message changed, and the last transition time is kept
+// unless the status changed.
+func (api *Client) SetNodeCondition(ctx context.Context, nodeName string, condition v1.NodeCondition) error {
+	node, err := api.GetNode(ctx, nodeName)
+	if err != nil {
+		return err
+	}
+	now := metav1.Now()
+	condition.LastHeartbeatTime = now
+	condition.LastTransitionTime = now
+	for _, existing := range node.Status.Conditions {
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message {
+			return nil
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.NodeCondition{condition},
+		},
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = api.Client.CoreV1().Nodes().PatchStatus(ctx, nodeName, patchBytes)
 	return err
 }
 
@@ -504,3 +603,33 @@ func (api *Client) CreateEvent(sourceComponent string, object runtime.Object, ev
 	api.eventRecorder.Eventf(object, eventType, reason, messageFmt, args)
 	return nil
 }
+
+// GetConfigMaps returns the configmaps in the namespace matching the labelSelector.
+func (api *Client) GetConfigMaps(ctx context.Context, namespace, labelSelector string) (*v1.ConfigMapList, error) {
+	configMaps, err := api.Client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		log.Errorf("error listing configmaps in namespace %s: %s", namespace, err)
+	}
+	return configMaps, err
+}
+
+// CreateOrUpdateConfigMap creates the configmap, or replaces it if it already exists.
+func (api *Client) CreateOrUpdateConfigMap(ctx context.Context, configMap *v1.ConfigMap) error {
+	configMaps := api.Client.CoreV1().ConfigMaps(configMap.ObjectMeta.Namespace)
+	existing, err := configMaps.Get(ctx, configMap.ObjectMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return err
+		}
+		_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		return err
+	}
+	configMap.ObjectMeta.ResourceVersion = existing.ObjectMeta.ResourceVersion
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
+
+// DeleteConfigMap deletes the configmap of the given namespace and name.
+func (api *Client) DeleteConfigMap(ctx context.Context, namespace, name string) error {
+	return api.Client.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+}
@@ -22,20 +22,24 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
 )
 
 func createClient() *fake.Clientset {
@@ -144,6 +148,37 @@ func TestGetVolumeAttachments(t *testing.T) {
 	assert.Equal(t, "volume-attachment-2", volumeAttachments.Items[1].Name, "VolumeAttachment name does not match")
 }
 
+func TestGetVolumeAttachmentsForPV(t *testing.T) {
+	pv1, pv2 := "pv1", "pv2"
+	va := func(name, nodeName string, pvName *string) *storagev1.VolumeAttachment {
+		return &storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: pvName},
+				NodeName: nodeName,
+			},
+		}
+	}
+	mockClient := fake.NewSimpleClientset(va("va1", "node1", &pv1), va("va2", "node2", &pv1), va("va3", "node1", &pv2), va("va4", "node1", nil))
+	api := &Client{Client: mockClient}
+
+	// Without the informer cache the VolumeAttachments are listed and filtered.
+	vaList, err := api.GetVolumeAttachmentsForPV(context.Background(), pv1)
+	assert.NoError(t, err)
+	assert.Len(t, vaList.Items, 2)
+	assert.Equal(t, "va1", vaList.Items[0].Name)
+	assert.Equal(t, "va2", vaList.Items[1].Name)
+	vaList, err = api.GetVolumeAttachmentsForPV(context.Background(), "pv3")
+	assert.NoError(t, err)
+	assert.Len(t, vaList.Items, 0)
+
+	mockClient.PrependReactor("list", "volumeattachments", func(_ core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("induced list error")
+	})
+	_, err = api.GetVolumeAttachmentsForPV(context.Background(), pv1)
+	assert.EqualError(t, err, "induced list error")
+}
+
 func TestDeleteVolumeAttachment(t *testing.T) {
 	mockClient := createClient()
 	api := &Client{
@@ -973,6 +1008,160 @@ func TestTaintNode(t *testing.T) {
 	})
 }
 
+func TestTaintNodeStaleCache(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", ResourceVersion: "1"}}
+	mockClient := fake.NewSimpleClientset(node)
+	// The informer cache holds the node as it was before any taints were added, and never catches up.
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, indexer.Add(node.DeepCopy()))
+	api := &Client{Client: mockClient}
+	api.informers.nodeLister = corelisters.NewNodeLister(indexer)
+
+	ctx := context.Background()
+	assert.NoError(t, api.TaintNode(ctx, "node1", "key1", v1.TaintEffectNoSchedule, false))
+	assert.NoError(t, api.TaintNode(ctx, "node1", "key2", v1.TaintEffectNoExecute, false))
+	live, err := mockClient.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, live.Spec.Taints, 2)
+	assert.True(t, taintExists(live, "key1", v1.TaintEffectNoSchedule))
+	assert.True(t, taintExists(live, "key2", v1.TaintEffectNoExecute))
+
+	// The stale cache has no taints, but the taint is still removed from the node.
+	assert.NoError(t, api.TaintNode(ctx, "node1", "key1", v1.TaintEffectNoSchedule, true))
+	live, err = mockClient.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, taintExists(live, "key1", v1.TaintEffectNoSchedule))
+	assert.True(t, taintExists(live, "key2", v1.TaintEffectNoExecute))
+
+	// A conflict because the node changed after it was read is retried.
+	conflicts := 0
+	mockClient.PrependReactor("patch", "nodes", func(_ core.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			conflicts++
+			return true, nil, k8serrors.NewConflict(v1.Resource("nodes"), "node1", errors.New("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+	assert.NoError(t, api.TaintNode(ctx, "node1", "key3", v1.TaintEffectNoSchedule, false))
+	assert.Equal(t, 1, conflicts)
+	live, err = mockClient.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, taintExists(live, "key2", v1.TaintEffectNoExecute))
+	assert.True(t, taintExists(live, "key3", v1.TaintEffectNoSchedule))
+}
+
+func TestAnnotateNode(t *testing.T) {
+	mockClient := createClient()
+	api := &Client{
+		Client: mockClient,
+	}
+
+	nodeName := "test-node"
+	testNode := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        nodeName,
+			Annotations: map[string]string{"other": "value"},
+		},
+	}
+	_, err := mockClient.CoreV1().Nodes().Create(context.Background(), testNode, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create test node: %s", err)
+	}
+
+	t.Run("set annotation", func(t *testing.T) {
+		err := api.AnnotateNode(context.Background(), nodeName, "test-key", "v1")
+		assert.NoError(t, err)
+
+		node, err := api.GetNode(context.Background(), nodeName)
+		assert.NoError(t, err)
+		assert.Equal(t, "v1", node.ObjectMeta.Annotations["test-key"])
+		assert.Equal(t, "value", node.ObjectMeta.Annotations["other"])
+	})
+
+	t.Run("update annotation", func(t *testing.T) {
+		err := api.AnnotateNode(context.Background(), nodeName, "test-key", "v2")
+		assert.NoError(t, err)
+
+		node, err := api.GetNode(context.Background(), nodeName)
+		assert.NoError(t, err)
+		assert.Equal(t, "v2", node.ObjectMeta.Annotations["test-key"])
+	})
+
+	t.Run("node not found", func(t *testing.T) {
+		err := api.AnnotateNode(context.Background(), "missing-node", "test-key", "v1")
+		assert.Error(t, err)
+	})
+}
+
+func TestSetNodeCondition(t *testing.T) {
+	mockClient := createClient()
+	api := &Client{
+		Client: mockClient,
+	}
+
+	nodeName := "test-node"
+	testNode := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+	_, err := mockClient.CoreV1().Nodes().Create(context.Background(), testNode, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create test node: %s", err)
+	}
+	conditionType := v1.NodeConditionType("StorageArrayConnectivity")
+	getCondition := func() *v1.NodeCondition {
+		node, err := api.GetNode(context.Background(), nodeName)
+		assert.NoError(t, err)
+		for i := range node.Status.Conditions {
+			if node.Status.Conditions[i].Type == conditionType {
+				return &node.Status.Conditions[i]
+			}
+		}
+		return nil
+	}
+
+	t.Run("set condition", func(t *testing.T) {
+		err := api.SetNodeCondition(context.Background(), nodeName, v1.NodeCondition{
+			Type: conditionType, Status: v1.ConditionTrue, Reason: "ArrayConnected", Message: "connected to array1",
+		})
+		assert.NoError(t, err)
+		condition := getCondition()
+		assert.NotNil(t, condition)
+		assert.Equal(t, "ArrayConnected", condition.Reason)
+		assert.False(t, condition.LastTransitionTime.IsZero())
+
+		node, err := api.GetNode(context.Background(), nodeName)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(node.Status.Conditions))
+	})
+
+	t.Run("keep the transition time if the status is unchanged", func(t *testing.T) {
+		before := getCondition().LastTransitionTime
+		err := api.SetNodeCondition(context.Background(), nodeName, v1.NodeCondition{
+			Type: conditionType, Status: v1.ConditionTrue, Reason: "ArrayConnected", Message: "connected to array1, array2",
+		})
+		assert.NoError(t, err)
+		condition := getCondition()
+		assert.Equal(t, "connected to array1, array2", condition.Message)
+		assert.True(t, before.Equal(&condition.LastTransitionTime))
+	})
+
+	t.Run("change the status", func(t *testing.T) {
+		err := api.SetNodeCondition(context.Background(), nodeName, v1.NodeCondition{
+			Type: conditionType, Status: v1.ConditionFalse, Reason: "ArrayConnectivityLost", Message: "lost array1",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, v1.ConditionFalse, getCondition().Status)
+	})
+
+	t.Run("node not found", func(t *testing.T) {
+		err := api.SetNodeCondition(context.Background(), "missing-node", v1.NodeCondition{Type: conditionType})
+		assert.Error(t, err)
+	})
+}
+
 func TestUpdateTaint(t *testing.T) {
 	taintKey := "key1"
 	effect := v1.TaintEffectNoSchedule
@@ -1289,111 +1478,222 @@ func TestGetContext(t *testing.T) {
 	})
 }
 
-func TestSetupPodWatch(t *testing.T) {
-	client := &Client{
-		Client: fake.NewSimpleClientset(),
-	}
-
-	type testCase struct {
-		name        string
-		namespace   string
-		listOptions metav1.ListOptions
-		setupMocks  func()
-		expectedErr string
-	}
-
-	testCases := []testCase{
-		{
-			name:        "Valid case",
-			namespace:   "default",
-			listOptions: metav1.ListOptions{},
-			setupMocks: func() {
-				client.Client.(*fake.Clientset).PrependWatchReactor("pods", func(_ core.Action) (handled bool, ret watch.Interface, err error) {
-					return true, watch.NewFake(), nil
-				})
-			},
-			expectedErr: "",
-		},
-		{
-			name:        "Watch error case",
-			namespace:   "default",
-			listOptions: metav1.ListOptions{},
-			setupMocks: func() {
-				client.Client.(*fake.Clientset).PrependWatchReactor("pods", func(_ core.Action) (handled bool, ret watch.Interface, err error) {
-					return true, nil, errors.New("watch error")
-				})
-			},
-			expectedErr: "watch error",
-		},
-	}
-
-	for _, tt := range testCases {
-		t.Run(tt.name, func(t *testing.T) {
-			tt.setupMocks()
+func TestAddPodEventHandler(t *testing.T) {
+	labeled := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "labeled", Labels: map[string]string{"podmon.dellemc.com/driver": "csi-vxflexos"}}}
+	unlabeled := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "unlabeled"}}
+	mockClient := fake.NewSimpleClientset(labeled, unlabeled)
+	api := &Client{Client: mockClient}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lock sync.Mutex
+	events := make(map[string]watch.EventType)
+	handler := func(eventType watch.EventType, object interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		events[object.(*v1.Pod).Name] = eventType
+	}
+	eventFor := func(name string) watch.EventType {
+		lock.Lock()
+		defer lock.Unlock()
+		return events[name]
+	}
+	err := api.AddPodEventHandler(ctx, "podmon.dellemc.com/driver=csi-vxflexos", time.Minute, handler)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return eventFor("labeled") == watch.Added }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, watch.EventType(""), eventFor("unlabeled"))
+
+	// The labeled pod is read from the cache, the unlabeled pod from the API server.
+	mockClient.PrependReactor("get", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.(core.GetAction).GetName() == "labeled" {
+			return true, nil, errors.New("labeled pod should be read from the cache")
+		}
+		return false, nil, nil
+	})
+	pod, err := api.GetPod(ctx, "ns", "labeled")
+	assert.NoError(t, err)
+	assert.Equal(t, "labeled", pod.Name)
+	pod, err = api.GetPod(ctx, "ns", "unlabeled")
+	assert.NoError(t, err)
+	assert.Equal(t, "unlabeled", pod.Name)
+
+	// Updates and deletes are passed to the handler.
+	updated := labeled.DeepCopy()
+	updated.Status.Reason = "NodeLost"
+	_, err = mockClient.CoreV1().Pods("ns").Update(ctx, updated, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return eventFor("labeled") == watch.Modified }, time.Second, 10*time.Millisecond)
+	err = mockClient.CoreV1().Pods("ns").Delete(ctx, "labeled", metav1.DeleteOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return eventFor("labeled") == watch.Deleted }, time.Second, 10*time.Millisecond)
+
+	// No connection
+	api = &Client{}
+	assert.Error(t, api.AddPodEventHandler(ctx, "", time.Minute, handler))
+}
 
-			watcher, err := client.SetupPodWatch(context.Background(), tt.namespace, tt.listOptions)
+func TestAddNodeEventHandler(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", UID: "uid1"}}
+	mockClient := fake.NewSimpleClientset(node)
+	api := &Client{Client: mockClient}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lock sync.Mutex
+	added := make([]string, 0)
+	err := api.AddNodeEventHandler(ctx, time.Minute, func(eventType watch.EventType, object interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		if eventType == watch.Added {
+			added = append(added, object.(*v1.Node).Name)
+		}
+	})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return reflect.DeepEqual(added, []string{"node1"})
+	}, time.Second, 10*time.Millisecond)
+
+	mockClient.PrependReactor("get", "nodes", func(_ core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("node should be read from the cache")
+	})
+	cached, err := api.GetNode(ctx, "node1")
+	assert.NoError(t, err)
+	assert.Equal(t, types.UID("uid1"), cached.UID)
 
-			if tt.expectedErr != "" {
-				assert.Nil(t, watcher)
-				assert.EqualError(t, err, tt.expectedErr)
-			} else {
-				assert.NotNil(t, watcher)
-				assert.NoError(t, err)
-			}
-		})
-	}
+	// No connection
+	api = &Client{}
+	assert.Error(t, api.AddNodeEventHandler(ctx, time.Minute, func(_ watch.EventType, _ interface{}) {}))
 }
 
-func TestSetupNodeWatch(t *testing.T) {
-	client := &Client{
-		Client: fake.NewSimpleClientset(),
-	}
-
-	type testCase struct {
-		name        string
-		listOptions metav1.ListOptions
-		setupMocks  func()
-		expectedErr string
-	}
+func TestAddPodEventsHandler(t *testing.T) {
+	event := &v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "pod1.1", Namespace: "ns"},
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "pod1", Namespace: "ns"},
+		Reason:         "FailedAttachVolume",
+	}
+	mockClient := fake.NewSimpleClientset(event)
+	api := &Client{Client: mockClient}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lock sync.Mutex
+	added := make([]string, 0)
+	err := api.AddPodEventsHandler(ctx, "reason=FailedAttachVolume", time.Minute, func(eventType watch.EventType, object interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		if eventType == watch.Added {
+			added = append(added, object.(*v1.Event).InvolvedObject.Name)
+		}
+	})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return reflect.DeepEqual(added, []string{"pod1"})
+	}, time.Second, 10*time.Millisecond)
+
+	// Each field selector gets its own informer, the same one is shared.
+	assert.NoError(t, api.AddPodEventsHandler(ctx, "reason=FailedMount", time.Minute, func(_ watch.EventType, _ interface{}) {}))
+	assert.NoError(t, api.AddPodEventsHandler(ctx, "reason=FailedAttachVolume", time.Minute, func(_ watch.EventType, _ interface{}) {}))
+	assert.Len(t, api.informers.eventFactories, 2)
+
+	// No connection
+	api = &Client{}
+	assert.Error(t, api.AddPodEventsHandler(ctx, "", time.Minute, func(_ watch.EventType, _ interface{}) {}))
+}
 
-	testCases := []testCase{
-		{
-			name:        "Valid case",
-			listOptions: metav1.ListOptions{},
-			setupMocks: func() {
-				client.Client.(*fake.Clientset).PrependWatchReactor("nodes", func(_ core.Action) (handled bool, ret watch.Interface, err error) {
-					return true, watch.NewFake(), nil
-				})
-			},
-			expectedErr: "",
-		},
-		{
-			name:        "Watch error case",
-			listOptions: metav1.ListOptions{},
-			setupMocks: func() {
-				client.Client.(*fake.Clientset).PrependWatchReactor("nodes", func(_ core.Action) (handled bool, ret watch.Interface, err error) {
-					return true, nil, errors.New("watch error")
-				})
-			},
-			expectedErr: "watch error",
+func TestStartInformers(t *testing.T) {
+	pvName := "pv1"
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: pvName}}
+	pvc := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pvc1"}}
+	va := &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va1"},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			NodeName: "node1",
 		},
 	}
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	mockClient := fake.NewSimpleClientset(pv, pvc, va, node)
+	api := &Client{Client: mockClient}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, api.StartInformers(ctx, time.Minute))
 
-	for _, tt := range testCases {
-		t.Run(tt.name, func(t *testing.T) {
-			tt.setupMocks()
-
-			watcher, err := client.SetupNodeWatch(context.Background(), tt.listOptions)
+	// Once the caches have synced no API calls are needed.
+	mockClient.PrependReactor("*", "*", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("unexpected API call %s %s", action.GetVerb(), action.GetResource().Resource)
+	})
+	gotPV, err := api.GetPersistentVolume(ctx, pvName)
+	assert.NoError(t, err)
+	assert.Equal(t, pvName, gotPV.Name)
+	gotPVC, err := api.GetPersistentVolumeClaim(ctx, "ns", "pvc1")
+	assert.NoError(t, err)
+	assert.Equal(t, "pvc1", gotPVC.Name)
+	pvcList, err := api.GetPersistentVolumeClaimsInNamespace(ctx, "ns")
+	assert.NoError(t, err)
+	assert.Len(t, pvcList.Items, 1)
+	vaList, err := api.GetVolumeAttachments(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, vaList.Items, 1)
+	vaList, err = api.GetVolumeAttachmentsForPV(ctx, pvName)
+	assert.NoError(t, err)
+	assert.Len(t, vaList.Items, 1)
+	gotVA, err := api.GetCachedVolumeAttachment(ctx, pvName, "node1")
+	assert.NoError(t, err)
+	assert.Equal(t, "va1", gotVA.Name)
+	gotNode, err := api.GetNode(ctx, "node1")
+	assert.NoError(t, err)
+	assert.Equal(t, "node1", gotNode.Name)
+
+	// An object not in the cache is read from the API server.
+	_, err = api.GetPersistentVolume(ctx, "pv2")
+	assert.EqualError(t, err, "unexpected API call get persistentvolumes")
+
+	// No connection
+	api = &Client{}
+	assert.Error(t, api.StartInformers(ctx, time.Minute))
+}
 
-			if tt.expectedErr != "" {
-				assert.Nil(t, watcher)
-				assert.EqualError(t, err, tt.expectedErr)
-			} else {
-				assert.NotNil(t, watcher)
-				assert.NoError(t, err)
-			}
-		})
-	}
+func TestStartInformersForbidden(t *testing.T) {
+	defer func(timeout time.Duration) { informerSyncTimeout = timeout }(informerSyncTimeout)
+	informerSyncTimeout = 500 * time.Millisecond
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	mockClient := fake.NewSimpleClientset(node)
+	var forbidden atomic.Bool
+	forbidden.Store(true)
+	mockClient.PrependReactor("list", "volumeattachments", func(_ core.Action) (bool, runtime.Object, error) {
+		if forbidden.Load() {
+			return true, nil, errors.New("volumeattachments is forbidden")
+		}
+		return false, nil, nil
+	})
+	api := &Client{Client: mockClient}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The caches can be read while waiting for a sync that never finishes, and the wait is bounded.
+	result := make(chan error, 1)
+	go func() { result <- api.StartInformers(ctx, time.Minute) }()
+	gotNode, err := api.GetNode(ctx, "node1")
+	assert.NoError(t, err)
+	assert.Equal(t, "node1", gotNode.Name)
+	select {
+	case err = <-result:
+		assert.Error(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("StartInformers did not return")
+	}
+
+	// A retry reuses the started informers, whose list is retried with backoff.
+	factory := api.informers.factory
+	forbidden.Store(false)
+	informerSyncTimeout = 30 * time.Second
+	assert.NoError(t, api.StartInformers(ctx, time.Minute))
+	assert.Equal(t, factory, api.informers.factory)
+	assert.NotNil(t, api.informers.vaIndexer)
 }
 
 func TestClient_GetClient(t *testing.T) {
@@ -1531,3 +1831,107 @@ func TestClient_GetVolumeHandleFromVA(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigMaps(t *testing.T) {
+	mockClient := createClient()
+	api := &Client{
+		Client: mockClient,
+	}
+	ctx := context.Background()
+	namespace := "podmon"
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-configmap",
+			Namespace: namespace,
+			Labels:    map[string]string{"app": "podmon"},
+		},
+		Data: map[string]string{"step": "Started"},
+	}
+
+	// Create the configmap
+	err := api.CreateOrUpdateConfigMap(ctx, configMap)
+	assert.NoError(t, err)
+
+	// Update the configmap
+	configMap.Data["step"] = "Fenced"
+	err = api.CreateOrUpdateConfigMap(ctx, configMap)
+	assert.NoError(t, err)
+
+	configMaps, err := api.GetConfigMaps(ctx, namespace, "app=podmon")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(configMaps.Items))
+	assert.Equal(t, "Fenced", configMaps.Items[0].Data["step"])
+
+	configMaps, err = api.GetConfigMaps(ctx, namespace, "app=other")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(configMaps.Items))
+
+	// Delete the configmap
+	err = api.DeleteConfigMap(ctx, namespace, "test-configmap")
+	assert.NoError(t, err)
+	err = api.DeleteConfigMap(ctx, namespace, "test-configmap")
+	assert.Error(t, err)
+
+	// Error getting the existing configmap
+	mockClient.PrependReactor("get", "configmaps", func(_ core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("induced get error")
+	})
+	err = api.CreateOrUpdateConfigMap(ctx, configMap)
+	assert.Error(t, err)
+}
+
+func TestGetPodsOnNode(t *testing.T) {
+	mockClient := createClient()
+	api := &Client{
+		Client: mockClient,
+	}
+	ctx := context.Background()
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-ns"}, Spec: v1.PodSpec{NodeName: "node1"}}
+	_, err := mockClient.CoreV1().Pods("test-ns").Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create test pod: %s", err)
+	}
+
+	pods, err := api.GetPodsOnNode(ctx, "node1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pods.Items))
+	assert.Equal(t, "test-pod", pods.Items[0].Name)
+
+	// Error listing the pods
+	mockClient.PrependReactor("list", "pods", func(_ core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("induced list error")
+	})
+	_, err = api.GetPodsOnNode(ctx, "node1")
+	assert.Error(t, err)
+}
+
+func TestGetPodEvents(t *testing.T) {
+	mockClient := createClient()
+	api := &Client{
+		Client: mockClient,
+	}
+	ctx := context.Background()
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-ns", UID: "test-uid"}}
+	event := &v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "test-pod.1", Namespace: "test-ns"},
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "test-pod", Namespace: "test-ns", UID: "test-uid"},
+		Reason:         "FailedMount",
+		Message:        "MountVolume.SetUp failed",
+	}
+	_, err := mockClient.CoreV1().Events("test-ns").Create(ctx, event, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create test event: %s", err)
+	}
+
+	events, err := api.GetPodEvents(ctx, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(events.Items))
+	assert.Equal(t, "FailedMount", events.Items[0].Reason)
+
+	// Error listing the events
+	mockClient.PrependReactor("list", "events", func(_ core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("induced list error")
+	})
+	_, err = api.GetPodEvents(ctx, pod)
+	assert.Error(t, err)
+}
@@ -0,0 +1,438 @@
+/*
+* Copyright (c) 2021-2023 Dell Inc., or its subsidiaries. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package metrics
+
+// metrics package provides the Prometheus collectors exported by podmon, along with
+// the http handler used to serve them. The collectors are package level so that the
+// monitor and k8sapi packages can record into them without any additional plumbing.
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "podmon"
+
+// Values used for the result label of the cleanup metrics.
+const (
+	ResultCleaned = "cleaned"
+	ResultAborted = "aborted"
+	ResultSkipped = "skipped"
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultDryRun  = "dry_run"
+)
+
+// Registry is the registry holding all the podmon collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// ControllerCleanupTotal counts the controllerCleanupPod outcomes by reason, result, and abort cause.
+	ControllerCleanupTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "controller",
+		Name:      "pod_cleanup_total",
+		Help:      "Number of controller pod cleanup attempts by reason, result, and abort cause.",
+	}, []string{"reason", "result", "abort_cause"})
+
+	// ControllerCleanupDuration records how long controllerCleanupPod took by reason and result.
+	ControllerCleanupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "controller",
+		Name:      "pod_cleanup_duration_seconds",
+		Help:      "Duration of controller pod cleanup attempts in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"reason", "result"})
+
+	// NodeCleanupTotal counts the nodeModeCleanupPod results.
+	NodeCleanupTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "node",
+		Name:      "pod_cleanup_total",
+		Help:      "Number of node pod cleanup attempts by result.",
+	}, []string{"result"})
+
+	// NodeCleanupDuration records how long nodeModeCleanupPod took by result.
+	NodeCleanupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "node",
+		Name:      "pod_cleanup_duration_seconds",
+		Help:      "Duration of node pod cleanup attempts in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"result"})
+
+	// CSICallDuration records the latency of calls into the CSI driver by method.
+	CSICallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "csi",
+		Name:      "call_duration_seconds",
+		Help:      "Latency of CSI driver calls in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// CSICallErrors counts the calls into the CSI driver that returned an error by method.
+	CSICallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "csi",
+		Name:      "call_errors_total",
+		Help:      "Number of CSI driver calls that returned an error.",
+	}, []string{"method"})
+
+	// VACacheHits counts the VolumeAttachment cache hits.
+	VACacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "va_cache",
+		Name:      "hits_total",
+		Help:      "Number of VolumeAttachment cache hits.",
+	})
+
+	// VACacheMisses counts the VolumeAttachment cache misses (each of which causes a cache rebuild).
+	VACacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "va_cache",
+		Name:      "misses_total",
+		Help:      "Number of VolumeAttachment cache misses.",
+	})
+
+	// NodeArrayConnected is 1 if the node is considered connected to the array, 0 otherwise.
+	NodeArrayConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "array",
+		Name:      "node_connected",
+		Help:      "Node to array connectivity state (1 connected, 0 connectivity lost).",
+	}, []string{"node", "array"})
+
+	// NodeArrayConnectivityLossCount is the number of consecutive samples with no connectivity.
+	NodeArrayConnectivityLossCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "array",
+		Name:      "node_connectivity_loss_count",
+		Help:      "Number of consecutive node to array connectivity samples that reported no connectivity.",
+	}, []string{"node", "array"})
+
+	// NodeArrayFlapping is 1 while the node's connectivity to the array is flapping, 0 otherwise.
+	NodeArrayFlapping = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "array",
+		Name:      "node_connectivity_flapping",
+		Help:      "Whether the node to array connectivity is flapping (1 flapping, 0 stable).",
+	}, []string{"node", "array"})
+
+	// NodeArrayFlaps counts the times the node's connectivity to the array started flapping.
+	NodeArrayFlaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "array",
+		Name:      "node_connectivity_flaps_total",
+		Help:      "Number of times the node to array connectivity started flapping.",
+	}, []string{"node", "array"})
+
+	// ArrayConnectivityPollDuration records how long sampling the node to array connectivity took in each poll.
+	ArrayConnectivityPollDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "array",
+		Name:      "connectivity_poll_duration_seconds",
+		Help:      "Duration of sampling the node to array connectivity in each poll in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	})
+
+	// ArrayConnectivityPollPairs is the number of node:array pairs sampled in the last poll.
+	ArrayConnectivityPollPairs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "array",
+		Name:      "connectivity_poll_pairs",
+		Help:      "Number of node to array pairs to sample in the last connectivity poll.",
+	})
+
+	// ArrayConnectivityPollSkipped counts the node:array pairs not sampled because the poll deadline was reached.
+	ArrayConnectivityPollSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "array",
+		Name:      "connectivity_poll_skipped_total",
+		Help:      "Number of node to array pairs not sampled because the connectivity poll deadline was reached.",
+	})
+
+	// ArrayOutage is 1 while most of the nodes using the array have lost connectivity to it, 0 otherwise.
+	ArrayOutage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "array",
+		Name:      "outage",
+		Help:      "Whether an array outage is suppressing the failover of the nodes that lost connectivity to the array (1) or not (0).",
+	}, []string{"array"})
+
+	// FailoverPaused is 1 while the failover guard has paused failover, 0 otherwise.
+	FailoverPaused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "failover",
+		Name:      "paused",
+		Help:      "Whether failover is paused because the failover limits were exceeded (1 paused, 0 not paused).",
+	})
+
+	// FailoverDenied counts the node failovers denied by the failover guard.
+	FailoverDenied = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "failover",
+		Name:      "denied_total",
+		Help:      "Number of node failovers denied because the failover limits were exceeded.",
+	})
+
+	// WatchRestarts counts the restarts of the pod and node watchers.
+	WatchRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "watch",
+		Name:      "restarts_total",
+		Help:      "Number of times a watcher was (re)started after a failure or disconnect.",
+	}, []string{"watcher", "cause"})
+
+	// WorkQueueDepth is the number of items waiting in a work queue.
+	WorkQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "depth",
+		Help:      "Number of items waiting in the work queue.",
+	}, []string{"name"})
+
+	// WorkQueueAdds counts the items added to a work queue.
+	WorkQueueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "adds_total",
+		Help:      "Number of items added to the work queue.",
+	}, []string{"name"})
+
+	// WorkQueueLatency records how long items waited in a work queue before being processed.
+	WorkQueueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "queue_duration_seconds",
+		Help:      "Time an item waited in the work queue before being processed in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"name"})
+
+	// WorkQueueWorkDuration records how long processing an item from a work queue took.
+	WorkQueueWorkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "work_duration_seconds",
+		Help:      "Time processing an item from the work queue took in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"name"})
+
+	// WorkQueueUnfinishedWork is the time the items being processed have been running.
+	WorkQueueUnfinishedWork = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "unfinished_work_seconds",
+		Help:      "Sum of the time the items being processed have been running in seconds.",
+	}, []string{"name"})
+
+	// WorkQueueLongestRunning is the time the longest running item has been processed.
+	WorkQueueLongestRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "longest_running_processor_seconds",
+		Help:      "Time the longest running item has been processed in seconds.",
+	}, []string{"name"})
+
+	// WorkQueueRetries counts the items requeued for a retry after failing.
+	WorkQueueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "retries_total",
+		Help:      "Number of items requeued for a retry after failing.",
+	}, []string{"name"})
+)
+
+// vaCacheHits and vaCacheMisses are kept alongside the counters so the hit ratio can be computed.
+var vaCacheHits, vaCacheMisses atomic.Int64
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ControllerCleanupTotal,
+		ControllerCleanupDuration,
+		NodeCleanupTotal,
+		NodeCleanupDuration,
+		CSICallDuration,
+		CSICallErrors,
+		VACacheHits,
+		VACacheMisses,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "va_cache",
+			Name:      "hit_ratio",
+			Help:      "Ratio of VolumeAttachment cache hits to total lookups.",
+		}, VACacheHitRatio),
+		NodeArrayConnected,
+		NodeArrayConnectivityLossCount,
+		NodeArrayFlapping,
+		NodeArrayFlaps,
+		ArrayConnectivityPollDuration,
+		ArrayConnectivityPollPairs,
+		ArrayConnectivityPollSkipped,
+		ArrayOutage,
+		FailoverPaused,
+		FailoverDenied,
+		WatchRestarts,
+		WorkQueueDepth,
+		WorkQueueAdds,
+		WorkQueueLatency,
+		WorkQueueWorkDuration,
+		WorkQueueUnfinishedWork,
+		WorkQueueLongestRunning,
+		WorkQueueRetries,
+	)
+}
+
+// ObserveControllerCleanup records the outcome of a controller pod cleanup.
+func ObserveControllerCleanup(reason, result, abortCause string, start time.Time) {
+	ControllerCleanupTotal.WithLabelValues(reason, result, abortCause).Inc()
+	ControllerCleanupDuration.WithLabelValues(reason, result).Observe(time.Since(start).Seconds())
+}
+
+// ObserveNodeCleanup records the outcome of a node pod cleanup.
+func ObserveNodeCleanup(err error, start time.Time) {
+	result := ResultSuccess
+	if err != nil {
+		result = ResultFailure
+	}
+	NodeCleanupTotal.WithLabelValues(result).Inc()
+	NodeCleanupDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// ObserveCSICall records the latency of a CSI call, and counts it as an error if err is non nil.
+func ObserveCSICall(method string, start time.Time, err error) {
+	CSICallDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		CSICallErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// RecordVACacheHit records a VolumeAttachment cache hit.
+func RecordVACacheHit() {
+	vaCacheHits.Add(1)
+	VACacheHits.Inc()
+}
+
+// RecordVACacheMiss records a VolumeAttachment cache miss.
+func RecordVACacheMiss() {
+	vaCacheMisses.Add(1)
+	VACacheMisses.Inc()
+}
+
+// VACacheCounts returns the number of VolumeAttachment cache hits and misses.
+func VACacheCounts() (int64, int64) {
+	return vaCacheHits.Load(), vaCacheMisses.Load()
+}
+
+// VACacheHitRatio returns the ratio of VolumeAttachment cache hits to lookups, or 0 if there were no lookups.
+func VACacheHitRatio() float64 {
+	hits, misses := VACacheCounts()
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// SetNodeArrayConnectivity records the connectivity state and consecutive loss count for a node:array pair.
+func SetNodeArrayConnectivity(node, array string, connected bool, lossCount int) {
+	value := 0.0
+	if connected {
+		value = 1.0
+	}
+	NodeArrayConnected.WithLabelValues(node, array).Set(value)
+	NodeArrayConnectivityLossCount.WithLabelValues(node, array).Set(float64(lossCount))
+}
+
+// SetNodeArrayFlapping records whether the connectivity of a node:array pair is flapping.
+func SetNodeArrayFlapping(node, array string, flapping bool) {
+	value := 0.0
+	if flapping {
+		value = 1.0
+	}
+	NodeArrayFlapping.WithLabelValues(node, array).Set(value)
+}
+
+// RecordNodeArrayFlap counts a node:array pair whose connectivity started flapping.
+func RecordNodeArrayFlap(node, array string) {
+	NodeArrayFlaps.WithLabelValues(node, array).Inc()
+}
+
+// ObserveArrayConnectivityPoll records the duration of a connectivity poll, the number of node:array pairs
+// it had to sample, and how many of them were skipped because of the poll deadline.
+func ObserveArrayConnectivityPoll(start time.Time, pairs, skipped int) {
+	ArrayConnectivityPollDuration.Observe(time.Since(start).Seconds())
+	ArrayConnectivityPollPairs.Set(float64(pairs))
+	ArrayConnectivityPollSkipped.Add(float64(skipped))
+}
+
+// SetArrayOutage records whether the array has an outage.
+func SetArrayOutage(array string, outage bool) {
+	value := 0.0
+	if outage {
+		value = 1.0
+	}
+	ArrayOutage.WithLabelValues(array).Set(value)
+}
+
+// SetFailoverPaused records whether failover is paused by the failover guard.
+func SetFailoverPaused(paused bool) {
+	value := 0.0
+	if paused {
+		value = 1.0
+	}
+	FailoverPaused.Set(value)
+}
+
+// RecordFailoverDenied counts a node failover denied by the failover guard.
+func RecordFailoverDenied() {
+	FailoverDenied.Inc()
+}
+
+// RecordWatchRestart counts a restart of the named watcher.
+func RecordWatchRestart(watcher, cause string) {
+	WatchRestarts.WithLabelValues(watcher, cause).Inc()
+}
+
+// Handler returns the http handler serving the podmon metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ListenAndServe serves the metrics endpoint at /metrics on the given address.
+// It is intended to be called as a Go routine and only returns on error.
+func ListenAndServe(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Infof("Serving metrics at %s/metrics", address)
+	err := server.ListenAndServe()
+	if err != nil {
+		log.Errorf("metrics server stopped: %s", err)
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+/*
+* Copyright (c) 2021-2023 Dell Inc., or its subsidiaries. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestObserveControllerCleanup(t *testing.T) {
+	before := testutil.ToFloat64(ControllerCleanupTotal.WithLabelValues("NodeFailure", ResultAborted, "FencingFailed"))
+	ObserveControllerCleanup("NodeFailure", ResultAborted, "FencingFailed", time.Now())
+	after := testutil.ToFloat64(ControllerCleanupTotal.WithLabelValues("NodeFailure", ResultAborted, "FencingFailed"))
+	assert.Equal(t, before+1, after)
+}
+
+func TestObserveNodeCleanup(t *testing.T) {
+	success := testutil.ToFloat64(NodeCleanupTotal.WithLabelValues(ResultSuccess))
+	failure := testutil.ToFloat64(NodeCleanupTotal.WithLabelValues(ResultFailure))
+	ObserveNodeCleanup(nil, time.Now())
+	ObserveNodeCleanup(errors.New("induced error"), time.Now())
+	assert.Equal(t, success+1, testutil.ToFloat64(NodeCleanupTotal.WithLabelValues(ResultSuccess)))
+	assert.Equal(t, failure+1, testutil.ToFloat64(NodeCleanupTotal.WithLabelValues(ResultFailure)))
+}
+
+func TestObserveCSICall(t *testing.T) {
+	before := testutil.ToFloat64(CSICallErrors.WithLabelValues("ControllerUnpublishVolume"))
+	ObserveCSICall("ControllerUnpublishVolume", time.Now(), nil)
+	assert.Equal(t, before, testutil.ToFloat64(CSICallErrors.WithLabelValues("ControllerUnpublishVolume")))
+	ObserveCSICall("ControllerUnpublishVolume", time.Now(), errors.New("induced error"))
+	assert.Equal(t, before+1, testutil.ToFloat64(CSICallErrors.WithLabelValues("ControllerUnpublishVolume")))
+}
+
+func TestVACacheHitRatio(t *testing.T) {
+	vaCacheHits.Store(0)
+	vaCacheMisses.Store(0)
+	assert.Equal(t, 0.0, VACacheHitRatio())
+	RecordVACacheMiss()
+	RecordVACacheHit()
+	RecordVACacheHit()
+	RecordVACacheHit()
+	assert.Equal(t, 0.75, VACacheHitRatio())
+}
+
+func TestSetNodeArrayConnectivity(t *testing.T) {
+	SetNodeArrayConnectivity("node1", "array1", true, 0)
+	assert.Equal(t, 1.0, testutil.ToFloat64(NodeArrayConnected.WithLabelValues("node1", "array1")))
+	SetNodeArrayConnectivity("node1", "array1", false, 3)
+	assert.Equal(t, 0.0, testutil.ToFloat64(NodeArrayConnected.WithLabelValues("node1", "array1")))
+	assert.Equal(t, 3.0, testutil.ToFloat64(NodeArrayConnectivityLossCount.WithLabelValues("node1", "array1")))
+}
+
+func TestNodeArrayFlappingMetrics(t *testing.T) {
+	before := testutil.ToFloat64(NodeArrayFlaps.WithLabelValues("node1", "array1"))
+	SetNodeArrayFlapping("node1", "array1", true)
+	RecordNodeArrayFlap("node1", "array1")
+	assert.Equal(t, 1.0, testutil.ToFloat64(NodeArrayFlapping.WithLabelValues("node1", "array1")))
+	assert.Equal(t, before+1, testutil.ToFloat64(NodeArrayFlaps.WithLabelValues("node1", "array1")))
+	SetNodeArrayFlapping("node1", "array1", false)
+	assert.Equal(t, 0.0, testutil.ToFloat64(NodeArrayFlapping.WithLabelValues("node1", "array1")))
+}
+
+func TestObserveArrayConnectivityPoll(t *testing.T) {
+	before := testutil.ToFloat64(ArrayConnectivityPollSkipped)
+	ObserveArrayConnectivityPoll(time.Now(), 20, 3)
+	assert.Equal(t, 20.0, testutil.ToFloat64(ArrayConnectivityPollPairs))
+	assert.Equal(t, before+3, testutil.ToFloat64(ArrayConnectivityPollSkipped))
+	assert.Equal(t, 1, testutil.CollectAndCount(ArrayConnectivityPollDuration))
+}
+
+func TestArrayOutageMetrics(t *testing.T) {
+	SetArrayOutage("array1", true)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ArrayOutage.WithLabelValues("array1")))
+	SetArrayOutage("array1", false)
+	assert.Equal(t, 0.0, testutil.ToFloat64(ArrayOutage.WithLabelValues("array1")))
+}
+
+func TestFailoverGuardMetrics(t *testing.T) {
+	before := testutil.ToFloat64(FailoverDenied)
+	SetFailoverPaused(true)
+	RecordFailoverDenied()
+	assert.Equal(t, 1.0, testutil.ToFloat64(FailoverPaused))
+	assert.Equal(t, before+1, testutil.ToFloat64(FailoverDenied))
+	SetFailoverPaused(false)
+	assert.Equal(t, 0.0, testutil.ToFloat64(FailoverPaused))
+}
+
+func TestWorkQueueMetricsProvider(t *testing.T) {
+	queue := workqueue.NewTypedRateLimitingQueueWithConfig(workqueue.NewTypedItemExponentialFailureRateLimiter[string](time.Millisecond, time.Millisecond),
+		workqueue.TypedRateLimitingQueueConfig[string]{Name: "test", MetricsProvider: WorkQueueMetricsProvider{}})
+	defer queue.ShutDown()
+	queue.Add("pod1")
+	queue.Add("pod2")
+	assert.Equal(t, 2.0, testutil.ToFloat64(WorkQueueDepth.WithLabelValues("test")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(WorkQueueAdds.WithLabelValues("test")))
+	item, _ := queue.Get()
+	assert.Equal(t, 1.0, testutil.ToFloat64(WorkQueueDepth.WithLabelValues("test")))
+	queue.AddRateLimited(item)
+	queue.Done(item)
+	assert.Equal(t, 1.0, testutil.ToFloat64(WorkQueueRetries.WithLabelValues("test")))
+}
+
+func TestHandler(t *testing.T) {
+	RecordWatchRestart("PodWatcher", "Disconnected")
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(body), `podmon_watch_restarts_total{cause="Disconnected",watcher="PodWatcher"}`))
+	assert.True(t, strings.Contains(string(body), "podmon_va_cache_hit_ratio"))
+}
@@ -0,0 +1,60 @@
+/*
+* Copyright (c) 2021-2023 Dell Inc., or its subsidiaries. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package metrics
+
+import (
+	"k8s.io/client-go/util/workqueue"
+)
+
+// WorkQueueMetricsProvider records the client-go work queue metrics in the podmon collectors,
+// labeled with the name of the queue.
+type WorkQueueMetricsProvider struct{}
+
+// NewDepthMetric returns the depth gauge for the named queue.
+func (WorkQueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return WorkQueueDepth.WithLabelValues(name)
+}
+
+// NewAddsMetric returns the adds counter for the named queue.
+func (WorkQueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return WorkQueueAdds.WithLabelValues(name)
+}
+
+// NewLatencyMetric returns the queue latency histogram for the named queue.
+func (WorkQueueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return WorkQueueLatency.WithLabelValues(name)
+}
+
+// NewWorkDurationMetric returns the work duration histogram for the named queue.
+func (WorkQueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return WorkQueueWorkDuration.WithLabelValues(name)
+}
+
+// NewUnfinishedWorkSecondsMetric returns the unfinished work gauge for the named queue.
+func (WorkQueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return WorkQueueUnfinishedWork.WithLabelValues(name)
+}
+
+// NewLongestRunningProcessorSecondsMetric returns the longest running processor gauge for the named queue.
+func (WorkQueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return WorkQueueLongestRunning.WithLabelValues(name)
+}
+
+// NewRetriesMetric returns the retries counter for the named queue.
+func (WorkQueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return WorkQueueRetries.WithLabelValues(name)
+}
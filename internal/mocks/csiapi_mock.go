@@ -20,6 +20,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csiext "github.com/dell/dell-csi-extensions/podmon"
@@ -30,6 +32,7 @@ type CSIMock struct {
 	InducedErrors struct {
 		NotConnected                   bool
 		ControllerUnpublishVolume      bool
+		ControllerUnpublishPending     bool
 		NodeUnpublishVolume            bool
 		NodeUnstageVolume              bool
 		ValidateVolumeHostConnectivity bool
@@ -41,6 +44,22 @@ type CSIMock struct {
 		Connected     bool
 		IosInProgress bool
 	}
+	// ArrayIDToConnected overrides the Connected response for requests with a matching ArrayId
+	ArrayIDToConnected map[string]bool
+	// ControllerUnpublishDelay is how long ControllerUnpublishVolume takes (or until the context is done)
+	ControllerUnpublishDelay time.Duration
+	// MaxControllerUnpublishInFlight is the most ControllerUnpublishVolume calls seen in flight at once
+	MaxControllerUnpublishInFlight int
+	// ControllerUnpublishedVolumeIDs are the volume IDs ControllerUnpublishVolume was called with
+	ControllerUnpublishedVolumeIDs []string
+	unpublishMutex                 sync.Mutex
+	unpublishInFlight              int
+	// ValidateVolumeHostConnectivityDelay is how long ValidateVolumeHostConnectivity takes (or until the context is done)
+	ValidateVolumeHostConnectivityDelay time.Duration
+	// MaxValidateVolumeHostConnectivityInFlight is the most ValidateVolumeHostConnectivity calls seen in flight at once
+	MaxValidateVolumeHostConnectivityInFlight int
+	validateMutex                             sync.Mutex
+	validateInFlight                          int
 }
 
 // Connected is a mock implementation of csiapi.CSIApi.Connected
@@ -57,11 +76,33 @@ func (mock *CSIMock) Close() error {
 }
 
 // ControllerUnpublishVolume is a mock implementation of csiapi.CSIApi.ControllerUnpublishVolume
-func (mock *CSIMock) ControllerUnpublishVolume(_ context.Context, _ *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+func (mock *CSIMock) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	rep := &csi.ControllerUnpublishVolumeResponse{}
+	mock.unpublishMutex.Lock()
+	mock.ControllerUnpublishedVolumeIDs = append(mock.ControllerUnpublishedVolumeIDs, req.GetVolumeId())
+	mock.unpublishInFlight++
+	if mock.unpublishInFlight > mock.MaxControllerUnpublishInFlight {
+		mock.MaxControllerUnpublishInFlight = mock.unpublishInFlight
+	}
+	mock.unpublishMutex.Unlock()
+	defer func() {
+		mock.unpublishMutex.Lock()
+		mock.unpublishInFlight--
+		mock.unpublishMutex.Unlock()
+	}()
+	if mock.ControllerUnpublishDelay > 0 {
+		select {
+		case <-time.After(mock.ControllerUnpublishDelay):
+		case <-ctx.Done():
+			return rep, ctx.Err()
+		}
+	}
 	if mock.InducedErrors.ControllerUnpublishVolume {
 		return rep, errors.New("ControllerUnpublishedVolume induced error")
 	}
+	if mock.InducedErrors.ControllerUnpublishPending {
+		return rep, errors.New("ControllerUnpublishedVolume induced error: pending")
+	}
 	return rep, nil
 }
 
@@ -90,12 +131,33 @@ func (mock *CSIMock) NodeUnstageVolume(_ context.Context, _ *csi.NodeUnstageVolu
 }
 
 // ValidateVolumeHostConnectivity is a mock implementation of csiapi.CSIApi.ValidateVolumeHostConnectivity
-func (mock *CSIMock) ValidateVolumeHostConnectivity(_ context.Context, _ *csiext.ValidateVolumeHostConnectivityRequest) (*csiext.ValidateVolumeHostConnectivityResponse, error) {
+func (mock *CSIMock) ValidateVolumeHostConnectivity(ctx context.Context, req *csiext.ValidateVolumeHostConnectivityRequest) (*csiext.ValidateVolumeHostConnectivityResponse, error) {
 	rep := &csiext.ValidateVolumeHostConnectivityResponse{}
+	mock.validateMutex.Lock()
+	mock.validateInFlight++
+	if mock.validateInFlight > mock.MaxValidateVolumeHostConnectivityInFlight {
+		mock.MaxValidateVolumeHostConnectivityInFlight = mock.validateInFlight
+	}
+	mock.validateMutex.Unlock()
+	defer func() {
+		mock.validateMutex.Lock()
+		mock.validateInFlight--
+		mock.validateMutex.Unlock()
+	}()
+	if mock.ValidateVolumeHostConnectivityDelay > 0 {
+		select {
+		case <-time.After(mock.ValidateVolumeHostConnectivityDelay):
+		case <-ctx.Done():
+			return rep, ctx.Err()
+		}
+	}
 	if mock.InducedErrors.ValidateVolumeHostConnectivity {
 		return rep, errors.New("ValidateVolumeHostConnectivity induced error")
 	}
 	rep.Connected = mock.ValidateVolumeHostConnectivityResponse.Connected
+	if connected, ok := mock.ArrayIDToConnected[req.GetArrayId()]; ok {
+		rep.Connected = connected
+	}
 	rep.IosInProgress = mock.ValidateVolumeHostConnectivityResponse.IosInProgress
 	return rep, nil
 }
@@ -20,15 +20,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"podmon/internal/k8sapi"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -39,6 +40,8 @@ type K8sMock struct {
 	NameToPV               map[string]*v1.PersistentVolume
 	NameToVolumeAttachment map[string]*storagev1.VolumeAttachment
 	NameToNode             map[string]*v1.Node
+	KeyToConfigMap         map[string]*v1.ConfigMap
+	KeyToEvents            map[string][]v1.Event
 	WantFailCount          int
 	FailCount              int
 	InducedErrors          struct {
@@ -54,6 +57,9 @@ type K8sMock struct {
 		GetPersistentVolumeClaimName         bool
 		GetPersistentVolume                  bool
 		GetPersistentVolumeClaim             bool
+		GetPodEvents                         bool
+		GetPodsOnNode                        bool
+		GetNodeNotFound                      bool
 		GetNode                              bool
 		GetNodeWithTimeout                   bool
 		GetNodeNoAnnotation                  bool
@@ -61,15 +67,28 @@ type K8sMock struct {
 		GetVolumeHandleFromVA                bool
 		GetPVNameFromVA                      bool
 		Watch                                bool
+		StartInformers                       bool
 		TaintNode                            bool
+		AnnotateNode                         bool
+		SetNodeCondition                     bool
 		CreateEvent                          bool
-	}
-	Watcher *watch.RaceFreeFakeWatcher
+		GetConfigMaps                        bool
+		CreateOrUpdateConfigMap              bool
+		DeleteConfigMap                      bool
+	}
+	PodEventHandlers []k8sapi.EventHandlerFunc
+	NodeEventHandler k8sapi.EventHandlerFunc
+	PodEventsHandler k8sapi.EventHandlerFunc
+	EventReasons     []string // the reasons of the events created
 }
 
 // Initialize initial the mock structure
 func (mock *K8sMock) Initialize() {
-	mock.Watcher = watch.NewRaceFreeFake()
+	mock.PodEventHandlers = nil
+	mock.NodeEventHandler = nil
+	mock.PodEventsHandler = nil
+	mock.EventReasons = nil
+	mock.KeyToEvents = nil
 }
 
 // AddPod creates unique functions for managing mocked database.
@@ -114,6 +133,30 @@ func (mock *K8sMock) AddNode(node *v1.Node) {
 	mock.NameToNode[node.ObjectMeta.Name] = node
 }
 
+// AddConfigMap adds mock ConfigMaps for testing
+func (mock *K8sMock) AddConfigMap(configMap *v1.ConfigMap) {
+	if mock.KeyToConfigMap == nil {
+		mock.KeyToConfigMap = make(map[string]*v1.ConfigMap)
+	}
+	key := mock.getKey(configMap.ObjectMeta.Namespace, configMap.ObjectMeta.Name)
+	mock.KeyToConfigMap[key] = configMap
+}
+
+// AddEvent adds a mock Event on the pod for testing
+func (mock *K8sMock) AddEvent(pod *v1.Pod, eventType, reason, message string) {
+	if mock.KeyToEvents == nil {
+		mock.KeyToEvents = make(map[string][]v1.Event)
+	}
+	key := mock.getKey(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+	event := v1.Event{
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Namespace: pod.ObjectMeta.Namespace, Name: pod.ObjectMeta.Name, UID: pod.ObjectMeta.UID},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+	}
+	mock.KeyToEvents[key] = append(mock.KeyToEvents[key], event)
+}
+
 // Connect connects to the Kubernetes system API
 func (mock *K8sMock) Connect(_ *string) error {
 	if mock.InducedErrors.Connect {
@@ -187,6 +230,21 @@ func (mock *K8sMock) GetVolumeAttachments(_ context.Context) (*storagev1.VolumeA
 	return valist, nil
 }
 
+// GetVolumeAttachmentsForPV gets the volume attachments of the persistent volume on any node
+func (mock *K8sMock) GetVolumeAttachmentsForPV(_ context.Context, pvName string) (*storagev1.VolumeAttachmentList, error) {
+	valist := &storagev1.VolumeAttachmentList{}
+	if mock.InducedErrors.GetVolumeAttachments {
+		return valist, errors.New("induced GetVolumeAttachments error")
+	}
+	valist.Items = make([]storagev1.VolumeAttachment, 0)
+	for _, item := range mock.NameToVolumeAttachment {
+		if item.Spec.Source.PersistentVolumeName != nil && *item.Spec.Source.PersistentVolumeName == pvName {
+			valist.Items = append(valist.Items, *item)
+		}
+	}
+	return valist, nil
+}
+
 // DeleteVolumeAttachment deletes a volume attachment by name.
 func (mock *K8sMock) DeleteVolumeAttachment(_ context.Context, va string) error {
 	if mock.InducedErrors.DeleteVolumeAttachment {
@@ -319,12 +377,39 @@ func (mock *K8sMock) GetPersistentVolumeClaim(_ context.Context, namespace, pvcN
 	return pvc, nil
 }
 
+// GetPodsOnNode returns the mock pods scheduled on the node.
+func (mock *K8sMock) GetPodsOnNode(_ context.Context, nodeName string) (*v1.PodList, error) {
+	pods := &v1.PodList{}
+	if mock.InducedErrors.GetPodsOnNode {
+		return pods, errors.New("induced GetPodsOnNode error")
+	}
+	for _, pod := range mock.KeyToPod {
+		if pod.Spec.NodeName == nodeName {
+			pods.Items = append(pods.Items, *pod)
+		}
+	}
+	return pods, nil
+}
+
+// GetPodEvents returns the mock events on the pod.
+func (mock *K8sMock) GetPodEvents(_ context.Context, pod *v1.Pod) (*v1.EventList, error) {
+	events := &v1.EventList{}
+	if mock.InducedErrors.GetPodEvents {
+		return events, errors.New("induced GetPodEvents error")
+	}
+	events.Items = append(events.Items, mock.KeyToEvents[mock.getKey(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)]...)
+	return events, nil
+}
+
 // GetNode returns the node with the specified nodeName.
 func (mock *K8sMock) GetNode(_ context.Context, nodeName string) (*v1.Node, error) {
 	var node *v1.Node
 	if mock.InducedErrors.GetNode {
 		return node, errors.New("induced GetNode error")
 	}
+	if mock.InducedErrors.GetNodeNotFound {
+		return node, k8serrors.NewNotFound(v1.Resource("nodes"), nodeName)
+	}
 	if mock.NameToNode[nodeName] != nil {
 		if mock.InducedErrors.GetNodeNoAnnotation { // no node annotation at all
 			mock.NameToNode[nodeName].ObjectMeta.Annotations["csi.volume.kubernetes.io/nodeid"] = ""
@@ -392,20 +477,39 @@ func (mock *K8sMock) getKey(namespace, name string) string {
 	return namespace + "/" + name
 }
 
-// SetupPodWatch returns a mock watcher
-func (mock *K8sMock) SetupPodWatch(_ context.Context, _ string, _ metav1.ListOptions) (watch.Interface, error) {
+// StartInformers mocks starting the shared informers
+func (mock *K8sMock) StartInformers(_ context.Context, _ time.Duration) error {
+	if mock.InducedErrors.StartInformers {
+		return errors.New("induced StartInformers error")
+	}
+	return nil
+}
+
+// AddPodEventHandler saves the handler so the tests can send it pod events
+func (mock *K8sMock) AddPodEventHandler(_ context.Context, _ string, _ time.Duration, fn k8sapi.EventHandlerFunc) error {
+	if mock.InducedErrors.Watch {
+		return errors.New("included Watch error")
+	}
+	mock.PodEventHandlers = append(mock.PodEventHandlers, fn)
+	return nil
+}
+
+// AddNodeEventHandler saves the handler so the tests can send it node events
+func (mock *K8sMock) AddNodeEventHandler(_ context.Context, _ time.Duration, fn k8sapi.EventHandlerFunc) error {
 	if mock.InducedErrors.Watch {
-		return nil, errors.New("included Watch error")
+		return errors.New("included Watch error")
 	}
-	return mock.Watcher, nil
+	mock.NodeEventHandler = fn
+	return nil
 }
 
-// SetupNodeWatch returns a mock watcher
-func (mock *K8sMock) SetupNodeWatch(_ context.Context, _ metav1.ListOptions) (watch.Interface, error) {
+// AddPodEventsHandler saves the handler so the tests can send it the Events about pods
+func (mock *K8sMock) AddPodEventsHandler(_ context.Context, _ string, _ time.Duration, fn k8sapi.EventHandlerFunc) error {
 	if mock.InducedErrors.Watch {
-		return nil, errors.New("included Watch error")
+		return errors.New("included Watch error")
 	}
-	return mock.Watcher, nil
+	mock.PodEventsHandler = fn
+	return nil
 }
 
 // TaintNode mocks tainting a node
@@ -436,10 +540,85 @@ func (mock *K8sMock) TaintNode(ctx context.Context, nodeName, taintKey string, e
 	return nil
 }
 
+// AnnotateNode sets the annotation on the mock node.
+func (mock *K8sMock) AnnotateNode(ctx context.Context, nodeName, key, value string) error {
+	if mock.InducedErrors.AnnotateNode {
+		return errors.New("induced AnnotateNode error")
+	}
+	node, err := mock.GetNode(ctx, nodeName)
+	if err != nil {
+		return err
+	}
+	if node.ObjectMeta.Annotations == nil {
+		node.ObjectMeta.Annotations = make(map[string]string)
+	}
+	node.ObjectMeta.Annotations[key] = value
+	mock.AddNode(node)
+	return nil
+}
+
+// SetNodeCondition sets the condition on the mock node, replacing the condition of the same type.
+func (mock *K8sMock) SetNodeCondition(ctx context.Context, nodeName string, condition v1.NodeCondition) error {
+	if mock.InducedErrors.SetNodeCondition {
+		return errors.New("induced SetNodeCondition error")
+	}
+	node, err := mock.GetNode(ctx, nodeName)
+	if err != nil {
+		return err
+	}
+	conditions := make([]v1.NodeCondition, 0, len(node.Status.Conditions)+1)
+	for _, existing := range node.Status.Conditions {
+		if existing.Type != condition.Type {
+			conditions = append(conditions, existing)
+		}
+	}
+	node.Status.Conditions = append(conditions, condition)
+	mock.AddNode(node)
+	return nil
+}
+
 // CreateEvent creates an event for the specified object.
-func (mock *K8sMock) CreateEvent(_ string, _ runtime.Object, _, _, _ string, _ ...interface{}) error {
+func (mock *K8sMock) CreateEvent(_ string, _ runtime.Object, _, reason, _ string, _ ...interface{}) error {
 	if mock.InducedErrors.CreateEvent {
 		return errors.New("induced CreateEvent error")
 	}
+	mock.EventReasons = append(mock.EventReasons, reason)
+	return nil
+}
+
+// GetConfigMaps returns the mock configmaps in the namespace matching the labelSelector.
+func (mock *K8sMock) GetConfigMaps(_ context.Context, namespace, labelSelector string) (*v1.ConfigMapList, error) {
+	cmlist := &v1.ConfigMapList{}
+	if mock.InducedErrors.GetConfigMaps {
+		return cmlist, errors.New("induced GetConfigMaps error")
+	}
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return cmlist, err
+	}
+	cmlist.Items = make([]v1.ConfigMap, 0)
+	for _, item := range mock.KeyToConfigMap {
+		if item.ObjectMeta.Namespace == namespace && selector.Matches(labels.Set(item.ObjectMeta.Labels)) {
+			cmlist.Items = append(cmlist.Items, *item)
+		}
+	}
+	return cmlist, nil
+}
+
+// CreateOrUpdateConfigMap creates or replaces a mock configmap.
+func (mock *K8sMock) CreateOrUpdateConfigMap(_ context.Context, configMap *v1.ConfigMap) error {
+	if mock.InducedErrors.CreateOrUpdateConfigMap {
+		return errors.New("induced CreateOrUpdateConfigMap error")
+	}
+	mock.AddConfigMap(configMap.DeepCopy())
+	return nil
+}
+
+// DeleteConfigMap deletes a mock configmap.
+func (mock *K8sMock) DeleteConfigMap(_ context.Context, namespace, name string) error {
+	if mock.InducedErrors.DeleteConfigMap {
+		return errors.New("induced DeleteConfigMap error")
+	}
+	delete(mock.KeyToConfigMap, mock.getKey(namespace, name))
 	return nil
 }
@@ -0,0 +1,161 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"podmon/internal/k8sapi"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Pods with required pod affinity must be scheduled in the same topology domain as the pods they select, so
+// podmon cleans up such pods together, letting the scheduler place them together again. The affinity graph has
+// an edge between two pods being cleaned up if a required pod affinity term of either selects the other and their
+// nodes are in the same domain of the term's topology key. The groups cleaned up together are the connected
+// components of the graph, so if A has affinity to B and B to C, all three are cleaned up as one unit.
+
+// affinityGroupCleanupReason is the Event reason used when pods with pod affinity are cleaned up together.
+const affinityGroupCleanupReason = "AffinityGroupCleanup"
+
+// getPodAffinityTerms returns the pod's required pod affinity terms that have a label selector.
+func getPodAffinityTerms(pod *v1.Pod) []v1.PodAffinityTerm {
+	affinity := pod.Spec.Affinity
+	if affinity == nil || affinity.PodAffinity == nil {
+		return nil
+	}
+	terms := make([]v1.PodAffinityTerm, 0)
+	for _, term := range affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution {
+		if term.LabelSelector == nil {
+			continue
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// affinityTermSelects returns true if the affinity term of the pod described by podInfo selects the other pod,
+// and the two pods' nodes are in the same domain of the term's topology key. A namespace selector is assumed
+// to select every namespace, as grouping too many pods is safer than splitting a group.
+func affinityTermSelects(term v1.PodAffinityTerm, podInfo, other *ControllerPodInfo) bool {
+	podNamespace, _ := splitPodKey(podInfo.PodKey)
+	otherNamespace, _ := splitPodKey(other.PodKey)
+	if term.NamespaceSelector == nil {
+		namespaces := term.Namespaces
+		if len(namespaces) == 0 {
+			namespaces = []string{podNamespace}
+		}
+		found := false
+		for _, namespace := range namespaces {
+			if namespace == otherNamespace {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	selector, err := metav1.LabelSelectorAsSelector(term.LabelSelector)
+	if err != nil {
+		log.Errorf("Ignoring pod %s invalid pod affinity label selector: %s", podInfo.PodKey, err)
+		return false
+	}
+	if !selector.Matches(labels.Set(other.PodLabels)) {
+		return false
+	}
+	if podInfo.Node.ObjectMeta.Name == other.Node.ObjectMeta.Name {
+		return true
+	}
+	domain, ok := podInfo.Node.ObjectMeta.Labels[term.TopologyKey]
+	return ok && domain == other.Node.ObjectMeta.Labels[term.TopologyKey]
+}
+
+// affinityGroups partitions the pod keys into the groups of pods that must be cleaned up together. The groups are
+// ordered by their first pod in podKeys, and the pods in each group keep their order in podKeys.
+func (cm *PodMonitorType) affinityGroups(podKeys []string) [][]string {
+	infos := make([]*ControllerPodInfo, len(podKeys))
+	for i, podKey := range podKeys {
+		if info, ok := cm.PodKeyToControllerPodInfo.Load(podKey); ok {
+			infos[i] = info.(*ControllerPodInfo)
+		}
+	}
+	// union-find over the pods, each pod's root is the earliest pod in its group
+	parent := make([]int, len(podKeys))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	related := func(a, b *ControllerPodInfo) bool {
+		for _, term := range a.PodAffinityTerms {
+			if affinityTermSelects(term, a, b) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := range infos {
+		for j := i + 1; j < len(infos); j++ {
+			if infos[i] == nil || infos[j] == nil {
+				continue
+			}
+			if related(infos[i], infos[j]) || related(infos[j], infos[i]) {
+				rootI, rootJ := find(i), find(j)
+				if rootI < rootJ {
+					parent[rootJ] = rootI
+				} else if rootJ < rootI {
+					parent[rootI] = rootJ
+				}
+			}
+		}
+	}
+	groups := make([][]string, 0)
+	groupIndex := make(map[int]int)
+	for i, podKey := range podKeys {
+		root := find(i)
+		index, ok := groupIndex[root]
+		if !ok {
+			index = len(groups)
+			groupIndex[root] = index
+			groups = append(groups, nil)
+		}
+		groups[index] = append(groups[index], podKey)
+	}
+	return groups
+}
+
+// sendAffinityGroupEvent sends one Event on the first pod of the group describing the pods cleaned up together.
+func sendAffinityGroupEvent(group []*ControllerPodInfo, reason string) {
+	podKeys := make([]string, 0, len(group))
+	for _, podInfo := range group {
+		podKeys = append(podKeys, podInfo.PodKey)
+	}
+	namespace, name := splitPodKey(group[0].PodKey)
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(group[0].PodUID)}}
+	if err := K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, affinityGroupCleanupReason,
+		"podmon cleaning up %d pods with pod affinity together because of %s: %s",
+		len(group), reason, strings.Join(podKeys, ", ")); err != nil {
+		log.Errorf("Failed to send %s event: %s", affinityGroupCleanupReason, err.Error())
+	}
+}
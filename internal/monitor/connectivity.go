@@ -0,0 +1,360 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"context"
+	"podmon/internal/k8sapi"
+	"podmon/internal/metrics"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// The ArrayConnectivityMonitor samples the connectivity of each node:array pair once per poll. The loss count of a
+// pair grows with each disconnected sample, and is only cleared after ArrayConnectivityRecoveryThreshold consecutive
+// connected samples, so a link that alternates between up and down still reaches the connection loss threshold if the
+// recovery threshold is above 1. The last samples of each pair are kept, and a pair whose connectivity changed at
+// least the flap threshold times within the flap window is flapping: a Warning Event is sent on the node and the
+// flapping metric is set. With the loss flap policy, a pair that keeps flapping for the connection loss threshold
+// number of samples is treated as having lost connectivity.
+//
+// Each poll samples the unique node:array pairs of the protected pods with a bounded pool of workers, so a poll of a
+// large cluster isn't the sum of the ValidateVolumeHostConnectivity latencies. Pairs not started before the poll
+// deadline aren't sampled, and like pairs whose connectivity could not be determined, are assumed connected.
+
+const (
+	// ArrayConnectivityFlapPolicyReport only reports flapping node:array pairs.
+	ArrayConnectivityFlapPolicyReport = "report"
+	// ArrayConnectivityFlapPolicyLoss treats sustained flapping of a node:array pair as a connectivity loss.
+	ArrayConnectivityFlapPolicyLoss = "loss"
+)
+
+// arrayConnectivityFlappingReason is the Event reason used when a node's connectivity to an array starts flapping.
+const arrayConnectivityFlappingReason = "ArrayConnectivityFlapping"
+
+// ArrayConnectivityConnectionLossThreshold is the number of consecutive samples that must fail before we declare connectivity loss
+var ArrayConnectivityConnectionLossThreshold = 3
+
+var (
+	arrayConnectivityRecoveryThreshold = 1
+	arrayConnectivityFlapThreshold     = 4
+	arrayConnectivityFlapWindow        = 10
+	arrayConnectivityFlapPolicy        = ArrayConnectivityFlapPolicyReport
+	arrayConnectivityPollConcurrency   = 10
+	arrayConnectivityPollDeadline      = time.Duration(0)
+)
+
+// GetArrayConnectivityPollLimits returns the maximum number of node:array pairs sampled concurrently, and the
+// deadline for sampling all of them in a poll. A deadline of 0 means the poll rate.
+func GetArrayConnectivityPollLimits() (int, time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return arrayConnectivityPollConcurrency, arrayConnectivityPollDeadline
+}
+
+// SetArrayConnectivityPollLimits sets the maximum number of node:array pairs sampled concurrently, and the
+// deadline for sampling all of them in a poll. A deadline of 0 means the poll rate.
+func SetArrayConnectivityPollLimits(concurrency int, deadline time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	arrayConnectivityPollConcurrency = concurrency
+	arrayConnectivityPollDeadline = deadline
+}
+
+// GetArrayConnectivityRecoveryThreshold returns the number of consecutive connected samples that clear a loss count.
+func GetArrayConnectivityRecoveryThreshold() int {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return arrayConnectivityRecoveryThreshold
+}
+
+// SetArrayConnectivityRecoveryThreshold sets the number of consecutive connected samples that clear a loss count.
+func SetArrayConnectivityRecoveryThreshold(threshold int) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	arrayConnectivityRecoveryThreshold = threshold
+}
+
+// GetArrayConnectivityFlapLimits returns how many connectivity changes within the flap window, in samples, make a
+// node:array pair flapping, and the window.
+func GetArrayConnectivityFlapLimits() (int, int) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return arrayConnectivityFlapThreshold, arrayConnectivityFlapWindow
+}
+
+// SetArrayConnectivityFlapLimits sets how many connectivity changes within the flap window, in samples, make a
+// node:array pair flapping, and the window. A threshold of 0 disables flap detection.
+func SetArrayConnectivityFlapLimits(threshold, window int) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	arrayConnectivityFlapThreshold = threshold
+	arrayConnectivityFlapWindow = window
+}
+
+// GetArrayConnectivityFlapPolicy returns what is done about flapping node:array pairs.
+func GetArrayConnectivityFlapPolicy() string {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return arrayConnectivityFlapPolicy
+}
+
+// SetArrayConnectivityFlapPolicy sets what is done about flapping node:array pairs,
+// ArrayConnectivityFlapPolicyReport or ArrayConnectivityFlapPolicyLoss.
+func SetArrayConnectivityFlapPolicy(policy string) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	arrayConnectivityFlapPolicy = policy
+}
+
+type nodeArrayConnectivityCache struct {
+	initOnce                       sync.Once            // Will be set after initialization
+	mutex                          sync.Mutex           // Protects the maps, which are updated by the sampling workers
+	nodeArrayConnectivitySampled   map[string]bool      // If true, already sampled, if need to call array to verify connectivity
+	nodeArrayConnectivityLossCount map[string]int       // 0 means connected, > 0 number of connection loss for n samples
+	nodeArrayConnectivityGoodCount map[string]int       // number of consecutive connected samples
+	nodeArrayConnectivityHistory   map[string][]bool    // the samples within the flap window, oldest first
+	nodeArrayConnectivityFlapCount map[string]int       // 0 if not flapping, else number of samples the pair has been flapping for
+	nodeArrayConnectivitySampledAt map[string]time.Time // when the pair was last sampled
+}
+
+var connectivityCache nodeArrayConnectivityCache
+
+// nodeArrayPair is a node:array pair to sample.
+type nodeArrayPair struct {
+	node    *v1.Node
+	arrayID string
+}
+
+// nodeArrayKey returns the cache key of a node:array pair.
+func nodeArrayKey(nodeName, arrayID string) string {
+	return nodeName + ":" + arrayID
+}
+
+// SamplePairs samples the connectivity of the node:array pairs, running at most the poll concurrency limit at a time,
+// until ctx is done. It returns the number of pairs that were not sampled because ctx was done.
+func (nacc *nodeArrayConnectivityCache) SamplePairs(ctx context.Context, cm *PodMonitorType, pairs []nodeArrayPair) int {
+	concurrency, _ := GetArrayConnectivityPollLimits()
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	skipped := 0
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, pair := range pairs {
+		if ctx.Err() != nil {
+			skipped++
+			continue
+		}
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			skipped++
+			continue
+		}
+		wg.Add(1)
+		go func(pair nodeArrayPair) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			nacc.sample(cm, pair.node, pair.arrayID)
+		}(pair)
+	}
+	wg.Wait()
+	if skipped > 0 {
+		log.Warnf("Array connectivity poll deadline reached, %d of %d node:array pairs were not sampled", skipped, len(pairs))
+	}
+	return skipped
+}
+
+// sample determines the connectivity of a node:array pair, and records it unless it could not be determined.
+// A disconnected sample doesn't count if the node's own array connectivity report disagrees.
+func (nacc *nodeArrayConnectivityCache) sample(cm *PodMonitorType, node *v1.Node, arrayID string) {
+	nodeUID := cm.GetNodeUID(node.ObjectMeta.Name)
+	if nodeUID == "" || nodeUID != string(node.ObjectMeta.UID) {
+		return
+	}
+	volumeIDs := make([]string, 0)
+	connected, _, err := cm.callValidateVolumeHostConnectivity(node, volumeIDs, arrayID, false)
+	if err != nil {
+		log.Infof("Could not determine array connectivity, assuming connected, error: %s", err)
+		return
+	}
+	if !connected && cm.nodeDisagreesWithLoss(node.ObjectMeta.Name, arrayID, time.Now()) {
+		log.Infof("Node %s reports it is connected to array %s, not counting the connectivity loss", node.ObjectMeta.Name, arrayID)
+		connected = true
+	}
+	key := nodeArrayKey(node.ObjectMeta.Name, arrayID)
+	limits := getSampleLimits()
+	nacc.mutex.Lock()
+	nacc.nodeArrayConnectivitySampled[key] = true
+	nacc.nodeArrayConnectivitySampledAt[key] = time.Now()
+	flap := nacc.recordSample(node, arrayID, key, connected, limits)
+	metrics.SetNodeArrayConnectivity(node.ObjectMeta.Name, arrayID, nacc.connected(key, limits.flapPolicy), nacc.nodeArrayConnectivityLossCount[key])
+	nacc.mutex.Unlock()
+	if flap != nil {
+		flap.send()
+	}
+}
+
+// CheckConnectivity returns true if the node has connectivity to the arrayID supplied.
+// Pairs that weren't sampled in this poll are assumed connected.
+func (nacc *nodeArrayConnectivityCache) CheckConnectivity(cm *PodMonitorType, node *v1.Node, arrayID string) bool {
+	nodeUID := cm.GetNodeUID(node.ObjectMeta.Name)
+	if nodeUID == "" || nodeUID != string(node.ObjectMeta.UID) {
+		log.Infof("node %s has stale node uid %s- skipping connectivity check and assuming connected", node.ObjectMeta.Name, string(node.ObjectMeta.UID))
+		return true
+	}
+	key := nodeArrayKey(node.ObjectMeta.Name, arrayID)
+	flapPolicy := GetArrayConnectivityFlapPolicy()
+	nacc.mutex.Lock()
+	defer nacc.mutex.Unlock()
+	if !nacc.nodeArrayConnectivitySampled[key] {
+		return true
+	}
+	// If below the ConnectionLossThreshold, assume we could be connected
+	return nacc.connected(key, flapPolicy)
+}
+
+// sampledConnectivity returns whether the node:array pair is connected, and whether it was sampled in this poll.
+func (nacc *nodeArrayConnectivityCache) sampledConnectivity(key string) (bool, bool) {
+	flapPolicy := GetArrayConnectivityFlapPolicy()
+	nacc.mutex.Lock()
+	defer nacc.mutex.Unlock()
+	if !nacc.nodeArrayConnectivitySampled[key] {
+		return false, false
+	}
+	return nacc.connected(key, flapPolicy), true
+}
+
+// sampleLimits are the settings used to record the samples. They are read before the mutex is taken, as
+// they are guarded by the dynamic config mutex.
+type sampleLimits struct {
+	recoveryThreshold int
+	flapThreshold     int
+	flapWindow        int
+	flapPolicy        string
+}
+
+// getSampleLimits returns the current settings used to record the samples.
+func getSampleLimits() sampleLimits {
+	flapThreshold, flapWindow := GetArrayConnectivityFlapLimits()
+	return sampleLimits{
+		recoveryThreshold: GetArrayConnectivityRecoveryThreshold(),
+		flapThreshold:     flapThreshold,
+		flapWindow:        flapWindow,
+		flapPolicy:        GetArrayConnectivityFlapPolicy(),
+	}
+}
+
+// connectivityFlapEvent is the Event reporting that a node:array pair started flapping. It is sent once the mutex is released.
+type connectivityFlapEvent struct {
+	node    *v1.Node
+	arrayID string
+	changes int
+	samples int
+}
+
+// send sends the Event on the node.
+func (e *connectivityFlapEvent) send() {
+	if err := K8sAPI.CreateEvent(podmon, e.node, k8sapi.EventTypeWarning, arrayConnectivityFlappingReason,
+		"podmon found the connectivity of node %s to array %s changed %d times in the last %d samples",
+		e.node.ObjectMeta.Name, e.arrayID, e.changes, e.samples); err != nil {
+		log.Errorf("Failed to send %s event: %s", arrayConnectivityFlappingReason, err.Error())
+	}
+}
+
+// recordSample updates the loss count, history, and flapping state of the node:array pair with a sample, returning
+// the Event to send if the pair started flapping, or nil. The caller must hold the mutex.
+func (nacc *nodeArrayConnectivityCache) recordSample(node *v1.Node, arrayID, key string, connected bool, limits sampleLimits) *connectivityFlapEvent {
+	if connected {
+		nacc.nodeArrayConnectivityGoodCount[key]++
+		if nacc.nodeArrayConnectivityGoodCount[key] >= limits.recoveryThreshold {
+			nacc.nodeArrayConnectivityLossCount[key] = 0
+		}
+	} else {
+		nacc.nodeArrayConnectivityGoodCount[key] = 0
+		nacc.nodeArrayConnectivityLossCount[key] = nacc.nodeArrayConnectivityLossCount[key] + 1
+	}
+
+	history := append(nacc.nodeArrayConnectivityHistory[key], connected)
+	if len(history) > limits.flapWindow {
+		history = history[len(history)-limits.flapWindow:]
+	}
+	nacc.nodeArrayConnectivityHistory[key] = history
+	changes := connectivityChanges(history)
+	flapping := limits.flapThreshold > 0 && changes >= limits.flapThreshold
+	nodeName := node.ObjectMeta.Name
+	var flap *connectivityFlapEvent
+	switch {
+	case flapping && nacc.nodeArrayConnectivityFlapCount[key] == 0:
+		log.Warnf("Connectivity of node %s to array %s is flapping: %d changes in the last %d samples", nodeName, arrayID, changes, len(history))
+		flap = &connectivityFlapEvent{node: node, arrayID: arrayID, changes: changes, samples: len(history)}
+		metrics.RecordNodeArrayFlap(nodeName, arrayID)
+		nacc.nodeArrayConnectivityFlapCount[key] = 1
+	case flapping:
+		nacc.nodeArrayConnectivityFlapCount[key]++
+		if nacc.nodeArrayConnectivityFlapCount[key] == ArrayConnectivityConnectionLossThreshold && limits.flapPolicy == ArrayConnectivityFlapPolicyLoss {
+			log.Warnf("Connectivity of node %s to array %s has been flapping for %d samples, treating it as lost", nodeName, arrayID, ArrayConnectivityConnectionLossThreshold)
+		}
+	case nacc.nodeArrayConnectivityFlapCount[key] > 0:
+		log.Infof("Connectivity of node %s to array %s is no longer flapping", nodeName, arrayID)
+		nacc.nodeArrayConnectivityFlapCount[key] = 0
+	}
+	metrics.SetNodeArrayFlapping(nodeName, arrayID, flapping)
+	return flap
+}
+
+// connected returns true if the node:array pair is below the connection loss threshold, and isn't treated as
+// disconnected because of sustained flapping under the flap policy. The caller must hold the mutex.
+func (nacc *nodeArrayConnectivityCache) connected(key, flapPolicy string) bool {
+	if nacc.nodeArrayConnectivityLossCount[key] >= ArrayConnectivityConnectionLossThreshold {
+		return false
+	}
+	if flapPolicy == ArrayConnectivityFlapPolicyLoss &&
+		nacc.nodeArrayConnectivityFlapCount[key] >= ArrayConnectivityConnectionLossThreshold {
+		return false
+	}
+	return true
+}
+
+// connectivityChanges returns the number of times the samples changed between connected and disconnected.
+func connectivityChanges(history []bool) int {
+	changes := 0
+	for i := 1; i < len(history); i++ {
+		if history[i] != history[i-1] {
+			changes++
+		}
+	}
+	return changes
+}
+
+func (nacc *nodeArrayConnectivityCache) ResetSampled() {
+	nacc.initOnce.Do(func() {
+		nacc.nodeArrayConnectivitySampled = make(map[string]bool)
+		nacc.nodeArrayConnectivityLossCount = make(map[string]int)
+		nacc.nodeArrayConnectivityGoodCount = make(map[string]int)
+		nacc.nodeArrayConnectivityHistory = make(map[string][]bool)
+		nacc.nodeArrayConnectivityFlapCount = make(map[string]int)
+		nacc.nodeArrayConnectivitySampledAt = make(map[string]time.Time)
+	})
+	nacc.mutex.Lock()
+	defer nacc.mutex.Unlock()
+	for key := range nacc.nodeArrayConnectivitySampled {
+		nacc.nodeArrayConnectivitySampled[key] = false
+	}
+}
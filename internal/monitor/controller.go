@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"os"
 	"podmon/internal/k8sapi"
+	"podmon/internal/metrics"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -32,16 +34,19 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 )
 
-// MaxCrashLoopBackOffRetry is the maximum number of times for a pod to be deleted in response to a CrashLoopBackOff
+// MaxCrashLoopBackOffRetry is the default maximum number of times for a pod to be deleted in response to a CrashLoopBackOff
 const MaxCrashLoopBackOffRetry = 5
 
 // ControllerPodInfo has information for tracking health of the system
 type ControllerPodInfo struct { // information controller keeps on hand about a pod
-	PodKey            string            // the Pod Key (namespace/name) of the pod
-	Node              *v1.Node          // the associated node structure
-	PodUID            string            // the pod container's UID
-	ArrayIDs          []string          // string of array IDs used by the pod's volumes
-	PodAffinityLabels map[string]string // A list of pod affinity labels for the pod
+	PodKey           string               // the Pod Key (namespace/name) of the pod
+	Node             *v1.Node             // the associated node structure
+	PodUID           string               // the pod container's UID
+	ArrayIDs         []string             // string of array IDs used by the pod's volumes
+	PodLabels        map[string]string    // the pod's labels, matched against the other pods' pod affinity terms
+	PodAffinityTerms []v1.PodAffinityTerm // the pod's required pod affinity terms
+	Policy           PodPolicy            // resiliency policy from the pod's annotations
+	CleanupPriority  int                  // the cleanup priority annotation, or the pod's PriorityClass value
 }
 
 const (
@@ -63,17 +68,15 @@ func (cm *PodMonitorType) controllerModePodHandler(pod *v1.Pod, eventType watch.
 	if driverNamespace == pod.ObjectMeta.Namespace {
 		return cm.controllerModeDriverPodHandler(pod, eventType)
 	}
-	// Lock so that only one thread is processing pod at a time
+	// The informer delivers the pod events one at a time. The cleanups and CrashLoopBackOff deletions of a pod are all
+	// run by the cleanup scheduler, which never runs two cleanups of the same pod at once.
 	podKey := getPodKey(pod)
-	// Clean up pod key to PodInfo and CrashLoopBackOffCount mappings if deleting.
+	// Clean up pod key to PodInfo and CrashLoopBackOff deletions mappings if deleting.
 	if eventType == watch.Deleted {
 		cm.PodKeyToControllerPodInfo.Delete(podKey)
-		cm.PodKeyToCrashLoopBackOffCount.Delete(podKey)
+		cm.PodKeyToCrashLoopBackOffDeletions.Delete(podKey)
 		return nil
 	}
-	// Single thread processing of this pod
-	Lock(podKey, pod, LockSleepTimeDelay)
-	defer Unlock(podKey)
 	// Check that pod is still present
 	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
 	defer cancel()
@@ -96,7 +99,7 @@ func (cm *PodMonitorType) controllerModePodHandler(pod *v1.Pod, eventType watch.
 			// Determine if node tainted
 			taintnosched := nodeHasTaint(node, nodeUnreachableTaint, v1.TaintEffectNoSchedule)
 			taintnoexec := nodeHasTaint(node, nodeUnreachableTaint, v1.TaintEffectNoExecute)
-			taintpodmon := nodeHasTaint(node, PodmonTaintKey, v1.TaintEffectNoSchedule) || nodeHasTaint(node, PodmonDriverPodTaintKey, v1.TaintEffectNoSchedule)
+			taintpodmon := cm.nodeHasPodmonTaint(node) || nodeHasTaint(node, PodmonDriverPodTaintKey, v1.TaintEffectNoSchedule)
 
 			// Determine pod status
 			ready, initialized := podStatus(pod.Status.Conditions)
@@ -127,23 +130,27 @@ func (cm *PodMonitorType) controllerModePodHandler(pod *v1.Pod, eventType watch.
 				}
 				log.Infof("podKey %s pvcCount %d arrayIDs %v", podKey, pvcCount, arrayIDs)
 
-				podAffinityLabels := cm.getPodAffinityLabels(pod)
-				if len(podAffinityLabels) > 0 {
-					log.Infof("podKey %s podAffinityLabels %v", podKey, podAffinityLabels)
+				podAffinityTerms := getPodAffinityTerms(pod)
+				if len(podAffinityTerms) > 0 {
+					log.Infof("podKey %s has %d required pod affinity terms", podKey, len(podAffinityTerms))
 				}
 				podUID := string(pod.ObjectMeta.UID)
+				policy := getPodPolicy(pod)
 				podInfo := &ControllerPodInfo{
-					PodKey:            podKey,
-					Node:              node.DeepCopy(),
-					PodUID:            podUID,
-					ArrayIDs:          arrayIDs,
-					PodAffinityLabels: podAffinityLabels,
+					PodKey:           podKey,
+					Node:             node.DeepCopy(),
+					PodUID:           podUID,
+					ArrayIDs:         arrayIDs,
+					PodLabels:        pod.ObjectMeta.Labels,
+					PodAffinityTerms: podAffinityTerms,
+					Policy:           policy,
+					CleanupPriority:  podCleanupPriority(pod, policy),
 				}
 				log.Debugf("Updating protected pod info podKey %s pvcCount %d arrayIDs %v", podKey, pvcCount, arrayIDs)
 				cm.PodKeyToControllerPodInfo.Store(podKey, podInfo)
 				if ready {
-					// Delete (reset) the CrashLoopBackOff counter since we're running.
-					cm.PodKeyToCrashLoopBackOffCount.Delete(podKey)
+					// Delete (reset) the CrashLoopBackOff deletions since we're running.
+					cm.PodKeyToCrashLoopBackOffDeletions.Delete(podKey)
 				}
 			}
 
@@ -158,20 +165,14 @@ func (cm *PodMonitorType) controllerModePodHandler(pod *v1.Pod, eventType watch.
 						node = controllerPodInfo.Node
 					}
 				}
-				go cm.controllerCleanupPod(pod, node, "NodeFailure", taintnoexec, taintpodmon)
-			} else if !ready && crashLoopBackOff {
-				cnt, _ := cm.PodKeyToCrashLoopBackOffCount.LoadOrStore(podKey, 0)
-				crashLoopBackOffCount := cnt.(int)
-				if crashLoopBackOffCount < MaxCrashLoopBackOffRetry {
-					log.Infof("cleaning up CrashLoopBackOff pod %s", podKey)
-					if err = K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, crashLoopBackOffReason, "podmon cleaning pod %s with delete",
-						string(pod.ObjectMeta.UID), node.ObjectMeta.Name, fmt.Sprintf("retry: %d", crashLoopBackOffCount)); err != nil {
-						log.Errorf("Failed to send %s event: %s", crashLoopBackOffReason, err.Error())
-					}
-					err = K8sAPI.DeletePod(ctx, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, pod.ObjectMeta.UID, false)
-					crashLoopBackOffCount = crashLoopBackOffCount + 1
-					cm.PodKeyToCrashLoopBackOffCount.Store(podKey, crashLoopBackOffCount)
+				if !cm.admitFailover(node, pod, "NodeFailure") {
+					return nil
 				}
+				cm.Scheduler.submit([]string{podKey}, podCleanupPriority(pod, getPodPolicy(pod)), cm.nodeFailureCleanup(pod, node, "NodeFailure", taintnoexec, taintpodmon))
+			} else if !ready && crashLoopBackOff && getPodPolicy(pod).SkipCrashLoopBackOffCleanup {
+				log.Infof("not cleaning up CrashLoopBackOff pod %s because of annotation %s", podKey, SkipCrashLoopBackOffCleanupAnnotation)
+			} else if !ready && crashLoopBackOff {
+				cm.crashLoopBackOffCleanup(ctx, pod, node, time.Now())
 			}
 		}
 
@@ -208,6 +209,32 @@ func isRWXVolume(pvlist []*v1.PersistentVolume) bool {
 	return false
 }
 
+// nodeFailureCleanup returns the cleanup of a pod on a failed node for the cleanup queue. Before a retry it checks
+// the pod is still on the node, as it may have been deleted or rescheduled since the cleanup failed.
+func (cm *PodMonitorType) nodeFailureCleanup(pod *v1.Pod, node *v1.Node, reason string, taintnoexec, taintpodmon bool) func() error {
+	attempt := 0
+	return func() error {
+		attempt++
+		if attempt > 1 {
+			ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+			defer cancel()
+			current, err := K8sAPI.GetPod(ctx, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+			if err != nil {
+				return fmt.Errorf("GetPod failed: %s: %s", getPodKey(pod), err)
+			}
+			if current.ObjectMeta.UID != pod.ObjectMeta.UID || current.Spec.NodeName != node.ObjectMeta.Name {
+				log.Infof("Not retrying cleanup of pod %s, it was replaced or moved off node %s", getPodKey(pod), node.ObjectMeta.Name)
+				return nil
+			}
+			pod = current
+		}
+		if !cm.controllerCleanupPod(pod, node, reason, taintnoexec, taintpodmon) {
+			return fmt.Errorf("cleanup of pod %s on node %s did not complete", getPodKey(pod), node.ObjectMeta.Name)
+		}
+		return nil
+	}
+}
+
 // Attempts to cleanup a Pod that is in trouble. Returns true if made it all the way to deleting the pod.
 func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reason string, taintnoexec, taintpodmon bool) bool {
 	fields := make(map[string]interface{})
@@ -215,11 +242,18 @@ func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reaso
 	fields["pod"] = pod.ObjectMeta.Name
 	fields["node"] = node.ObjectMeta.Name
 	fields["reason"] = reason
-	// Lock so that only one thread is processing pod at a time
+	// Record the outcome of the cleanup in the metrics. abortCause is set before each abort.
+	start := time.Now()
+	result, abortCause := metrics.ResultAborted, ""
+	defer func() {
+		metrics.ObserveControllerCleanup(reason, result, abortCause, start)
+	}()
 	podKey := getPodKey(pod)
-	// Single thread processing of this pod
-	Lock(podKey, pod, LockSleepTimeDelay)
-	defer Unlock(podKey)
+	// Record the progress of the cleanup so that a new leader can resume it.
+	ledger := newCleanupLedger(pod, node, reason, taintnoexec)
+	defer func() {
+		ledger.finish(result == metrics.ResultAborted)
+	}()
 
 	// If ControllerPodInfo struct has UID mismatch, assume pod deleted already
 	podInfoValue, ok := cm.PodKeyToControllerPodInfo.Load(podKey)
@@ -227,10 +261,12 @@ func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reaso
 		controllerPodInfo := podInfoValue.(*ControllerPodInfo)
 		if controllerPodInfo.PodUID != string(pod.ObjectMeta.UID) {
 			log.Infof("monitored pod UID %s different than pod to clean UID %s - aborting pod cleanup", controllerPodInfo.PodUID, string(pod.ObjectMeta.UID))
+			abortCause = "PodUIDMismatch"
 			return false
 		}
 	}
 
+	policy := getPodPolicy(pod)
 	log.WithFields(fields).Infof("Cleaning up pod")
 	ctx, cancel := K8sAPI.GetContext(LongTimeout)
 	defer cancel()
@@ -240,23 +276,35 @@ func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reaso
 	pvlist, err := K8sAPI.GetPersistentVolumesInPod(ctx, pod)
 	if err != nil {
 		log.WithFields(fields).Errorf("Could not get PersistentVolumes: %s", err)
+		abortCause = "GetPersistentVolumesFailed"
 		return false
 	}
 
 	// ignoreVolumeless pod
 	if IgnoreVolumelessPods && len(pvlist) == 0 {
 		log.WithFields(fields).Infof("Ignoring volumeless pod")
+		result = metrics.ResultSkipped
 		return true
 	}
 
-	// Get the volume handles from the PVs
+	// Get the volume handles from the PVs, grouped by the array they are on, and the drivers they are routed to
 	volIDs := make([]string, 0)
+	arrayIDToVolIDs := make(map[string][]string)
+	volIDToDriver := make(map[string]*CSIDriver)
 	for _, pv := range pvlist {
 		pvsrc := pv.Spec.PersistentVolumeSource
 		if pvsrc.CSI != nil {
 			volIDs = append(volIDs, pvsrc.CSI.VolumeHandle)
+			arrayID := cm.pvToArrayID(pv)
+			arrayIDToVolIDs[arrayID] = append(arrayIDToVolIDs[arrayID], pvsrc.CSI.VolumeHandle)
+			volIDToDriver[pvsrc.CSI.VolumeHandle] = cm.csiDriverForPV(pv)
 		}
 	}
+	drivers := cm.csiDriversForPod(pod, pvlist)
+	taintKeys := make([]string, 0, len(drivers))
+	for _, d := range drivers {
+		taintKeys = append(taintKeys, d.TaintKey)
+	}
 	if len(pvlist) != len(volIDs) {
 		log.WithFields(fields).Warnf("Could not get volume handles for every PV: pvs %d volIDs %d", len(pvlist), len(volIDs))
 	}
@@ -268,6 +316,7 @@ func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reaso
 		va, err := K8sAPI.GetCachedVolumeAttachment(ctx, pv.ObjectMeta.Name, node.ObjectMeta.Name)
 		if err != nil {
 			log.WithFields(fields).Errorf("Could not get cached VolumeAttachment: %s", err)
+			abortCause = "GetVolumeAttachmentFailed"
 			return false
 		}
 		if va != nil {
@@ -275,17 +324,25 @@ func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reaso
 			vaNamesToDelete = append(vaNamesToDelete, va.ObjectMeta.Name)
 		}
 	}
+	ledger.entry.VolumeIDs = volIDs
+	ledger.entry.VANames = vaNamesToDelete
+	ledger.entry.TaintKeys = taintKeys
+	ledger.record(LedgerStepStarted)
 
 	// Call the driver to validate the volumes are not in use
-	if cm.CSIExtensionsPresent && CSIApi.Connected() {
+	if csiDriversHaveExtensions(drivers) && csiDriversConnected(drivers) {
 		log.WithFields(fields).Infof("Checking host connectivity for node %s and iosInProgress for volumes %v", node.ObjectMeta.Name, volIDs)
-		connected, iosInProgress, err := cm.callValidateVolumeHostConnectivity(node, volIDs, true)
+		connected, iosInProgress, err := cm.callValidateVolumeHostConnectivityByArray(node, arrayIDToVolIDs, true)
 		log.WithFields(fields).Infof("Validating host connectivity for node: %s, volumes: %v, connected: %t, iosInProgress: %t", node.ObjectMeta.Name, volIDs, connected, iosInProgress)
 		// If the volume's access mode is RWX, ignore iosInProgress, as other applications may perform I/O operations on the volume.
 		if isRWXVolume(pvlist) {
 			log.WithFields(fields).Info("Skipping iosInProgress check as the volume accessMode is RWX or ReadWriteMany")
 			iosInProgress = false
 		}
+		if policy.IgnoreIOsInProgress {
+			log.WithFields(fields).Infof("Skipping iosInProgress check because of annotation %s", IgnoreIOsInProgressAnnotation)
+			iosInProgress = false
+		}
 		// Don't consider connected status if taintpodmon is set, because the node may just have come back online.
 		if (connected && !taintpodmon) || iosInProgress || err != nil {
 			fields["connected"] = connected
@@ -296,7 +353,9 @@ func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reaso
 			} else {
 				if err != nil {
 					log.WithFields(fields).Info("Aborting pod cleanup due to error: ", err.Error())
+					abortCause = "ValidateConnectivityFailed"
 					if strings.Contains(err.Error(), "Could not determine CSI NodeID for node") {
+						abortCause = "MissingCSINodeID"
 						if err = K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, reason,
 							"podmon aborted pod cleanup %s due to missing CSI annotations",
 							string(pod.ObjectMeta.UID), node.ObjectMeta.Name); err != nil {
@@ -312,6 +371,7 @@ func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reaso
 					return false
 				}
 				log.WithFields(fields).Info("Aborting pod cleanup because array still connected and/or recently did I/O")
+				abortCause = "ArrayConnectedOrIOInProgress"
 				if err = K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, reason,
 					"podmon aborted pod cleanup %s array connected or recent I/O",
 					string(pod.ObjectMeta.UID), node.ObjectMeta.Name); err != nil {
@@ -323,19 +383,62 @@ func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reaso
 	} else {
 		log.WithFields(fields).Error("Array validation check skipped because CSIApi not connected")
 	}
+	ledger.record(LedgerStepValidated)
+
+	// The out-of-service taint makes Kubernetes detach the volumes, which is only safe once the array has fenced the node.
+	outOfService := GetFencingMode() == FencingModeOutOfService
+	if outOfService && !csiDriversConnected(drivers) {
+		log.WithFields(fields).Error("Aborting pod cleanup because fencing cannot be confirmed with CSIApi not connected")
+		abortCause = "FencingNotConfirmed"
+		if err = K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, reason,
+			"podmon aborted pod cleanup %s on node %s couldn't confirm fencing for out-of-service taint",
+			string(pod.ObjectMeta.UID), node.ObjectMeta.Name); err != nil {
+			log.Errorf("Failed to send %s event: %s", reason, err.Error())
+		}
+		return false
+	}
+
+	// In dry-run mode report the remaining steps rather than performing them.
+	if GetDryRun() {
+		if csiDriversConnected(drivers) {
+			for _, volID := range volIDs {
+				reportDryRun(pod, fields, dryRunFenceVolume, volID)
+			}
+		}
+		reportDryRun(pod, fields, dryRunTaintNode, node.ObjectMeta.Name)
+		if outOfService {
+			reportDryRun(pod, fields, dryRunOutOfServiceTaint, node.ObjectMeta.Name)
+			result = metrics.ResultDryRun
+			return true
+		}
+		for _, vaName := range vaNamesToDelete {
+			reportDryRun(pod, fields, dryRunDeleteVA, vaName)
+		}
+		reportDryRun(pod, fields, dryRunForceDeletePod, podKey)
+		result = metrics.ResultDryRun
+		return true
+	}
 
 	// Fence all the volumes
-	if CSIApi.Connected() {
+	if csiDriversConnected(drivers) {
 		log.WithFields(fields).Infof("Commencing fencing of the node")
+		ledger.record(LedgerStepFencing)
+		_, deadline := GetFencingLimits()
+		fenceCtx, fenceCancel := context.WithDeadline(context.Background(), start.Add(deadline))
+		defer fenceCancel()
 		nerrors := 0
-		for _, volID := range volIDs {
-			err := cm.callControllerUnpublishVolume(node, volID)
-			if err != nil {
+		for _, fenceResult := range cm.fenceVolumes(fenceCtx, node, volIDs, volIDToDriver) {
+			volumeLog := log.WithFields(fields).WithField("volume", fenceResult.VolumeID).WithField("duration", fenceResult.Duration)
+			if fenceResult.Err != nil {
 				nerrors++
+				volumeLog.Errorf("Fencing volume failed: %s", fenceResult.Err.Error())
+				continue
 			}
+			volumeLog.Info("Fenced volume")
 		}
 		if nerrors > 0 {
 			log.WithFields(fields).Errorf("There were %d errors calling ControllerUnpublishVolume to fence the node. Aborting pod cleanup.", nerrors)
+			abortCause = "FencingFailed"
 			if err = K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, reason,
 				"podmon aborted pod cleanup %s couldn't fence volumes",
 				string(pod.ObjectMeta.UID), node.ObjectMeta.Name); err != nil {
@@ -343,12 +446,40 @@ func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reaso
 			}
 			return false
 		}
+		ledger.record(LedgerStepFenced)
 	}
 
-	// Add a taint for the pod on the node.
-	if err = taintNode(node.ObjectMeta.Name, PodmonTaintKey, false); err != nil {
-		log.WithFields(fields).Errorf("Failed to update taint against %s node: %v", node.ObjectMeta.Name, err)
-		return false
+	// Add a taint for the pod on the node for each of the pod's drivers.
+	for _, taintKey := range taintKeys {
+		if err = taintNode(node.ObjectMeta.Name, taintKey, false); err != nil {
+			log.WithFields(fields).Errorf("Failed to update taint against %s node: %v", node.ObjectMeta.Name, err)
+			abortCause = "TaintFailed"
+			return false
+		}
+	}
+	ledger.record(LedgerStepTainted)
+	cleanedArrayIDs := make([]string, 0, len(arrayIDToVolIDs))
+	for arrayID := range arrayIDToVolIDs {
+		cleanedArrayIDs = append(cleanedArrayIDs, arrayID)
+	}
+	cm.Recovery.recordCleanedPVs(node.ObjectMeta.Name, pvlist, cleanedArrayIDs)
+
+	// With the node fenced, the out-of-service taint lets Kubernetes delete the pod and its VolumeAttachments.
+	if outOfService {
+		if err = callK8sAPITaint("tainting ", node.ObjectMeta.Name, outOfServiceTaint, v1.TaintEffectNoExecute, false); err != nil {
+			log.WithFields(fields).Errorf("Failed to apply out-of-service taint against %s node: %v", node.ObjectMeta.Name, err)
+			abortCause = "OutOfServiceTaintFailed"
+			return false
+		}
+		if err = K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, reason,
+			"podmon applied out-of-service taint for pod %s",
+			string(pod.ObjectMeta.UID), node.ObjectMeta.Name); err != nil {
+			log.Errorf("Failed to send %s event: %s", reason, err.Error())
+		}
+		log.WithFields(fields).Infof("Applied out-of-service taint, Kubernetes will delete the pod and its VolumeAttachments")
+		result = metrics.ResultCleaned
+		cm.PodKeyToControllerPodInfo.Delete(podKey)
+		return true
 	}
 
 	// Delete all the volumeattachments attached to our pod
@@ -358,33 +489,62 @@ func (cm *PodMonitorType) controllerCleanupPod(pod *v1.Pod, node *v1.Node, reaso
 			err = K8sAPI.DeleteVolumeAttachment(ctx, vaName)
 			if err != nil && !strings.Contains(err.Error(), notFound) {
 				log.WithFields(fields).Errorf("Couldn't delete VolumeAttachment- aborting after retry: %s: %s", vaName, err.Error())
+				abortCause = "DeleteVolumeAttachmentFailed"
 				return false
 			}
 		}
 	}
+	ledger.record(LedgerStepVolumeAttachmentsDeleted)
+
+	// Force delete the pod once any extra grace time requested by the pod has passed. The cleanup queue waits out
+	// the grace time, so it doesn't hold a cleanup worker.
+	if policy.ForceDeleteGracePeriod > 0 {
+		log.WithFields(fields).Infof("Force deleting pod in %v because of annotation %s", policy.ForceDeleteGracePeriod, ForceDeleteGracePeriodAnnotation)
+		cm.Scheduler.submitAfter([]string{podKey}, podCleanupPriority(pod, policy), policy.ForceDeleteGracePeriod, func() error {
+			return cm.forceDeletePod(pod, node, reason, fields)
+		})
+		result = metrics.ResultCleaned
+		return true
+	}
+	if err = cm.forceDeletePod(pod, node, reason, fields); err != nil {
+		abortCause = "DeletePodFailed"
+		return false
+	}
+	result = metrics.ResultCleaned
+	return true
+}
 
-	// Force delete the pod.
-	if err = K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, reason,
+// forceDeletePod sends the force delete Event for the pod and force deletes it.
+func (cm *PodMonitorType) forceDeletePod(pod *v1.Pod, node *v1.Node, reason string, fields map[string]interface{}) error {
+	if err := K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, reason,
 		"podmon cleaning pod %s with force delete",
 		string(pod.ObjectMeta.UID), node.ObjectMeta.Name); err != nil {
 		log.Errorf("Failed to send %s event: %s", reason, err.Error())
 	}
-	err = K8sAPI.DeletePod(ctx, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, pod.ObjectMeta.UID, true)
-	if err == nil {
-		log.WithFields(fields).Infof("Successfully cleaned up pod")
-		// Delete the ControllerPodInfo reference to this pod, we've deleted it.
-		cm.PodKeyToControllerPodInfo.Delete(podKey)
-		return true
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	if err := K8sAPI.DeletePod(ctx, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, pod.ObjectMeta.UID, true); err != nil {
+		log.WithFields(fields).Errorf("Delete pod failed")
+		return fmt.Errorf("delete of pod %s failed: %s", getPodKey(pod), err)
 	}
-	log.WithFields(fields).Errorf("Delete pod failed")
-	return false
+	log.WithFields(fields).Infof("Successfully cleaned up pod")
+	// Delete the ControllerPodInfo reference to this pod, we've deleted it.
+	cm.PodKeyToControllerPodInfo.Delete(getPodKey(pod))
+	return nil
 }
 
 // call ValidateVolumeHostConnectivity in the driver, log any messages, and then
-// return the booleans Connected and IosInProgress.
-func (cm *PodMonitorType) callValidateVolumeHostConnectivity(node *v1.Node, volumeIDs []string, logIt bool) (bool, bool, error) {
+// return the booleans Connected and IosInProgress. If arrayID is set (and not the default array)
+// the connectivity is checked against that array only. The call goes to the driver of the arrayID.
+func (cm *PodMonitorType) callValidateVolumeHostConnectivity(node *v1.Node, volumeIDs []string, arrayID string, logIt bool) (bool, bool, error) {
+	driver, arrayID := cm.csiDriverForArray(arrayID)
+	return callDriverValidateVolumeHostConnectivity(driver, node, volumeIDs, arrayID, logIt)
+}
+
+// callDriverValidateVolumeHostConnectivity calls ValidateVolumeHostConnectivity in the given driver, see callValidateVolumeHostConnectivity.
+func callDriverValidateVolumeHostConnectivity(driver *CSIDriver, node *v1.Node, volumeIDs []string, arrayID string, logIt bool) (bool, bool, error) {
 	// Get the CSI annotations for nodeID
-	csiNodeID := getCSINodeIDAnnotation(node, cm.DriverPathStr)
+	csiNodeID := getCSINodeIDAnnotation(node, driver.Path)
 	if csiNodeID != "" {
 		// Validate host connectivity for the node
 		req := &csiext.ValidateVolumeHostConnectivityRequest{
@@ -393,11 +553,16 @@ func (cm *PodMonitorType) callValidateVolumeHostConnectivity(node *v1.Node, volu
 		if len(volumeIDs) > 0 {
 			req.VolumeIds = volumeIDs
 		}
+		if arrayID != "" && arrayID != defaultArray {
+			req.ArrayId = arrayID
+		}
 		log.Debugf("calling ValidateVolumeHostConnectivity with %v", req)
 		// Get the connected status of the Node to the StorageSystem
 		ctx, cancel := context.WithTimeout(context.Background(), ShortTimeout)
 		defer cancel()
-		resp, err := CSIApi.ValidateVolumeHostConnectivity(ctx, req)
+		start := time.Now()
+		resp, err := driver.API.ValidateVolumeHostConnectivity(ctx, req)
+		metrics.ObserveCSICall("ValidateVolumeHostConnectivity", start, err)
 		if err != nil {
 			if strings.Contains(err.Error(), "there is no corresponding SDC") {
 				// This error is returned if the array cannot find the SDC, which can happen on connectivity loss
@@ -412,16 +577,83 @@ func (cm *PodMonitorType) callValidateVolumeHostConnectivity(node *v1.Node, volu
 				log.Info(message)
 			}
 		}
-		log.Infof("ValidateVolumeHostConnectivity Node: %s, NodeId: %s, Connected: %t, IosInProgress: %t", node.ObjectMeta.Name, req.NodeId, resp.GetConnected(), resp.GetIosInProgress())
+		log.Infof("ValidateVolumeHostConnectivity Node: %s, NodeId: %s, ArrayId: %s, Connected: %t, IosInProgress: %t", node.ObjectMeta.Name, req.NodeId, req.ArrayId, resp.GetConnected(), resp.GetIosInProgress())
 		return resp.GetConnected(), resp.GetIosInProgress(), nil
 	}
 	return false, false, fmt.Errorf("callValidateVolumeHostConnectivity: Could not determine CSI NodeID for node: %s", node.ObjectMeta.Name)
 }
 
+// callValidateVolumeHostConnectivityByArray calls ValidateVolumeHostConnectivity once for each array with the volumes on that array.
+// It returns connected or iosInProgress true if any of the arrays reported them, and the first error encountered.
+func (cm *PodMonitorType) callValidateVolumeHostConnectivityByArray(node *v1.Node, arrayIDToVolumeIDs map[string][]string, logIt bool) (bool, bool, error) {
+	if len(arrayIDToVolumeIDs) == 0 {
+		return cm.callValidateVolumeHostConnectivity(node, nil, "", logIt)
+	}
+	arrayIDs := make([]string, 0, len(arrayIDToVolumeIDs))
+	for arrayID := range arrayIDToVolumeIDs {
+		arrayIDs = append(arrayIDs, arrayID)
+	}
+	sort.Strings(arrayIDs)
+	anyConnected, anyIosInProgress := false, false
+	for _, arrayID := range arrayIDs {
+		connected, iosInProgress, err := cm.callValidateVolumeHostConnectivity(node, arrayIDToVolumeIDs[arrayID], arrayID, logIt)
+		if err != nil {
+			return connected, iosInProgress, err
+		}
+		anyConnected = anyConnected || connected
+		anyIosInProgress = anyIosInProgress || iosInProgress
+	}
+	return anyConnected, anyIosInProgress, nil
+}
+
+// volumeFenceResult is the result of fencing one volume.
+type volumeFenceResult struct {
+	VolumeID string
+	Err      error
+	Duration time.Duration
+}
+
+// fenceVolumes calls ControllerUnpublishVolume for each of the volumes, running at most the fencing
+// concurrency limit at a time, until ctx is done. The results are returned in the order of volumeIDs.
+// Each volume is fenced by its driver in volumeIDToDriver, or by the primary driver if it has none.
+func (cm *PodMonitorType) fenceVolumes(ctx context.Context, node *v1.Node, volumeIDs []string, volumeIDToDriver map[string]*CSIDriver) []volumeFenceResult {
+	concurrency, _ := GetFencingLimits()
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]volumeFenceResult, len(volumeIDs))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, volumeID := range volumeIDs {
+		results[i].VolumeID = volumeID
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		driver := volumeIDToDriver[volumeID]
+		if driver == nil {
+			driver = cm.primaryCSIDriver()
+		}
+		wg.Add(1)
+		go func(result *volumeFenceResult) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			start := time.Now()
+			result.Err = callControllerUnpublishVolume(ctx, driver, node, result.VolumeID)
+			result.Duration = time.Since(start)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
 // callControllerUnpublishVolume in the driver, log any messages, return error.
-func (cm *PodMonitorType) callControllerUnpublishVolume(node *v1.Node, volumeID string) error {
+// Pending errors are retried until CSIMaxRetries is reached or ctx is done.
+func callControllerUnpublishVolume(ctx context.Context, driver *CSIDriver, node *v1.Node, volumeID string) error {
 	var err error
-	csiNodeID := getCSINodeIDAnnotation(node, cm.DriverPathStr)
+	csiNodeID := getCSINodeIDAnnotation(node, driver.Path)
 	if csiNodeID == "" {
 		log.Errorf("callControllerUnpublishVolume: Could not determine CSI NodeID for node: %s", node.ObjectMeta.Name)
 		return errors.New("csiNodeID is not set")
@@ -433,7 +665,9 @@ func (cm *PodMonitorType) callControllerUnpublishVolume(node *v1.Node, volumeID
 			NodeId:   csiNodeID,
 			VolumeId: volumeID,
 		}
-		_, err = CSIApi.ControllerUnpublishVolume(context.Background(), req)
+		start := time.Now()
+		_, err = driver.API.ControllerUnpublishVolume(ctx, req)
+		metrics.ObserveCSICall("ControllerUnpublishVolume", start, err)
 		if err == nil {
 			break
 		}
@@ -441,19 +675,64 @@ func (cm *PodMonitorType) callControllerUnpublishVolume(node *v1.Node, volumeID
 		if !strings.HasSuffix(err.Error(), "pending") {
 			break
 		}
-		time.Sleep(PendingRetryTime)
+		select {
+		case <-time.After(PendingRetryTime):
+		case <-ctx.Done():
+			return fmt.Errorf("cleanup deadline reached while volume %s fencing was pending: %s", volumeID, err.Error())
+		}
 	}
 	return err
 }
 
-// podToArrayIDs returns the array IDs used by the pod, along with pvCount, and error
+// podToArrayIDs returns the unique array IDs used by the pod, along with pvCount, and error.
+// Pods without volumes, or whose arrays cannot be determined, are tracked against the default array.
 func (cm *PodMonitorType) podToArrayIDs(ctx context.Context, pod *v1.Pod) ([]string, int, error) {
 	arrayIDs := make([]string, 0)
-	pvlist, _ := K8sAPI.GetPersistentVolumesInPod(ctx, pod)
-	arrayIDs = append(arrayIDs, defaultArray)
+	pvlist, err := K8sAPI.GetPersistentVolumesInPod(ctx, pod)
+	if err != nil {
+		return append(arrayIDs, defaultArray), 0, err
+	}
+	seen := make(map[string]bool)
+	for _, pv := range pvlist {
+		arrayID := cm.pvToArrayID(pv)
+		if !seen[arrayID] {
+			seen[arrayID] = true
+			arrayIDs = append(arrayIDs, arrayID)
+		}
+	}
+	if len(arrayIDs) == 0 {
+		arrayIDs = append(arrayIDs, defaultArray)
+	}
 	return arrayIDs, len(pvlist), nil
 }
 
+// pvToArrayID returns the array ID for a PV. The arrayID or StorageSystem volume attributes are used if present,
+// otherwise the array ID is parsed from the volume handle by the driver. If neither works, defaultArray is returned.
+// The array IDs of the additional drivers are prefixed with the driver path, see csiDriverForArray.
+func (cm *PodMonitorType) pvToArrayID(pv *v1.PersistentVolume) string {
+	csiSource := pv.Spec.PersistentVolumeSource.CSI
+	if csiSource == nil {
+		return defaultArray
+	}
+	driver := cm.csiDriverForPV(pv)
+	arrayID := defaultArray
+	for _, attribute := range []string{arrayIDVolumeAttribute, storageSystemVolumeAttribute} {
+		if id := csiSource.VolumeAttributes[attribute]; id != "" {
+			arrayID = id
+			break
+		}
+	}
+	if arrayID == defaultArray {
+		if id := driver.Type.GetArrayIDFromVolumeHandle(csiSource.VolumeHandle); id != "" {
+			arrayID = id
+		}
+	}
+	if driver.Path != cm.DriverPathStr {
+		return driver.Path + arrayIDSeparator + arrayID
+	}
+	return arrayID
+}
+
 // ArrayConnectivityMonitor -- periodically checks array connectivity to all the nodes using it.
 // If connectivity is lost, will initiate cleanup of the pods.
 // This is a never ending function, intended to be called as Go routine.
@@ -461,10 +740,13 @@ func (cm *PodMonitorType) ArrayConnectivityMonitor() {
 	// Loop through all the monitored Pods making sure they still have array access
 	for {
 		podKeysToClean := make([]string, 0)
-		nodesToTaint := make(map[string]bool)
+		nodesToTaint := make(map[string]*v1.Node)
+		nodeTaintKeys := make(map[string]map[string]bool)
 
 		// Clear the connectivity cache so it will sample again.
 		connectivityCache.ResetSampled()
+		cm.sampleArrayConnectivity()
+
 		// Internal function for iterating PodKeyToControllerPodInfo
 		// This will clean up Pods that have lost connectivity to at least one of their arrays
 		fnPodKeyToControllerPodInfo := func(_, value interface{}) bool {
@@ -474,15 +756,32 @@ func (cm *PodMonitorType) ArrayConnectivityMonitor() {
 
 			// Check if we have connectivity for all our array ids
 			connected := true
+			taintKeys := make(map[string]bool)
 			for _, arrayID := range controllerPodInfo.ArrayIDs {
 				cnct := connectivityCache.CheckConnectivity(cm, node, arrayID)
+				if !cnct && cm.Outages.inOutage(arrayID) {
+					log.Infof("Pod %s node %s has no connectivity to arrayID %s, not failing over because of the array outage", podKey, node.ObjectMeta.Name, arrayID)
+					continue
+				}
 				if !cnct {
 					log.Infof("Pod %s node %s has no connectivity to arrayID %s", podKey, node.ObjectMeta.Name, arrayID)
 					connected = false
+					driver, _ := cm.csiDriverForArray(arrayID)
+					taintKeys[driver.TaintKey] = true
 				}
 			}
+			if !connected && controllerPodInfo.Policy.SkipArrayConnectivityCleanup {
+				log.Infof("Pod %s not cleaned up because of annotation %s", podKey, SkipArrayConnectivityCleanupAnnotation)
+				return true
+			}
 			if !connected {
-				nodesToTaint[node.ObjectMeta.Name] = true
+				nodesToTaint[node.ObjectMeta.Name] = node
+				if nodeTaintKeys[node.ObjectMeta.Name] == nil {
+					nodeTaintKeys[node.ObjectMeta.Name] = make(map[string]bool)
+				}
+				for taintKey := range taintKeys {
+					nodeTaintKeys[node.ObjectMeta.Name][taintKey] = true
+				}
 				podKeysToClean = append(podKeysToClean, podKey)
 			}
 			return true
@@ -491,43 +790,48 @@ func (cm *PodMonitorType) ArrayConnectivityMonitor() {
 		// Process all the pods, generating the associated connectivity cache entries
 		cm.PodKeyToControllerPodInfo.Range(fnPodKeyToControllerPodInfo)
 
-		// Taint all the nodes that were not connected
-		for nodeName := range nodesToTaint {
-			log.Infof("Tainting node %s because of connectivity loss", nodeName)
-			err := taintNode(nodeName, PodmonTaintKey, false)
-			if err != nil {
-				log.Errorf("Unable to taint node: %s: %s", nodeName, err.Error())
+		// Don't taint or clean up nodes beyond the failover limits
+		for nodeName, node := range nodesToTaint {
+			if !cm.admitFailover(node, nil, "ArrayConnectivityLoss") {
+				delete(nodesToTaint, nodeName)
 			}
 		}
-
-		// Cleanup pods that are on the tainted nodes.
+		admittedPodKeys := make([]string, 0)
 		for _, podKey := range podKeysToClean {
-			// Fetch the pod.
-			info, ok := cm.PodKeyToControllerPodInfo.Load(podKey)
-			if !ok {
+			if info, ok := cm.PodKeyToControllerPodInfo.Load(podKey); ok && nodesToTaint[info.(*ControllerPodInfo).Node.ObjectMeta.Name] != nil {
+				admittedPodKeys = append(admittedPodKeys, podKey)
+			}
+		}
+		podKeysToClean = admittedPodKeys
+		cm.sortPodKeysByCleanupPriority(podKeysToClean)
+
+		// Taint all the nodes that were not connected
+		for nodeName, node := range nodesToTaint {
+			if GetDryRun() {
+				reportDryRun(node, map[string]interface{}{"node": nodeName, "reason": "ArrayConnectivityLoss"}, dryRunTaintNode, nodeName)
 				continue
 			}
-			podInfo := info.(*ControllerPodInfo)
-			if len(podInfo.PodAffinityLabels) > 0 {
-				// Process all the pods with affinity together
-				log.Infof("Processing pods with affinity %v", podInfo.PodAffinityLabels)
-				for _, podKey := range podKeysToClean {
-					// Fetch the pod.
-					infox, ok := cm.PodKeyToControllerPodInfo.Load(podKey)
-					if !ok {
-						continue
-					}
-					podInfox := infox.(*ControllerPodInfo)
-					if mapEqualsMap(podInfo.PodAffinityLabels, podInfox.PodAffinityLabels) {
-						cm.ProcessPodInfoForCleanup(podInfox, "ArrayConnectivityLoss")
-					}
+			log.Infof("Tainting node %s because of connectivity loss", nodeName)
+			taintKeys := make([]string, 0, len(nodeTaintKeys[nodeName]))
+			for taintKey := range nodeTaintKeys[nodeName] {
+				taintKeys = append(taintKeys, taintKey)
+			}
+			sort.Strings(taintKeys)
+			for _, taintKey := range taintKeys {
+				if err := taintNode(nodeName, taintKey, false); err != nil {
+					log.Errorf("Unable to taint node: %s: %s", nodeName, err.Error())
 				}
-				log.Infof("End Processing pods with affinity %v", podInfo.PodAffinityLabels)
-			} else {
-				cm.ProcessPodInfoForCleanup(podInfo, "ArrayConnectivityLoss")
 			}
 		}
 
+		// Cleanup pods that are on the tainted nodes, highest priority first.
+		if len(podKeysToClean) > 0 {
+			log.Infof("Cleanup order for array connectivity loss: %v", podKeysToClean)
+		}
+		// The cleanups run in the background, so a slow cleanup doesn't hold up sampling the other nodes. Pods still
+		// disconnected at the next poll are submitted again, which the scheduler merges with their pending cleanups.
+		cm.submitPodCleanups(podKeysToClean, "ArrayConnectivityLoss")
+
 		// Sleep according to the NODE_CONNECTIVITY_POLL_RATE
 		pollRate := GetArrayConnectivityPollRate()
 		time.Sleep(pollRate)
@@ -538,69 +842,112 @@ func (cm *PodMonitorType) ArrayConnectivityMonitor() {
 	}
 }
 
-// ProcessPodInfoForCleanup processes a ControllerPodInfo for cleanup, checking that the UID and object are the same, and then calling controllerCleanupPod.
-func (cm *PodMonitorType) ProcessPodInfoForCleanup(podInfo *ControllerPodInfo, reason string) {
-	podNamespace, podName := splitPodKey(podInfo.PodKey)
-	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
-	defer cancel()
-	pod, err := K8sAPI.GetPod(ctx, podNamespace, podName)
-	if err == nil {
-		if string(pod.ObjectMeta.UID) == podInfo.PodUID && pod.Spec.NodeName == podInfo.Node.ObjectMeta.Name {
-			log.Infof("Cleaning up pod %s/%s because of %s", reason, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
-			cm.controllerCleanupPod(pod, podInfo.Node, reason, false, false)
-		} else {
-			log.Infof("Skipping pod %s/%s podUID %s %s node %s %s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name,
-				string(pod.ObjectMeta.UID), podInfo.PodUID, pod.Spec.NodeName, podInfo.Node.ObjectMeta.Name)
+// sampleArrayConnectivity samples the connectivity of each unique node:array pair used by the monitored pods
+// into the connectivity cache, within the poll deadline, publishes it on the nodes, and detects array outages.
+func (cm *PodMonitorType) sampleArrayConnectivity() {
+	start := time.Now()
+	pairs := make([]nodeArrayPair, 0)
+	seen := make(map[string]bool)
+	cm.PodKeyToControllerPodInfo.Range(func(_, value interface{}) bool {
+		controllerPodInfo := value.(*ControllerPodInfo)
+		for _, arrayID := range controllerPodInfo.ArrayIDs {
+			key := nodeArrayKey(controllerPodInfo.Node.ObjectMeta.Name, arrayID)
+			if !seen[key] {
+				seen[key] = true
+				pairs = append(pairs, nodeArrayPair{node: controllerPodInfo.Node, arrayID: arrayID})
+			}
 		}
+		return true
+	})
+	_, deadline := GetArrayConnectivityPollLimits()
+	if deadline <= 0 {
+		deadline = GetArrayConnectivityPollRate()
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	skipped := connectivityCache.SamplePairs(ctx, cm, pairs)
+	metrics.ObserveArrayConnectivityPoll(start, len(pairs), skipped)
+	cm.publishArrayConnectivity(pairs)
+	cm.detectArrayOutages(pairs)
 }
 
-type nodeArrayConnectivityCache struct {
-	initOnce                       sync.Once       // Will be set after initialization
-	nodeArrayConnectivitySampled   map[string]bool // If true, already sampled, if need to call array to verify connectivity
-	nodeArrayConnectivityLossCount map[string]int  // 0 means connected, > 0 number of connection loss for n samples
-}
-
-var connectivityCache nodeArrayConnectivityCache
-
-// ArrayConnectivityConnectionLossThreshold is the number of consecutive samples that must fail before we declare connectivity loss
-var ArrayConnectivityConnectionLossThreshold = 3
-
-// CheckConnectivity returns true if the node has connectivity to the arrayID supplied
-func (nacc *nodeArrayConnectivityCache) CheckConnectivity(cm *PodMonitorType, node *v1.Node, arrayID string) bool {
-	nodeUID := cm.GetNodeUID(node.ObjectMeta.Name)
-	if nodeUID == "" || nodeUID != string(node.ObjectMeta.UID) {
-		log.Infof("node %s has stale node uid %s- skipping connectivity check and assuming connected", node.ObjectMeta.Name, string(node.ObjectMeta.UID))
-		return true
-	}
-	key := node.ObjectMeta.Name + ":" + arrayID
-	if nacc.nodeArrayConnectivitySampled[key] == false {
-		// Determine connectivity
-		volumeIDs := make([]string, 0)
-		connected, _, err := cm.callValidateVolumeHostConnectivity(node, volumeIDs, false)
-		if err != nil {
-			log.Infof("Could not determine array connectivity, assuming connected, error: %s", err)
-			return true
+// submitPodCleanups submits the cleanups of the pods to the cleanup scheduler, cleaning up the pods with pod affinity
+// together. A cleanup that fails is retried by the scheduler. The pod keys must be sorted by cleanup priority.
+func (cm *PodMonitorType) submitPodCleanups(podKeys []string, reason string) {
+	for _, groupKeys := range cm.affinityGroups(podKeys) {
+		group := make([]*ControllerPodInfo, 0, len(groupKeys))
+		for _, podKey := range groupKeys {
+			if info, ok := cm.PodKeyToControllerPodInfo.Load(podKey); ok {
+				group = append(group, info.(*ControllerPodInfo))
+			}
 		}
-		nacc.nodeArrayConnectivitySampled[key] = true
-		if connected {
-			nacc.nodeArrayConnectivityLossCount[key] = 0
+		if len(group) == 0 {
+			continue
+		}
+		// The pods are sorted by cleanup priority, so the first pod has the group's highest priority.
+		podInfo := group[0]
+		if len(group) > 1 {
+			// Process all the pods with affinity together, a retry only processes the pods that failed
+			sendAffinityGroupEvent(group, reason)
+			remaining := group
+			cm.Scheduler.submit(groupKeys, podInfo.CleanupPriority, func() error {
+				log.Infof("Processing pods with affinity %v", groupKeys)
+				failed := make([]*ControllerPodInfo, 0)
+				errs := make([]error, 0)
+				for _, podInfox := range remaining {
+					if err := cm.ProcessPodInfoForCleanup(podInfox, reason); err != nil {
+						failed = append(failed, podInfox)
+						errs = append(errs, err)
+					}
+				}
+				remaining = failed
+				log.Infof("End Processing pods with affinity %v", groupKeys)
+				return errors.Join(errs...)
+			})
 		} else {
-			nacc.nodeArrayConnectivityLossCount[key] = nacc.nodeArrayConnectivityLossCount[key] + 1
+			cm.Scheduler.submit([]string{podInfo.PodKey}, podInfo.CleanupPriority, func() error {
+				return cm.ProcessPodInfoForCleanup(podInfo, reason)
+			})
 		}
 	}
-	// If below the ConnectionLossThreshold, assume we could be connected
-	return nacc.nodeArrayConnectivityLossCount[key] < ArrayConnectivityConnectionLossThreshold
 }
 
-func (nacc *nodeArrayConnectivityCache) ResetSampled() {
-	nacc.initOnce.Do(func() {
-		nacc.nodeArrayConnectivitySampled = make(map[string]bool)
-		nacc.nodeArrayConnectivityLossCount = make(map[string]int)
+// sortPodKeysByCleanupPriority sorts the pod keys so that the pods with the highest cleanup priority are first.
+func (cm *PodMonitorType) sortPodKeysByCleanupPriority(podKeys []string) {
+	priority := func(podKey string) int {
+		if info, ok := cm.PodKeyToControllerPodInfo.Load(podKey); ok {
+			return info.(*ControllerPodInfo).CleanupPriority
+		}
+		return 0
+	}
+	sort.SliceStable(podKeys, func(i, j int) bool {
+		return priority(podKeys[i]) > priority(podKeys[j])
 	})
-	for key := range nacc.nodeArrayConnectivitySampled {
-		nacc.nodeArrayConnectivitySampled[key] = false
+}
+
+// ProcessPodInfoForCleanup processes a ControllerPodInfo for cleanup, checking that the UID and object are the same, and then calling controllerCleanupPod.
+// An error is returned if the pod could not be read or its cleanup did not complete, so the cleanup can be retried.
+func (cm *PodMonitorType) ProcessPodInfoForCleanup(podInfo *ControllerPodInfo, reason string) error {
+	podNamespace, podName := splitPodKey(podInfo.PodKey)
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	pod, err := K8sAPI.GetPod(ctx, podNamespace, podName)
+	if err != nil {
+		if strings.Contains(err.Error(), notFound) {
+			return nil
+		}
+		return fmt.Errorf("could not get pod %s: %s", podInfo.PodKey, err)
+	}
+	if string(pod.ObjectMeta.UID) != podInfo.PodUID || pod.Spec.NodeName != podInfo.Node.ObjectMeta.Name {
+		log.Infof("Skipping pod %s/%s podUID %s %s node %s %s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name,
+			string(pod.ObjectMeta.UID), podInfo.PodUID, pod.Spec.NodeName, podInfo.Node.ObjectMeta.Name)
+		return nil
 	}
+	log.Infof("Cleaning up pod %s/%s because of %s", reason, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
+	if !cm.controllerCleanupPod(pod, podInfo.Node, reason, false, false) {
+		return fmt.Errorf("cleanup of pod %s did not complete", podInfo.PodKey)
+	}
+	return nil
 }
 
 // getCSINodeIDAnnotation gets the csi.volume.kubernetes.io/nodeid annotation for a given driver
@@ -660,72 +1007,16 @@ func nodeHasTaint(node *v1.Node, key string, taintEffect v1.TaintEffect) bool {
 	return false
 }
 
-// getPodAffinityLabels returns nil if no node affinity is specified. If node affinity is specified,
-// podPodAffinity returns a map of podLabels for pods the specificed pod should have affinity with.
-func (cm *PodMonitorType) getPodAffinityLabels(pod *v1.Pod) map[string]string {
-	result := make(map[string]string)
-	affinity := pod.Spec.Affinity
-	if affinity == nil {
-		return result
-	}
-	podAffinity := affinity.PodAffinity
-	if podAffinity == nil {
-		return result
-	}
-	requiredDuringSchedulingIgnoredDuringExecution := podAffinity.RequiredDuringSchedulingIgnoredDuringExecution
-	if requiredDuringSchedulingIgnoredDuringExecution == nil {
-		return result
-	}
-	for _, schedConstraints := range requiredDuringSchedulingIgnoredDuringExecution {
-		topologyKey := schedConstraints.TopologyKey
-		if topologyKey != hostNameTopologyKey {
-			continue
-		}
-		labelSelector := schedConstraints.LabelSelector
-		if labelSelector == nil {
-			continue
-		}
-		matchLabels := labelSelector.MatchLabels
-		for k, v := range matchLabels {
-			result[k] = v
-		}
-		for _, matchExpr := range labelSelector.MatchExpressions {
-			if matchExpr.Operator != "In" {
-				continue
-			}
-			for _, v := range matchExpr.Values {
-				result[matchExpr.Key] = v
-			}
-		}
-
-	}
-	return result
-}
-
-// mapEqualsMap returns true IFF string map1 contains the same elements as map2
-func mapEqualsMap(map1, map2 map[string]string) bool {
-	if len(map1) != len(map2) {
-		return false
-	}
-	for k1, v1 := range map1 {
-		v2, ok := map2[k1]
-		if !ok || v2 != v1 {
-			return false
-		}
-	}
-	return true
-}
-
 // controllerModeDriverPodHandler handles controller mode functionality when a driver pod event happens
 func (cm *PodMonitorType) controllerModeDriverPodHandler(pod *v1.Pod, eventType watch.EventType) error {
 	log.Debugf("controllerModeDriverPodHandler-controller:  name %s/%s node %s message %s reason %s event %v",
 		pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, pod.Spec.NodeName, pod.Status.Message, pod.Status.Reason, eventType)
 
-	// Lock so that only one thread is processing pod at a time
 	podKey := getPodKey(pod)
-	// Single thread processing of this pod
-	Lock(podKey, pod, LockSleepTimeDelay)
-	defer Unlock(podKey)
+	if eventType == watch.Deleted && pod.Spec.NodeName != "" {
+		cm.Recovery.setDriverPodReady(pod.Spec.NodeName, false)
+		cm.DriverPods.observe(pod.Spec.NodeName, false, time.Now())
+	}
 	// Check that pod is still present
 	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
 	defer cancel()
@@ -742,27 +1033,13 @@ func (cm *PodMonitorType) controllerModeDriverPodHandler(pod *v1.Pod, eventType
 		} else {
 			// Determine pod status
 			ready, initialized := podStatus(pod.Status.Conditions)
-
-			if !ready {
-				log.Infof("Taint node %s with %s driver node pod down", node.ObjectMeta.Name, PodmonDriverPodTaintKey)
-				err := taintNode(node.ObjectMeta.Name, PodmonDriverPodTaintKey, false)
-				if err != nil {
-					log.Errorf("Unable to taint node: %s: %s", node.ObjectMeta.Name, err.Error())
-				}
-			} else {
-				hasTaint := nodeHasTaint(node, PodmonDriverPodTaintKey, v1.TaintEffectNoSchedule)
-				log.Infof("Removing taint from node %s with %s", node.ObjectMeta.Name, PodmonDriverPodTaintKey)
-				// remove taint
-				if hasTaint {
-					err := taintNode(node.ObjectMeta.Name, PodmonDriverPodTaintKey, true)
-					if err != nil {
-						log.Errorf("Unable to untaint node: %s: %s", node.ObjectMeta.Name, err.Error())
-					}
-				}
-			}
-
+			cm.Recovery.setDriverPodReady(node.ObjectMeta.Name, ready)
+			cm.DriverPods.observe(node.ObjectMeta.Name, ready, time.Now())
 			log.Infof("podMonitorHandler: namespace: %s name: %s nodename: %s initialized: %t ready: %t ",
 				pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, pod.Spec.NodeName, initialized, ready)
+
+			// taint or untaint the node, the grace period and escalation are also applied by the DriverPodReconciler
+			cm.reconcileDriverPod(node, time.Now())
 		}
 	}
 
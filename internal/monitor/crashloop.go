@@ -0,0 +1,210 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"podmon/internal/k8sapi"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// A protected pod in CrashLoopBackOff is deleted so it can be rescheduled, which clears a stale mount left behind
+// by a storage problem. The pod is deleted at most crashLoopBackOffMaxRetries times within the rolling
+// crashLoopBackOffWindow, waiting crashLoopBackOffBackoff after the first deletion and doubling the wait after each
+// further deletion. The deletions are forgotten when the pod becomes Ready. If crashLoopBackOffStorageErrorsOnly is
+// set, the pod is only deleted when its Warning Events or last termination message show a storage error, so an
+// application crashing for its own reasons is left alone.
+
+var (
+	crashLoopBackOffMaxRetries        = MaxCrashLoopBackOffRetry
+	crashLoopBackOffBackoff           = time.Duration(0)
+	crashLoopBackOffWindow            = time.Duration(0)
+	crashLoopBackOffStorageErrorsOnly = false
+)
+
+// maxCrashLoopBackOffDoublings bounds the exponential growth of the backoff between deletions.
+const maxCrashLoopBackOffDoublings = 10
+
+// storageErrorEventReason is the reason of a pod Warning Event that indicates a storage error.
+const storageErrorEventReason = "FailedMount"
+
+// storageErrorPatterns are the lower case substrings of a pod Warning Event or termination message that indicate
+// a storage error. Messages are matched regardless of case, e.g. "Input/output error" as reported by the kernel.
+var storageErrorPatterns = []string{
+	"mountvolume.setup failed",
+	"input/output error",
+	"stale file handle",
+}
+
+// GetCrashLoopBackOffLimits returns the maximum number of deletions of a pod in CrashLoopBackOff, the backoff after
+// the first deletion, and the rolling window the deletions are counted in.
+func GetCrashLoopBackOffLimits() (int, time.Duration, time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return crashLoopBackOffMaxRetries, crashLoopBackOffBackoff, crashLoopBackOffWindow
+}
+
+// SetCrashLoopBackOffLimits sets the maximum number of deletions of a pod in CrashLoopBackOff, the backoff after the
+// first deletion, and the rolling window the deletions are counted in. A backoff of 0 deletes the pod on each
+// CrashLoopBackOff, and a window of 0 counts the deletions until the pod becomes Ready.
+func SetCrashLoopBackOffLimits(maxRetries int, backoff, window time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	crashLoopBackOffMaxRetries = maxRetries
+	crashLoopBackOffBackoff = backoff
+	crashLoopBackOffWindow = window
+}
+
+// GetCrashLoopBackOffStorageErrorsOnly returns true if a pod in CrashLoopBackOff is only deleted for storage errors.
+func GetCrashLoopBackOffStorageErrorsOnly() bool {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return crashLoopBackOffStorageErrorsOnly
+}
+
+// SetCrashLoopBackOffStorageErrorsOnly sets whether a pod in CrashLoopBackOff is only deleted for storage errors.
+func SetCrashLoopBackOffStorageErrorsOnly(storageErrorsOnly bool) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	crashLoopBackOffStorageErrorsOnly = storageErrorsOnly
+}
+
+// crashLoopBackOffDeletions records when a pod in CrashLoopBackOff was deleted.
+type crashLoopBackOffDeletions struct {
+	mutex sync.Mutex
+	times []time.Time
+}
+
+// admit returns the number of deletions within the window, and whether the pod may be deleted again at now.
+// If not, the string explains why.
+func (d *crashLoopBackOffDeletions) admit(now time.Time) (int, bool, string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	maxRetries, backoff, window := GetCrashLoopBackOffLimits()
+	if window > 0 {
+		kept := d.times[:0]
+		for _, t := range d.times {
+			if now.Sub(t) < window {
+				kept = append(kept, t)
+			}
+		}
+		d.times = kept
+	}
+	count := len(d.times)
+	if count >= maxRetries {
+		return count, false, fmt.Sprintf("deleted %d times, the limit is %d", count, maxRetries)
+	}
+	if count > 0 && backoff > 0 {
+		wait := backoff << min(count-1, maxCrashLoopBackOffDoublings)
+		if next := d.times[count-1].Add(wait); now.Before(next) {
+			return count, false, fmt.Sprintf("backing off until %s", next.Format(time.RFC3339))
+		}
+	}
+	return count, true, ""
+}
+
+// record records a deletion at now.
+func (d *crashLoopBackOffDeletions) record(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.times = append(d.times, now)
+}
+
+// isStorageError returns true if the message contains one of the storage error patterns, ignoring case.
+func isStorageError(message string) bool {
+	message = strings.ToLower(message)
+	for _, pattern := range storageErrorPatterns {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// podStorageError returns the first storage error found in the pod's last container termination messages or its
+// Warning Events, or "" if there is none.
+func podStorageError(ctx context.Context, pod *v1.Pod) string {
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		terminated := containerStatus.LastTerminationState.Terminated
+		if terminated == nil {
+			continue
+		}
+		if isStorageError(terminated.Message) {
+			return terminated.Message
+		}
+	}
+	events, err := K8sAPI.GetPodEvents(ctx, pod)
+	if err != nil {
+		log.Errorf("Could not get events of pod %s/%s: %s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, err)
+		return ""
+	}
+	for _, event := range events.Items {
+		if event.Type != v1.EventTypeWarning {
+			continue
+		}
+		if event.Reason == storageErrorEventReason || isStorageError(event.Message) {
+			return fmt.Sprintf("%s: %s", event.Reason, event.Message)
+		}
+	}
+	return ""
+}
+
+// crashLoopBackOffCleanup deletes the pod in CrashLoopBackOff if the retry limit, backoff, and storage error filter allow it.
+func (cm *PodMonitorType) crashLoopBackOffCleanup(ctx context.Context, pod *v1.Pod, node *v1.Node, now time.Time) {
+	podKey := getPodKey(pod)
+	value, _ := cm.PodKeyToCrashLoopBackOffDeletions.LoadOrStore(podKey, &crashLoopBackOffDeletions{})
+	deletions := value.(*crashLoopBackOffDeletions)
+	count, ok, explanation := deletions.admit(now)
+	if !ok {
+		log.Infof("not cleaning up CrashLoopBackOff pod %s: %s", podKey, explanation)
+		return
+	}
+	storageError := ""
+	if GetCrashLoopBackOffStorageErrorsOnly() {
+		if storageError = podStorageError(ctx, pod); storageError == "" {
+			log.Infof("not cleaning up CrashLoopBackOff pod %s because no storage errors were found", podKey)
+			return
+		}
+		log.Infof("CrashLoopBackOff pod %s has storage error: %s", podKey, storageError)
+	}
+	if GetDryRun() {
+		fields := map[string]interface{}{"namespace": pod.ObjectMeta.Namespace, "pod": pod.ObjectMeta.Name, "node": node.ObjectMeta.Name,
+			"reason": crashLoopBackOffReason, "retry": count}
+		reportDryRun(pod, fields, dryRunDeletePod, podKey)
+		deletions.record(now)
+		return
+	}
+	// The deletion is counted when it is queued, so repeated pod events don't queue it again.
+	deletions.record(now)
+	cm.Scheduler.submit([]string{podKey}, podCleanupPriority(pod, getPodPolicy(pod)), func() error {
+		log.Infof("cleaning up CrashLoopBackOff pod %s", podKey)
+		if err := K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, crashLoopBackOffReason, "podmon cleaning pod %s with delete",
+			string(pod.ObjectMeta.UID), node.ObjectMeta.Name, fmt.Sprintf("retry: %d", count), storageError); err != nil {
+			log.Errorf("Failed to send %s event: %s", crashLoopBackOffReason, err.Error())
+		}
+		ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+		defer cancel()
+		if err := K8sAPI.DeletePod(ctx, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, pod.ObjectMeta.UID, false); err != nil {
+			return fmt.Errorf("failed to delete CrashLoopBackOff pod %s: %s", podKey, err)
+		}
+		return nil
+	})
+}
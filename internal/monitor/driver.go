@@ -19,6 +19,7 @@ import (
 	"os"
 	"podmon/internal/tools"
 	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -33,11 +34,63 @@ type drivertype interface {
 	NodeUnpublishExcludedError(err error) bool
 	NodeUnstageExcludedError(err error) bool
 	FinalCleanup(rawBlock bool, volumeHandle, pvName, podUUID string) error
+	GetArrayIDFromVolumeHandle(volumeHandle string) string
 }
 
 // Driver is an instance of the drivertype interface to provide driver specific functions.
 var Driver drivertype
 
+// driverTypes is the registry of the drivertypes keyed by CSI driver name, see RegisterDriverType.
+var (
+	driverTypes = map[string]func() drivertype{
+		"csi-vxflexos.dellemc.com":   func() drivertype { return new(VxflexDriver) },
+		"csi-unity.dellemc.com":      func() drivertype { return new(UnityDriver) },
+		"csi-isilon.dellemc.com":     func() drivertype { return new(PScaleDriver) },
+		"csi-powerstore.dellemc.com": func() drivertype { return new(PStoreDriver) },
+		"csi-powermax.dellemc.com":   func() drivertype { return new(PMaxDriver) },
+	}
+	driverTypesMutex sync.Mutex
+)
+
+// RegisterDriverType registers the function returning the drivertype for the CSI driver with the driverPath,
+// replacing any drivertype already registered for it.
+func RegisterDriverType(driverPath string, newDriver func() drivertype) {
+	driverTypesMutex.Lock()
+	defer driverTypesMutex.Unlock()
+	driverTypes[driverPath] = newDriver
+}
+
+// GetDriverType returns the drivertype registered for the CSI driver with the driverPath. If there is none, the
+// drivertype is chosen by the driver's name appearing in the driverPath, defaulting to PowerFlex.
+func GetDriverType(driverPath string) drivertype {
+	driverTypesMutex.Lock()
+	newDriver, ok := driverTypes[driverPath]
+	driverTypesMutex.Unlock()
+	if ok {
+		driver := newDriver()
+		log.Infof("CSI Driver for %s from the driver registry", driver.GetDriverName())
+		return driver
+	}
+	switch {
+	case strings.Contains(driverPath, "unity"):
+		log.Infof("CSI Driver for Unity")
+		return new(UnityDriver)
+	case strings.Contains(driverPath, "isilon"):
+		// added condition to create instance of PowerScale driver
+		log.Infof("CSI Driver for PowerScale")
+		return new(PScaleDriver)
+	case strings.Contains(driverPath, "powerstore"):
+		log.Infof("CSI Driver for PowerStore")
+		return new(PStoreDriver)
+	case strings.Contains(driverPath, "powermax"):
+		log.Infof("CSI Driver for PowerMax")
+		return new(PMaxDriver)
+	default:
+		log.Infof("CSI Driver for VxFlex OS")
+		return new(VxflexDriver)
+	}
+}
+
 // VxflexDriver provides a Driver instance for the PowerFlex (VxFlex) architecture.
 type VxflexDriver struct{}
 
@@ -111,6 +164,16 @@ func (d *VxflexDriver) FinalCleanup(_ bool, _, _, _ string) error {
 	return nil
 }
 
+// GetArrayIDFromVolumeHandle returns the PowerFlex system ID from a volume handle of the form systemID-volumeID.
+// Legacy volume handles without a system ID return an empty string.
+func (d *VxflexDriver) GetArrayIDFromVolumeHandle(volumeHandle string) string {
+	parts := strings.SplitN(volumeHandle, "-", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[0]
+}
+
 // UnityDriver provides a Driver instance for the Unity architecture.
 type UnityDriver struct{}
 
@@ -200,6 +263,15 @@ func (d *UnityDriver) FinalCleanup(rawBlock bool, _, pvName, podUUID string) err
 	return nil
 }
 
+// GetArrayIDFromVolumeHandle returns the Unity array ID from a volume handle of the form name-protocol-arrayID-volumeID.
+func (d *UnityDriver) GetArrayIDFromVolumeHandle(volumeHandle string) string {
+	parts := strings.Split(volumeHandle, "-")
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
 var (
 	getLoopBackDevice    = tools.GetLoopBackDevice
 	deleteLoopBackDevice = tools.DeleteLoopBackDevice
@@ -260,6 +332,16 @@ func (d *PScaleDriver) FinalCleanup(_ bool, _, _, _ string) error {
 	return nil
 }
 
+// GetArrayIDFromVolumeHandle returns the PowerScale cluster name from a volume handle of the form
+// name=_=_=exportID=_=_=accessZone=_=_=clusterName.
+func (d *PScaleDriver) GetArrayIDFromVolumeHandle(volumeHandle string) string {
+	parts := strings.Split(volumeHandle, "=_=_=")
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[3]
+}
+
 // PStoreDriver provides a Driver instance for the Powerstore architecture.
 type PStoreDriver struct{}
 
@@ -325,6 +407,17 @@ func (d *PStoreDriver) FinalCleanup(_ bool, _, _, _ string) error {
 	return nil
 }
 
+// GetArrayIDFromVolumeHandle returns the PowerStore global ID from a volume handle of the form volumeID/globalID/protocol.
+// For metro volumes only the local part of the handle (before the ':') is considered.
+func (d *PStoreDriver) GetArrayIDFromVolumeHandle(volumeHandle string) string {
+	local := strings.SplitN(volumeHandle, ":", 2)[0]
+	parts := strings.Split(local, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
 // PMaxDriver provides a Driver instance for the PowerMax architecture.
 type PMaxDriver struct{}
 
@@ -390,6 +483,16 @@ func (d *PMaxDriver) FinalCleanup(_ bool, _, _, _ string) error {
 	return nil
 }
 
+// GetArrayIDFromVolumeHandle returns the PowerMax symmetrix ID from a volume handle of the form
+// csi-clusterPrefix-volumeName-symID-deviceID.
+func (d *PMaxDriver) GetArrayIDFromVolumeHandle(volumeHandle string) string {
+	parts := strings.Split(volumeHandle, "-")
+	if len(parts) < 5 || parts[0] != "csi" {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
 func getPrivateMountDir(defaultDir string) string {
 	privateMountDir := os.Getenv("X_CSI_PRIVATE_MOUNT_DIR")
 	if privateMountDir == "" {
@@ -0,0 +1,342 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"fmt"
+	"podmon/internal/k8sapi"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// A node is tainted with PodmonDriverPodTaintKey while the driver node pod on it is not Ready, so that no new pods
+// needing the driver are scheduled there. The taint is only applied once the driver node pod has been not Ready for
+// the driver pod grace period, so a restart of the pod doesn't taint the node. A driver node pod that stops being
+// Ready driverPodFlapLimit times within driverPodFlapWindow is flapping: the node is tainted as soon as the pod is
+// not Ready, and the taint is kept until the pod has been Ready long enough for the flap window to forget its
+// outages. If the driver node pod stays not Ready for the escalation period its CSI node plugin is considered dead,
+// and the node's protected pods are cleaned up as they are when the node loses array connectivity.
+
+const (
+	// driverNodePodFlappingReason is the Event reason used when a driver node pod starts flapping.
+	driverNodePodFlappingReason = "DriverNodePodFlapping"
+	// driverNodePodDownReason is the Event reason used when the protected pods are cleaned up because the driver node pod is down.
+	driverNodePodDownReason = "DriverNodePodDown"
+)
+
+// DriverPodReconcileInterval is the time between the driver node pod reconciler's passes over the nodes whose
+// driver node pod is not Ready or that have the driver node pod taint.
+var DriverPodReconcileInterval = 10 * time.Second
+
+var (
+	driverPodGracePeriod      = time.Duration(0)
+	driverPodEscalationPeriod = time.Duration(0)
+	driverPodFlapLimit        = 0
+	driverPodFlapWindow       = 10 * time.Minute
+)
+
+// GetDriverPodLimits returns how long a driver node pod must be not Ready before its node is tainted, and before
+// the protected pods on the node are cleaned up.
+func GetDriverPodLimits() (time.Duration, time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return driverPodGracePeriod, driverPodEscalationPeriod
+}
+
+// SetDriverPodLimits sets how long a driver node pod must be not Ready before its node is tainted, and before the
+// protected pods on the node are cleaned up. A grace period of 0 taints the node immediately, and an escalation
+// period of 0 never cleans up the pods.
+func SetDriverPodLimits(gracePeriod, escalationPeriod time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	driverPodGracePeriod = gracePeriod
+	driverPodEscalationPeriod = escalationPeriod
+}
+
+// GetDriverPodFlapLimits returns how many times a driver node pod must stop being Ready within the flap window to be flapping, and the window.
+func GetDriverPodFlapLimits() (int, time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return driverPodFlapLimit, driverPodFlapWindow
+}
+
+// SetDriverPodFlapLimits sets how many times a driver node pod must stop being Ready within the flap window to be
+// flapping, and the window. A limit of 0 disables flap detection.
+func SetDriverPodFlapLimits(limit int, window time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	driverPodFlapLimit = limit
+	driverPodFlapWindow = window
+}
+
+// driverPodState is what the tracker knows about the driver node pod on a node.
+type driverPodState struct {
+	ready     bool        // whether the driver node pod is Ready
+	since     time.Time   // when ready last changed
+	downs     []time.Time // when the pod stopped being Ready, within the flap window
+	flapping  bool        // whether the pod was flapping when last evaluated, an Event is only sent when it starts
+	tainted   bool        // whether podmon tainted the node because of the pod
+	escalated bool        // whether the cleanup of the protected pods was admitted during the current outage
+}
+
+// driverPodAction is what should be done about the node of a driver node pod.
+type driverPodAction struct {
+	taint       bool          // taint the node
+	untaint     bool          // remove the taint from the node
+	escalate    bool          // clean up the protected pods on the node
+	flappingNow bool          // the pod just started flapping
+	downFor     time.Duration // how long the pod has been not Ready
+	explanation string        // why the taint is neither applied nor removed
+}
+
+// DriverPodTracker debounces the readiness of the driver node pods. The zero value is ready to use.
+type DriverPodTracker struct {
+	mutex sync.Mutex
+	nodes map[string]*driverPodState // node name to the state of the driver node pod on it
+}
+
+// observe records the readiness of the driver node pod on the node.
+func (t *DriverPodTracker) observe(nodeName string, ready bool, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.nodes == nil {
+		t.nodes = make(map[string]*driverPodState)
+	}
+	state, ok := t.nodes[nodeName]
+	if ok && state.ready == ready {
+		return
+	}
+	if !ok {
+		state = &driverPodState{}
+		t.nodes[nodeName] = state
+	}
+	state.ready, state.since = ready, now
+	if !ready {
+		state.downs = append(state.downs, now)
+	}
+}
+
+// evaluate returns what should be done about the node given the readiness history of its driver node pod.
+func (t *DriverPodTracker) evaluate(nodeName string, now time.Time) driverPodAction {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	action := driverPodAction{}
+	state, ok := t.nodes[nodeName]
+	if !ok {
+		action.explanation = "readiness is unknown"
+		return action
+	}
+	gracePeriod, escalationPeriod := GetDriverPodLimits()
+	flapLimit, flapWindow := GetDriverPodFlapLimits()
+	kept := state.downs[:0]
+	for _, down := range state.downs {
+		if now.Sub(down) < flapWindow {
+			kept = append(kept, down)
+		}
+	}
+	state.downs = kept
+	flapping := flapLimit > 0 && len(state.downs) >= flapLimit
+	action.flappingNow = flapping && !state.flapping
+	state.flapping = flapping
+	if state.ready {
+		state.escalated = false
+		if flapping {
+			action.explanation = fmt.Sprintf("is flapping, it was not Ready %d times within %v", len(state.downs), flapWindow)
+			return action
+		}
+		action.untaint = true
+		return action
+	}
+	action.downFor = now.Sub(state.since)
+	if flapping || action.downFor >= gracePeriod {
+		action.taint = true
+	} else {
+		action.explanation = fmt.Sprintf("has not been Ready for %v of the %v grace period", action.downFor.Truncate(time.Second), gracePeriod)
+	}
+	// The node is only marked escalated once the failover guard admits it, so a denied escalation is retried.
+	action.escalate = escalationPeriod > 0 && action.downFor >= escalationPeriod && !state.escalated
+	return action
+}
+
+// setEscalated records that the cleanup of the protected pods on the node was admitted during the current outage.
+func (t *DriverPodTracker) setEscalated(nodeName string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if state, ok := t.nodes[nodeName]; ok {
+		state.escalated = true
+	}
+}
+
+// setTainted records whether podmon has tainted the node because of its driver node pod.
+func (t *DriverPodTracker) setTainted(nodeName string, tainted bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if state, ok := t.nodes[nodeName]; ok {
+		state.tainted = tainted
+	}
+}
+
+// isTainted returns whether podmon has tainted the node because of its driver node pod.
+func (t *DriverPodTracker) isTainted(nodeName string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state, ok := t.nodes[nodeName]
+	return ok && state.tainted
+}
+
+// forgetNode stops tracking the node.
+func (t *DriverPodTracker) forgetNode(nodeName string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.nodes, nodeName)
+}
+
+// snapshot returns the names of the nodes whose driver node pod is not Ready or that podmon has tainted, sorted.
+func (t *DriverPodTracker) snapshot() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	names := make([]string, 0)
+	for name, state := range t.nodes {
+		if !state.ready || state.tainted {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reconcileDriverPod taints or untaints the node depending on the readiness history of its driver node pod, and
+// cleans up the protected pods on the node if the driver node pod has been down for the escalation period.
+func (cm *PodMonitorType) reconcileDriverPod(node *v1.Node, now time.Time) {
+	nodeName := node.ObjectMeta.Name
+	action := cm.DriverPods.evaluate(nodeName, now)
+	if action.flappingNow {
+		flapLimit, flapWindow := GetDriverPodFlapLimits()
+		log.Infof("Driver node pod on node %s is flapping, keeping taint %s until it is Ready for %v", nodeName, PodmonDriverPodTaintKey, flapWindow)
+		if err := K8sAPI.CreateEvent(podmon, node, k8sapi.EventTypeWarning, driverNodePodFlappingReason,
+			"podmon keeping taint %s on node %s: driver node pod was not Ready %d times within %v",
+			PodmonDriverPodTaintKey, nodeName, flapLimit, flapWindow); err != nil {
+			log.Errorf("Failed to send %s event: %s", driverNodePodFlappingReason, err.Error())
+		}
+	}
+	hasTaint := nodeHasTaint(node, PodmonDriverPodTaintKey, v1.TaintEffectNoSchedule)
+	if GetDryRun() {
+		// The node is never tainted in dry-run mode, so report the changes to the taint podmon would have applied.
+		hasTaint = cm.DriverPods.isTainted(nodeName)
+	}
+	fields := map[string]interface{}{"node": nodeName, "taint": PodmonDriverPodTaintKey}
+	switch {
+	case action.taint:
+		if !hasTaint {
+			log.Infof("Taint node %s with %s driver node pod down", nodeName, PodmonDriverPodTaintKey)
+			if GetDryRun() {
+				reportDryRun(node, fields, dryRunTaintNode, nodeName)
+			} else if err := taintNode(nodeName, PodmonDriverPodTaintKey, false); err != nil {
+				log.Errorf("Unable to taint node: %s: %s", nodeName, err.Error())
+				break
+			}
+		}
+		cm.DriverPods.setTainted(nodeName, true)
+	case action.untaint:
+		if hasTaint {
+			log.Infof("Removing taint from node %s with %s", nodeName, PodmonDriverPodTaintKey)
+			if GetDryRun() {
+				reportDryRun(node, fields, dryRunUntaintNode, nodeName)
+			} else if err := taintNode(nodeName, PodmonDriverPodTaintKey, true); err != nil {
+				log.Errorf("Unable to untaint node: %s: %s", nodeName, err.Error())
+				break
+			}
+		}
+		cm.DriverPods.setTainted(nodeName, false)
+	default:
+		log.Infof("Not changing taint %s on node %s: driver node pod %s", PodmonDriverPodTaintKey, nodeName, action.explanation)
+	}
+	if action.escalate {
+		cm.escalateDriverPodDown(node, action.downFor)
+	}
+}
+
+// escalateDriverPodDown taints the node with the podmon taint and cleans up its protected pods, highest priority
+// first, because the driver node pod on it has been down for the escalation period.
+func (cm *PodMonitorType) escalateDriverPodDown(node *v1.Node, downFor time.Duration) {
+	nodeName := node.ObjectMeta.Name
+	podKeys := make([]string, 0)
+	cm.PodKeyToControllerPodInfo.Range(func(_, value interface{}) bool {
+		podInfo := value.(*ControllerPodInfo)
+		if podInfo.Node.ObjectMeta.Name == nodeName {
+			podKeys = append(podKeys, podInfo.PodKey)
+		}
+		return true
+	})
+	fields := map[string]interface{}{"node": nodeName, "reason": driverNodePodDownReason, "downFor": downFor.Truncate(time.Second)}
+	if len(podKeys) == 0 {
+		log.WithFields(fields).Infof("Driver node pod down but no protected pods to clean up")
+		return
+	}
+	if !cm.admitFailover(node, nil, driverNodePodDownReason) {
+		return
+	}
+	cm.DriverPods.setEscalated(nodeName)
+	log.WithFields(fields).Infof("Cleaning up %d protected pods because the driver node pod is down", len(podKeys))
+	if err := K8sAPI.CreateEvent(podmon, node, k8sapi.EventTypeWarning, driverNodePodDownReason,
+		"podmon cleaning up %d protected pods on node %s: driver node pod not Ready for %v",
+		len(podKeys), nodeName, downFor.Truncate(time.Second)); err != nil {
+		log.Errorf("Failed to send %s event: %s", driverNodePodDownReason, err.Error())
+	}
+	if GetDryRun() {
+		reportDryRun(node, fields, dryRunTaintNode, nodeName)
+	} else if err := taintNode(nodeName, PodmonTaintKey, false); err != nil {
+		log.Errorf("Unable to taint node: %s: %s", nodeName, err.Error())
+	}
+	cm.sortPodKeysByCleanupPriority(podKeys)
+	cm.submitPodCleanups(podKeys, driverNodePodDownReason)
+}
+
+// reconcileDriverPods makes a pass over the nodes whose driver node pod is not Ready or that podmon has tainted,
+// applying the grace period, flap hysteresis and escalation that no pod event triggers.
+func (cm *PodMonitorType) reconcileDriverPods(now time.Time) {
+	for _, nodeName := range cm.DriverPods.snapshot() {
+		ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+		node, err := K8sAPI.GetNode(ctx, nodeName)
+		cancel()
+		if err != nil {
+			if k8serrors.IsNotFound(err) {
+				cm.DriverPods.forgetNode(nodeName)
+				continue
+			}
+			log.Errorf("Driver node pod reconciler couldn't get node %s: %s", nodeName, err)
+			continue
+		}
+		cm.reconcileDriverPod(node, now)
+	}
+}
+
+// DriverPodReconciler -- periodically taints, untaints, or cleans up the nodes whose driver node pod is down.
+// This is a never ending function, intended to be called as Go routine.
+func (cm *PodMonitorType) DriverPodReconciler() {
+	for {
+		cm.reconcileDriverPods(time.Now())
+		time.Sleep(DriverPodReconcileInterval)
+		if DriverPodReconcileInterval < 10*time.Millisecond {
+			// unit testing exit
+			return
+		}
+	}
+}
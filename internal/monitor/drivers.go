@@ -0,0 +1,213 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"fmt"
+	"podmon/internal/csiapi"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// A single podmon controller can protect the pods of several CSI drivers. The primary driver is the one configured
+// by Driver, CSIApi, PodmonTaintKey and the DriverPathStr of the PodMonitor. Each additional driver is registered as
+// a CSIDriver with its own CSI client, drivertype, label selector and taint key. A PV is routed to the driver named
+// by its pv.Spec.CSI.Driver, and the PVs of drivers that are not registered stay with the primary driver. The array
+// IDs of the additional drivers are qualified with the driver path, so the array connectivity of each driver is
+// sampled separately and the checks are sent to the right driver. The node sidecars and driver node pods are still
+// deployed per driver, so the node mode and the driver node pod monitoring only handle the primary driver.
+
+// arrayIDSeparator separates the driver path from the array ID of an additional driver's array.
+const arrayIDSeparator = "/"
+
+// CSIDriver is a CSI driver whose pods are protected by podmon.
+type CSIDriver struct {
+	Path              string        // CSI driver name, matched with pv.Spec.CSI.Driver and the csi.volume.kubernetes.io/nodeid annotation
+	Type              drivertype    // driver specific functions
+	API               csiapi.CSIApi // client of the driver's controller plugin
+	LabelKey          string        // label key of the protected pods using the driver
+	LabelValue        string        // label value of the protected pods using the driver
+	TaintKey          string        // podmon taint key for the driver
+	ExtensionsPresent bool          // the driver implements the CSI PodmonExtensions
+}
+
+// connected returns true if the driver's CSI client is connected.
+func (d *CSIDriver) connected() bool {
+	return d.API != nil && d.API.Connected()
+}
+
+// RegisterCSIDriver adds a driver to the drivers podmon manages in addition to the primary driver.
+// If the taint key is not set, it is derived from the driver name like PodmonTaintKey.
+func (cm *PodMonitorType) RegisterCSIDriver(d *CSIDriver) {
+	if d.TaintKey == "" {
+		d.TaintKey = fmt.Sprintf("%s.%s", d.Type.GetDriverName(), PodmonTaintKeySuffix)
+	}
+	cm.Drivers.Store(d.Path, d)
+}
+
+// AdditionalCSIDrivers returns the registered drivers other than the primary driver, sorted by path.
+func (cm *PodMonitorType) AdditionalCSIDrivers() []*CSIDriver {
+	drivers := make([]*CSIDriver, 0)
+	cm.Drivers.Range(func(_, value interface{}) bool {
+		drivers = append(drivers, value.(*CSIDriver))
+		return true
+	})
+	sort.Slice(drivers, func(i, j int) bool { return drivers[i].Path < drivers[j].Path })
+	return drivers
+}
+
+// HasCSIExtensions returns true if the primary driver or any additional driver implements the CSI PodmonExtensions.
+func (cm *PodMonitorType) HasCSIExtensions() bool {
+	for _, d := range cm.csiDrivers() {
+		if d.ExtensionsPresent {
+			return true
+		}
+	}
+	return false
+}
+
+// primaryCSIDriver returns the primary driver, described by the package Driver, CSIApi, and PodmonTaintKey.
+func (cm *PodMonitorType) primaryCSIDriver() *CSIDriver {
+	return &CSIDriver{
+		Path:              cm.DriverPathStr,
+		Type:              Driver,
+		API:               CSIApi,
+		TaintKey:          PodmonTaintKey,
+		ExtensionsPresent: cm.CSIExtensionsPresent,
+	}
+}
+
+// csiDrivers returns the primary driver followed by the additional drivers.
+func (cm *PodMonitorType) csiDrivers() []*CSIDriver {
+	return append([]*CSIDriver{cm.primaryCSIDriver()}, cm.AdditionalCSIDrivers()...)
+}
+
+// additionalCSIDriver returns the additional driver with the path, or nil if there is none.
+func (cm *PodMonitorType) additionalCSIDriver(path string) *CSIDriver {
+	if path == "" || path == cm.DriverPathStr {
+		return nil
+	}
+	if value, ok := cm.Drivers.Load(path); ok {
+		return value.(*CSIDriver)
+	}
+	return nil
+}
+
+// managedCSIDriver returns the driver with the path, or nil if podmon doesn't manage it.
+func (cm *PodMonitorType) managedCSIDriver(path string) *CSIDriver {
+	if path == cm.DriverPathStr {
+		return cm.primaryCSIDriver()
+	}
+	return cm.additionalCSIDriver(path)
+}
+
+// csiDriverForPV returns the driver the PV is routed to.
+func (cm *PodMonitorType) csiDriverForPV(pv *v1.PersistentVolume) *CSIDriver {
+	if csiSource := pv.Spec.PersistentVolumeSource.CSI; csiSource != nil {
+		if d := cm.additionalCSIDriver(csiSource.Driver); d != nil {
+			return d
+		}
+	}
+	return cm.primaryCSIDriver()
+}
+
+// csiDriverForArray returns the driver of the array ID returned by pvToArrayID, and the array ID known to the driver.
+func (cm *PodMonitorType) csiDriverForArray(arrayID string) (*CSIDriver, string) {
+	if path, driverArrayID, ok := strings.Cut(arrayID, arrayIDSeparator); ok {
+		if d := cm.additionalCSIDriver(path); d != nil {
+			return d, driverArrayID
+		}
+	}
+	return cm.primaryCSIDriver(), arrayID
+}
+
+// csiDriversForPod returns the drivers of the pod's PVs, primary driver first. A pod without CSI volumes is routed to
+// the additional driver whose label selects it, or else to the primary driver.
+func (cm *PodMonitorType) csiDriversForPod(pod *v1.Pod, pvlist []*v1.PersistentVolume) []*CSIDriver {
+	drivers := make([]*CSIDriver, 0)
+	seen := make(map[string]bool)
+	for _, pv := range pvlist {
+		if pv.Spec.PersistentVolumeSource.CSI == nil {
+			continue
+		}
+		d := cm.csiDriverForPV(pv)
+		if !seen[d.Path] {
+			seen[d.Path] = true
+			drivers = append(drivers, d)
+		}
+	}
+	if len(drivers) == 0 {
+		for _, d := range cm.AdditionalCSIDrivers() {
+			if d.LabelKey != "" && labels.SelectorFromSet(labels.Set{d.LabelKey: d.LabelValue}).Matches(labels.Set(pod.ObjectMeta.Labels)) {
+				return []*CSIDriver{d}
+			}
+		}
+		return []*CSIDriver{cm.primaryCSIDriver()}
+	}
+	sort.SliceStable(drivers, func(i, j int) bool { return drivers[i].Path == cm.DriverPathStr && drivers[j].Path != cm.DriverPathStr })
+	return drivers
+}
+
+// csiDriversConnected returns true if the CSI clients of all the drivers are connected.
+func csiDriversConnected(drivers []*CSIDriver) bool {
+	for _, d := range drivers {
+		if !d.connected() {
+			return false
+		}
+	}
+	return true
+}
+
+// csiDriversHaveExtensions returns true if all the drivers implement the CSI PodmonExtensions.
+func csiDriversHaveExtensions(drivers []*CSIDriver) bool {
+	for _, d := range drivers {
+		if !d.ExtensionsPresent {
+			return false
+		}
+	}
+	return true
+}
+
+// podmonTaintKeys returns the podmon taint keys of all the drivers.
+func (cm *PodMonitorType) podmonTaintKeys() []string {
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, d := range cm.csiDrivers() {
+		if !seen[d.TaintKey] {
+			seen[d.TaintKey] = true
+			keys = append(keys, d.TaintKey)
+		}
+	}
+	return keys
+}
+
+// nodePodmonTaintKeys returns the podmon taint keys of the drivers that are on the node.
+func (cm *PodMonitorType) nodePodmonTaintKeys(node *v1.Node) []string {
+	keys := make([]string, 0)
+	for _, key := range cm.podmonTaintKeys() {
+		if nodeHasTaint(node, key, v1.TaintEffectNoSchedule) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// nodeHasPodmonTaint returns true if the node has the podmon taint of any of the drivers.
+func (cm *PodMonitorType) nodeHasPodmonTaint(node *v1.Node) bool {
+	return len(cm.nodePodmonTaintKeys(node)) > 0
+}
@@ -0,0 +1,61 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package monitor
+
+import (
+	"fmt"
+	"podmon/internal/k8sapi"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// In dry-run mode podmon performs all of its checks, but instead of fencing, tainting,
+// deleting volume attachments or pods, or unpublishing volumes, it reports what it would
+// have done with a structured log entry and a Kubernetes Event.
+
+const (
+	// dryRunReason is the Event reason used for reporting the actions that would have been taken.
+	dryRunReason = "DryRun"
+
+	dryRunFenceVolume         = "fence volume"
+	dryRunTaintNode           = "taint node"
+	dryRunOutOfServiceTaint   = "apply out-of-service taint to node"
+	dryRunUntaintNode         = "remove taint from node"
+	dryRunDeleteVA            = "delete VolumeAttachment"
+	dryRunForceDeletePod      = "force delete pod"
+	dryRunDeletePod           = "delete pod"
+	dryRunNodeUnpublishVolume = "unpublish and unstage volume"
+	dryRunResumeCleanup       = "resume or roll back cleanup ledger entry"
+)
+
+// reportDryRun logs the action that would have been taken against target along with the supplied fields,
+// and emits a Normal Event on object describing it.
+func reportDryRun(object runtime.Object, fields map[string]interface{}, action, target string) {
+	f := make(map[string]interface{})
+	for key, value := range fields {
+		f[key] = value
+	}
+	f["dryRun"] = true
+	f["action"] = action
+	f["target"] = target
+	log.WithFields(f).Infof("Dry-run: would %s %s", action, target)
+	if object == nil {
+		return
+	}
+	if err := K8sAPI.CreateEvent(podmon, object, k8sapi.EventTypeNormal, dryRunReason,
+		"podmon dry-run would %s", fmt.Sprintf("%s %s", action, target)); err != nil {
+		log.Errorf("Failed to send %s event: %s", dryRunReason, err.Error())
+	}
+}
@@ -26,6 +26,84 @@ Feature: Controller Monitor
       | "node1" | 2    | "CreateEvent"                    | "node1" | "true"    | "Successfully cleaned up pod"                        |
 
 
+  @controller-mode
+  Scenario Outline: Test controllerCleanupPod records its progress in the cleanup ledger
+    Given a controller monitor "vxflex"
+    And a cleanup ledger in namespace "podmon"
+    And a pod for node "node1" with 2 volumes condition ""
+    And I induce error <error>
+    When I call controllerCleanupPod for node "node1"
+    Then the return status is <retstatus>
+    And the cleanup ledger has <entries> entries
+    And the cleanup ledger step is <step>
+
+    Examples:
+      | error                            | retstatus | entries | step                       |
+      | "none"                           | "true"    | 0       | "none"                     |
+      | "ValidateVolumeHostConnectivity" | "false"   | 0       | "none"                     |
+      | "ControllerUnpublishVolume"      | "false"   | 1       | "Fencing"                  |
+      | "K8sTaint"                       | "false"   | 1       | "Fenced"                   |
+      | "DeleteVolumeAttachment"         | "false"   | 1       | "Tainted"                  |
+      | "DeletePod"                      | "false"   | 1       | "VolumeAttachmentsDeleted" |
+      | "CreateOrUpdateConfigMap"        | "true"    | 0       | "none"                     |
+
+  @controller-mode
+  Scenario Outline: Test controllerCleanupPod in out-of-service fencing mode
+    Given a controller monitor "vxflex"
+    And the fencing mode is "out-of-service"
+    And a pod for node "node1" with 2 volumes condition ""
+    And I induce error <error>
+    When I call controllerCleanupPod for node "node1"
+    Then the return status is <retstatus>
+    And the pod is present "true"
+    And the node "node1" has the out-of-service taint <tainted>
+    And the last log message contains <errormsg>
+
+    Examples:
+      | error                       | retstatus | tainted | errormsg                                     |
+      | "none"                      | "true"    | "true"  | "Applied out-of-service taint"               |
+      | "CSINotConnected"           | "false"   | "false" | "fencing cannot be confirmed"                |
+      | "ControllerUnpublishVolume" | "false"   | "false" | "errors calling ControllerUnpublishVolume"   |
+      | "K8sTaint"                  | "false"   | "false" | "Failed to update taint against node1 node"  |
+
+  @controller-mode
+  Scenario Outline: Test ResumeCleanups rolls unfinished cleanups forward or back
+    Given a controller monitor "vxflex"
+    And a cleanup ledger in namespace "podmon"
+    And a pod for node "node1" with 2 volumes condition ""
+    And a cleanup ledger entry for the pod at step <step>
+    And the ledger pod has been deleted <deleted>
+    And I induce error <error>
+    When I call ResumeCleanups
+    Then the cleanup ledger has <entries> entries
+    And the pod is present <present>
+    And the node "node1" is tainted <tainted>
+
+    Examples:
+      | step        | deleted | error           | entries | present | tainted |
+      | "Started"   | "false" | "none"          | 0       | "true"  | "false" |
+      | "Validated" | "false" | "none"          | 0       | "true"  | "false" |
+      | "Fencing"   | "false" | "none"          | 0       | "false" | "true"  |
+      | "Fenced"    | "false" | "none"          | 0       | "false" | "true"  |
+      | "Tainted"   | "false" | "DeletePod"     | 1       | "true"  | "true"  |
+      | "Fenced"    | "true"  | "none"          | 0       | "false" | "true"  |
+      | "Fenced"    | "true"  | "K8sTaint"      | 1       | "false" | "false" |
+      | "Fenced"    | "false" | "GetNode"       | 1       | "true"  | "false" |
+      | "Fenced"    | "false" | "GetConfigMaps" | 1       | "true"  | "false" |
+
+  @controller-mode
+  Scenario: Test ResumeCleanups with the failover guard
+    Given a controller monitor "vxflex"
+    And the failover limits are 1 nodes 0 percent
+    And the failover guard has admitted node "node2"
+    And a cleanup ledger in namespace "podmon"
+    And a pod for node "node1" with 2 volumes condition ""
+    And a cleanup ledger entry for the pod at step "Fenced"
+    When I call ResumeCleanups
+    Then the cleanup ledger has 1 entries
+    And the pod is present "true"
+    And the node "node1" is tainted "false"
+
   @controller-mode
   Scenario Outline: Test controllerCleanupPodWithRWX
     Given a controller monitor <driver>
@@ -145,21 +223,263 @@ Feature: Controller Monitor
     When I call controllerModePodHandler with event "Updated"
     And I call ArrayConnectivityMonitor
     Then the pod is cleaned <cleaned>
+    And <groups> events with reason "AffinityGroupCleanup" are sent
     And the last log message contains <errormsg>
 
     Examples:
-      | podnode | nvol | condition | affin   | error              | cleaned | errormsg                      |
-      | "node1" | 2    | "Ready"   | "true"  | "NodeNotConnected" | "true"  | "none"                        |
-      | "node1" | 2    | "Ready"   | "false" | "NodeConnected"    | "false" | "Connected: true"              |
-      | "node1" | 2    | "Ready"   | "false" | "NodeNotConnected" | "true"  | "Successfully cleaned up pod" |
-      | "node1" | 2    | "Ready"   | "false" | "CreateEvent"      | "true"  | "Successfully cleaned up pod" |
+      | podnode | nvol | condition | affin   | error              | cleaned | groups | errormsg                            |
+      | "node1" | 2    | "Ready"   | "true"  | "NodeNotConnected" | "true"  | 1      | "End Processing pods with affinity" |
+      | "node1" | 2    | "Ready"   | "false" | "NodeConnected"    | "false" | 0      | "Connected: true"                   |
+      | "node1" | 2    | "Ready"   | "false" | "NodeNotConnected" | "true"  | 0      | "Successfully cleaned up pod"       |
+      | "node1" | 2    | "Ready"   | "false" | "CreateEvent"      | "true"  | 0      | "Successfully cleaned up pod"       |
+
+  @controller-mode
+  Scenario Outline: test pod annotations overriding the resiliency behavior
+    Given a controller monitor "vxflex"
+    And a pod for node <podnode> with 2 volumes condition <condition> affinity "false"
+    And the pod has annotation <annotation> <value>
+    And a node <podnode> with taint <nodetaint>
+    And I send a node event type "Modify"
+    And I induce error <error>
+    When I call controllerModePodHandler with event "Updated"
+    Then the pod is cleaned <cleaned>
+    And the last log message contains <errormsg>
+
+    Examples:
+      | podnode | condition   | annotation                                         | value  | nodetaint | error          | cleaned | errormsg                                        |
+      | "node1" | "CrashLoop" | "podmon.dellemc.com/skip-crashloopbackoff-cleanup" | "true" | "none"    | "none"         | "false" | "not cleaning up CrashLoopBackOff pod"          |
+      | "node1" | "CrashLoop" | "podmon.dellemc.com/skip-crashloopbackoff-cleanup" | "no"   | "none"    | "none"         | "false" | "cleaning up CrashLoopBackOff pod"              |
+      | "node1" | "NotReady"  | "none"                                             | ""     | "noexec"  | "IOInProgress" | "false" | "array still connected and/or recently did I/O" |
+      | "node1" | "NotReady"  | "podmon.dellemc.com/ignore-ios-in-progress"        | "true" | "noexec"  | "IOInProgress" | "true"  | "Successfully cleaned up pod"                   |
+      | "node1" | "NotReady"  | "podmon.dellemc.com/force-delete-grace-period"     | "10ms" | "noexec"  | "none"         | "true"  | "Successfully cleaned up pod"                   |
+      | "node1" | "NotReady"  | "podmon.dellemc.com/force-delete-grace-period"     | "soon" | "noexec"  | "none"         | "true"  | "Successfully cleaned up pod"                   |
+      | "node1" | "NotReady"  | "podmon.dellemc.com/force-delete-grace-period"     | "1h"   | "noexec"  | "none"         | "true"  | "Successfully cleaned up pod"                   |
+
+  @controller-mode
+  Scenario Outline: test controllerModePodHandler CrashLoopBackOff limits and storage error filter
+    Given a controller monitor "vxflex"
+    And the CrashLoopBackOff limits are <retries> retries backoff <backoff> window <window> storage errors only <storage>
+    And a pod for node "node1" with 2 volumes condition <condition> affinity "false"
+    And the pod has a <type> event with reason <event>
+    And the pod was deleted for CrashLoopBackOff <deleted> times <ago> seconds ago
+    And a node "node1" with taint "none"
+    And I induce error <error>
+    When I call controllerModePodHandler with event "Updated"
+    Then the pod has <deletions> CrashLoopBackOff deletions
+    And <events> events with reason "CrashLoopBackOff" are sent
+    And the last log message contains <errormsg>
+
+    Examples:
+      | retries | backoff | window | storage | condition           | type      | event         | deleted | ago | error          | deletions | events | errormsg                               |
+      | 5       | 0       | 0      | "true"  | "CrashLoop"         | "Warning" | "none"        | 0       | 0   | "none"         | 1         | 1      | "cleaning up CrashLoopBackOff pod"     |
+      | 5       | 0       | 0      | "true"  | "CrashLoopAppError" | "Warning" | "none"        | 0       | 0   | "none"         | 0         | 0      | "because no storage errors were found" |
+      | 5       | 0       | 0      | "true"  | "CrashLoopAppError" | "Warning" | "FailedMount" | 0       | 0   | "none"         | 1         | 1      | "cleaning up CrashLoopBackOff pod"     |
+      | 5       | 0       | 0      | "true"  | "CrashLoopAppError" | "Normal"  | "FailedMount" | 0       | 0   | "none"         | 0         | 0      | "because no storage errors were found" |
+      | 5       | 0       | 0      | "true"  | "CrashLoopAppError" | "Warning" | "BackOff"     | 0       | 0   | "none"         | 0         | 0      | "because no storage errors were found" |
+      | 5       | 0       | 0      | "true"  | "CrashLoopAppError" | "Warning" | "FailedMount" | 0       | 0   | "GetPodEvents" | 0         | 0      | "because no storage errors were found" |
+      | 5       | 0       | 0      | "false" | "CrashLoopAppError" | "Warning" | "none"        | 0       | 0   | "none"         | 1         | 1      | "cleaning up CrashLoopBackOff pod"     |
+      | 5       | 0       | 0      | "true"  | "CrashLoop"         | "Warning" | "none"        | 5       | 600 | "none"         | 5         | 0      | "deleted 5 times, the limit is 5"      |
+      | 3       | 0       | 0      | "true"  | "CrashLoop"         | "Warning" | "none"        | 3       | 600 | "none"         | 3         | 0      | "deleted 3 times, the limit is 3"      |
+      | 5       | 0       | 300    | "true"  | "CrashLoop"         | "Warning" | "none"        | 5       | 600 | "none"         | 1         | 1      | "cleaning up CrashLoopBackOff pod"     |
+      | 5       | 0       | 900    | "true"  | "CrashLoop"         | "Warning" | "none"        | 5       | 600 | "none"         | 5         | 0      | "deleted 5 times, the limit is 5"      |
+      | 5       | 60      | 0      | "true"  | "CrashLoop"         | "Warning" | "none"        | 1       | 30  | "none"         | 1         | 0      | "backing off until"                    |
+      | 5       | 60      | 0      | "true"  | "CrashLoop"         | "Warning" | "none"        | 1       | 90  | "none"         | 2         | 1      | "cleaning up CrashLoopBackOff pod"     |
+      | 5       | 60      | 0      | "true"  | "CrashLoop"         | "Warning" | "none"        | 2       | 90  | "none"         | 2         | 0      | "backing off until"                    |
+
+  @controller-mode
+  Scenario Outline: test ArrayConnectivityMonitor with a pod opted out of array connectivity cleanup
+    Given a controller monitor "vxflex"
+    And a pod for node <podnode> with 2 volumes condition "Ready" affinity "false"
+    And the pod has annotation "podmon.dellemc.com/skip-array-connectivity-cleanup" <value>
+    And I induce error "NodeNotConnected"
+    And a node <podnode> with taint "none"
+    And I send a node event type "Modify"
+    When I call controllerModePodHandler with event "Updated"
+    And I call ArrayConnectivityMonitor
+    Then the pod is cleaned <cleaned>
+    And the node <podnode> has the podmon taint <tainted>
+    And the last log message contains <errormsg>
+
+    Examples:
+      | podnode | value   | cleaned | tainted | errormsg                               |
+      | "node1" | "true"  | "false" | "false" | "not cleaned up because of annotation" |
+      | "node1" | "false" | "true"  | "true"  | "Successfully cleaned up pod"          |
+
+  @controller-mode
+  Scenario Outline: test dry-run mode reports the cleanup instead of performing it
+    Given a controller monitor "vxflex"
+    And dry-run mode is "true"
+    And a cleanup ledger in namespace "podmon"
+    And a pod for node <podnode> with <nvol> volumes condition <condition> affinity "false"
+    And a node <podnode> with taint <nodetaint>
+    And I send a node event type "Modify"
+    When I call controllerModePodHandler with event "Updated"
+    Then the pod is cleaned "false"
+    And the pod is present "true"
+    And the cleanup ledger has 0 entries
+    And the last log message contains <errormsg>
+
+    Examples:
+      | podnode | nvol | condition   | nodetaint | errormsg                          |
+      | "node1" | 2    | "NotReady"  | "noexec"  | "Dry-run: would force delete pod" |
+      | "node1" | 2    | "NotReady"  | "nosched" | "Dry-run: would force delete pod" |
+      | "node1" | 2    | "CrashLoop" | "none"    | "Dry-run: would delete pod"       |
+
+  @controller-mode
+  Scenario Outline: test the failover guard pauses cleanup when the failover limits are exceeded
+    Given a controller monitor "vxflex"
+    And the failover limits are <maxnodes> nodes <maxpercent> percent
+    And the failover guard has admitted node "node2"
+    And a pod for node "node1" with 2 volumes condition "NotReady" affinity "false"
+    And a node "node1" with taint "noexec"
+    And I send a node event type "Modify"
+    When I call controllerModePodHandler with event "Updated"
+    Then the pod is cleaned <cleaned>
+    And the last log message contains <errormsg>
+
+    Examples:
+      | maxnodes | maxpercent | cleaned | errormsg                      |
+      | 0        | 0          | "true"  | "Successfully cleaned up pod" |
+      | 2        | 0          | "true"  | "Successfully cleaned up pod" |
+      | 1        | 0          | "false" | "Failover limit exceeded"     |
+      | 0        | 50         | "false" | "Failover limit exceeded"     |
+
+  @controller-mode
+  Scenario Outline: test ArrayConnectivityMonitor with the failover guard
+    Given a controller monitor "vxflex"
+    And the failover limits are 1 nodes 0 percent
+    And the failover guard has admitted node "node2"
+    And pods for node <podnode> on arrays <arrays> condition "Ready"
+    And a node <podnode> with taint "none"
+    And array <lostarray> has lost connectivity
+    When I call ArrayConnectivityMonitor
+    Then the pods on array <lostarray> are cleaned "false"
+    And the node <podnode> has the podmon taint "false"
+
+    Examples:
+      | podnode | arrays          | lostarray |
+      | "node1" | "array1,array2" | "array1"  |
+
+  @controller-mode
+  Scenario Outline: test ArrayConnectivityMonitor in dry-run mode
+    Given a controller monitor "vxflex"
+    And dry-run mode is "true"
+    And pods for node <podnode> on arrays <arrays> condition "Ready"
+    And a node <podnode> with taint "none"
+    And array <lostarray> has lost connectivity
+    When I call ArrayConnectivityMonitor
+    Then the pods on array <lostarray> are cleaned "false"
+    And the node <podnode> has the podmon taint "false"
+
+    Examples:
+      | podnode | arrays          | lostarray |
+      | "node1" | "array1,array2" | "array1"  |
+
+  @controller-mode
+  Scenario Outline: test ArrayConnectivityMonitor with multiple arrays
+    Given a controller monitor "vxflex"
+    And pods for node <podnode> on arrays <arrays> condition "Ready"
+    And a node <podnode> with taint "none"
+    And the pods have arrayIDs <arrays>
+    And array <lostarray> has lost connectivity
+    When I call ArrayConnectivityMonitor
+    Then the pods on array <lostarray> are cleaned "true"
+    And the pods on array <okarray> are cleaned "false"
+
+    Examples:
+      | podnode | arrays            | lostarray | okarray  |
+      | "node1" | "array1,array2"   | "array1"  | "array2" |
+      | "node1" | "array1,array2"   | "array2"  | "array1" |
+      | "node1" | "array1"          | "array2"  | "array1" |
+
+  @controller-mode
+  Scenario Outline: test ArrayConnectivityMonitor publishing the array connectivity on the node
+    Given a controller monitor "vxflex"
+    And publishing the array connectivity is <publish>
+    And pods for node <podnode> on arrays <arrays> condition "Ready"
+    And a node <podnode> with taint "none"
+    And array <lostarray> has lost connectivity
+    And I induce error <error>
+    When I call ArrayConnectivityMonitor
+    Then the node <podnode> has array connectivity condition <status> reason <reason>
+    And the node <podnode> has connected arrays <connected>
+
+    Examples:
+      | podnode | arrays          | lostarray | publish | error              | status  | reason                  | connected       |
+      | "node1" | "array1,array2" | "array1"  | "true"  | "none"             | "False" | "ArrayConnectivityLost" | "array2"        |
+      | "node1" | "array1,array2" | "array3"  | "true"  | "none"             | "True"  | "ArrayConnected"        | "array1,array2" |
+      | "node1" | "array1"        | "array1"  | "true"  | "none"             | "False" | "ArrayConnectivityLost" | ""              |
+      | "node1" | "array1,array2" | "array1"  | "true"  | "SetNodeCondition" | "none"  | "none"                  | "array2"        |
+      | "node1" | "array1,array2" | "array1"  | "true"  | "AnnotateNode"     | "False" | "ArrayConnectivityLost" | "none"          |
+      | "node1" | "array1,array2" | "array1"  | "false" | "none"             | "none"  | "none"                  | "none"          |
 
   @controller-mode
-  Scenario Outline: test PodAffinityLabels
+  Scenario Outline: test ArrayConnectivityMonitor with an array outage
+    Given a controller monitor "vxflex"
+    And the array outage nodes percent is <percent>
+    And pods for node "node1" on arrays "array1,array2" condition "Ready"
+    And pods for node "node2" on arrays "array1" condition "Ready"
+    And a node "node1" with taint "none"
+    And a node "node2" with taint "none"
+    And array <lostarray> has lost connectivity
+    When I call ArrayConnectivityMonitor
+    Then the node "node1" has the podmon taint <node1tainted>
+    And the node "node2" has the podmon taint <node2tainted>
+    And <outages> events with reason "ArrayOutage" are sent
+
+    Examples:
+      | percent | lostarray | node1tainted | node2tainted | outages |
+      | 50      | "array1"  | "false"      | "false"      | 1       |
+      | 0       | "array1"  | "true"       | "true"       | 0       |
+      | 100     | "array1"  | "true"       | "true"       | 0       |
+      | 50      | "array2"  | "true"       | "false"      | 0       |
+      | 50      | "array3"  | "false"      | "false"      | 0       |
+
+  @controller-mode
+  Scenario: test ArrayConnectivityMonitor resuming failover after an array outage
+    Given a controller monitor "vxflex"
+    And the array outage nodes percent is 50
+    And pods for node "node1" on arrays "array1" condition "Ready"
+    And pods for node "node2" on arrays "array1" condition "Ready"
+    And a node "node1" with taint "none"
+    And a node "node2" with taint "none"
+    And array "array1" has lost connectivity
+    When I call ArrayConnectivityMonitor
+    Then 1 events with reason "ArrayOutage" are sent
+    And array "array1" has an outage "true"
+    And array "array2" has lost connectivity
+    When I call ArrayConnectivityMonitor
+    Then 1 events with reason "ArrayOutageRecovered" are sent
+    And array "array1" has an outage "false"
+    And the node "node1" has the podmon taint "false"
+    And the node "node2" has the podmon taint "false"
+
+  @controller-mode
+  Scenario Outline: test ArrayConnectivityMonitor with the node's array connectivity report
+    Given a controller monitor "vxflex"
+    And the node connectivity report interval is <interval> seconds
+    And pods for node <podnode> on arrays <arrays> condition "Ready"
+    And a node <podnode> with taint "none"
+    And node <podnode> reported array <lostarray> connected <reported> <age> seconds ago
+    And array <lostarray> has lost connectivity
+    When I call ArrayConnectivityMonitor
+    Then the pods on array <lostarray> are cleaned <cleaned>
+    And the node <podnode> has the podmon taint <cleaned>
+
+    Examples:
+      | podnode | arrays          | lostarray | interval | reported | age | cleaned |
+      | "node1" | "array1,array2" | "array1"  | 30       | "true"   | 10  | "false" |
+      | "node1" | "array1,array2" | "array1"  | 30       | "false"  | 10  | "true"  |
+      | "node1" | "array1,array2" | "array1"  | 30       | "true"   | 120 | "true"  |
+      | "node1" | "array1,array2" | "array1"  | 30       | "none"   | 0   | "true"  |
+      | "node1" | "array1,array2" | "array1"  | 0        | "true"   | 10  | "true"  |
+
+  @controller-mode
+  Scenario Outline: test PodAffinityTerms
     Given a controller pod with podaffinitylabels
     And create a pod for node <podnode> with <nvol> volumes condition <condition> affinity <affin> errorcase <errorcase>
     And I induce error <error>
-    When I call getPodAffinityLabels
+    When I call getPodAffinityTerms
     Then the pod is cleaned <cleaned>
 
   Examples:
@@ -201,3 +521,263 @@ Feature: Controller Monitor
       | podnode | nvol | condition | affin   | error              | cleaned | errormsg                      |
       | "node1" | 0    | "Ready"   | "true"  | "NodeNotConnected" | "false" | "none"                        |
       | "node1" | 0    | "Ready"   | "false" | "NodeConnected"    | "false" | "Connected true"              |
+
+  @controller-mode
+  Scenario Outline: test the recovery reconciler untaints a node only once it has recovered
+    Given a controller monitor "vxflex"
+    And a tainted node "node1" stable for <stable> seconds
+    And the driver node pod on "node1" is ready <ready>
+    And a cleaned up pod on "node1" with stale VolumeAttachment <staleva>
+    And I induce error "NodeConnected"
+    And I induce error <error>
+    When I call reconcileNodeRecovery
+    And I call reconcileNodeRecovery
+    Then the node "node1" has the podmon taint <tainted>
+    And <events> events with reason <reason> are sent
+    And the last log message contains <errormsg>
+
+    Examples:
+      | stable | ready   | staleva | error                            | tainted | events | reason                | errormsg                                  |
+      | 120    | "true"  | "false" | "none"                           | "false" | 1      | "NodeRecovered"       | "Removed taint from recovered node"       |
+      | 30     | "true"  | "false" | "none"                           | "true"  | 1      | "NodeRecoveryPending" | "node UID and bootID have been stable"    |
+      | 120    | "true"  | "false" | "NodeNotConnected"               | "true"  | 1      | "NodeRecoveryPending" | "reports the node is not connected"       |
+      | 120    | "true"  | "false" | "ValidateVolumeHostConnectivity" | "true"  | 1      | "NodeRecoveryPending" | "couldn't validate connectivity to array" |
+      | 120    | "true"  | "true"  | "none"                           | "true"  | 1      | "NodeRecoveryPending" | "VolumeAttachment va-cleaned for cleaned" |
+      | 120    | "false" | "false" | "none"                           | "true"  | 1      | "NodeRecoveryPending" | "driver node pod is not Ready"            |
+      | 120    | "true"  | "false" | "K8sTaint"                       | "true"  | 0      | "NodeRecovered"       | "failed to remove taint"                  |
+
+  @controller-mode
+  Scenario: test the recovery reconciler checks every array of the cleaned up volumes
+    Given a controller monitor "vxflex"
+    And a tainted node "node1" stable for 120 seconds
+    And the driver node pod on "node1" is ready "true"
+    And a cleaned up pod on "node1" with a volume on array "array2"
+    And array "array2" has lost connectivity
+    When I call reconcileNodeRecovery
+    Then the node "node1" has the podmon taint "true"
+    And 1 events with reason "NodeRecoveryPending" are sent
+    And the last log message contains "not connected to array array2"
+
+  @controller-mode
+  Scenario: test the recovery reconciler restarts the stable period when the node reboots
+    Given a controller monitor "vxflex"
+    And a tainted node "node1" stable for 120 seconds
+    And the driver node pod on "node1" is ready "true"
+    And the node "node1" reboots with bootID "boot-2"
+    When I call reconcileNodeRecovery
+    Then the node "node1" has the podmon taint "true"
+    And the last log message contains "node UID and bootID have been stable for 0s"
+
+  @controller-mode
+  Scenario Outline: test multiAttachHandler deleting the stale VolumeAttachment on the old node
+    Given a controller monitor "vxflex"
+    And a pod for node "node2" with 1 volumes condition "NotReady" affinity "false"
+    And the pod's volumes are still attached to node "node1"
+    And dry-run mode is <dryrun>
+    And I induce error <error>
+    When I call multiAttachHandler for the pod with message <message> and selector <selector>
+    Then the stale VolumeAttachments are deleted <deleted>
+    And <events> events with reason "MultiAttachRepaired" are sent
+    And the last log message contains <errormsg>
+
+    Examples:
+      | message                | selector                                 | dryrun  | error                       | deleted | events | errormsg                                                      |
+      | "MultiAttach"          | ""                                       | "false" | "none"                      | "true"  | 1      | "Deleted stale VolumeAttachment to repair Multi-Attach error" |
+      | "MultiAttach"          | ""                                       | "false" | "CreateEvent"               | "true"  | 0      | "Failed to send MultiAttachRepaired event"                    |
+      | "MultiAttach"          | ""                                       | "true"  | "none"                      | "false" | 0      | "Dry-run: would delete VolumeAttachment"                      |
+      | "MultiAttach"          | ""                                       | "false" | "NodeConnected"             | "false" | 0      | "old node is not confirmed fenced"                            |
+      | "MultiAttach"          | ""                                       | "false" | "IOInProgress"              | "false" | 0      | "old node is not confirmed fenced"                            |
+      | "MultiAttach"          | ""                                       | "false" | "CSIExtensionsNotPresent"   | "false" | 0      | "cannot be confirmed without the CSI extensions"              |
+      | "MultiAttach"          | ""                                       | "false" | "DeleteVolumeAttachment"    | "false" | 0      | "Couldn't delete stale VolumeAttachment"                      |
+      | "MultiAttach"          | ""                                       | "false" | "ControllerUnpublishVolume" | "false" | 0      | "Not deleting stale VolumeAttachment as fencing failed"       |
+      | "MultiAttach"          | ""                                       | "false" | "GetPodsOnNode"             | "false" | 0      | "GetPodsOnNode failed"                                        |
+      | "MultiAttach"          | ""                                       | "false" | "GetPod"                    | "false" | 0      | "Multi-Attach error GetPod failed"                            |
+      | "MultiAttach"          | ""                                       | "false" | "GetVolumeAttachments"      | "false" | 0      | "Couldn't get VolumeAttachments of the volume"                |
+      | "MultiAttach"          | ""                                       | "false" | "GetPersistentVolume"       | "false" | 0      | "the CSI volume could not be determined"                      |
+      | "MultiAttach"          | "podmon.dellemc.com/driver=csi-vxflexos" | "false" | "none"                      | "false" | 0      | "none"                                                        |
+      | "MultiAttachNoVolume"  | ""                                       | "false" | "none"                      | "false" | 0      | "Couldn't determine the volume of Multi-Attach error"         |
+      | "AttachVolume timeout" | ""                                       | "false" | "none"                      | "false" | 0      | "none"                                                        |
+
+  @controller-mode
+  Scenario: test multiAttachHandler not deleting the VolumeAttachment of a volume still used on the old node
+    Given a controller monitor "vxflex"
+    And a pod for node "node2" with 1 volumes condition "NotReady" affinity "false"
+    And the pod's volumes are still attached to node "node1"
+    And a pod on node "node1" still uses the pod's volumes
+    When I call multiAttachHandler for the pod with message "MultiAttach" and selector ""
+    Then the stale VolumeAttachments are deleted "false"
+    And 0 events with reason "MultiAttachRepaired" are sent
+    And the last log message contains "on the old node still uses the volume"
+
+  @controller-mode
+  Scenario Outline: test reconcileOrphanedVAs fencing and deleting or reporting orphaned VolumeAttachments
+    Given a controller monitor "vxflex"
+    And a VolumeAttachment "va-orphan" on node "node1" for driver "csi-vxflexos.dellemc.com"
+    And the node "node1" state is <state>
+    And the orphaned VolumeAttachment mode is <mode>
+    And dry-run mode is <dryrun>
+    And I induce error <error>
+    When I call reconcileOrphanedVAs 1 times
+    Then the VolumeAttachment "va-orphan" is deleted <deleted>
+    And <events> events with reason "OrphanedVolumeAttachmentDeleted" are sent
+    And the last log message contains <errormsg>
+
+    Examples:
+      | state              | mode       | dryrun  | error                       | deleted | events | errormsg                                                                        |
+      | "gone"             | "delete"   | "false" | "none"                      | "false" | 0      | "Found orphaned VolumeAttachment: node is gone, not deleting it"                |
+      | "gone"             | "report"   | "false" | "none"                      | "false" | 0      | "Found orphaned VolumeAttachment: node is gone, not deleting it"                |
+      | "tainted"          | "delete"   | "false" | "none"                      | "true"  | 1      | "Deleted orphaned VolumeAttachment: node has the podmon taint"                  |
+      | "NotReady"         | "delete"   | "false" | "none"                      | "true"  | 1      | "Deleted orphaned VolumeAttachment: node has been NotReady for more than 10m0s" |
+      | "RecentlyNotReady" | "delete"   | "false" | "none"                      | "false" | 0      | "none"                                                                          |
+      | "Ready"            | "delete"   | "false" | "none"                      | "false" | 0      | "none"                                                                          |
+      | "tainted"          | "report"   | "false" | "none"                      | "false" | 0      | "Found orphaned VolumeAttachment: node has the podmon taint"                    |
+      | "tainted"          | "disabled" | "false" | "none"                      | "false" | 0      | "none"                                                                          |
+      | "tainted"          | "delete"   | "true"  | "none"                      | "false" | 0      | "Dry-run: would delete VolumeAttachment"                                        |
+      | "tainted"          | "delete"   | "false" | "ControllerUnpublishVolume" | "false" | 0      | "Not deleting orphaned VolumeAttachment as fencing failed"                      |
+      | "gone"             | "delete"   | "true"  | "none"                      | "false" | 0      | "Found orphaned VolumeAttachment: node is gone, not deleting it"                |
+      | "tainted"          | "delete"   | "false" | "DeleteVolumeAttachment"    | "false" | 0      | "Couldn't delete orphaned VolumeAttachment"                                     |
+      | "tainted"          | "delete"   | "false" | "CreateEvent"               | "true"  | 0      | "Failed to send OrphanedVolumeAttachmentDeleted event"                          |
+      | "tainted"          | "delete"   | "false" | "GetVolumeAttachments"      | "false" | 0      | "couldn't list VolumeAttachments"                                               |
+      | "tainted"          | "delete"   | "false" | "GetNode"                   | "false" | 0      | "couldn't check node node1"                                                     |
+      | "tainted"          | "delete"   | "false" | "GetPodsOnNode"             | "false" | 0      | "couldn't check node node1"                                                     |
+      | "tainted"          | "delete"   | "false" | "GetPersistentVolume"       | "false" | 0      | "couldn't get PV pv-va-orphan"                                                  |
+
+  @controller-mode
+  Scenario Outline: test reconcileOrphanedVAs skipping VolumeAttachments in use or of other drivers
+    Given a controller monitor "vxflex"
+    And a VolumeAttachment "va-orphan" on node "node1" for driver <driver>
+    And a pod on node "node1" using the volume of VolumeAttachment "va-orphan" phase <phase>
+    And the node "node1" state is <state>
+    When I call reconcileOrphanedVAs 1 times
+    Then the VolumeAttachment "va-orphan" is deleted <deleted>
+    And the last log message contains <errormsg>
+
+    Examples:
+      | driver                     | phase       | state    | deleted | errormsg                                             |
+      | "csi-vxflexos.dellemc.com" | "Running"   | "tainted" | "false" | "pod podns/pod-va-orphan still uses the volume" |
+      | "csi-vxflexos.dellemc.com" | "Succeeded" | "tainted" | "true"  | "Deleted orphaned VolumeAttachment"                  |
+      | "csi-vxflexos.dellemc.com" | "Running"   | "gone"    | "false" | "pod podns/pod-va-orphan still uses the volume" |
+      | "csi-isilon.dellemc.com"   | "Succeeded" | "tainted" | "false" | "none"                                               |
+
+  @controller-mode
+  Scenario: test reconcileOrphanedVAs reports each orphaned VolumeAttachment once
+    Given a controller monitor "vxflex"
+    And a VolumeAttachment "va-orphan" on node "node1" for driver "csi-vxflexos.dellemc.com"
+    And the node "node1" state is "tainted"
+    And the orphaned VolumeAttachment mode is "report"
+    When I call reconcileOrphanedVAs 3 times
+    Then the VolumeAttachment "va-orphan" is deleted "false"
+    And 1 events with reason "OrphanedVolumeAttachment" are sent
+
+  @controller-mode
+  Scenario: test OrphanedVolumeAttachmentReconciler
+    Given a controller monitor "vxflex"
+    And a VolumeAttachment "va-orphan" on node "node1" for driver "csi-vxflexos.dellemc.com"
+    And the node "node1" state is "tainted"
+    When I call OrphanedVolumeAttachmentReconciler
+    Then the VolumeAttachment "va-orphan" is deleted "true"
+
+  @controller-mode
+  Scenario Outline: test controllerModeDriverPodHandler grace period and flap detection
+    Given a controller monitor "vxflex"
+    And the driver pod limits are grace <grace> escalation 0 flaps <flaps> window 600
+    And the driver node pod on "node1" went down <downs> times and is <state> for <seconds> seconds
+    And a driver pod for node "node1" with condition <condition>
+    And I taint the node "node1" with <taint>
+    When I call controllerModeDriverPodHandler with event "Updated"
+    Then the node "node1" has the driver pod taint <tainted>
+    And <events> events with reason "DriverNodePodFlapping" are sent
+    And the last log message contains <errormsg>
+
+    Examples:
+      | grace | flaps | downs | state      | seconds | condition  | taint   | tainted | events | errormsg                                              |
+      | 60    | 0     | 1     | "NotReady" | 10      | "NotReady" | "false" | "false" | 0      | "has not been Ready for 10s of the 1m0s grace period" |
+      | 60    | 0     | 1     | "NotReady" | 120     | "NotReady" | "false" | "true"  | 0      | "Calling to tainting  node1"                          |
+      | 60    | 3     | 3     | "NotReady" | 10      | "NotReady" | "false" | "true"  | 1      | "Calling to tainting  node1"                          |
+      | 0     | 3     | 3     | "Ready"    | 60      | "Ready"    | "true"  | "true"  | 1      | "is flapping, it was not Ready 3 times within 10m0s"  |
+      | 0     | 3     | 3     | "Ready"    | 900     | "Ready"    | "true"  | "false" | 0      | "Calling to untainting  node1"                        |
+      | 0     | 0     | 1     | "Ready"    | 5       | "Ready"    | "true"  | "false" | 0      | "Calling to untainting  node1"                        |
+
+  @controller-mode
+  Scenario Outline: test reconcileDriverPods escalating to the cleanup of the protected pods
+    Given a controller monitor "vxflex"
+    And pods for node "node1" on arrays "array1" condition "Ready"
+    And a node "node1" with taint "none"
+    And the driver pod limits are grace 0 escalation 300 flaps 0 window 600
+    And the driver node pod on "node1" went down 1 times and is "NotReady" for <seconds> seconds
+    And dry-run mode is <dryrun>
+    When I call reconcileDriverPods 2 times
+    Then the pods on array "array1" are cleaned <cleaned>
+    And the node "node1" has the podmon taint <podmontaint>
+    And the node "node1" has the driver pod taint <drivertaint>
+    And <events> events with reason "DriverNodePodDown" are sent
+
+    Examples:
+      | seconds | dryrun  | cleaned | podmontaint | drivertaint | events |
+      | 600     | "false" | "true"  | "true"      | "true"      | 2      |
+      | 60      | "false" | "false" | "false"     | "true"      | 0      |
+      | 600     | "true"  | "false" | "false"     | "false"     | 1      |
+
+  @controller-mode
+  Scenario: test reconcileDriverPods flap detection in dry-run mode
+    Given a controller monitor "vxflex"
+    And dry-run mode is "true"
+    And a node "node1" with taint "none"
+    And the driver pod limits are grace 0 escalation 0 flaps 3 window 600
+    And the driver node pod on "node1" went down 3 times and is "NotReady" for 10 seconds
+    When I call reconcileDriverPods 2 times
+    Then the node "node1" has the driver pod taint "false"
+    And 1 events with reason "DriverNodePodFlapping" are sent
+    And 1 events with reason "DryRun" are sent
+    And the driver pod limits are grace 0 escalation 0 flaps 3 window 5
+    And the driver node pod on "node1" went down 0 times and is "Ready" for 0 seconds
+    And I call reconcileDriverPods 2 times
+    And the node "node1" has the driver pod taint "false"
+    And 2 events with reason "DryRun" are sent
+    And the last log message contains "Dry-run: would remove taint from node node1"
+
+  @controller-mode
+  Scenario: test reconcileDriverPods with the failover guard
+    Given a controller monitor "vxflex"
+    And the failover limits are 1 nodes 0 percent
+    And the failover guard has admitted node "node2"
+    And pods for node "node1" on arrays "array1" condition "Ready"
+    And a node "node1" with taint "none"
+    And the driver pod limits are grace 0 escalation 300 flaps 0 window 600
+    And the driver node pod on "node1" went down 1 times and is "NotReady" for 600 seconds
+    When I call reconcileDriverPods 1 times
+    Then the pods on array "array1" are cleaned "false"
+    And the node "node1" has the podmon taint "false"
+    And 0 events with reason "DriverNodePodDown" are sent
+
+  @controller-mode
+  Scenario: test reconcileDriverPods retrying the escalation the failover guard denied
+    Given a controller monitor "vxflex"
+    And the failover limits are 1 nodes 0 percent
+    And the failover guard has admitted node "node2"
+    And pods for node "node1" on arrays "array1" condition "Ready"
+    And a node "node1" with taint "none"
+    And the driver pod limits are grace 0 escalation 300 flaps 0 window 600
+    And the driver node pod on "node1" went down 1 times and is "NotReady" for 600 seconds
+    When I call reconcileDriverPods 1 times
+    Then the pods on array "array1" are cleaned "false"
+    And the failover guard window has passed
+    When I call reconcileDriverPods 1 times
+    Then the pods on array "array1" are cleaned "true"
+    And the node "node1" has the podmon taint "true"
+
+  @controller-mode
+  Scenario Outline: test DriverPodReconciler
+    Given a controller monitor "vxflex"
+    And the driver pod limits are grace 60 escalation 0 flaps 0 window 600
+    And the driver node pod on "node1" went down 1 times and is "NotReady" for 120 seconds
+    And I induce error <error>
+    When I call DriverPodReconciler
+    Then the node "node1" has the driver pod taint <tainted>
+    And the driver node pod on "node1" is tracked <tracked>
+
+    Examples:
+      | error             | tainted | tracked |
+      | "none"            | "true"  | "true"  |
+      | "GetNode"         | "false" | "true"  |
+      | "GetNodeNotFound" | "false" | "false" |
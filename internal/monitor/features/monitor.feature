@@ -27,8 +27,6 @@ Feature: Monitor generic code
       | "node1" | 0    | "GetPod"         | "standalone" | "Add"     | "GetPod error"                 |
       | "node1" | 0    | "none"           | "none"       | "Modify"  | "PodMonitor.Mode not set"      |
       | "node1" | 0    | "none"           | "none"       | "Delete"  | "PodMonitor.Mode not set"      |
-      | "node1" | 0    | "none"           | "none"       | "Stop"    | "PodWatcher stopped..."        |
-      | "node1" | 0    | "none"           | "none"       | "Error"   | "Setup of PodWatcher complete" |
 
   @monitor
   Scenario Outline: Test StartNodeMonitorHandler
@@ -48,15 +46,26 @@ Feature: Monitor generic code
       | "node1" | 0    | "BadWatchObject" | "Add"     | "nodeMonitorHandler nil node"   |
       | "node1" | 0    | "none"           | "Modify"  | "node name: node1"              |
       | "node1" | 0    | "none"           | "Delete"  | "node name: node1"              |
-      | "node1" | 0    | "none"           | "Stop"    | "NodeWatcher stopped..."        |
-      | "node1" | 0    | "none"           | "Error"   | "Setup of NodeWatcher complete" |
 
   @monitor
-  Scenario Outline: Test Lock/Unlock and getPodKey
+  Scenario Outline: Test StartMultiAttachMonitor
+    Given a controller monitor "vxflex"
+    And I induce error <error>
+    When I call StartMultiAttachMonitor
+    Then I close the Watcher
+    And the last log message contains <errormsg>
+
+    Examples:
+      | error   | errormsg                               |
+      | "Watch" | "none"                                 |
+      | "none"  | "Setup of MultiAttachWatcher complete" |
+
+  @monitor
+  Scenario Outline: Test getPodKey
     Given a controller monitor "vxflex"
     And a pod for node <podnode> with <nvol> volumes condition ""
     And I send a node event type "Modify"
-    When I call test lock and getPodKey
+    When I call test getPodKey
    # The previous step will fail if there is an error
 
     Examples:
@@ -167,6 +167,39 @@ Feature: Controller Monitor
       | "node1"  | "podmon-nosched" | 3         | "GetNodeWithTimeout" | "6"          | "Cleanup of pods complete"          |
       | "node1"  | "podmon-noexec"  | 3         | "GetNodeWithTimeout" | "6"          | "API connectivity restored to node" |
 
+  @node-mode
+  Scenario Outline: Testing monitor.nodeModeCleanupPods removes the out-of-service taint
+    Given a controller monitor <driver>
+    And node <nodeName> env vars set
+    And a node <nodeName> with taint "out-of-service"
+    And I have a <pods> pods for node <nodeName> with <vols> volumes <devs> devices condition ""
+    And the controller cleaned up <cleaned> pods for node <nodeName>
+    And I induce error <taintErr>
+    When I call nodeModeCleanupPods for node <nodeName>
+    Then the node <nodeName> has the out-of-service taint <tainted>
+    And the last log message contains <errorMsg>
+
+    Examples:
+      | driver | nodeName | pods | vols | devs | cleaned | taintErr   | tainted | errorMsg                                           |
+      | vxflex | "node1"  | 1    | 1    | 1    | 1       | "none"     | "false" | "none"                                             |
+      | vxflex | "node1"  | 1    | 1    | 1    | 1       | "K8sTaint" | "true"  | "Failed to remove out-of-service taint against node1 node" |
+
+  @node-mode
+  Scenario Outline: Testing monitor.nodeModeCleanupPods in dry-run mode
+    Given a controller monitor <driver>
+    And node <nodeName> env vars set
+    And I have a <pods> pods for node <nodeName> with <vols> volumes <devs> devices condition ""
+    And the controller cleaned up <cleaned> pods for node <nodeName>
+    And dry-run mode is "true"
+    When I call nodeModeCleanupPods for node <nodeName>
+    Then the last log message contains <errorMsg>
+    And the node monitor has <pods> pods registered
+
+    Examples:
+      | driver | nodeName | pods | vols | devs | cleaned | errorMsg                                      |
+      | vxflex | "node1"  | 1    | 1    | 1    | 1       | "Dry-run: would remove taint from node"        |
+      | vxflex | "node1"  | 2    | 1    | 0    | 1       | "Dry-run: would unpublish and unstage volume" |
+
   @node-mode
   Scenario Outline: Testing monitor.nodeModeCleanupPods with privateMountDir
     Given a controller monitor <driver>
@@ -221,3 +254,24 @@ Feature: Controller Monitor
       | driver | nodeName | pods | vols | devs | cleaned | unMountErr | rmDirErr    | taintErr       | k8apiErr   | errorMsg    | phase        |
       | vxflex | "node1"  | 1    | 1    | 1    | 1       | "none"     | "none"      | "none"         | "none"     | "none"      | "running"    |
       | vxflex | "node1"  | 1    | 0    | 0    |0        | "none"     | "none"      | "none"         | "none"     | "none"      | "pending"    |
+
+  @node-mode
+  Scenario Outline: Testing the node's array connectivity report
+    Given a controller monitor "vxflex"
+    And node "node1" env vars set
+    And the node connectivity report interval is <interval> seconds
+    And a pod for node "node1" with 2 volumes condition ""
+    And I call nodeModePodHandler for node "node1" with event "ADDED"
+    And I induce error <error>
+    When I call NodeConnectivityReporter
+    Then node "node1" reports array "default" connected <connected>
+    And the last log message contains <errorMsg>
+
+    Examples:
+      | interval | error                            | connected | errorMsg                                                    |
+      | 30       | "NodeConnected"                  | "true"    | "Node node1 reported array connectivity map[default:true]"  |
+      | 30       | "NodeNotConnected"               | "false"   | "Node node1 reported array connectivity map[default:false]" |
+      | 30       | "ValidateVolumeHostConnectivity" | "none"    | "Node node1 reported array connectivity map[]"              |
+      | 30       | "AnnotateNode"                   | "none"    | "Couldn't publish the array connectivity report"            |
+      | 30       | "GetNodeWithTimeout"             | "none"    | "Couldn't get node node1 to report"                         |
+      | 0        | "NodeConnected"                  | "none"    | "none"                                                      |
@@ -0,0 +1,282 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// Most drivers only differ in the paths of their mounts and in the node errors to ignore, so a driver can be
+// described in a YAML file instead of being built into podmon. Each driver in the file is registered as a
+// GenericDriver for its CSI driver name, replacing any built in drivertype. The paths are text/template templates
+// with the fields of driverPathValues, and an env function returning an environment variable or a default, e.g.
+//
+//	drivers:
+//	  - driverPath: csi-example.dell.com
+//	    name: example
+//	    driverMountDir: '{{env "X_CSI_PRIVATE_MOUNT_DIR" "/var/lib/kubelet/plugins/example/disks"}}/{{.VolumeHandle}}'
+//	    driverBlockDev: /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/{{.PVName}}/{{.PodUID}}
+//	    stagingMountDirAfter125: /var/lib/kubelet/plugins/kubernetes.io/csi/csi-example.dell.com/{{.VolumeHandleSHA256}}/globalmount
+//	    arrayIDPattern: '^([^-]+)-'
+//	    nodeUnpublishExcludedErrors: ['NFS Share .* not found']
+
+// GenericDriverConfig describes a driver in the driver types file.
+type GenericDriverConfig struct {
+	DriverPath                  string   `json:"driverPath"`                  // CSI driver name the drivertype is registered for
+	Name                        string   `json:"name"`                        // driver name used for the podmon taint keys
+	DriverMountDir              string   `json:"driverMountDir"`              // template of the private mount directory of a volume
+	DriverBlockDev              string   `json:"driverBlockDev"`              // template of the block device used by a pod
+	StagingMountDir             string   `json:"stagingMountDir"`             // template of the staging directory of a mount device, optional
+	StagingMountDirAfter125     string   `json:"stagingMountDirAfter125"`     // template of the staging directory of a mount device since Kubernetes 1.25, optional
+	StagingBlockDir             string   `json:"stagingBlockDir"`             // template of the staging directory of a block device, optional
+	ArrayIDPattern              string   `json:"arrayIDPattern"`              // regular expression whose first group is the array ID in a volume handle
+	NodeUnpublishExcludedErrors []string `json:"nodeUnpublishExcludedErrors"` // regular expressions of the NodeUnpublish errors to ignore
+	NodeUnstageExcludedErrors   []string `json:"nodeUnstageExcludedErrors"`   // regular expressions of the NodeUnstage errors to ignore
+}
+
+// driverTypesFile is the format of the driver types file.
+type driverTypesFile struct {
+	Drivers []GenericDriverConfig `json:"drivers"`
+}
+
+// driverPathValues are the fields available to the path templates.
+type driverPathValues struct {
+	VolumeHandle       string
+	VolumeHandleSHA256 string
+	PVName             string
+	PodUID             string
+}
+
+// newDriverPathValues returns the template fields of the volume and pod.
+func newDriverPathValues(volumeHandle, pvName, podUID string) driverPathValues {
+	return driverPathValues{
+		VolumeHandle:       volumeHandle,
+		VolumeHandleSHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(volumeHandle))),
+		PVName:             pvName,
+		PodUID:             podUID,
+	}
+}
+
+// GenericDriver provides a Driver instance whose paths and excluded errors come from a GenericDriverConfig.
+type GenericDriver struct {
+	name                    string
+	driverMountDir          *template.Template
+	driverBlockDev          *template.Template
+	stagingMountDir         *template.Template
+	stagingMountDirAfter125 *template.Template
+	stagingBlockDir         *template.Template
+	arrayIDPattern          *regexp.Regexp
+	unpublishExcludedErrors []*regexp.Regexp
+	unstageExcludedErrors   []*regexp.Regexp
+}
+
+// genericDriverFuncs are the functions available to the path templates.
+var genericDriverFuncs = template.FuncMap{
+	"env": func(name, defaultValue string) string {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		return defaultValue
+	},
+}
+
+// NewGenericDriver returns a GenericDriver for the config, or an error if a field is missing or doesn't parse.
+// The staging directory templates are optional, NodeUnstage isn't called for the staging directories not given.
+// Each template is expanded with sample values, so a template that can't be expanded is rejected when loaded.
+func NewGenericDriver(config GenericDriverConfig) (*GenericDriver, error) {
+	if config.DriverPath == "" || config.Name == "" {
+		return nil, fmt.Errorf("driverPath and name are required")
+	}
+	d := &GenericDriver{name: config.Name}
+	templates := []struct {
+		field    string
+		text     string
+		required bool
+		tmpl     **template.Template
+	}{
+		{"driverMountDir", config.DriverMountDir, true, &d.driverMountDir},
+		{"driverBlockDev", config.DriverBlockDev, true, &d.driverBlockDev},
+		{"stagingMountDir", config.StagingMountDir, false, &d.stagingMountDir},
+		{"stagingMountDirAfter125", config.StagingMountDirAfter125, false, &d.stagingMountDirAfter125},
+		{"stagingBlockDir", config.StagingBlockDir, false, &d.stagingBlockDir},
+	}
+	sample := newDriverPathValues("volume-handle", "pv-name", "pod-uid")
+	for _, t := range templates {
+		if t.text == "" {
+			if t.required {
+				return nil, fmt.Errorf("driver %s: %s is required", config.DriverPath, t.field)
+			}
+			continue
+		}
+		tmpl, err := template.New(t.field).Funcs(genericDriverFuncs).Option("missingkey=error").Parse(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("driver %s: %s: %s", config.DriverPath, t.field, err)
+		}
+		if err = tmpl.Execute(io.Discard, sample); err != nil {
+			return nil, fmt.Errorf("driver %s: %s: %s", config.DriverPath, t.field, err)
+		}
+		*t.tmpl = tmpl
+	}
+	if config.ArrayIDPattern != "" {
+		pattern, err := regexp.Compile(config.ArrayIDPattern)
+		if err != nil {
+			return nil, fmt.Errorf("driver %s: arrayIDPattern: %s", config.DriverPath, err)
+		}
+		if pattern.NumSubexp() < 1 {
+			return nil, fmt.Errorf("driver %s: arrayIDPattern must have a group for the array ID", config.DriverPath)
+		}
+		d.arrayIDPattern = pattern
+	}
+	var err error
+	if d.unpublishExcludedErrors, err = compilePatterns(config.NodeUnpublishExcludedErrors); err != nil {
+		return nil, fmt.Errorf("driver %s: nodeUnpublishExcludedErrors: %s", config.DriverPath, err)
+	}
+	if d.unstageExcludedErrors, err = compilePatterns(config.NodeUnstageExcludedErrors); err != nil {
+		return nil, fmt.Errorf("driver %s: nodeUnstageExcludedErrors: %s", config.DriverPath, err)
+	}
+	return d, nil
+}
+
+// compilePatterns compiles the regular expressions.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// LoadDriverTypes reads the driver types file and registers a GenericDriver for each driver in it.
+// Nothing is registered if any of the drivers is invalid.
+func LoadDriverTypes(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file driverTypesFile
+	if err = yaml.UnmarshalStrict(data, &file); err != nil {
+		return fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	drivers := make([]*GenericDriver, 0, len(file.Drivers))
+	for _, config := range file.Drivers {
+		d, err := NewGenericDriver(config)
+		if err != nil {
+			return err
+		}
+		drivers = append(drivers, d)
+	}
+	for i, d := range drivers {
+		driver := d
+		RegisterDriverType(file.Drivers[i].DriverPath, func() drivertype { return driver })
+		log.Infof("Registered driver %s for %s from %s", driver.name, file.Drivers[i].DriverPath, path)
+	}
+	return nil
+}
+
+// expand returns the path from the template, or "" if there is no template or it cannot be expanded.
+func (d *GenericDriver) expand(tmpl *template.Template, volumeHandle, pvName, podUID string) string {
+	if tmpl == nil {
+		return ""
+	}
+	var path bytes.Buffer
+	if err := tmpl.Execute(&path, newDriverPathValues(volumeHandle, pvName, podUID)); err != nil {
+		log.Errorf("Could not expand %s path for driver %s: %s", tmpl.Name(), d.name, err)
+		return ""
+	}
+	log.Debugf("%s: %s", tmpl.Name(), path.String())
+	return path.String()
+}
+
+// excluded returns true if the error matches one of the patterns.
+func (d *GenericDriver) excluded(err error, patterns []*regexp.Regexp) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(err.Error()) {
+			log.Infof("Ignored error: %s", err)
+			return true
+		}
+	}
+	return false
+}
+
+// GetDriverName returns the driver name string
+func (d *GenericDriver) GetDriverName() string {
+	return d.name
+}
+
+// GetDriverMountDir returns the private mount directory.
+func (d *GenericDriver) GetDriverMountDir(volumeHandle, pvName, podUUID string) string {
+	return d.expand(d.driverMountDir, volumeHandle, pvName, podUUID)
+}
+
+// GetDriverBlockDev Returns the block device used for a PV by a pod.
+func (d *GenericDriver) GetDriverBlockDev(volumeHandle, pvName, podUUID string) string {
+	return d.expand(d.driverBlockDev, volumeHandle, pvName, podUUID)
+}
+
+// GetStagingMountDir Returns the staging directory used by NodeUnstage for a mount device.
+func (d *GenericDriver) GetStagingMountDir(volumeHandle, pvName string) string {
+	return d.expand(d.stagingMountDir, volumeHandle, pvName, "")
+}
+
+// GetStagingMountDirAfter125 Returns the staging directory used by NodeUnstage for a mount device.
+func (d *GenericDriver) GetStagingMountDirAfter125(volumeHandle, pvName string) string {
+	return d.expand(d.stagingMountDirAfter125, volumeHandle, pvName, "")
+}
+
+// GetStagingBlockDir Returns the staging directory used by NodeUnstage for a block device.
+func (d *GenericDriver) GetStagingBlockDir(volumeHandle, pvName string) string {
+	return d.expand(d.stagingBlockDir, volumeHandle, pvName, "")
+}
+
+// NodeUnpublishExcludedError filters out NodeUnpublish errors matching the nodeUnpublishExcludedErrors
+func (d *GenericDriver) NodeUnpublishExcludedError(err error) bool {
+	return d.excluded(err, d.unpublishExcludedErrors)
+}
+
+// NodeUnstageExcludedError filters out NodeStage errors matching the nodeUnstageExcludedErrors
+func (d *GenericDriver) NodeUnstageExcludedError(err error) bool {
+	return d.excluded(err, d.unstageExcludedErrors)
+}
+
+// FinalCleanup handles any driver specific final cleanup.
+func (d *GenericDriver) FinalCleanup(_ bool, _, _, _ string) error {
+	return nil
+}
+
+// GetArrayIDFromVolumeHandle returns the first group of the arrayIDPattern match in the volume handle,
+// or an empty string if there is no pattern or it doesn't match.
+func (d *GenericDriver) GetArrayIDFromVolumeHandle(volumeHandle string) string {
+	if d.arrayIDPattern == nil {
+		return ""
+	}
+	match := d.arrayIDPattern.FindStringSubmatch(volumeHandle)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
@@ -0,0 +1,159 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package monitor
+
+import (
+	"podmon/internal/k8sapi"
+	"podmon/internal/metrics"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// The failover guard limits the blast radius of a control plane or network partition, where the
+// unreachable taint can appear on many nodes at once. It counts the distinct nodes podmon taints or
+// cleans up pods from within a sliding window. If admitting another node would exceed the absolute or
+// percentage limit, the guard pauses failover of new nodes until a full window passes with no requests for new nodes.
+
+// failoverLimitExceededReason is the Event reason used when the failover guard pauses failover.
+const failoverLimitExceededReason = "FailoverLimitExceeded"
+
+var (
+	// maxFailoverNodes is the maximum number of nodes failed over within the failover window, 0 is unlimited.
+	maxFailoverNodes = 0
+	// maxFailoverNodesPercent is the maximum percentage of cluster nodes failed over within the failover window, 0 is unlimited.
+	maxFailoverNodesPercent = 0
+	// failoverWindow is the sliding window the failover limits apply to.
+	failoverWindow = 5 * time.Minute
+)
+
+// GetFailoverLimits returns the maximum number of nodes, the maximum percentage of the cluster nodes,
+// and the window they apply to.
+func GetFailoverLimits() (int, int, time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return maxFailoverNodes, maxFailoverNodesPercent, failoverWindow
+}
+
+// SetFailoverLimits sets the maximum number of nodes, the maximum percentage of the cluster nodes,
+// and the window they apply to. A limit of 0 disables that limit.
+func SetFailoverLimits(maxNodes, maxPercent int, window time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	maxFailoverNodes = maxNodes
+	maxFailoverNodesPercent = maxPercent
+	failoverWindow = window
+}
+
+// FailoverGuard tracks the nodes failed over within the failover window. The zero value is ready to use.
+type FailoverGuard struct {
+	mutex       sync.Mutex
+	nodes       map[string]time.Time // node name to the time it was admitted
+	pausedUntil time.Time            // failover is paused until this time
+}
+
+// admit returns true if failover of the named node may proceed, recording the node if it is new to the window.
+// clusterNodes is the number of nodes in the cluster, used for the percentage limit (ignored if 0).
+// If failover is paused, or admitting the node would exceed a limit, false is returned. The bool
+// returned second is true if this call caused failover to be paused.
+func (g *FailoverGuard) admit(nodeName string, clusterNodes int, now time.Time) (bool, bool) {
+	maxNodes, maxPercent, window := GetFailoverLimits()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.nodes == nil {
+		g.nodes = make(map[string]time.Time)
+	}
+	for name, admitted := range g.nodes {
+		if now.Sub(admitted) > window {
+			delete(g.nodes, name)
+		}
+	}
+	if _, ok := g.nodes[nodeName]; ok {
+		// The monitors request the same nodes again on every poll and resync, they were already counted.
+		return true, false
+	}
+	if now.Before(g.pausedUntil) {
+		// Each request for a new node while paused extends the pause, so failover resumes only once things are quiet.
+		g.pausedUntil = now.Add(window)
+		metrics.RecordFailoverDenied()
+		return false, false
+	}
+	count := len(g.nodes) + 1
+	exceeded := maxNodes > 0 && count > maxNodes
+	if maxPercent > 0 && clusterNodes > 0 && count*100 > maxPercent*clusterNodes {
+		exceeded = true
+	}
+	if exceeded {
+		g.pausedUntil = now.Add(window)
+		metrics.RecordFailoverDenied()
+		metrics.SetFailoverPaused(true)
+		return false, true
+	}
+	if !g.pausedUntil.IsZero() {
+		log.Infof("Failover guard resuming failover, no failover requests were denied for %v", window)
+		g.pausedUntil = time.Time{}
+		metrics.SetFailoverPaused(false)
+	}
+	g.nodes[nodeName] = now
+	return true, false
+}
+
+// nodeCount returns the number of nodes being monitored.
+func (pm *PodMonitorType) nodeCount() int {
+	count := 0
+	pm.NodeNameToUID.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// admitFailover returns true if podmon may taint or clean up pods on node. If the failover limits are
+// exceeded failover is paused, and a Warning Event is emitted on the node (and pod if supplied) when that happens.
+func (pm *PodMonitorType) admitFailover(node *v1.Node, pod *v1.Pod, reason string) bool {
+	nodeName := node.ObjectMeta.Name
+	clusterNodes := pm.nodeCount()
+	admitted, pausedNow := pm.Guard.admit(nodeName, clusterNodes, time.Now())
+	if admitted {
+		return true
+	}
+	maxNodes, maxPercent, window := GetFailoverLimits()
+	fields := make(map[string]interface{})
+	fields["node"] = nodeName
+	fields["reason"] = reason
+	fields["clusterNodes"] = clusterNodes
+	fields["maxFailoverNodes"] = maxNodes
+	fields["maxFailoverNodesPercent"] = maxPercent
+	fields["failoverWindow"] = window
+	if !pausedNow {
+		log.WithFields(fields).Warn("Failover paused by failover guard- not failing over node")
+		return false
+	}
+	log.WithFields(fields).Error("********** Failover limit exceeded- pausing failover, check for a control plane or network partition **********")
+	objects := []runtime.Object{node}
+	if pod != nil {
+		objects = append(objects, pod)
+	}
+	for _, obj := range objects {
+		if err := K8sAPI.CreateEvent(podmon, obj, k8sapi.EventTypeWarning, failoverLimitExceededReason,
+			"podmon paused failover: failover limit exceeded by node %s, check for a control plane or network partition",
+			nodeName); err != nil {
+			log.Errorf("Failed to send %s event: %s", failoverLimitExceededReason, err.Error())
+		}
+	}
+	return false
+}
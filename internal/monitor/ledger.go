@@ -0,0 +1,306 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"podmon/internal/k8sapi"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The cleanup ledger persists the progress of each controllerCleanupPod in a ConfigMap
+// in the driver namespace, so that a newly elected leader can finish (roll forward)
+// a cleanup that was interrupted after fencing commenced, or discard (roll back) one
+// that was interrupted before anything was changed on the array or in the cluster.
+
+const (
+	// CleanupLedgerLabelKey labels the ConfigMaps holding cleanup ledger entries. The value is the driver name.
+	CleanupLedgerLabelKey = "podmon.dellemc.com/cleanup-ledger"
+	// CleanupLedgerStepAnnotation annotates the ConfigMap with the last step the cleanup completed.
+	CleanupLedgerStepAnnotation = "podmon.dellemc.com/cleanup-step"
+	// CleanupLedgerPodAnnotation annotates the ConfigMap with the namespace/name of the pod being cleaned.
+	CleanupLedgerPodAnnotation = "podmon.dellemc.com/cleanup-pod"
+	cleanupLedgerDataKey       = "entry"
+)
+
+// The cleanup steps in the order they are recorded.
+const (
+	// LedgerStepStarted is recorded once the volumes and volume attachments to be cleaned are known.
+	LedgerStepStarted = "Started"
+	// LedgerStepValidated is recorded once the array connectivity and I/O checks have passed.
+	LedgerStepValidated = "Validated"
+	// LedgerStepFencing is recorded just before ControllerUnpublishVolume is called for the volumes.
+	LedgerStepFencing = "Fencing"
+	// LedgerStepFenced is recorded once all the volumes have been fenced from the node.
+	LedgerStepFenced = "Fenced"
+	// LedgerStepTainted is recorded once the podmon taint has been applied to the node.
+	LedgerStepTainted = "Tainted"
+	// LedgerStepVolumeAttachmentsDeleted is recorded once the volume attachments have been deleted.
+	LedgerStepVolumeAttachmentsDeleted = "VolumeAttachmentsDeleted"
+)
+
+var ledgerStepOrder = map[string]int{
+	LedgerStepStarted:                  0,
+	LedgerStepValidated:                1,
+	LedgerStepFencing:                  2,
+	LedgerStepFenced:                   3,
+	LedgerStepTainted:                  4,
+	LedgerStepVolumeAttachmentsDeleted: 5,
+}
+
+// Event reasons used when processing the ledger on leader election.
+const (
+	cleanupResumedReason    = "CleanupResumed"
+	cleanupRolledBackReason = "CleanupRolledBack"
+)
+
+// CleanupLedgerEntry is the record of a pod cleanup kept in the ledger ConfigMap.
+type CleanupLedgerEntry struct {
+	PodKey      string   `json:"podKey"`      // namespace/name of the pod being cleaned
+	PodUID      string   `json:"podUID"`      // UID of the pod being cleaned
+	NodeName    string   `json:"nodeName"`    // node the pod was running on
+	Reason      string   `json:"reason"`      // reason passed to controllerCleanupPod
+	TaintNoExec bool     `json:"taintNoExec"` // node had the NoExecute unreachable taint
+	Step        string   `json:"step"`        // last step completed
+	VolumeIDs   []string `json:"volumeIDs"`   // CSI volume handles to be fenced
+	VANames     []string `json:"vaNames"`     // volume attachments to be deleted
+	TaintKeys   []string `json:"taintKeys"`   // podmon taint keys of the pod's drivers, PodmonTaintKey if empty
+	Updated     string   `json:"updated"`     // time the entry was last written (RFC3339)
+}
+
+// cleanupLedger writes the ledger entry for a single controllerCleanupPod invocation.
+// If the driver namespace is not known the ledger is disabled and all operations are no-ops.
+type cleanupLedger struct {
+	namespace string
+	name      string
+	entry     CleanupLedgerEntry
+	written   bool
+}
+
+// ledgerNamespace returns the namespace the ledger ConfigMaps are kept in (the driver namespace).
+func ledgerNamespace() string {
+	return os.Getenv("MY_POD_NAMESPACE")
+}
+
+// ledgerName returns the name of the ledger ConfigMap for the pod with the given UID.
+func ledgerName(podUID string) string {
+	return fmt.Sprintf("podmon-%s-cleanup-%s", Driver.GetDriverName(), strings.ToLower(podUID))
+}
+
+func newCleanupLedger(pod *v1.Pod, node *v1.Node, reason string, taintnoexec bool) *cleanupLedger {
+	namespace := ledgerNamespace()
+	if GetDryRun() {
+		// Nothing is changed in dry-run mode, so there is nothing to resume.
+		namespace = ""
+	}
+	return &cleanupLedger{
+		namespace: namespace,
+		name:      ledgerName(string(pod.ObjectMeta.UID)),
+		entry: CleanupLedgerEntry{
+			PodKey:      getPodKey(pod),
+			PodUID:      string(pod.ObjectMeta.UID),
+			NodeName:    node.ObjectMeta.Name,
+			Reason:      reason,
+			TaintNoExec: taintnoexec,
+		},
+	}
+}
+
+// record persists the completion of step. Failures are logged but do not stop the cleanup.
+func (l *cleanupLedger) record(step string) {
+	if l.namespace == "" {
+		return
+	}
+	l.entry.Step = step
+	l.entry.Updated = time.Now().Format(time.RFC3339)
+	data, err := json.Marshal(l.entry)
+	if err != nil {
+		log.Errorf("Could not marshal cleanup ledger entry for pod %s: %s", l.entry.PodKey, err)
+		return
+	}
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      l.name,
+			Namespace: l.namespace,
+			Labels:    map[string]string{CleanupLedgerLabelKey: Driver.GetDriverName()},
+			Annotations: map[string]string{
+				CleanupLedgerStepAnnotation: step,
+				CleanupLedgerPodAnnotation:  l.entry.PodKey,
+			},
+		},
+		Data: map[string]string{cleanupLedgerDataKey: string(data)},
+	}
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	if err = K8sAPI.CreateOrUpdateConfigMap(ctx, configMap); err != nil {
+		log.Warnf("Could not record cleanup step %s for pod %s in ledger %s/%s: %s", step, l.entry.PodKey, l.namespace, l.name, err)
+		return
+	}
+	l.written = true
+}
+
+// finish removes the ledger entry, unless the cleanup was aborted after fencing commenced,
+// in which case the entry is kept so that the cleanup can be resumed by a new leader.
+func (l *cleanupLedger) finish(aborted bool) {
+	if !l.written {
+		return
+	}
+	if aborted && ledgerStepOrder[l.entry.Step] >= ledgerStepOrder[LedgerStepFencing] {
+		log.Infof("Keeping cleanup ledger entry %s/%s for pod %s at step %s", l.namespace, l.name, l.entry.PodKey, l.entry.Step)
+		return
+	}
+	deleteLedgerEntry(l.namespace, l.name)
+}
+
+func deleteLedgerEntry(namespace, name string) {
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	if err := K8sAPI.DeleteConfigMap(ctx, namespace, name); err != nil && !strings.Contains(err.Error(), notFound) {
+		log.Errorf("Could not delete cleanup ledger entry %s/%s: %s", namespace, name, err)
+	}
+}
+
+// ResumeCleanups processes the cleanup ledger when this instance becomes the leader.
+// Cleanups that were interrupted before fencing commenced are rolled back (the entry is discarded,
+// the pod will be re-evaluated by the monitors). Cleanups interrupted after fencing commenced are
+// rolled forward: if the pod still exists on the node its cleanup is queued again (if the failover guard
+// denies it the entry is kept), otherwise the node is tainted so the node agent cleans up any remaining mounts.
+func (cm *PodMonitorType) ResumeCleanups() {
+	namespace := ledgerNamespace()
+	if namespace == "" {
+		log.Info("MY_POD_NAMESPACE not set, cleanup ledger disabled")
+		return
+	}
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	configMaps, err := K8sAPI.GetConfigMaps(ctx, namespace, fmt.Sprintf("%s=%s", CleanupLedgerLabelKey, Driver.GetDriverName()))
+	if err != nil {
+		log.Errorf("Could not read cleanup ledger in namespace %s: %s", namespace, err)
+		return
+	}
+	log.Infof("Found %d unfinished cleanups in the cleanup ledger", len(configMaps.Items))
+	for i := range configMaps.Items {
+		cm.resumeCleanup(&configMaps.Items[i])
+	}
+}
+
+func (cm *PodMonitorType) resumeCleanup(configMap *v1.ConfigMap) {
+	namespace, name := configMap.ObjectMeta.Namespace, configMap.ObjectMeta.Name
+	entry := CleanupLedgerEntry{}
+	if err := json.Unmarshal([]byte(configMap.Data[cleanupLedgerDataKey]), &entry); err != nil || entry.PodKey == "" {
+		log.Errorf("Discarding unreadable cleanup ledger entry %s/%s: %v", namespace, name, err)
+		deleteLedgerEntry(namespace, name)
+		return
+	}
+	fields := make(map[string]interface{})
+	fields["pod"] = entry.PodKey
+	fields["podUID"] = entry.PodUID
+	fields["node"] = entry.NodeName
+	fields["step"] = entry.Step
+	fields["reason"] = entry.Reason
+	if GetDryRun() {
+		reportDryRun(nil, fields, dryRunResumeCleanup, namespace+"/"+name)
+		return
+	}
+
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	podNamespace, podName := splitPodKey(entry.PodKey)
+	pod, err := K8sAPI.GetPod(ctx, podNamespace, podName)
+	podPresent := err == nil && pod != nil && string(pod.ObjectMeta.UID) == entry.PodUID && pod.Spec.NodeName == entry.NodeName
+
+	// Nothing was changed before fencing commenced, so the cleanup can be rolled back by discarding the entry.
+	if ledgerStepOrder[entry.Step] < ledgerStepOrder[LedgerStepFencing] {
+		log.WithFields(fields).Info("Rolling back unfinished pod cleanup")
+		if podPresent {
+			if err = K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeNormal, cleanupRolledBackReason,
+				"podmon rolled back unfinished cleanup of pod %s on node %s",
+				entry.PodUID, entry.NodeName); err != nil {
+				log.Errorf("Failed to send %s event: %s", cleanupRolledBackReason, err.Error())
+			}
+		}
+		deleteLedgerEntry(namespace, name)
+		return
+	}
+
+	node, err := K8sAPI.GetNode(ctx, entry.NodeName)
+	if err != nil {
+		if strings.Contains(err.Error(), notFound) {
+			log.WithFields(fields).Info("Node no longer exists, discarding unfinished pod cleanup")
+			deleteLedgerEntry(namespace, name)
+		} else {
+			log.WithFields(fields).Errorf("Could not get node to resume pod cleanup: %s", err)
+		}
+		return
+	}
+
+	if podPresent {
+		if !cm.admitFailover(node, pod, cleanupResumedReason) {
+			// The entry is kept, so the cleanup is resumed by the next leader.
+			log.WithFields(fields).Warn("Failover guard denied resuming unfinished pod cleanup")
+			return
+		}
+		log.WithFields(fields).Info("Resuming unfinished pod cleanup")
+		if err = K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, cleanupResumedReason,
+			"podmon resuming cleanup of pod %s on node %s interrupted after step %s",
+			entry.PodUID, entry.NodeName, entry.Step); err != nil {
+			log.Errorf("Failed to send %s event: %s", cleanupResumedReason, err.Error())
+		}
+		// The volumes may already be fenced, so the array connected status is not considered.
+		cleanup := cm.nodeFailureCleanup(pod, node, entry.Reason, entry.TaintNoExec, true)
+		cm.Scheduler.submit([]string{entry.PodKey}, podCleanupPriority(pod, getPodPolicy(pod)), func() error {
+			if err := cleanup(); err != nil {
+				// Restore the original entry, the resumed attempt may have discarded it if it aborted early.
+				log.WithFields(fields).Errorf("Resumed pod cleanup did not complete: %s", err)
+				restoreCtx, restoreCancel := K8sAPI.GetContext(MediumTimeout)
+				defer restoreCancel()
+				configMap.ObjectMeta.ResourceVersion = ""
+				if err := K8sAPI.CreateOrUpdateConfigMap(restoreCtx, configMap); err != nil {
+					log.WithFields(fields).Errorf("Could not restore cleanup ledger entry %s/%s: %s", namespace, name, err)
+				}
+				return err
+			}
+			return nil
+		})
+		return
+	}
+
+	// The pod is gone, make sure the node is tainted so the node agent will clean up any remaining mounts.
+	log.WithFields(fields).Info("Pod no longer present, completing unfinished cleanup of the node")
+	if ledgerStepOrder[entry.Step] < ledgerStepOrder[LedgerStepTainted] {
+		taintKeys := entry.TaintKeys
+		if len(taintKeys) == 0 {
+			taintKeys = []string{PodmonTaintKey}
+		}
+		for _, taintKey := range taintKeys {
+			if err = taintNode(entry.NodeName, taintKey, false); err != nil {
+				log.WithFields(fields).Errorf("Failed to update taint against %s node: %v", entry.NodeName, err)
+				return
+			}
+		}
+	}
+	if err = K8sAPI.CreateEvent(podmon, node, k8sapi.EventTypeWarning, cleanupResumedReason,
+		"podmon completed cleanup of pod %s on node %s interrupted after step %s",
+		entry.PodUID, entry.NodeName, entry.Step); err != nil {
+		log.Errorf("Failed to send %s event: %s", cleanupResumedReason, err.Error())
+	}
+	deleteLedgerEntry(namespace, name)
+}
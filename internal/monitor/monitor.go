@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"podmon/internal/csiapi"
 	"podmon/internal/k8sapi"
+	"podmon/internal/metrics"
 	"strings"
 	"sync"
 	"time"
@@ -28,11 +29,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/client-go/kubernetes"
 )
 
 const (
 	nodeUnreachableTaint    = "node.kubernetes.io/unreachable"
+	outOfServiceTaint       = "node.kubernetes.io/out-of-service"
 	podReadyCondition       = "Ready"
 	podInitializedCondition = "Initialized"
 	podmon                  = "podmon"
@@ -41,6 +42,11 @@ const (
 	PodmonTaintKeySuffix = "podmon.storage.dell.com"
 	// PodmonDriverPodTaintKeySuffix is used for creating a driver node pod specific podmon taint key
 	PodmonDriverPodTaintKeySuffix = "storage.dell.com"
+	// FencingModePodmon releases a failed node's volumes by deleting the VolumeAttachments and force deleting the pods.
+	FencingModePodmon = "podmon"
+	// FencingModeOutOfService releases a failed node's volumes by applying the node.kubernetes.io/out-of-service taint once the
+	// array has fenced the node, letting Kubernetes delete the pods and VolumeAttachments. The driver node pods must tolerate the taint.
+	FencingModeOutOfService = "out-of-service"
 )
 
 var (
@@ -62,14 +68,20 @@ var (
 	CSIMaxRetries = 3
 	// MonitorRestartTimeDelay time to wait before restarting monitor
 	MonitorRestartTimeDelay = 10 * time.Second
-	// LockSleepTimeDelay wait for lock retry
-	LockSleepTimeDelay = 1 * time.Second
 	// dynamicConfigUpdateMutex protects concurrently running threads that could be affected by dynamic configuration parameters.
 	dynamicConfigUpdateMutex sync.Mutex
 	// arrayConnectivityPollRate is the rate it polls to check array connectivity to nodes.
 	arrayConnectivityPollRate = ShortTimeout
 	// IgnoreVolumelessPods when set will keep labeled pods with no volumes from being force deleted on node or connectivity failures.
 	IgnoreVolumelessPods bool
+	// dryRun when set reports the fencing, tainting, and deletions podmon would perform instead of performing them.
+	dryRun bool
+	// fencingMode is how a failed node's volumes are released after fencing, FencingModePodmon or FencingModeOutOfService.
+	fencingMode = FencingModePodmon
+	// fencingConcurrency is the maximum number of volumes fenced concurrently when cleaning up a pod.
+	fencingConcurrency = 10
+	// cleanupDeadline is the overall deadline, measured from the start of a pod cleanup, for fencing its volumes.
+	cleanupDeadline = 5 * time.Minute
 )
 
 // GetArrayConnectivityPollRate returns the array connectivity poll rate.
@@ -86,18 +98,68 @@ func SetArrayConnectivityPollRate(rate time.Duration) {
 	arrayConnectivityPollRate = rate
 }
 
+// GetDryRun returns true if podmon is in dry-run (audit) mode.
+func GetDryRun() bool {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return dryRun
+}
+
+// SetDryRun enables or disables dry-run (audit) mode.
+func SetDryRun(enabled bool) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	dryRun = enabled
+}
+
+// GetFencingMode returns how a failed node's volumes are released after fencing.
+func GetFencingMode() string {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return fencingMode
+}
+
+// SetFencingMode sets how a failed node's volumes are released after fencing, FencingModePodmon or FencingModeOutOfService.
+func SetFencingMode(mode string) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	fencingMode = mode
+}
+
+// GetFencingLimits returns the maximum number of volumes fenced concurrently and the cleanup deadline.
+func GetFencingLimits() (int, time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return fencingConcurrency, cleanupDeadline
+}
+
+// SetFencingLimits sets the maximum number of volumes fenced concurrently and the cleanup deadline.
+func SetFencingLimits(concurrency int, deadline time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	fencingConcurrency = concurrency
+	cleanupDeadline = deadline
+}
+
 // PodMonitorType structure is tracking data for the pod monitor
 type PodMonitorType struct {
-	Mode                          string   // controller, node, or standalone
-	PodKeyMap                     sync.Map // podkey to *v1.Pod in controller (temporal) or *NodePodInfo in node
-	PodKeyToControllerPodInfo     sync.Map // podkey to *ControllerPodInfo in controller
-	PodKeyToCrashLoopBackOffCount sync.Map // podkey to CrashLoopBackOffCount
-	APIConnected                  bool     // connected to k8s API
-	ArrayConnected                bool     // node is connected to array
-	SkipArrayConnectionValidation bool     // skip validation array connection lost
-	CSIExtensionsPresent          bool     // the CSI PodmonExtensions are present
-	DriverPathStr                 string   // CSI Driver path string for parsing csi.volume.kubernetes.io/nodeid annotation
-	NodeNameToUID                 sync.Map // Node.ObjectMeta.Name to Node.ObjectMeta.Uid
+	Mode                              string               // controller, node, or standalone
+	PodKeyMap                         sync.Map             // podkey to *NodePodInfo in node
+	PodKeyToControllerPodInfo         sync.Map             // podkey to *ControllerPodInfo in controller
+	PodKeyToCrashLoopBackOffDeletions sync.Map             // podkey to *crashLoopBackOffDeletions in controller
+	APIConnected                      bool                 // connected to k8s API
+	ArrayConnected                    bool                 // node is connected to array
+	SkipArrayConnectionValidation     bool                 // skip validation array connection lost
+	CSIExtensionsPresent              bool                 // the CSI PodmonExtensions are present
+	DriverPathStr                     string               // CSI Driver path string for parsing csi.volume.kubernetes.io/nodeid annotation
+	NodeNameToUID                     sync.Map             // Node.ObjectMeta.Name to Node.ObjectMeta.Uid
+	Guard                             FailoverGuard        // limits the number of nodes failed over within a window
+	Scheduler                         CleanupScheduler     // runs pod cleanups by priority with bounded parallelism
+	Recovery                          RecoveryReconciler   // removes the podmon taint from nodes that have recovered
+	OrphanedVAs                       OrphanedVAReconciler // remembers the orphaned VolumeAttachments already reported
+	DriverPods                        DriverPodTracker     // debounces the readiness of the driver node pods
+	Drivers                           sync.Map             // CSI driver path to *CSIDriver for the drivers other than the primary driver
+	Outages                           ArrayOutageDetector  // suppresses failover for arrays lost by most of their nodes
 }
 
 // PodMonitor is a reference to tracking data for the pod monitor
@@ -125,30 +187,8 @@ func splitPodKey(podKey string) (string, string) {
 	return parts[0], parts[1]
 }
 
-// WatchFunc will receive a callback if there is a Watch Event.
-// eventType is Added, Modified, Deleted, Bookmark, or Error.
-type WatchFunc func(eventType watch.EventType, object interface{}) error
-
-// Monitor sets up a Watch on a Pod or other object by calling the Watch function.
-type Monitor struct {
-	Client   kubernetes.Interface
-	StopChan chan bool
-	Watcher  watch.Interface
-}
-
-// Lock acquires a sync lock based on the pod reference and key
-func Lock(podkey string, pod *v1.Pod, delay time.Duration) {
-	_, loaded := PodMonitor.PodKeyMap.LoadOrStore(podkey, pod)
-	for loaded {
-		time.Sleep(delay)
-		_, loaded = PodMonitor.PodKeyMap.LoadOrStore(podkey, pod)
-	}
-}
-
-// Unlock returns a sync lock based on a pod key reference
-func Unlock(podkey string) {
-	PodMonitor.PodKeyMap.Delete(podkey)
-}
+// InformerResyncPeriod is how often the informers redeliver the cached pods and nodes to the handlers.
+var InformerResyncPeriod = 10 * time.Minute
 
 // StoreNodeUID store node name and UID
 func (pm *PodMonitorType) StoreNodeUID(nodeName, uid string) {
@@ -172,31 +212,6 @@ func (pm *PodMonitorType) ClearNodeUID(nodeName, oldNodeUID string) bool {
 	return pm.NodeNameToUID.CompareAndSwap(nodeName, oldNodeUID, "")
 }
 
-// Watch watches a watcher result channel. Upon receiving an event, the fn WatchFunc is invoked.Load
-func (pm *Monitor) Watch(fn WatchFunc) error {
-	defer pm.Watcher.Stop()
-	for {
-		select {
-		case event, more := <-pm.Watcher.ResultChan():
-			log.Debugf("event received")
-			if !more {
-				return fmt.Errorf("watcher disconnected")
-			}
-			if event.Object != nil {
-				log.Debugf("received object %+v", event.Object)
-				err := fn(event.Type, event.Object)
-				if err != nil {
-					log.Error(err)
-				}
-			}
-		case stop := <-pm.StopChan:
-			if stop == true {
-				return nil
-			}
-		}
-	}
-}
-
 func podMonitorHandler(eventType watch.EventType, object interface{}) error {
 	log.Debugf("podMonitorHandler %s eventType %+v object %+v", PodMonitor.Mode, eventType, object)
 	pod, ok := object.(*v1.Pod)
@@ -224,42 +239,39 @@ func podMonitorHandler(eventType watch.EventType, object interface{}) error {
 	return nil
 }
 
+// podEventHandler passes the pod informer events to podMonitorHandler, logging any error.
+func podEventHandler(eventType watch.EventType, object interface{}) {
+	if err := podMonitorHandler(eventType, object); err != nil {
+		log.Error(err)
+	}
+}
+
 // StartPodMonitor starts the PodMonitor so that it is processing pods which might have problems.
-// The labelKey and labelValue are used for filtering.
-func StartPodMonitor(api k8sapi.K8sAPI, client kubernetes.Interface, labelKey, labelValue string, restartDelay time.Duration) {
+// The labelKey and labelValue are used for filtering. The pods are delivered by a shared informer,
+// which handles reconnecting to the API server and resyncs every InformerResyncPeriod.
+func StartPodMonitor(api k8sapi.K8sAPI, labelKey, labelValue string, restartDelay time.Duration) {
 	log.Infof("attempting to start PodMonitor\n")
 	PodmonTaintKey = fmt.Sprintf("%s.%s", Driver.GetDriverName(), PodmonTaintKeySuffix)
 	PodmonDriverPodTaintKey = fmt.Sprintf("offline.%s.%s", Driver.GetDriverName(), PodmonDriverPodTaintKeySuffix)
-	podMonitor := Monitor{Client: client}
-	listOptions := metav1.ListOptions{
-		Watch: true,
-	}
+	selector := ""
 	if labelKey != "" {
 		labelSelector := metav1.LabelSelector{MatchLabels: map[string]string{labelKey: labelValue}}
 		log.Infof("labelSelector: %v\n", labelSelector)
-		listOptions.LabelSelector = labels.Set(labelSelector.MatchLabels).String()
+		selector = labels.Set(labelSelector.MatchLabels).String()
 	}
 	for {
-		ctx := context.Background()
-		watcher, err := api.SetupPodWatch(ctx, "", listOptions)
-		if err != nil {
-			// The following check excludes unit testing, to avoid polluting the log messages captured
-			if restartDelay > 10*time.Millisecond {
-				log.Errorf("Could not create PodWatcher: %s - will retry\n", err)
-			}
-			time.Sleep(restartDelay)
-			continue
-		}
-		podMonitor.Watcher = watcher
-		log.Infof("Setup of PodWatcher complete\n")
-		err = podMonitor.Watch(podMonitorHandler)
+		err := api.AddPodEventHandler(context.Background(), selector, InformerResyncPeriod, podEventHandler)
 		if err == nil {
-			// requested stop
-			return
+			break
+		}
+		// The following check excludes unit testing, to avoid polluting the log messages captured
+		if restartDelay > 10*time.Millisecond {
+			log.Errorf("Could not create PodWatcher: %s - will retry\n", err)
 		}
-		log.Warnf("PodWatcher stopped... attempting restart: %s", err)
+		metrics.RecordWatchRestart("PodWatcher", "SetupFailed")
 		time.Sleep(restartDelay)
 	}
+	log.Infof("Setup of PodWatcher complete\n")
 }
 
 func nodeMonitorHandler(eventType watch.EventType, object interface{}) error {
@@ -282,10 +294,11 @@ func nodeMonitorHandler(eventType watch.EventType, object interface{}) error {
 			log.Debugf("Node deleted: %s previously %s", node.ObjectMeta.Name, oldUID)
 			pm.ClearNodeUID(node.ObjectMeta.Name, oldUID)
 		}
+		pm.nodeRecoveryHandler(node, eventType)
 		// Get the CSI annotations for nodeID
 		volumeIDs := make([]string, 0)
 		// Print out whether the host is connected or not...
-		_, _, _ = pm.callValidateVolumeHostConnectivity(node, volumeIDs, true)
+		_, _, _ = pm.callValidateVolumeHostConnectivity(node, volumeIDs, "", true)
 
 		// Determine if the node is tainted
 		taintnosched := nodeHasTaint(node, nodeUnreachableTaint, v1.TaintEffectNoSchedule)
@@ -296,38 +309,28 @@ func nodeMonitorHandler(eventType watch.EventType, object interface{}) error {
 	return nil
 }
 
+// nodeEventHandler passes the node informer events to nodeMonitorHandler, logging any error.
+func nodeEventHandler(eventType watch.EventType, object interface{}) {
+	if err := nodeMonitorHandler(eventType, object); err != nil {
+		log.Error(err)
+	}
+}
+
 // StartNodeMonitor starts the NodeMonitor so that it is process nodes which might go offline.
-func StartNodeMonitor(api k8sapi.K8sAPI, client kubernetes.Interface, labelKey, labelValue string, restartDelay time.Duration) {
+// The nodes are delivered by a shared informer, which resyncs every InformerResyncPeriod.
+func StartNodeMonitor(api k8sapi.K8sAPI, restartDelay time.Duration) {
 	log.Printf("attempting to start NodeMonitor\n")
-	nodeMonitor := Monitor{Client: client}
-	listOptions := metav1.ListOptions{
-		Watch: true,
-	}
-	if labelKey != "" {
-		labelSelector := metav1.LabelSelector{MatchLabels: map[string]string{labelKey: labelValue}}
-		log.Infof("labelSelector: %v\n", labelSelector)
-		listOptions.LabelSelector = labels.Set(labelSelector.MatchLabels).String()
-	}
 	for {
-		ctx := context.Background()
-		watcher, err := api.SetupNodeWatch(ctx, listOptions)
-		if err != nil {
-			// The following check excludes unit testing, to avoid polluting the log messages captured
-			if restartDelay > 10*time.Millisecond {
-				log.Errorf("Could not create NodeWatcher: %s - will retry\n", err)
-			}
-			time.Sleep(restartDelay)
-			continue
-		}
-		nodeMonitor.Watcher = watcher
-		log.Infof("Setup of NodeWatcher complete\n")
-		err = nodeMonitor.Watch(nodeMonitorHandler)
-
+		err := api.AddNodeEventHandler(context.Background(), InformerResyncPeriod, nodeEventHandler)
 		if err == nil {
-			// requested stop
-			return
+			break
+		}
+		// The following check excludes unit testing, to avoid polluting the log messages captured
+		if restartDelay > 10*time.Millisecond {
+			log.Errorf("Could not create NodeWatcher: %s - will retry\n", err)
 		}
-		log.Errorf("NodeWatcher stopped... attempting restart: %s", err)
+		metrics.RecordWatchRestart("NodeWatcher", "SetupFailed")
 		time.Sleep(restartDelay)
 	}
+	log.Infof("Setup of NodeWatcher complete\n")
 }
@@ -17,6 +17,7 @@ package monitor
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -26,7 +27,6 @@ import (
 	"podmon/internal/tools"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/cucumber/godog"
@@ -37,10 +37,10 @@ import (
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/client-go/kubernetes/fake"
 	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
@@ -133,6 +133,27 @@ func (f *feature) aControllerMonitor(driver string) error {
 	f.podmonMonitor = &PodMonitorType{}
 	f.podmonMonitor.CSIExtensionsPresent = true
 	f.podmonMonitor.DriverPathStr = "csi-vxflexos.dellemc.com"
+	os.Unsetenv("MY_POD_NAMESPACE")
+	SetDryRun(false)
+	SetFailoverLimits(0, 0, 5*time.Minute)
+	SetFencingLimits(10, 5*time.Minute)
+	SetCleanupConcurrency(10)
+	SetCleanupRetryLimits(0, 5*time.Second, 5*time.Minute)
+	SetFencingMode(FencingModePodmon)
+	SetRecoveryStablePeriod(5 * time.Minute)
+	SetCrashLoopBackOffLimits(MaxCrashLoopBackOffRetry, 0, 0)
+	SetCrashLoopBackOffStorageErrorsOnly(false)
+	SetOrphanedVAMode(OrphanedVAModeDelete)
+	SetOrphanedVANotReadyPeriod(10 * time.Minute)
+	SetDriverPodLimits(0, 0)
+	SetDriverPodFlapLimits(0, 10*time.Minute)
+	SetNodeConnectivityReportInterval(0)
+	SetPublishArrayConnectivity(true)
+	SetArrayOutageNodesPercent(0)
+	SetArrayConnectivityRecoveryThreshold(1)
+	SetArrayConnectivityFlapLimits(4, 10)
+	SetArrayConnectivityFlapPolicy(ArrayConnectivityFlapPolicyReport)
+	connectivityCache = nodeArrayConnectivityCache{}
 	gofsutil.UseMockFS()
 	RemoveDir = f.mockRemoveDir
 	f.badWatchObject = false
@@ -171,6 +192,7 @@ func (f *feature) aPodForNodeWithVolumesConditionAffinity(node string, nvolumes
 	f.k8sapiMock.AddPod(pod)
 	// If affinity, create a second pod with affinity to the first
 	if affinity == "true" {
+		pod.ObjectMeta.Labels = map[string]string{"affinityLabel1": "affinityLabelValue1", "affinityLabel2": "affinityValue1"}
 		f.pod2 = f.createPod(node, nvolumes, condition, affinity)
 		f.pod2.ObjectMeta.Name = "affinityPod"
 		f.k8sapiMock.AddPod(f.pod2)
@@ -294,6 +316,434 @@ func (f *feature) iCallControllerCleanupPodForNode(nodeName string) error {
 	return nil
 }
 
+func (f *feature) aCleanupLedgerInNamespace(namespace string) error {
+	return os.Setenv("MY_POD_NAMESPACE", namespace)
+}
+
+func (f *feature) aCleanupLedgerEntryForThePodAtStep(step string) error {
+	node, _ := f.k8sapiMock.GetNode(context.Background(), f.pod.Spec.NodeName)
+	ledger := newCleanupLedger(f.pod, node, "Unit Test", false)
+	ledger.record(step)
+	if !ledger.written {
+		return fmt.Errorf("could not record cleanup ledger entry at step %s", step)
+	}
+	return nil
+}
+
+func (f *feature) theLedgerPodHasBeenDeleted(value string) error {
+	if value == "true" {
+		return f.k8sapiMock.DeletePod(context.Background(), f.pod.ObjectMeta.Namespace, f.pod.ObjectMeta.Name, f.pod.ObjectMeta.UID, true)
+	}
+	return nil
+}
+
+func (f *feature) iCallResumeCleanups() error {
+	f.podmonMonitor.ResumeCleanups()
+	waitForCleanups(&f.podmonMonitor.Scheduler, 5*time.Second)
+	return nil
+}
+
+func (f *feature) theCleanupLedgerHasEntries(entries int) error {
+	if len(f.k8sapiMock.KeyToConfigMap) != entries {
+		return fmt.Errorf("expected %d cleanup ledger entries but found %d", entries, len(f.k8sapiMock.KeyToConfigMap))
+	}
+	return nil
+}
+
+func (f *feature) theCleanupLedgerStepIs(step string) error {
+	for _, configMap := range f.k8sapiMock.KeyToConfigMap {
+		if configMap.ObjectMeta.Annotations[CleanupLedgerStepAnnotation] != step {
+			return fmt.Errorf("expected cleanup ledger step %s but was %s", step, configMap.ObjectMeta.Annotations[CleanupLedgerStepAnnotation])
+		}
+	}
+	return nil
+}
+
+func (f *feature) thePodIsPresent(value string) error {
+	_, present := f.k8sapiMock.KeyToPod[getPodKey(f.pod)]
+	if present != (value == "true") {
+		return fmt.Errorf("expected pod present %s but was %t", value, present)
+	}
+	return nil
+}
+
+func (f *feature) dryRunModeIs(value string) error {
+	SetDryRun(value == "true")
+	return nil
+}
+
+func (f *feature) theNodeHasThePodmonTaint(nodeName, value string) error {
+	node, _ := f.k8sapiMock.GetNode(context.Background(), nodeName)
+	tainted := nodeHasTaint(node, PodmonTaintKey, v1.TaintEffectNoSchedule)
+	if tainted != (value == "true") {
+		return fmt.Errorf("expected node %s podmon taint %s but was %t", nodeName, value, tainted)
+	}
+	return nil
+}
+
+func (f *feature) theFencingModeIs(mode string) error {
+	SetFencingMode(mode)
+	return nil
+}
+
+func (f *feature) theNodeHasTheOutOfServiceTaint(nodeName, value string) error {
+	node, _ := f.k8sapiMock.GetNode(context.Background(), nodeName)
+	tainted := nodeHasTaint(node, outOfServiceTaint, v1.TaintEffectNoExecute)
+	if tainted != (value == "true") {
+		return fmt.Errorf("expected node %s out-of-service taint %s but was %t", nodeName, value, tainted)
+	}
+	return nil
+}
+
+func (f *feature) aTaintedNodeStableForSeconds(nodeName string, seconds int) error {
+	node, _ := f.k8sapiMock.GetNode(context.Background(), nodeName)
+	node.Spec.Taints = []v1.Taint{{Key: PodmonTaintKey, Effect: v1.TaintEffectNoSchedule}}
+	node.Status.NodeInfo.BootID = "boot-1"
+	f.k8sapiMock.AddNode(node)
+	SetRecoveryStablePeriod(time.Minute)
+	f.podmonMonitor.Recovery.observeNode(node, true, time.Now().Add(-time.Duration(seconds)*time.Second))
+	return nil
+}
+
+func (f *feature) theNodeRebootsWithBootID(nodeName, bootID string) error {
+	node, _ := f.k8sapiMock.GetNode(context.Background(), nodeName)
+	node.Status.NodeInfo.BootID = bootID
+	return nil
+}
+
+func (f *feature) theDriverNodePodOnIsReady(nodeName, value string) error {
+	f.podmonMonitor.Recovery.setDriverPodReady(nodeName, value == "true")
+	return nil
+}
+
+func (f *feature) aCleanedUpPodOnWithStaleVolumeAttachment(nodeName, value string) error {
+	pvName := "pv-cleaned"
+	f.podmonMonitor.Recovery.recordCleanedPVs(nodeName, []*v1.PersistentVolume{{ObjectMeta: metav1.ObjectMeta{Name: pvName}}}, []string{defaultArray})
+	if value == "true" {
+		f.k8sapiMock.AddVA(&storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: "va-cleaned"},
+			Spec: storagev1.VolumeAttachmentSpec{
+				NodeName: nodeName,
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			},
+		})
+	}
+	return nil
+}
+
+func (f *feature) aCleanedUpPodOnWithAVolumeOnArray(nodeName, arrayID string) error {
+	f.podmonMonitor.Recovery.recordCleanedPVs(nodeName, []*v1.PersistentVolume{{ObjectMeta: metav1.ObjectMeta{Name: "pv-" + arrayID}}}, []string{arrayID})
+	return nil
+}
+
+func (f *feature) iCallReconcileNodeRecovery() error {
+	f.podmonMonitor.reconcileNodeRecovery(time.Now())
+	return nil
+}
+
+func (f *feature) eventsWithReasonAreSent(count int, reason string) error {
+	sent := 0
+	for _, eventReason := range f.k8sapiMock.EventReasons {
+		if eventReason == reason {
+			sent++
+		}
+	}
+	if sent != count {
+		return fmt.Errorf("expected %d %s events but %d were sent", count, reason, sent)
+	}
+	return nil
+}
+
+func (f *feature) theCrashLoopBackOffLimitsAre(maxRetries, backoff, window int, storageErrorsOnly string) error {
+	SetCrashLoopBackOffLimits(maxRetries, time.Duration(backoff)*time.Second, time.Duration(window)*time.Second)
+	SetCrashLoopBackOffStorageErrorsOnly(storageErrorsOnly == "true")
+	return nil
+}
+
+func (f *feature) thePodHasEventWithReason(eventType, reason string) error {
+	switch reason {
+	case "none":
+	case "FailedMount":
+		f.k8sapiMock.AddEvent(f.pod, eventType, reason, "MountVolume.SetUp failed for volume")
+	default:
+		f.k8sapiMock.AddEvent(f.pod, eventType, reason, "unit test event")
+	}
+	return nil
+}
+
+func (f *feature) thePodWasDeletedForCrashLoopBackOffTimesSecondsAgo(count, ago int) error {
+	deletions := &crashLoopBackOffDeletions{}
+	for i := 0; i < count; i++ {
+		deletions.record(time.Now().Add(-time.Duration(ago) * time.Second))
+	}
+	f.podmonMonitor.PodKeyToCrashLoopBackOffDeletions.Store(getPodKey(f.pod), deletions)
+	return nil
+}
+
+func (f *feature) thePodHasCrashLoopBackOffDeletions(count int) error {
+	value, ok := f.podmonMonitor.PodKeyToCrashLoopBackOffDeletions.Load(getPodKey(f.pod))
+	actual := 0
+	if ok {
+		actual = len(value.(*crashLoopBackOffDeletions).times)
+	}
+	if actual != count {
+		return fmt.Errorf("expected %d CrashLoopBackOff deletions but there were %d", count, actual)
+	}
+	return nil
+}
+
+func (f *feature) thePodsVolumesAreStillAttachedToNode(nodeName string) error {
+	for _, pvName := range f.pvNames {
+		va := &storagev1.VolumeAttachment{}
+		va.ObjectMeta.Name = "stale-" + pvName
+		va.Spec.NodeName = nodeName
+		va.Spec.Source.PersistentVolumeName = &pvName
+		f.k8sapiMock.AddVA(va)
+	}
+	f.podmonMonitor.StoreNodeUID(f.pod.Spec.NodeName, "uid-new")
+	f.podmonMonitor.StoreNodeUID(nodeName, "uid-old")
+	return nil
+}
+
+func (f *feature) aPodOnNodeStillUsesThePodsVolumes(nodeName string) error {
+	oldPod := f.pod.DeepCopy()
+	oldPod.ObjectMeta.Name = f.pod.ObjectMeta.Name + "-old"
+	oldPod.ObjectMeta.UID = types.UID(string(f.pod.ObjectMeta.UID) + "-old")
+	oldPod.Spec.NodeName = nodeName
+	f.k8sapiMock.AddPod(oldPod)
+	return nil
+}
+
+func (f *feature) iCallMultiAttachHandlerForThePodWithMessageAndSelector(message, selector string) error {
+	event := &v1.Event{
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Namespace: f.pod.ObjectMeta.Namespace, Name: f.pod.ObjectMeta.Name},
+		Reason:         failedAttachVolumeReason,
+	}
+	switch message {
+	case "MultiAttach":
+		event.Message = fmt.Sprintf(`Multi-Attach error for volume "%s" Volume is already exclusively attached to one node and can't be attached to another`, f.pvNames[0])
+	case "MultiAttachNoVolume":
+		event.Message = "Multi-Attach error"
+	default:
+		event.Message = message
+	}
+	labelSelector, err := labels.Parse(selector)
+	if err != nil {
+		return err
+	}
+	f.podmonMonitor.multiAttachHandler(event, labelSelector)
+	waitForCleanups(&f.podmonMonitor.Scheduler, 5*time.Second)
+	return nil
+}
+
+func (f *feature) theStaleVolumeAttachmentsAreDeleted(value string) error {
+	for _, pvName := range f.pvNames {
+		_, present := f.k8sapiMock.NameToVolumeAttachment["stale-"+pvName]
+		if present == (value == "true") {
+			return fmt.Errorf("expected stale VolumeAttachment for %s deleted %s, but present was %t", pvName, value, present)
+		}
+	}
+	return nil
+}
+
+func (f *feature) iCallStartMultiAttachMonitor() error {
+	MonitorRestartTimeDelay = 5 * time.Millisecond
+	f.validateWatcherMessage = true
+	if f.k8sapiMock.InducedErrors.Watch {
+		// StartMultiAttachMonitor retries until the handler can be added
+		go StartMultiAttachMonitor(K8sAPI, "podmon.dellemc.com/driver", "csi-vxflexos", MonitorRestartTimeDelay)
+		return nil
+	}
+	StartMultiAttachMonitor(K8sAPI, "podmon.dellemc.com/driver", "csi-vxflexos", MonitorRestartTimeDelay)
+	return nil
+}
+
+func (f *feature) aVolumeAttachmentOnNodeForDriver(vaName, nodeName, driver string) error {
+	pv := &v1.PersistentVolume{}
+	pv.ObjectMeta.Name = "pv-" + vaName
+	pv.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: podns, Name: "pvc-" + vaName}
+	pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: "vhandle-" + vaName}
+	f.k8sapiMock.AddPV(pv)
+	va := &storagev1.VolumeAttachment{}
+	va.ObjectMeta.Name = vaName
+	va.Spec.NodeName = nodeName
+	va.Spec.Source.PersistentVolumeName = &pv.ObjectMeta.Name
+	va.Status.Attached = true
+	f.k8sapiMock.AddVA(va)
+	return nil
+}
+
+func (f *feature) aPodOnNodeUsingTheVolumeOfVolumeAttachmentPhase(nodeName, vaName, phase string) error {
+	pod := &v1.Pod{}
+	pod.ObjectMeta.Namespace = podns
+	pod.ObjectMeta.Name = "pod-" + vaName
+	pod.Spec.NodeName = nodeName
+	pod.Spec.Volumes = []v1.Volume{{
+		Name:         "pv-" + vaName,
+		VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "pvc-" + vaName}},
+	}}
+	pod.Status.Phase = v1.PodPhase(phase)
+	f.k8sapiMock.AddPod(pod)
+	return nil
+}
+
+func (f *feature) theNodeStateIs(nodeName, state string) error {
+	node, _ := f.k8sapiMock.GetNode(context.Background(), nodeName)
+	switch state {
+	case "gone":
+		f.k8sapiMock.InducedErrors.GetNodeNotFound = true
+	case "tainted":
+		node.Spec.Taints = []v1.Taint{{Key: PodmonTaintKey, Effect: v1.TaintEffectNoSchedule}}
+	case "NotReady":
+		node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse,
+			LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Hour))}}
+	case "RecentlyNotReady":
+		node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionUnknown,
+			LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Minute))}}
+	case "Ready":
+		node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue,
+			LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Hour))}}
+	}
+	f.k8sapiMock.AddNode(node)
+	return nil
+}
+
+func (f *feature) theOrphanedVolumeAttachmentModeIs(mode string) error {
+	SetOrphanedVAMode(mode)
+	return nil
+}
+
+func (f *feature) iCallReconcileOrphanedVAsTimes(count int) error {
+	for i := 0; i < count; i++ {
+		f.podmonMonitor.reconcileOrphanedVAs(time.Now())
+	}
+	return nil
+}
+
+func (f *feature) iCallOrphanedVolumeAttachmentReconciler() error {
+	OrphanedVAInterval = 5 * time.Millisecond
+	f.podmonMonitor.OrphanedVolumeAttachmentReconciler()
+	return nil
+}
+
+func (f *feature) theVolumeAttachmentIsDeleted(vaName, value string) error {
+	_, present := f.k8sapiMock.NameToVolumeAttachment[vaName]
+	if present == (value == "true") {
+		return fmt.Errorf("expected VolumeAttachment %s deleted %s, but present was %t", vaName, value, present)
+	}
+	return nil
+}
+
+func (f *feature) theDriverPodLimitsAre(grace, escalation, flapLimit, flapWindow int) error {
+	SetDriverPodLimits(time.Duration(grace)*time.Second, time.Duration(escalation)*time.Second)
+	SetDriverPodFlapLimits(flapLimit, time.Duration(flapWindow)*time.Second)
+	return nil
+}
+
+func (f *feature) theDriverNodePodOnWentDownTimesAndIsForSeconds(nodeName string, downs int, state string, seconds int) error {
+	PodmonDriverPodTaintKey = vxflexDriverPodTaint
+	// each outage but the last lasts a second and is a second apart
+	last := time.Now().Add(-time.Duration(seconds) * time.Second)
+	for i := 0; i < downs; i++ {
+		down := last.Add(-time.Duration(2*(downs-1-i)) * time.Second)
+		f.podmonMonitor.DriverPods.observe(nodeName, false, down)
+		if i < downs-1 {
+			f.podmonMonitor.DriverPods.observe(nodeName, true, down.Add(time.Second))
+		}
+	}
+	if state == "Ready" {
+		f.podmonMonitor.DriverPods.observe(nodeName, true, last)
+	}
+	return nil
+}
+
+func (f *feature) iCallReconcileDriverPodsTimes(count int) error {
+	PodmonDriverPodTaintKey = vxflexDriverPodTaint
+	for i := 0; i < count; i++ {
+		f.podmonMonitor.reconcileDriverPods(time.Now())
+	}
+	waitForCleanups(&f.podmonMonitor.Scheduler, 5*time.Second)
+	return nil
+}
+
+func (f *feature) iCallDriverPodReconciler() error {
+	PodmonDriverPodTaintKey = vxflexDriverPodTaint
+	DriverPodReconcileInterval = 5 * time.Millisecond
+	f.podmonMonitor.DriverPodReconciler()
+	waitForCleanups(&f.podmonMonitor.Scheduler, 5*time.Second)
+	return nil
+}
+
+func (f *feature) theNodeHasTheDriverPodTaint(nodeName, value string) error {
+	// read the node directly, GetNode may have an induced error
+	node, tainted := f.k8sapiMock.NameToNode[nodeName], false
+	if node != nil {
+		tainted = nodeHasTaint(node, vxflexDriverPodTaint, v1.TaintEffectNoSchedule)
+	}
+	if tainted != (value == "true") {
+		return fmt.Errorf("expected node %s driver pod taint %s but was %t", nodeName, value, tainted)
+	}
+	return nil
+}
+
+func (f *feature) theDriverNodePodOnIsTracked(nodeName, value string) error {
+	f.podmonMonitor.DriverPods.mutex.Lock()
+	_, tracked := f.podmonMonitor.DriverPods.nodes[nodeName]
+	f.podmonMonitor.DriverPods.mutex.Unlock()
+	if tracked != (value == "true") {
+		return fmt.Errorf("expected driver node pod on %s tracked %s but was %t", nodeName, value, tracked)
+	}
+	return nil
+}
+
+func (f *feature) theNodeMonitorHasPodsRegistered(count int) error {
+	actual := 0
+	f.podmonMonitor.PodKeyMap.Range(func(_, _ interface{}) bool {
+		actual++
+		return true
+	})
+	return AssertExpectedAndActual(assert.Equal, count, actual,
+		"Expected %d pods registered, but there were %d", count, actual)
+}
+
+func (f *feature) theFailoverLimitsAreNodesPercent(maxNodes, maxPercent int) error {
+	SetFailoverLimits(maxNodes, maxPercent, time.Minute)
+	return nil
+}
+
+func (f *feature) theFailoverGuardHasAdmittedNode(nodeName string) error {
+	if admitted, _ := f.podmonMonitor.Guard.admit(nodeName, f.podmonMonitor.nodeCount(), time.Now()); !admitted {
+		return fmt.Errorf("node %s was not admitted by the failover guard", nodeName)
+	}
+	return nil
+}
+
+func (f *feature) theFailoverGuardWindowHasPassed() error {
+	guard := &f.podmonMonitor.Guard
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.nodes = nil
+	guard.pausedUntil = time.Time{}
+	return nil
+}
+
+func (f *feature) thePodHasAnnotation(key, value string) error {
+	if key == "none" {
+		return nil
+	}
+	pods := append([]*v1.Pod{f.pod}, f.podList...)
+	for _, pod := range pods {
+		if pod == nil {
+			continue
+		}
+		if pod.ObjectMeta.Annotations == nil {
+			pod.ObjectMeta.Annotations = make(map[string]string)
+		}
+		pod.ObjectMeta.Annotations[key] = value
+	}
+	return nil
+}
+
 func (f *feature) iInduceError(induced string) error {
 	switch induced {
 	case "none":
@@ -327,10 +777,14 @@ func (f *feature) iInduceError(induced string) error {
 		f.k8sapiMock.InducedErrors.IsVolumeAttachmentToPod = true
 	case "GetPersistentVolumeClaimName":
 		f.k8sapiMock.InducedErrors.GetPersistentVolumeClaimName = true
+	case "GetPodsOnNode":
+		f.k8sapiMock.InducedErrors.GetPodsOnNode = true
 	case "GetPersistentVolume":
 		f.k8sapiMock.InducedErrors.GetPersistentVolume = true
 	case "GetPersistentVolumeClaim":
 		f.k8sapiMock.InducedErrors.GetPersistentVolumeClaim = true
+	case "GetNodeNotFound":
+		f.k8sapiMock.InducedErrors.GetNodeNotFound = true
 	case "GetNode":
 		f.k8sapiMock.InducedErrors.GetNode = true
 	case "GetNodeWithTimeout":
@@ -357,12 +811,20 @@ func (f *feature) iInduceError(induced string) error {
 		f.csiapiMock.ValidateVolumeHostConnectivityResponse.Connected = true
 	case "NodeNotConnected":
 		f.csiapiMock.ValidateVolumeHostConnectivityResponse.Connected = false
+	case "IOInProgress":
+		f.csiapiMock.ValidateVolumeHostConnectivityResponse.IosInProgress = true
+	case "CSINotConnected":
+		f.csiapiMock.InducedErrors.NotConnected = true
 	case "CSIExtensionsNotPresent":
 		f.podmonMonitor.CSIExtensionsPresent = false
 	case "CSIVolumePathDirRead":
 		f.failCSIVolumePathDirRead = true
 	case "K8sTaint":
 		f.k8sapiMock.InducedErrors.TaintNode = true
+	case "AnnotateNode":
+		f.k8sapiMock.InducedErrors.AnnotateNode = true
+	case "SetNodeCondition":
+		f.k8sapiMock.InducedErrors.SetNodeCondition = true
 	case "RemoveDir":
 		f.failRemoveDir = "Could not delete"
 	case "BadWatchObject":
@@ -371,6 +833,14 @@ func (f *feature) iInduceError(induced string) error {
 		gofsutil.GOFSMock.InduceUnmountError = true
 	case "CreateEvent":
 		f.k8sapiMock.InducedErrors.CreateEvent = true
+	case "GetPodEvents":
+		f.k8sapiMock.InducedErrors.GetPodEvents = true
+	case "GetConfigMaps":
+		f.k8sapiMock.InducedErrors.GetConfigMaps = true
+	case "CreateOrUpdateConfigMap":
+		f.k8sapiMock.InducedErrors.CreateOrUpdateConfigMap = true
+	case "DeleteConfigMap":
+		f.k8sapiMock.InducedErrors.DeleteConfigMap = true
 	case "GetContainerInfo":
 		f.criMock.InducedErrors.GetContainerInfo = true
 	case "ContainerRunning":
@@ -417,8 +887,8 @@ func (f *feature) theLastLogMessageContains(errormsg string) error {
 		return nil
 	} else if f.validateWatcherMessage {
 		possibleLastMsg := []string{
-			"PodMonitor.Mode not set", "PodWatcher stopped...", "Setup of PodWatcher complete", "node name: node1",
-			"Setup of NodeWatcher complete", "NodeWatcher stopped...", "labelSelector:", "attempting to start",
+			"PodMonitor.Mode not set", "Setup of PodWatcher complete", "node name: node1",
+			"Setup of NodeWatcher complete", "labelSelector:", "attempting to start",
 		}
 		for _, msg := range possibleLastMsg {
 			if strings.Contains(lastEntry.Message, msg) {
@@ -480,6 +950,12 @@ func (f *feature) aNodeWithTaint(nodeName, taint string) error {
 			Effect: v1.TaintEffectNoSchedule,
 		}
 		node.Spec.Taints = append(node.Spec.Taints, taint)
+	case "out-of-service":
+		taint := v1.Taint{
+			Key:    outOfServiceTaint,
+			Effect: v1.TaintEffectNoExecute,
+		}
+		node.Spec.Taints = append(node.Spec.Taints, taint)
 	case "podmon-nosched":
 		taint := v1.Taint{
 			Key:    PodmonTaintKey,
@@ -508,19 +984,25 @@ func (f *feature) iCallControllerModePodHandlerWithEvent(event string) error {
 		f.podmonMonitor.controllerModePodHandler(f.pod2, eventType)
 	}
 
-	// Wait on the go routine to finish
-	time.Sleep(100 * time.Millisecond)
-	podKey := getPodKey(f.pod)
-	Lock(podKey, f.pod, LockSleepTimeDelay)
-	Unlock(podKey)
+	// Wait on the cleanups to finish
+	waitForCleanups(&f.podmonMonitor.Scheduler, 5*time.Second)
 	return nil
 }
 
+// waitForCleanups waits until the scheduler has no cleanups waiting or running, or the timeout expires.
+func waitForCleanups(scheduler *CleanupScheduler, timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if status := scheduler.status(); len(status.Running) == 0 && len(status.Waiting) == 0 {
+			return
+		}
+	}
+}
+
 func (f *feature) thePodIsCleaned(boolean string) error {
 	lastentry := f.loghook.LastEntry()
 	switch boolean {
 	case "true":
-		if strings.Contains(lastentry.Message, "End Processing pods with affinity map") && f.pod2 != nil {
+		if strings.Contains(lastentry.Message, "End Processing pods with affinity") && f.pod2 != nil {
 			return nil
 		}
 		if !strings.Contains(lastentry.Message, "Successfully cleaned up pod") {
@@ -538,6 +1020,173 @@ func (f *feature) iCallArrayConnectivityMonitor() error {
 	ArrayConnectivityConnectionLossThreshold = 1
 	SetArrayConnectivityPollRate(1 * time.Millisecond)
 	f.podmonMonitor.ArrayConnectivityMonitor()
+	waitForCleanups(&f.podmonMonitor.Scheduler, 5*time.Second)
+	return nil
+}
+
+func (f *feature) podsForNodeOnArraysCondition(node, arrays, condition string) error {
+	f.podList = make([]*v1.Pod, 0)
+	for _, arrayID := range strings.Split(arrays, ",") {
+		pod := f.createPod(node, 1, condition, "false")
+		pvName := fmt.Sprintf("pv-%s-%d", pod.ObjectMeta.UID, 0)
+		f.k8sapiMock.NameToPV[pvName].Spec.CSI.VolumeAttributes = map[string]string{arrayIDVolumeAttribute: arrayID}
+		pod.ObjectMeta.Labels = map[string]string{"array": arrayID}
+		f.k8sapiMock.AddPod(pod)
+		f.podList = append(f.podList, pod)
+	}
+	f.pod = f.podList[0]
+	node1, _ := f.k8sapiMock.GetNode(context.Background(), node)
+	f.node = node1
+	f.k8sapiMock.AddNode(node1)
+	for _, pod := range f.podList {
+		if err := f.podmonMonitor.controllerModePodHandler(pod, watch.Modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *feature) arrayHasLostConnectivity(lostArray string) error {
+	f.csiapiMock.ValidateVolumeHostConnectivityResponse.Connected = true
+	f.csiapiMock.ArrayIDToConnected = map[string]bool{lostArray: false}
+	return nil
+}
+
+func (f *feature) theArrayOutageNodesPercentIs(percent int) error {
+	SetArrayOutageNodesPercent(percent)
+	return nil
+}
+
+func (f *feature) arrayHasAnOutage(arrayID, value string) error {
+	outage := f.podmonMonitor.Outages.inOutage(arrayID)
+	if outage != (value == "true") {
+		return fmt.Errorf("expected array %s outage %s but was %t", arrayID, value, outage)
+	}
+	return nil
+}
+
+func (f *feature) publishingTheArrayConnectivityIs(value string) error {
+	SetPublishArrayConnectivity(value == "true")
+	return nil
+}
+
+func (f *feature) theNodeHasArrayConnectivityConditionReason(nodeName, status, reason string) error {
+	node, err := f.k8sapiMock.GetNode(context.Background(), nodeName)
+	if err != nil {
+		return err
+	}
+	conditionType := v1.NodeConditionType(PodmonTaintKey + arrayConnectivityConditionSuffix)
+	for _, condition := range node.Status.Conditions {
+		if condition.Type != conditionType {
+			continue
+		}
+		if string(condition.Status) != status || condition.Reason != reason {
+			return fmt.Errorf("expected node %s condition %s status %s reason %s, but was %s %s", nodeName, conditionType, status, reason, condition.Status, condition.Reason)
+		}
+		return nil
+	}
+	if status != "none" {
+		return fmt.Errorf("expected node %s condition %s status %s, but there was none", nodeName, conditionType, status)
+	}
+	return nil
+}
+
+func (f *feature) theNodeHasConnectedArrays(nodeName, arrays string) error {
+	node, err := f.k8sapiMock.GetNode(context.Background(), nodeName)
+	if err != nil {
+		return err
+	}
+	value, ok := node.ObjectMeta.Annotations[PodmonTaintKey+connectedArraysAnnotationSuffix]
+	if arrays == "none" {
+		if ok {
+			return fmt.Errorf("expected node %s to have no connected arrays annotation, but it was %s", nodeName, value)
+		}
+		return nil
+	}
+	if !ok || value != arrays {
+		return fmt.Errorf("expected node %s connected arrays %s, but were %s", nodeName, arrays, value)
+	}
+	return nil
+}
+
+func (f *feature) theNodeConnectivityReportIntervalIsSeconds(interval int) error {
+	SetNodeConnectivityReportInterval(time.Duration(interval) * time.Second)
+	return nil
+}
+
+func (f *feature) nodeReportedArrayConnectedSecondsAgo(nodeName, arrayID, connected string, age int) error {
+	if connected == "none" {
+		return nil
+	}
+	report := nodeConnectivityReport{
+		Time:   time.Now().Add(-time.Duration(age) * time.Second),
+		Arrays: map[string]bool{arrayID: connected == "true"},
+	}
+	value, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return f.k8sapiMock.AnnotateNode(context.Background(), nodeName, arrayConnectivityAnnotation(PodmonTaintKey), string(value))
+}
+
+func (f *feature) iCallNodeConnectivityReporter() error {
+	if GetNodeConnectivityReportInterval() > 0 {
+		SetNodeConnectivityReportInterval(time.Millisecond)
+	}
+	NodeConnectivityReportIdleInterval = time.Millisecond
+	f.podmonMonitor.NodeConnectivityReporter()
+	return nil
+}
+
+func (f *feature) nodeReportsArrayConnected(nodeName, arrayID, connected string) error {
+	node, err := f.k8sapiMock.GetNode(context.Background(), nodeName)
+	if err != nil {
+		return err
+	}
+	report := getNodeConnectivityReport(node, PodmonTaintKey)
+	if connected == "none" {
+		if report != nil && len(report.Arrays) > 0 {
+			return fmt.Errorf("expected node %s to report no array connectivity, but it reported %v", nodeName, report.Arrays)
+		}
+		return nil
+	}
+	if report == nil {
+		return fmt.Errorf("expected node %s to report its array connectivity, but there was no report", nodeName)
+	}
+	actual, ok := report.Arrays[arrayID]
+	if !ok || fmt.Sprintf("%t", actual) != connected {
+		return fmt.Errorf("expected node %s to report array %s connected %s, but the report was %v", nodeName, arrayID, connected, report.Arrays)
+	}
+	return nil
+}
+
+func (f *feature) thePodsOnArrayAreCleaned(arrayID, boolean string) error {
+	for _, pod := range f.podList {
+		if pod.ObjectMeta.Labels["array"] != arrayID {
+			continue
+		}
+		_, present := f.k8sapiMock.KeyToPod[getPodKey(pod)]
+		if boolean == "true" && present {
+			return fmt.Errorf("Expected pod %s on array %s to be cleaned but it was not", getPodKey(pod), arrayID)
+		}
+		if boolean == "false" && !present {
+			return fmt.Errorf("Expected pod %s on array %s not to be cleaned but it was", getPodKey(pod), arrayID)
+		}
+	}
+	return nil
+}
+
+func (f *feature) thePodsHaveArrayIDs(arrayIDs string) error {
+	for _, pod := range f.podList {
+		info, ok := f.podmonMonitor.PodKeyToControllerPodInfo.Load(getPodKey(pod))
+		if !ok {
+			return fmt.Errorf("Expected ControllerPodInfo for pod %s but wasn't there", getPodKey(pod))
+		}
+		actual := strings.Join(info.(*ControllerPodInfo).ArrayIDs, ",")
+		if !strings.Contains(arrayIDs, actual) {
+			return fmt.Errorf("Expected pod %s arrayIDs to be one of %s but was %s", getPodKey(pod), arrayIDs, actual)
+		}
+	}
 	return nil
 }
 
@@ -658,7 +1307,7 @@ func (f *feature) createPod(node string, nvolumes int, condition, affinity strin
 			Message: condition,
 		}
 		pod.Status.Conditions = append(pod.Status.Conditions, condition)
-	case "CrashLoop":
+	case "CrashLoop", "CrashLoopAppError":
 		waiting := &v1.ContainerStateWaiting{
 			Reason:  crashLoopBackOffReason,
 			Message: "unit test condition",
@@ -669,6 +1318,12 @@ func (f *feature) createPod(node string, nvolumes int, condition, affinity strin
 		containerStatus := v1.ContainerStatus{
 			State: state,
 		}
+		if condition == "CrashLoop" {
+			containerStatus.LastTerminationState.Terminated = &v1.ContainerStateTerminated{
+				ExitCode: 1,
+				Message:  "open /data/file: Input/output error",
+			}
+		}
 		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, containerStatus)
 		// PodCondition is Ready=false
 		condition := v1.PodCondition{
@@ -950,36 +1605,35 @@ func (f *feature) iCallAPIMonitorLoop(nodeName string) error {
 
 func (f *feature) iCallStartPodMonitorWithKeyAndValue(key, value string) error {
 	MonitorRestartTimeDelay = 5 * time.Millisecond
-	client := fake.NewSimpleClientset()
 	f.validateWatcherMessage = true
-	go StartPodMonitor(K8sAPI, client, key, value, MonitorRestartTimeDelay)
+	if f.k8sapiMock.InducedErrors.Watch {
+		// StartPodMonitor retries until the handler can be added
+		go StartPodMonitor(K8sAPI, key, value, MonitorRestartTimeDelay)
+		return nil
+	}
+	StartPodMonitor(K8sAPI, key, value, MonitorRestartTimeDelay)
 	return nil
 }
 
 func (f *feature) iCloseTheWatcher() error {
 	time.Sleep(7 * time.Millisecond)
-	f.k8sapiMock.Watcher.Reset()
 	return nil
 }
 
 func (f *feature) iSendAPodEventType(eventType string) error {
-	fakeWatcher := f.k8sapiMock.Watcher
-	switch eventType {
-	case "None":
-	case "Add":
-		if f.badWatchObject {
-			fakeWatcher.Add(f.node)
-		} else {
-			fakeWatcher.Add(f.pod)
+	var object interface{} = f.pod
+	if f.badWatchObject {
+		object = f.node
+	}
+	for _, handler := range f.k8sapiMock.PodEventHandlers {
+		switch eventType {
+		case "Add":
+			handler(watch.Added, object)
+		case "Modify":
+			handler(watch.Modified, object)
+		case "Delete":
+			handler(watch.Deleted, object)
 		}
-	case "Modify":
-		fakeWatcher.Modify(f.pod)
-	case "Delete":
-		fakeWatcher.Delete(f.pod)
-	case "Error":
-		fakeWatcher.Error(nil)
-	case "Stop":
-		fakeWatcher.Stop()
 	}
 	return nil
 }
@@ -989,87 +1643,47 @@ func (f *feature) podMonitorMode(mode string) error {
 	return nil
 }
 
-func (f *feature) iCallStartNodeMonitorWithKeyAndValue(key, value string) error {
+func (f *feature) iCallStartNodeMonitorWithKeyAndValue(_, _ string) error {
 	MonitorRestartTimeDelay = 5 * time.Millisecond
-	client := fake.NewSimpleClientset()
 	f.validateWatcherMessage = true
-	go StartNodeMonitor(K8sAPI, client, key, value, MonitorRestartTimeDelay)
+	if f.k8sapiMock.InducedErrors.Watch {
+		// StartNodeMonitor retries until the handler can be added
+		go StartNodeMonitor(K8sAPI, MonitorRestartTimeDelay)
+		return nil
+	}
+	StartNodeMonitor(K8sAPI, MonitorRestartTimeDelay)
 	return nil
 }
 
 func (f *feature) iSendANodeEventType(eventType string) error {
 	node, _ := f.k8sapiMock.GetNode(context.Background(), "node1")
 	f.node = node
-	fakeWatcher := f.k8sapiMock.Watcher
+	handler := f.k8sapiMock.NodeEventHandler
+	if handler == nil {
+		return nil
+	}
+	var object interface{} = f.node
+	if f.badWatchObject {
+		object = f.pod
+	}
 	switch eventType {
-	case "None":
 	case "Add":
-		if f.badWatchObject {
-			fakeWatcher.Add(f.pod)
-		} else {
-			fakeWatcher.Add(f.node)
-		}
+		handler(watch.Added, object)
 	case "Modify":
-		fakeWatcher.Modify(f.node)
+		handler(watch.Modified, object)
 	case "Delete":
-		fakeWatcher.Delete(f.node)
-	case "Error":
-		fakeWatcher.Error(nil)
-	case "Stop":
-		fakeWatcher.Stop()
+		handler(watch.Deleted, object)
 	}
 	return nil
 }
 
-type safeCount struct {
-	lock  sync.Mutex
-	value int
-}
-
-func (c *safeCount) inc() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.value++
-}
-
-func (c *safeCount) equals(compareTo int) bool {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	return c.value == compareTo
-}
-
-func (c *safeCount) dump() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	fmt.Printf("value = %d", c.value)
-}
-
-func (f *feature) iCallTestLockAndGetPodKey() error {
+func (f *feature) iCallTestGetPodKey() error {
 	// Test getPodKey and splitPodKey
 	podkey := getPodKey(f.pod)
 	ns, name := splitPodKey(podkey)
 	if podkey != fmt.Sprintf("%s/%s", ns, name) {
 		return fmt.Errorf("Error in getPodKey/splitPodKey %s %s/%s", podkey, ns, name)
 	}
-	lockSleepTimeDelay := LockSleepTimeDelay
-	LockSleepTimeDelay = 100 * time.Millisecond
-	// Test Lock and Unlock
-	const nlocks = 5
-	var counter safeCount
-	for i := 0; i < nlocks; i++ {
-		go func(duration time.Duration) {
-			Lock(podkey, f.pod, duration)
-			counter.inc()
-			time.Sleep(duration)
-			Unlock(podkey)
-		}(LockSleepTimeDelay)
-	}
-	time.Sleep(10 * LockSleepTimeDelay)
-	LockSleepTimeDelay = lockSleepTimeDelay
-	counter.dump()
-	if !counter.equals(nlocks) {
-		return fmt.Errorf("Error in Lock()/Unlock()")
-	}
 	return nil
 }
 
@@ -1252,7 +1866,7 @@ func (f *feature) aControllerPodWithPodaffinitylabels() error {
 	} else {
 		fmt.Printf("loghook last-entry %+v\n", f.loghook.LastEntry())
 	}
-	// This test is for error condition of func getPodAffinityLabels
+	// This test is for error condition of func getPodAffinityTerms
 	// testing only for VxflexosDriver
 	Driver = new(VxflexDriver)
 
@@ -1281,8 +1895,8 @@ func (f *feature) createAPodForNodeWithVolumesConditionAffinityErrorcase(node st
 	return nil
 }
 
-func (f *feature) iCallGetPodAffinityLabels() error {
-	f.podmonMonitor.getPodAffinityLabels(f.pod)
+func (f *feature) iCallGetPodAffinityTerms() error {
+	getPodAffinityTerms(f.pod)
 	return nil
 }
 
@@ -1314,6 +1928,7 @@ func (f *feature) iCallControllerModeDriverPodHandlerWithEvent(event string) err
 	if f.pod2 != nil {
 		f.podmonMonitor.controllerModeDriverPodHandler(f.pod2, eventType)
 	}
+	waitForCleanups(&f.podmonMonitor.Scheduler, 5*time.Second)
 	return nil
 }
 
@@ -1494,6 +2109,51 @@ func MonitorTestScenarioInit(context *godog.ScenarioContext) {
 	context.Step(`^a pod for node "([^"]*)" with (\d+) with RWX volumes condition$`, f.aPodForNodeWithRWXVolumesCondition)
 	context.Step(`^I call controllerCleanupPod for node "([^"]*)"$`, f.iCallControllerCleanupPodForNode)
 	context.Step(`^I induce error "([^"]*)"$`, f.iInduceError)
+	context.Step(`^a cleanup ledger in namespace "([^"]*)"$`, f.aCleanupLedgerInNamespace)
+	context.Step(`^a cleanup ledger entry for the pod at step "([^"]*)"$`, f.aCleanupLedgerEntryForThePodAtStep)
+	context.Step(`^the ledger pod has been deleted "([^"]*)"$`, f.theLedgerPodHasBeenDeleted)
+	context.Step(`^I call ResumeCleanups$`, f.iCallResumeCleanups)
+	context.Step(`^the cleanup ledger has (\d+) entries$`, f.theCleanupLedgerHasEntries)
+	context.Step(`^the cleanup ledger step is "([^"]*)"$`, f.theCleanupLedgerStepIs)
+	context.Step(`^the pod is present "([^"]*)"$`, f.thePodIsPresent)
+	context.Step(`^dry-run mode is "([^"]*)"$`, f.dryRunModeIs)
+	context.Step(`^the failover limits are (\d+) nodes (\d+) percent$`, f.theFailoverLimitsAreNodesPercent)
+	context.Step(`^the failover guard has admitted node "([^"]*)"$`, f.theFailoverGuardHasAdmittedNode)
+	context.Step(`^the failover guard window has passed$`, f.theFailoverGuardWindowHasPassed)
+	context.Step(`^the pod has annotation "([^"]*)" "([^"]*)"$`, f.thePodHasAnnotation)
+	context.Step(`^the node "([^"]*)" has the podmon taint "([^"]*)"$`, f.theNodeHasThePodmonTaint)
+	context.Step(`^the fencing mode is "([^"]*)"$`, f.theFencingModeIs)
+	context.Step(`^a tainted node "([^"]*)" stable for (\d+) seconds$`, f.aTaintedNodeStableForSeconds)
+	context.Step(`^the node "([^"]*)" reboots with bootID "([^"]*)"$`, f.theNodeRebootsWithBootID)
+	context.Step(`^the driver node pod on "([^"]*)" is ready "([^"]*)"$`, f.theDriverNodePodOnIsReady)
+	context.Step(`^a cleaned up pod on "([^"]*)" with stale VolumeAttachment "([^"]*)"$`, f.aCleanedUpPodOnWithStaleVolumeAttachment)
+	context.Step(`^a cleaned up pod on "([^"]*)" with a volume on array "([^"]*)"$`, f.aCleanedUpPodOnWithAVolumeOnArray)
+	context.Step(`^I call reconcileNodeRecovery$`, f.iCallReconcileNodeRecovery)
+	context.Step(`^(\d+) events with reason "([^"]*)" are sent$`, f.eventsWithReasonAreSent)
+	context.Step(`^the CrashLoopBackOff limits are (\d+) retries backoff (\d+) window (\d+) storage errors only "([^"]*)"$`, f.theCrashLoopBackOffLimitsAre)
+	context.Step(`^the pod has a "([^"]*)" event with reason "([^"]*)"$`, f.thePodHasEventWithReason)
+	context.Step(`^the pod was deleted for CrashLoopBackOff (\d+) times (\d+) seconds ago$`, f.thePodWasDeletedForCrashLoopBackOffTimesSecondsAgo)
+	context.Step(`^the pod has (\d+) CrashLoopBackOff deletions$`, f.thePodHasCrashLoopBackOffDeletions)
+	context.Step(`^the pod's volumes are still attached to node "([^"]*)"$`, f.thePodsVolumesAreStillAttachedToNode)
+	context.Step(`^a pod on node "([^"]*)" still uses the pod's volumes$`, f.aPodOnNodeStillUsesThePodsVolumes)
+	context.Step(`^I call multiAttachHandler for the pod with message "([^"]*)" and selector "([^"]*)"$`, f.iCallMultiAttachHandlerForThePodWithMessageAndSelector)
+	context.Step(`^the stale VolumeAttachments are deleted "([^"]*)"$`, f.theStaleVolumeAttachmentsAreDeleted)
+	context.Step(`^I call StartMultiAttachMonitor$`, f.iCallStartMultiAttachMonitor)
+	context.Step(`^a VolumeAttachment "([^"]*)" on node "([^"]*)" for driver "([^"]*)"$`, f.aVolumeAttachmentOnNodeForDriver)
+	context.Step(`^a pod on node "([^"]*)" using the volume of VolumeAttachment "([^"]*)" phase "([^"]*)"$`, f.aPodOnNodeUsingTheVolumeOfVolumeAttachmentPhase)
+	context.Step(`^the node "([^"]*)" state is "([^"]*)"$`, f.theNodeStateIs)
+	context.Step(`^the orphaned VolumeAttachment mode is "([^"]*)"$`, f.theOrphanedVolumeAttachmentModeIs)
+	context.Step(`^I call reconcileOrphanedVAs (\d+) times$`, f.iCallReconcileOrphanedVAsTimes)
+	context.Step(`^I call OrphanedVolumeAttachmentReconciler$`, f.iCallOrphanedVolumeAttachmentReconciler)
+	context.Step(`^the VolumeAttachment "([^"]*)" is deleted "([^"]*)"$`, f.theVolumeAttachmentIsDeleted)
+	context.Step(`^the driver pod limits are grace (\d+) escalation (\d+) flaps (\d+) window (\d+)$`, f.theDriverPodLimitsAre)
+	context.Step(`^the driver node pod on "([^"]*)" went down (\d+) times and is "([^"]*)" for (\d+) seconds$`, f.theDriverNodePodOnWentDownTimesAndIsForSeconds)
+	context.Step(`^I call reconcileDriverPods (\d+) times$`, f.iCallReconcileDriverPodsTimes)
+	context.Step(`^I call DriverPodReconciler$`, f.iCallDriverPodReconciler)
+	context.Step(`^the node "([^"]*)" has the driver pod taint "([^"]*)"$`, f.theNodeHasTheDriverPodTaint)
+	context.Step(`^the driver node pod on "([^"]*)" is tracked "([^"]*)"$`, f.theDriverNodePodOnIsTracked)
+	context.Step(`^the node "([^"]*)" has the out-of-service taint "([^"]*)"$`, f.theNodeHasTheOutOfServiceTaint)
+	context.Step(`^the node monitor has (\d+) pods registered$`, f.theNodeMonitorHasPodsRegistered)
 	context.Step(`^the last log message contains "([^"]*)"$`, f.theLastLogMessageContains)
 	context.Step(`^the return status is "([^"]*)"$`, f.theReturnStatusIs)
 	context.Step(`^a controllerPodInfo is present "([^"]*)"$`, f.aControllerPodInfoIsPresent)
@@ -1501,6 +2161,19 @@ func MonitorTestScenarioInit(context *godog.ScenarioContext) {
 	context.Step(`^I call controllerModePodHandler with event "([^"]*)"$`, f.iCallControllerModePodHandlerWithEvent)
 	context.Step(`^the pod is cleaned "([^"]*)"$`, f.thePodIsCleaned)
 	context.Step(`^I call ArrayConnectivityMonitor$`, f.iCallArrayConnectivityMonitor)
+	context.Step(`^pods for node "([^"]*)" on arrays "([^"]*)" condition "([^"]*)"$`, f.podsForNodeOnArraysCondition)
+	context.Step(`^array "([^"]*)" has lost connectivity$`, f.arrayHasLostConnectivity)
+	context.Step(`^the array outage nodes percent is (\d+)$`, f.theArrayOutageNodesPercentIs)
+	context.Step(`^array "([^"]*)" has an outage "([^"]*)"$`, f.arrayHasAnOutage)
+	context.Step(`^the node connectivity report interval is (\d+) seconds$`, f.theNodeConnectivityReportIntervalIsSeconds)
+	context.Step(`^publishing the array connectivity is "([^"]*)"$`, f.publishingTheArrayConnectivityIs)
+	context.Step(`^the node "([^"]*)" has array connectivity condition "([^"]*)" reason "([^"]*)"$`, f.theNodeHasArrayConnectivityConditionReason)
+	context.Step(`^the node "([^"]*)" has connected arrays "([^"]*)"$`, f.theNodeHasConnectedArrays)
+	context.Step(`^node "([^"]*)" reported array "([^"]*)" connected "([^"]*)" (\d+) seconds ago$`, f.nodeReportedArrayConnectedSecondsAgo)
+	context.Step(`^I call NodeConnectivityReporter$`, f.iCallNodeConnectivityReporter)
+	context.Step(`^node "([^"]*)" reports array "([^"]*)" connected "([^"]*)"$`, f.nodeReportsArrayConnected)
+	context.Step(`^the pods on array "([^"]*)" are cleaned "([^"]*)"$`, f.thePodsOnArrayAreCleaned)
+	context.Step(`^the pods have arrayIDs "([^"]*)"$`, f.thePodsHaveArrayIDs)
 	context.Step(`^I call nodeModePodHandler for node "([^"]*)" with event "([^"]*)"$`, f.iCallNodeModePodHandlerForNodeWithEvent)
 	context.Step(`^I call nodeModeCleanupPods for node "([^"]*)"$`, f.iCallNodeModeCleanupPodsForNode)
 	context.Step(`^I call nodeModeCleanupPods for node "([^"]*)" with empty private mount$`, f.iCallNodeModeCleanupPodsForNodeWithEmptyPrivateMount)
@@ -1520,10 +2193,10 @@ func MonitorTestScenarioInit(context *godog.ScenarioContext) {
 	context.Step(`^pod monitor mode "([^"]*)"$`, f.podMonitorMode)
 	context.Step(`^I call StartNodeMonitor with key "([^"]*)" and value "([^"]*)"$`, f.iCallStartNodeMonitorWithKeyAndValue)
 	context.Step(`^I send a node event type "([^"]*)"$`, f.iSendANodeEventType)
-	context.Step(`^I call test lock and getPodKey$`, f.iCallTestLockAndGetPodKey)
+	context.Step(`^I call test getPodKey$`, f.iCallTestGetPodKey)
 	context.Step(`^a controller pod with podaffinitylabels$`, f.aControllerPodWithPodaffinitylabels)
 	context.Step(`^create a pod for node "([^"]*)" with (\d+) volumes condition "([^"]*)" affinity "([^"]*)" errorcase "([^"]*)"$`, f.createAPodForNodeWithVolumesConditionAffinityErrorcase)
-	context.Step(`^I call getPodAffinityLabels$`, f.iCallGetPodAffinityLabels)
+	context.Step(`^I call getPodAffinityTerms$`, f.iCallGetPodAffinityTerms)
 	context.Step(`^a driver pod for node "([^"]*)" with condition "([^"]*)"$`, f.aDriverPodForNodeWithCondition)
 	context.Step(`^I call controllerModeDriverPodHandler with event "([^"]*)"$`, f.iCallControllerModeDriverPodHandlerWithEvent)
 	context.Step(`^the node "([^"]*)" is tainted "([^"]*)"$`, f.theNodeIsTainted)
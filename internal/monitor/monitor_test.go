@@ -17,12 +17,27 @@
 package monitor
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"podmon/internal/mocks"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cucumber/godog"
 	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 func TestMain(m *testing.M) {
@@ -88,31 +103,1073 @@ func TestNodeMode(t *testing.T) {
 	log.Printf("Node-mode test finished")
 }
 
-func TestMapEqualsMap(t *testing.T) {
+func TestAffinityGroups(t *testing.T) {
+	node := func(name, zone string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"topology.kubernetes.io/zone": zone}}}
+	}
+	term := func(topologyKey string, expr metav1.LabelSelectorRequirement) v1.PodAffinityTerm {
+		return v1.PodAffinityTerm{
+			TopologyKey:   topologyKey,
+			LabelSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{expr}},
+		}
+	}
+	exists := func(key string) metav1.LabelSelectorRequirement {
+		return metav1.LabelSelectorRequirement{Key: key, Operator: metav1.LabelSelectorOpExists}
+	}
+	notIn := func(key, value string) metav1.LabelSelectorRequirement {
+		return metav1.LabelSelectorRequirement{Key: key, Operator: metav1.LabelSelectorOpNotIn, Values: []string{value}}
+	}
+	pod := func(podKey string, node *v1.Node, podLabels map[string]string, terms ...v1.PodAffinityTerm) *ControllerPodInfo {
+		return &ControllerPodInfo{PodKey: podKey, Node: node, PodLabels: podLabels, PodAffinityTerms: terms}
+	}
+	cases := []struct {
+		pods   []*ControllerPodInfo
+		groups string
+	}{
+		// Exists on the same node
+		{[]*ControllerPodInfo{
+			pod("ns/a", node("n1", "z1"), nil, term(hostNameTopologyKey, exists("db"))),
+			pod("ns/b", node("n1", "z1"), map[string]string{"db": "x"}),
+			pod("ns/c", node("n1", "z1"), map[string]string{"web": "x"}),
+		}, "ns/a,ns/b|ns/c"},
+		// NotIn
+		{[]*ControllerPodInfo{
+			pod("ns/a", node("n1", "z1"), nil, term(hostNameTopologyKey, notIn("tier", "web"))),
+			pod("ns/b", node("n1", "z1"), map[string]string{"tier": "web"}),
+			pod("ns/c", node("n1", "z1"), map[string]string{"tier": "db"}),
+		}, "ns/a,ns/c|ns/b"},
+		// zone topology groups pods on different nodes in the same zone only
+		{[]*ControllerPodInfo{
+			pod("ns/a", node("n1", "z1"), nil, term("topology.kubernetes.io/zone", exists("db"))),
+			pod("ns/b", node("n2", "z1"), map[string]string{"db": "x"}),
+			pod("ns/c", node("n3", "z2"), map[string]string{"db": "x"}),
+		}, "ns/a,ns/b|ns/c"},
+		// hostname topology doesn't group pods on different nodes
+		{[]*ControllerPodInfo{
+			pod("ns/a", node("n1", "z1"), nil, term(hostNameTopologyKey, exists("db"))),
+			pod("ns/b", node("n2", "z1"), map[string]string{"db": "x"}),
+		}, "ns/a|ns/b"},
+		// transitive groups: c has affinity to b, and b to a
+		{[]*ControllerPodInfo{
+			pod("ns/a", node("n1", "z1"), map[string]string{"app": "a"}),
+			pod("ns/x", node("n1", "z1"), nil),
+			pod("ns/c", node("n1", "z1"), nil, term(hostNameTopologyKey, exists("b"))),
+			pod("ns/b", node("n1", "z1"), map[string]string{"b": "x"}, term(hostNameTopologyKey, exists("app"))),
+		}, "ns/a,ns/c,ns/b|ns/x"},
+		// the term selects the pod's own namespace by default
+		{[]*ControllerPodInfo{
+			pod("ns/a", node("n1", "z1"), nil, term(hostNameTopologyKey, exists("db"))),
+			pod("other/b", node("n1", "z1"), map[string]string{"db": "x"}),
+		}, "ns/a|other/b"},
+	}
+	for caseNum, acase := range cases {
+		pm := &PodMonitorType{}
+		podKeys := make([]string, 0)
+		for _, info := range acase.pods {
+			pm.PodKeyToControllerPodInfo.Store(info.PodKey, info)
+			podKeys = append(podKeys, info.PodKey)
+		}
+		groups := make([]string, 0)
+		for _, group := range pm.affinityGroups(podKeys) {
+			groups = append(groups, strings.Join(group, ","))
+		}
+		if result := strings.Join(groups, "|"); result != acase.groups {
+			t.Errorf("Case %d: Expected groups %s got %s", caseNum, acase.groups, result)
+		}
+	}
+}
+
+// getPodRecorder records the pods the cleanups get.
+type getPodRecorder struct {
+	*mocks.K8sMock
+	mutex   sync.Mutex
+	podKeys []string
+}
+
+func (r *getPodRecorder) GetPod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	r.mutex.Lock()
+	r.podKeys = append(r.podKeys, namespace+"/"+name)
+	r.mutex.Unlock()
+	return r.K8sMock.GetPod(ctx, namespace, name)
+}
+
+func TestSubmitPodCleanupsRetriesFailedGroupPods(t *testing.T) {
+	maxRetries, baseDelay, maxDelay := GetCleanupRetryLimits()
+	defer SetCleanupRetryLimits(maxRetries, baseDelay, maxDelay)
+	SetCleanupRetryLimits(2, time.Millisecond, 4*time.Millisecond)
+	savedK8sAPI := K8sAPI
+	defer func() { K8sAPI = savedK8sAPI }()
+	k8sMock := &mocks.K8sMock{}
+	k8sMock.Initialize()
+	recorder := &getPodRecorder{K8sMock: k8sMock}
+	K8sAPI = recorder
+
+	// ns/a was rescheduled so its cleanup is skipped, ns/b can't be read so its cleanup fails
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1"}}
+	k8sMock.AddPod(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "a", UID: "new-uid"}, Spec: v1.PodSpec{NodeName: "n2"}})
+	term := v1.PodAffinityTerm{
+		TopologyKey:   hostNameTopologyKey,
+		LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"db": "x"}},
+	}
+	pm := &PodMonitorType{}
+	pm.PodKeyToControllerPodInfo.Store("ns/a", &ControllerPodInfo{PodKey: "ns/a", PodUID: "uid-a", Node: node, PodAffinityTerms: []v1.PodAffinityTerm{term}})
+	pm.PodKeyToControllerPodInfo.Store("ns/b", &ControllerPodInfo{PodKey: "ns/b", PodUID: "uid-b", Node: node, PodLabels: map[string]string{"db": "x"}})
+
+	pm.submitPodCleanups([]string{"ns/a", "ns/b"}, "NodeNotConnected")
+	waitForCleanups(&pm.Scheduler, 5*time.Second)
+	if len(k8sMock.EventReasons) != 1 || k8sMock.EventReasons[0] != affinityGroupCleanupReason {
+		t.Errorf("Expected one %s event got %v", affinityGroupCleanupReason, k8sMock.EventReasons)
+	}
+	expected := "ns/a,ns/b,ns/b,ns/b"
+	if podKeys := strings.Join(recorder.podKeys, ","); podKeys != expected {
+		t.Errorf("Expected the retries to only clean up the failed pod %s got %s", expected, podKeys)
+	}
+}
+
+func TestMultiAttachHandlerKeepsQueuedCleanup(t *testing.T) {
+	savedK8sAPI := K8sAPI
+	defer func() { K8sAPI = savedK8sAPI }()
+	k8sMock := &mocks.K8sMock{}
+	k8sMock.Initialize()
+	K8sAPI = k8sMock
+	k8sMock.AddPod(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "p1", UID: "uid-1"}, Spec: v1.PodSpec{NodeName: "n2"}})
+
+	// A cleanup of the pod is running, and another is waiting for it to finish.
+	pm := &PodMonitorType{}
+	release := make(chan struct{})
+	pm.Scheduler.submit([]string{"ns/p1"}, 0, func() error {
+		<-release
+		return nil
+	})
+	waitForCleanupRunning(&pm.Scheduler, "ns/p1")
+	var waitingRan atomic.Bool
+	pm.Scheduler.submit([]string{"ns/p1"}, 0, func() error {
+		waitingRan.Store(true)
+		return nil
+	})
+
+	event := &v1.Event{
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Namespace: "ns", Name: "p1"},
+		Reason:         failedAttachVolumeReason,
+		Message:        `Multi-Attach error for volume "pv1" Volume is already exclusively attached to one node and can't be attached to another`,
+	}
+	pm.multiAttachHandler(event, labels.Everything())
+	close(release)
+	waitForCleanups(&pm.Scheduler, 5*time.Second)
+	if !waitingRan.Load() {
+		t.Errorf("Expected the queued cleanup of the pod to run instead of being replaced by the Multi-Attach repair")
+	}
+}
+
+func TestGetArrayIDFromVolumeHandle(t *testing.T) {
+	cases := []struct {
+		driver       drivertype
+		volumeHandle string
+		arrayID      string
+	}{
+		{new(VxflexDriver), "7045c4cc20dffc0f-e6d4e5b400000004", "7045c4cc20dffc0f"},
+		{new(VxflexDriver), "e6d4e5b400000004", ""},
+		{new(UnityDriver), "csivol-6a7b3c2d1e-FC-apm00213404195-sv_123", "apm00213404195"},
+		{new(UnityDriver), "sv_123", ""},
+		{new(PScaleDriver), "k8s-7b1c2d3e4f=_=_=19=_=_=System=_=_=cluster1", "cluster1"},
+		{new(PScaleDriver), "k8s-7b1c2d3e4f", ""},
+		{new(PStoreDriver), "1cd254c9-7a83-4d9b-8a8f-1f2a3b4c5d6e/PS4ebb8d4e8488/scsi", "PS4ebb8d4e8488"},
+		{new(PStoreDriver), "1cd254c9-7a83-4d9b-8a8f-1f2a3b4c5d6e/PS4ebb8d4e8488/scsi:9f840c56-96e6-4de9-b5a3-27e7c20eaa77/PS9c5d3b1f2a4e", "PS4ebb8d4e8488"},
+		{new(PStoreDriver), "1cd254c9-7a83-4d9b-8a8f-1f2a3b4c5d6e", ""},
+		{new(PMaxDriver), "csi-ABC-pmax-7a8b9c0d1e-000197900123-00A1B", "000197900123"},
+		{new(PMaxDriver), "00A1B", ""},
+	}
+	for caseNum, acase := range cases {
+		arrayID := acase.driver.GetArrayIDFromVolumeHandle(acase.volumeHandle)
+		if arrayID != acase.arrayID {
+			t.Errorf("Case %d: Expected %s got %s", caseNum, acase.arrayID, arrayID)
+		}
+	}
+}
+
+func TestGenericDriver(t *testing.T) {
+	file := fmt.Sprintf("%s/driver-types.yaml", t.TempDir())
+	data := `drivers:
+  - driverPath: csi-generic.dell.com
+    name: generic
+    driverMountDir: '{{env "X_CSI_GENERIC_MOUNT_DIR" "/var/lib/kubelet/plugins/generic/disks"}}/{{.VolumeHandle}}'
+    driverBlockDev: /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/{{.PVName}}/{{.PodUID}}
+    stagingMountDir: /var/lib/kubelet/plugins/kubernetes.io/csi/pv/{{.PVName}}/globalmount
+    stagingMountDirAfter125: /var/lib/kubelet/plugins/kubernetes.io/csi/csi-generic.dell.com/{{.VolumeHandleSHA256}}/globalmount
+    stagingBlockDir: /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/staging/{{.PVName}}
+    arrayIDPattern: '^([^-]+)-'
+    nodeUnpublishExcludedErrors: ['NFS Share for filesystem .* not found']
+`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadDriverTypes(file); err != nil {
+		t.Fatalf("Expected the driver types to load, got %s", err)
+	}
+	d := GetDriverType("csi-generic.dell.com")
+	if d.GetDriverName() != "generic" {
+		t.Fatalf("Expected the generic driver to be registered, got %s", d.GetDriverName())
+	}
+	t.Setenv("X_CSI_GENERIC_MOUNT_DIR", "/private")
+	cases := []struct {
+		actual, expected string
+	}{
+		{d.GetDriverMountDir("sys1-vol1", "pv1", "pod1"), "/private/sys1-vol1"},
+		{d.GetDriverBlockDev("sys1-vol1", "pv1", "pod1"), "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pv1/pod1"},
+		{d.GetStagingMountDir("sys1-vol1", "pv1"), "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv1/globalmount"},
+		{d.GetStagingMountDirAfter125("sys1-vol1", "pv1"), fmt.Sprintf("/var/lib/kubelet/plugins/kubernetes.io/csi/csi-generic.dell.com/%x/globalmount",
+			sha256.Sum256([]byte("sys1-vol1")))},
+		{d.GetStagingBlockDir("sys1-vol1", "pv1"), "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/staging/pv1"},
+		{d.GetArrayIDFromVolumeHandle("sys1-vol1"), "sys1"},
+		{d.GetArrayIDFromVolumeHandle("vol1"), ""},
+	}
+	for caseNum, acase := range cases {
+		if acase.actual != acase.expected {
+			t.Errorf("Case %d: Expected %s got %s", caseNum, acase.expected, acase.actual)
+		}
+	}
+	if !d.NodeUnpublishExcludedError(errors.New("NFS Share for filesystem fs1 not found")) {
+		t.Errorf("Expected the NFS share error to be excluded from NodeUnpublish")
+	}
+	if d.NodeUnstageExcludedError(errors.New("NFS Share for filesystem fs1 not found")) {
+		t.Errorf("Expected no errors to be excluded from NodeUnstage")
+	}
+
+	// The staging directories are optional.
+	d, err := NewGenericDriver(GenericDriverConfig{DriverPath: "csi-generic.dell.com", Name: "generic",
+		DriverMountDir: "/disks/{{.VolumeHandle}}", DriverBlockDev: "/dev/{{.PVName}}"})
+	if err != nil {
+		t.Fatalf("Expected the driver without staging directories to load, got %s", err)
+	}
+	if d.GetStagingMountDir("vol1", "pv1") != "" || d.GetStagingMountDirAfter125("vol1", "pv1") != "" || d.GetStagingBlockDir("vol1", "pv1") != "" {
+		t.Errorf("Expected no staging directories")
+	}
+	if path := d.GetDriverBlockDev("vol1", "pv1", "pod1"); path != "/dev/pv1" {
+		t.Errorf("Expected /dev/pv1 got %s", path)
+	}
+
+	// Invalid drivers are rejected.
+	invalid := []GenericDriverConfig{
+		{Name: "generic"},
+		{DriverPath: "csi-generic.dell.com", Name: "generic", DriverMountDir: "/disks/{{.VolumeHandle}}"},
+		// templates that parse but can't be expanded
+		{DriverPath: "csi-generic.dell.com", Name: "generic", DriverMountDir: "/disks/{{.VolumeHandel}}", DriverBlockDev: "/dev"},
+		{DriverPath: "csi-generic.dell.com", Name: "generic", DriverMountDir: "/disks", DriverBlockDev: "/dev",
+			StagingMountDir: `{{env "X_CSI_STAGING_DIR"}}/{{.PVName}}`},
+		{DriverPath: "csi-generic.dell.com", Name: "generic", DriverMountDir: "/disks/{{.VolumeHandle", DriverBlockDev: "/dev",
+			StagingMountDir: "/stage", StagingMountDirAfter125: "/stage", StagingBlockDir: "/stage"},
+		{DriverPath: "csi-generic.dell.com", Name: "generic", DriverMountDir: "/disks", DriverBlockDev: "/dev",
+			StagingMountDir: "/stage", StagingMountDirAfter125: "/stage", StagingBlockDir: "/stage", ArrayIDPattern: "^[^-]+-"},
+		{DriverPath: "csi-generic.dell.com", Name: "generic", DriverMountDir: "/disks", DriverBlockDev: "/dev",
+			StagingMountDir: "/stage", StagingMountDirAfter125: "/stage", StagingBlockDir: "/stage", NodeUnstageExcludedErrors: []string{"("}},
+	}
+	for caseNum, config := range invalid {
+		if _, err := NewGenericDriver(config); err == nil {
+			t.Errorf("Case %d: Expected the driver to be rejected", caseNum)
+		}
+	}
+}
+
+func TestPVToArrayID(t *testing.T) {
+	Driver = new(VxflexDriver)
+	pm := &PodMonitorType{DriverPathStr: "csi-vxflexos.dellemc.com"}
+	pm.RegisterCSIDriver(&CSIDriver{Path: "csi-powerstore.dellemc.com", Type: new(PStoreDriver)})
+	cases := []struct {
+		source  *v1.CSIPersistentVolumeSource
+		arrayID string
+	}{
+		{nil, defaultArray},
+		{&v1.CSIPersistentVolumeSource{VolumeHandle: "vhandle0"}, defaultArray},
+		{&v1.CSIPersistentVolumeSource{VolumeHandle: "7045c4cc20dffc0f-e6d4e5b400000004"}, "7045c4cc20dffc0f"},
+		{&v1.CSIPersistentVolumeSource{VolumeHandle: "vhandle0", VolumeAttributes: map[string]string{arrayIDVolumeAttribute: "array1"}}, "array1"},
+		{&v1.CSIPersistentVolumeSource{VolumeHandle: "vhandle0", VolumeAttributes: map[string]string{storageSystemVolumeAttribute: "array2"}}, "array2"},
+		// the array IDs of an additional driver are parsed by that driver and qualified with its path
+		{&v1.CSIPersistentVolumeSource{Driver: "csi-powerstore.dellemc.com", VolumeHandle: "vol1/PS0123/scsi"}, "csi-powerstore.dellemc.com/PS0123"},
+		{&v1.CSIPersistentVolumeSource{Driver: "csi-powerstore.dellemc.com", VolumeHandle: "vol1"}, "csi-powerstore.dellemc.com/" + defaultArray},
+		// the volumes of drivers that are not registered stay with the primary driver
+		{&v1.CSIPersistentVolumeSource{Driver: "csi-unity.dellemc.com", VolumeHandle: "7045c4cc20dffc0f-e6d4e5b400000004"}, "7045c4cc20dffc0f"},
+	}
+	for caseNum, acase := range cases {
+		pv := &v1.PersistentVolume{}
+		pv.Spec.CSI = acase.source
+		arrayID := pm.pvToArrayID(pv)
+		if arrayID != acase.arrayID {
+			t.Errorf("Case %d: Expected %s got %s", caseNum, acase.arrayID, arrayID)
+		}
+	}
+}
+
+func TestFailoverGuardAdmit(t *testing.T) {
+	defer SetFailoverLimits(GetFailoverLimits())
+	now := time.Now()
+	cases := []struct {
+		maxNodes     int
+		maxPercent   int
+		clusterNodes int
+		nodes        []string
+		admitted     []bool
+	}{
+		// no limits
+		{0, 0, 10, []string{"n1", "n2", "n3"}, []bool{true, true, true}},
+		// absolute limit, a node already admitted is not counted again, and is still admitted while paused
+		{2, 0, 10, []string{"n1", "n1", "n2", "n3", "n1", "n4"}, []bool{true, true, true, false, true, false}},
+		// percentage limit of 10 nodes
+		{0, 20, 10, []string{"n1", "n2", "n3"}, []bool{true, true, false}},
+		// percentage limit ignored if the cluster size is not known
+		{0, 20, 0, []string{"n1", "n2", "n3"}, []bool{true, true, true}},
+	}
+	for caseNum, acase := range cases {
+		SetFailoverLimits(acase.maxNodes, acase.maxPercent, time.Minute)
+		guard := &FailoverGuard{}
+		for i, node := range acase.nodes {
+			admitted, _ := guard.admit(node, acase.clusterNodes, now)
+			if admitted != acase.admitted[i] {
+				t.Errorf("Case %d node %d %s: Expected admitted %t got %t", caseNum, i, node, acase.admitted[i], admitted)
+			}
+		}
+	}
+
+	// The window expires and failover resumes once no requests were denied for a window.
+	SetFailoverLimits(1, 0, time.Minute)
+	guard := &FailoverGuard{}
+	if admitted, _ := guard.admit("n1", 0, now); !admitted {
+		t.Errorf("Expected n1 admitted")
+	}
+	if admitted, pausedNow := guard.admit("n2", 0, now.Add(30*time.Second)); admitted || !pausedNow {
+		t.Errorf("Expected n2 to pause failover")
+	}
+	if admitted, _ := guard.admit("n2", 0, now.Add(80*time.Second)); admitted {
+		t.Errorf("Expected n2 denied while paused")
+	}
+	if admitted, _ := guard.admit("n2", 0, now.Add(150*time.Second)); !admitted {
+		t.Errorf("Expected n2 admitted after the pause expired")
+	}
+
+	// Requests for nodes already admitted don't extend the pause.
+	guard = &FailoverGuard{}
+	guard.admit("n1", 0, now)
+	guard.admit("n2", 0, now.Add(10*time.Second))
+	if admitted, _ := guard.admit("n1", 0, now.Add(50*time.Second)); !admitted {
+		t.Errorf("Expected n1 admitted while paused")
+	}
+	if admitted, _ := guard.admit("n2", 0, now.Add(75*time.Second)); !admitted {
+		t.Errorf("Expected n2 admitted after the pause expired")
+	}
+}
+
+func TestArrayOutageDetectorUpdate(t *testing.T) {
+	defer SetArrayOutageNodesPercent(GetArrayOutageNodesPercent())
+	now := time.Now()
+	lost := map[string]bool{"n1": false, "n2": false, "n3": true}
+	cases := []struct {
+		percent    int
+		arrayNodes map[string]map[string]bool
+		outage     bool
+	}{
+		// disabled
+		{0, map[string]map[string]bool{"array1": lost}, false},
+		// 2 of 3 nodes is more than 50 percent
+		{50, map[string]map[string]bool{"array1": lost}, true},
+		// but not more than 70 percent
+		{70, map[string]map[string]bool{"array1": lost}, false},
+		// a single node is never an outage
+		{50, map[string]map[string]bool{"array1": {"n1": false}}, false},
+		// no nodes lost the array
+		{50, map[string]map[string]bool{"array1": {"n1": true, "n2": true}}, false},
+	}
+	for caseNum, acase := range cases {
+		SetArrayOutageNodesPercent(acase.percent)
+		detector := &ArrayOutageDetector{}
+		started, ended := detector.update(acase.arrayNodes, now)
+		if detector.inOutage("array1") != acase.outage || (len(started) == 1) != acase.outage || len(ended) != 0 {
+			t.Errorf("Case %d: Expected outage %t got %t started %v ended %v", caseNum, acase.outage, detector.inOutage("array1"), started, ended)
+		}
+	}
+
+	// The outage continues while the array is lost, keeps its classification if not sampled, and ends once it recovers.
+	SetArrayOutageNodesPercent(50)
+	detector := &ArrayOutageDetector{}
+	steps := []struct {
+		arrayNodes map[string]map[string]bool
+		started    int
+		ended      int
+		outage     bool
+	}{
+		{map[string]map[string]bool{"array1": lost}, 1, 0, true},
+		{map[string]map[string]bool{"array1": lost}, 0, 0, true},
+		{map[string]map[string]bool{}, 0, 0, true},
+		{map[string]map[string]bool{"array1": {"n1": false, "n2": true, "n3": true}}, 0, 1, false},
+	}
+	for i, step := range steps {
+		started, ended := detector.update(step.arrayNodes, now.Add(time.Duration(i)*time.Minute))
+		if len(started) != step.started || len(ended) != step.ended || detector.inOutage("array1") != step.outage {
+			t.Errorf("Step %d: Expected started %d ended %d outage %t got %v %v %t", i, step.started, step.ended, step.outage, started, ended, detector.inOutage("array1"))
+		}
+	}
+	if status := detector.status(); len(status) != 0 {
+		t.Errorf("Expected no outages got %v", status)
+	}
+
+	// Disabling detection ends the outages, even of arrays that weren't sampled.
+	detector.update(map[string]map[string]bool{"array1": lost}, now)
+	SetArrayOutageNodesPercent(0)
+	if _, ended := detector.update(map[string]map[string]bool{}, now); len(ended) != 1 || detector.inOutage("array1") {
+		t.Errorf("Expected the array1 outage to end got %v", ended)
+	}
+}
+
+func TestNodeArrayConnectivityCacheFlapping(t *testing.T) {
+	defer SetArrayConnectivityRecoveryThreshold(GetArrayConnectivityRecoveryThreshold())
+	defer SetArrayConnectivityFlapLimits(GetArrayConnectivityFlapLimits())
+	defer SetArrayConnectivityFlapPolicy(GetArrayConnectivityFlapPolicy())
+	savedK8sAPI, savedThreshold := K8sAPI, ArrayConnectivityConnectionLossThreshold
+	defer func() {
+		K8sAPI, ArrayConnectivityConnectionLossThreshold = savedK8sAPI, savedThreshold
+	}()
+	k8sMock := &mocks.K8sMock{}
+	k8sMock.Initialize()
+	K8sAPI = k8sMock
+	ArrayConnectivityConnectionLossThreshold = 3
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1"}}
+	flappingSamples := []bool{false, true, false, true, false, true, false, true}
+
+	cases := []struct {
+		recovery  int
+		flaps     int
+		policy    string
+		samples   []bool
+		connected bool
+		events    int
+	}{
+		// a single good sample clears the loss count, the link is never lost
+		{1, 0, ArrayConnectivityFlapPolicyReport, flappingSamples, true, 0},
+		// with hysteresis the loss count keeps growing while the link alternates
+		{2, 0, ArrayConnectivityFlapPolicyReport, flappingSamples, false, 0},
+		// flapping is reported once, and doesn't count as a loss
+		{1, 4, ArrayConnectivityFlapPolicyReport, flappingSamples, true, 1},
+		// sustained flapping counts as a loss with the loss policy
+		{1, 4, ArrayConnectivityFlapPolicyLoss, flappingSamples, false, 1},
+		// a stable link is not flapping
+		{1, 4, ArrayConnectivityFlapPolicyLoss, []bool{true, true, false, false, true, true, true, true}, true, 0},
+	}
+	for caseNum, acase := range cases {
+		SetArrayConnectivityRecoveryThreshold(acase.recovery)
+		SetArrayConnectivityFlapLimits(acase.flaps, 10)
+		SetArrayConnectivityFlapPolicy(acase.policy)
+		k8sMock.EventReasons = nil
+		nacc := &nodeArrayConnectivityCache{}
+		nacc.ResetSampled()
+		for _, sample := range acase.samples {
+			if flap := nacc.recordSample(node, "array1", "n1:array1", sample, getSampleLimits()); flap != nil {
+				flap.send()
+			}
+		}
+		if connected := nacc.connected("n1:array1", acase.policy); connected != acase.connected {
+			t.Errorf("Case %d: Expected connected %t got %t", caseNum, acase.connected, connected)
+		}
+		if len(k8sMock.EventReasons) != acase.events {
+			t.Errorf("Case %d: Expected %d events got %v", caseNum, acase.events, k8sMock.EventReasons)
+		}
+	}
+}
+
+func TestSamplePairs(t *testing.T) {
+	defer SetArrayConnectivityPollLimits(GetArrayConnectivityPollLimits())
+	savedCSIApi, savedThreshold := CSIApi, ArrayConnectivityConnectionLossThreshold
+	defer func() {
+		CSIApi, ArrayConnectivityConnectionLossThreshold = savedCSIApi, savedThreshold
+	}()
+	ArrayConnectivityConnectionLossThreshold = 1
+	pm := &PodMonitorType{DriverPathStr: "csi-vxflexos.dellemc.com"}
+	pairs := make([]nodeArrayPair, 0)
+	for i := 0; i < 10; i++ {
+		nodeName := fmt.Sprintf("node%d", i)
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:        nodeName,
+			UID:         types.UID(nodeName + "-uid"),
+			Annotations: map[string]string{"csi.volume.kubernetes.io/nodeid": fmt.Sprintf(`{"csi-vxflexos.dellemc.com": "%s"}`, nodeName)},
+		}}
+		pm.StoreNodeUID(nodeName, nodeName+"-uid")
+		pairs = append(pairs, nodeArrayPair{node: node, arrayID: "array1"}, nodeArrayPair{node: node, arrayID: "array2"})
+	}
+	cases := []struct {
+		concurrency int
+		deadline    time.Duration
+		maxInFlight int
+		maxElapsed  time.Duration
+		skipped     int
+	}{
+		// 20 pairs taking 50ms each are sampled in two rounds, not twenty
+		{10, time.Minute, 10, 500 * time.Millisecond, 0},
+		{1, time.Minute, 1, 2 * time.Second, 0},
+		// the pairs not started before the deadline are skipped
+		{5, 75 * time.Millisecond, 5, 500 * time.Millisecond, 10},
+	}
+	for caseNum, acase := range cases {
+		SetArrayConnectivityPollLimits(acase.concurrency, acase.deadline)
+		csiMock := &mocks.CSIMock{ValidateVolumeHostConnectivityDelay: 50 * time.Millisecond, ArrayIDToConnected: map[string]bool{"array2": false}}
+		csiMock.ValidateVolumeHostConnectivityResponse.Connected = true
+		CSIApi = csiMock
+		nacc := &nodeArrayConnectivityCache{}
+		nacc.ResetSampled()
+		ctx, cancel := context.WithTimeout(context.Background(), acase.deadline)
+		start := time.Now()
+		skipped := nacc.SamplePairs(ctx, pm, pairs)
+		elapsed := time.Since(start)
+		cancel()
+		if skipped != acase.skipped {
+			t.Errorf("Case %d: Expected %d skipped pairs got %d", caseNum, acase.skipped, skipped)
+		}
+		if csiMock.MaxValidateVolumeHostConnectivityInFlight > acase.maxInFlight {
+			t.Errorf("Case %d: Expected at most %d calls in flight got %d", caseNum, acase.maxInFlight, csiMock.MaxValidateVolumeHostConnectivityInFlight)
+		}
+		if elapsed > acase.maxElapsed {
+			t.Errorf("Case %d: Expected sampling to take less than %v took %v", caseNum, acase.maxElapsed, elapsed)
+		}
+		if acase.skipped == 0 {
+			for _, pair := range pairs {
+				expected := pair.arrayID == "array1"
+				if connected := nacc.CheckConnectivity(pm, pair.node, pair.arrayID); connected != expected {
+					t.Errorf("Case %d: Expected %s:%s connected %t got %t", caseNum, pair.node.ObjectMeta.Name, pair.arrayID, expected, connected)
+				}
+			}
+		}
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	pm := &PodMonitorType{Mode: "controller"}
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", UID: "node1-uid"}}
+	pm.StoreNodeUID("node1", "node1-uid")
+	pm.PodKeyToControllerPodInfo.Store("ns/pod1", &ControllerPodInfo{PodKey: "ns/pod1", PodUID: "pod1-uid", Node: node, ArrayIDs: []string{"array1"}})
+	pm.PodKeyMap.Store("ns/pod2", &NodePodInfo{PodUID: "pod2-uid", Mounts: []MountPathVolumeInfo{{VolumeID: "vol1"}}})
+	pm.PodKeyToCrashLoopBackOffDeletions.Store("ns/pod1", &crashLoopBackOffDeletions{times: []time.Time{time.Now()}})
+	blocked := make(chan struct{})
+	pm.Scheduler.submit([]string{"ns/pod1"}, 100, func() error {
+		<-blocked
+		return nil
+	})
+	defer close(blocked)
+	for i := 0; i < 100 && len(pm.Scheduler.status().Running) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server := httptest.NewServer(pm.StatusHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + StatusPath)
+	if err != nil {
+		t.Fatalf("GET %s failed: %s", StatusPath, err)
+	}
+	defer resp.Body.Close()
+	status := Status{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Couldn't decode the status: %s", err)
+	}
+	if status.Mode != "controller" || status.NodeUIDs["node1"] != "node1-uid" {
+		t.Errorf("Expected controller mode and node1 uid, got %s %v", status.Mode, status.NodeUIDs)
+	}
+	if len(status.ControllerPods) != 1 || status.ControllerPods[0].Node != "node1" || status.ControllerPods[0].ArrayIDs[0] != "array1" {
+		t.Errorf("Expected pod ns/pod1 on node1 array1, got %v", status.ControllerPods)
+	}
+	if len(status.NodePods) != 1 || status.NodePods[0].PodKey != "ns/pod2" || status.NodePods[0].Mounts[0].VolumeID != "vol1" {
+		t.Errorf("Expected node pod ns/pod2 with vol1, got %v", status.NodePods)
+	}
+	if len(status.CrashLoopBackOffDeletions["ns/pod1"]) != 1 {
+		t.Errorf("Expected 1 CrashLoopBackOff deletion, got %v", status.CrashLoopBackOffDeletions)
+	}
+	if len(status.Cleanups.Running) != 1 || status.Cleanups.Running[0].Name != "ns/pod1" || status.Cleanups.Running[0].Priority != 100 {
+		t.Errorf("Expected the cleanup of ns/pod1 running, got %v", status.Cleanups)
+	}
+	if status.Configuration["FencingMode"] != GetFencingMode() {
+		t.Errorf("Expected fencing mode %s, got %v", GetFencingMode(), status.Configuration["FencingMode"])
+	}
+
+	// the status API is read-only
+	resp, err = http.Post(server.URL+StatusPath, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("POST %s failed: %s", StatusPath, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestRecoveryReconcilerObserveNode(t *testing.T) {
+	now := time.Now()
+	tainted := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1", UID: "uid-1"}}
+	tainted.Spec.Taints = []v1.Taint{{Key: PodmonTaintKey, Effect: v1.TaintEffectNoSchedule}}
+	tainted.Status.NodeInfo.BootID = "boot-1"
+	untainted := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1", UID: "uid-1"}}
+
+	r := &RecoveryReconciler{}
+	// An untainted node delivered after a cleanup recorded its PVs doesn't drop them.
+	r.recordCleanedPVs("n1", []*v1.PersistentVolume{{ObjectMeta: metav1.ObjectMeta{Name: "pv1"}}}, []string{"array1"})
+	r.observeNode(untainted, false, now)
+	if _, pvNames, arrayIDs, _, ok := r.recoveryChecks("n1"); !ok || len(pvNames) != 1 || len(arrayIDs) != 1 || arrayIDs[0] != "array1" {
+		t.Errorf("Expected the cleaned PVs and their arrays to be kept, got %v %v %t", pvNames, arrayIDs, ok)
+	}
+	// The stable period starts when the node is seen tainted, and only restarts if the UID or bootID change.
+	r.observeNode(tainted, true, now)
+	r.observeNode(tainted, true, now.Add(time.Minute))
+	if stableSince, _, _, _, _ := r.recoveryChecks("n1"); !stableSince.Equal(now) {
+		t.Errorf("Expected stable since %v got %v", now, stableSince)
+	}
+	rebooted := tainted.DeepCopy()
+	rebooted.Status.NodeInfo.BootID = "boot-2"
+	r.observeNode(rebooted, true, now.Add(2*time.Minute))
+	if stableSince, _, _, _, _ := r.recoveryChecks("n1"); !stableSince.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("Expected the stable period to restart after reboot, got %v", stableSince)
+	}
+	// Once the taint is removed the node is no longer tracked.
+	r.observeNode(untainted, false, now.Add(3*time.Minute))
+	if _, _, _, _, ok := r.recoveryChecks("n1"); ok {
+		t.Errorf("Expected the untainted node to be forgotten")
+	}
+}
+
+func TestFenceVolumes(t *testing.T) {
+	defer SetFencingLimits(GetFencingLimits())
+	savedCSIApi, savedPendingRetryTime := CSIApi, PendingRetryTime
+	defer func() {
+		CSIApi, PendingRetryTime = savedCSIApi, savedPendingRetryTime
+	}()
+	PendingRetryTime = time.Second
+	pm := &PodMonitorType{DriverPathStr: "csi-vxflexos.dellemc.com"}
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "node1",
+		Annotations: map[string]string{"csi.volume.kubernetes.io/nodeid": `{"csi-vxflexos.dellemc.com": "node1"}`},
+	}}
+	volumeIDs := make([]string, 20)
+	for i := range volumeIDs {
+		volumeIDs[i] = fmt.Sprintf("vol%d", i)
+	}
 	cases := []struct {
-		mapA, mapB map[string]string
-		result     bool
+		concurrency int
+		deadline    time.Duration
+		pending     bool
+		maxInFlight int
+		maxElapsed  time.Duration
+		failed      int
 	}{
-		{
-			map[string]string{"key": "value"},
-			map[string]string{"key": "value"},
-			true,
-		},
-		{
-			map[string]string{"key": "value"},
-			map[string]string{"value": "key"},
-			false,
-		},
-		{
-			map[string]string{"key": "value"},
-			map[string]string{},
-			false,
-		},
+		// 20 volumes taking 50ms each complete in two rounds, not twenty
+		{10, time.Minute, false, 10, 500 * time.Millisecond, 0},
+		{1, time.Minute, false, 1, 2 * time.Second, 0},
+		// pending volumes stop retrying when the deadline is reached
+		{10, 200 * time.Millisecond, true, 10, 900 * time.Millisecond, 20},
 	}
 	for caseNum, acase := range cases {
-		result := mapEqualsMap(acase.mapA, acase.mapB)
-		if result != acase.result {
-			t.Errorf("Case %d: Expected %t got %t", caseNum, acase.result, result)
+		SetFencingLimits(acase.concurrency, acase.deadline)
+		csiMock := &mocks.CSIMock{ControllerUnpublishDelay: 50 * time.Millisecond}
+		csiMock.InducedErrors.ControllerUnpublishPending = acase.pending
+		CSIApi = csiMock
+		ctx, cancel := context.WithTimeout(context.Background(), acase.deadline)
+		start := time.Now()
+		results := pm.fenceVolumes(ctx, node, volumeIDs, nil)
+		elapsed := time.Since(start)
+		cancel()
+		if len(results) != len(volumeIDs) {
+			t.Fatalf("Case %d: Expected %d results got %d", caseNum, len(volumeIDs), len(results))
+		}
+		failed := 0
+		for i, result := range results {
+			if result.VolumeID != volumeIDs[i] {
+				t.Errorf("Case %d: Expected result %d for %s got %s", caseNum, i, volumeIDs[i], result.VolumeID)
+			}
+			if result.Err != nil {
+				failed++
+			}
+		}
+		if failed != acase.failed {
+			t.Errorf("Case %d: Expected %d failed volumes got %d", caseNum, acase.failed, failed)
+		}
+		if csiMock.MaxControllerUnpublishInFlight > acase.maxInFlight {
+			t.Errorf("Case %d: Expected at most %d calls in flight got %d", caseNum, acase.maxInFlight, csiMock.MaxControllerUnpublishInFlight)
+		}
+		if elapsed > acase.maxElapsed {
+			t.Errorf("Case %d: Expected fencing to take less than %v took %v", caseNum, acase.maxElapsed, elapsed)
+		}
+	}
+}
+
+func TestCSIDriverRouting(t *testing.T) {
+	savedDriver, savedCSIApi, savedTaintKey := Driver, CSIApi, PodmonTaintKey
+	defer func() {
+		Driver, CSIApi, PodmonTaintKey = savedDriver, savedCSIApi, savedTaintKey
+	}()
+	primaryMock, pstoreMock := &mocks.CSIMock{}, &mocks.CSIMock{}
+	Driver, CSIApi, PodmonTaintKey = new(VxflexDriver), primaryMock, "vxflexos.podmon.storage.dell.com"
+	pm := &PodMonitorType{DriverPathStr: "csi-vxflexos.dellemc.com", CSIExtensionsPresent: true}
+	pm.RegisterCSIDriver(&CSIDriver{Path: "csi-powerstore.dellemc.com", Type: new(PStoreDriver), API: pstoreMock,
+		LabelKey: "podmon.dellemc.com/driver", LabelValue: "csi-powerstore"})
+	pstore := pm.additionalCSIDriver("csi-powerstore.dellemc.com")
+	if pstore == nil || pstore.TaintKey != "powerstore.podmon.storage.dell.com" {
+		t.Fatalf("Expected powerstore to be registered with its taint key, got %+v", pstore)
+	}
+	if !pm.HasCSIExtensions() {
+		t.Errorf("Expected the primary driver's CSI extensions to be found")
+	}
+
+	newPV := func(name, driver, handle string) *v1.PersistentVolume {
+		pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: handle}
+		return pv
+	}
+	vxflexPV := newPV("pv1", "csi-vxflexos.dellemc.com", "7045c4cc20dffc0f-e6d4e5b400000004")
+	pstorePV := newPV("pv2", "csi-powerstore.dellemc.com", "vol2/PS0123/scsi")
+	if d := pm.csiDriverForPV(pstorePV); d != pstore {
+		t.Errorf("Expected the powerstore PV to be routed to powerstore, got %s", d.Path)
+	}
+	if d := pm.csiDriverForPV(newPV("pv3", "csi-unity.dellemc.com", "vol3")); d.Path != pm.DriverPathStr {
+		t.Errorf("Expected the PV of an unregistered driver to be routed to the primary driver, got %s", d.Path)
+	}
+	if d, arrayID := pm.csiDriverForArray(pm.pvToArrayID(pstorePV)); d != pstore || arrayID != "PS0123" {
+		t.Errorf("Expected the powerstore array PS0123, got %s %s", d.Path, arrayID)
+	}
+	if d, arrayID := pm.csiDriverForArray("7045c4cc20dffc0f"); d.Path != pm.DriverPathStr || arrayID != "7045c4cc20dffc0f" {
+		t.Errorf("Expected the primary array 7045c4cc20dffc0f, got %s %s", d.Path, arrayID)
+	}
+
+	// The drivers of a pod come from its PVs, primary first, or from its labels if it has no CSI volumes.
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"podmon.dellemc.com/driver": "csi-powerstore"}}}
+	drivers := pm.csiDriversForPod(pod, []*v1.PersistentVolume{pstorePV, vxflexPV})
+	if len(drivers) != 2 || drivers[0].Path != pm.DriverPathStr || drivers[1] != pstore {
+		t.Errorf("Expected the primary and powerstore drivers, got %d drivers", len(drivers))
+	}
+	if drivers = pm.csiDriversForPod(pod, nil); len(drivers) != 1 || drivers[0] != pstore {
+		t.Errorf("Expected the volumeless pod to be routed to powerstore by its label")
+	}
+	if csiDriversHaveExtensions([]*CSIDriver{pm.primaryCSIDriver(), pstore}) {
+		t.Errorf("Expected powerstore to have no CSI extensions")
+	}
+
+	// Each volume is fenced by its own driver.
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "node1",
+		Annotations: map[string]string{"csi.volume.kubernetes.io/nodeid": `{"csi-vxflexos.dellemc.com": "node1", "csi-powerstore.dellemc.com": "node1-ps"}`},
+	}}
+	results := pm.fenceVolumes(context.Background(), node, []string{"vol1", "vol2/PS0123/scsi"}, map[string]*CSIDriver{"vol2/PS0123/scsi": pstore})
+	for _, result := range results {
+		if result.Err != nil {
+			t.Errorf("Expected %s to be fenced, got %s", result.VolumeID, result.Err)
+		}
+	}
+	if len(primaryMock.ControllerUnpublishedVolumeIDs) != 1 || primaryMock.ControllerUnpublishedVolumeIDs[0] != "vol1" {
+		t.Errorf("Expected the primary driver to fence vol1, got %v", primaryMock.ControllerUnpublishedVolumeIDs)
+	}
+	if len(pstoreMock.ControllerUnpublishedVolumeIDs) != 1 || pstoreMock.ControllerUnpublishedVolumeIDs[0] != "vol2/PS0123/scsi" {
+		t.Errorf("Expected powerstore to fence vol2, got %v", pstoreMock.ControllerUnpublishedVolumeIDs)
+	}
+
+	// The taint keys of both drivers are recognized.
+	node.Spec.Taints = []v1.Taint{{Key: "powerstore.podmon.storage.dell.com", Effect: v1.TaintEffectNoSchedule}}
+	if keys := pm.nodePodmonTaintKeys(node); len(keys) != 1 || keys[0] != "powerstore.podmon.storage.dell.com" || !pm.nodeHasPodmonTaint(node) {
+		t.Errorf("Expected the powerstore taint to be found, got %v", keys)
+	}
+}
+
+func TestGetPodPolicy(t *testing.T) {
+	cases := []struct {
+		annotations map[string]string
+		expected    PodPolicy
+	}{
+		{nil, PodPolicy{}},
+		{map[string]string{
+			SkipArrayConnectivityCleanupAnnotation: "true",
+			SkipCrashLoopBackOffCleanupAnnotation:  "True",
+			IgnoreIOsInProgressAnnotation:          "1",
+			ForceDeleteGracePeriodAnnotation:       "90s",
+			CleanupPriorityAnnotation:              "100",
+		}, PodPolicy{true, true, true, 90 * time.Second, 100, true}},
+		{map[string]string{
+			SkipArrayConnectivityCleanupAnnotation: "false",
+			SkipCrashLoopBackOffCleanupAnnotation:  "yes",
+			ForceDeleteGracePeriodAnnotation:       "-1s",
+			CleanupPriorityAnnotation:              "high",
+		}, PodPolicy{}},
+		{map[string]string{
+			ForceDeleteGracePeriodAnnotation: "30",
+			CleanupPriorityAnnotation:        "-5",
+		}, PodPolicy{CleanupPriority: -5, CleanupPrioritySet: true}},
+		{map[string]string{
+			ForceDeleteGracePeriodAnnotation: "10m",
+		}, PodPolicy{ForceDeleteGracePeriod: 10 * time.Minute}},
+		{map[string]string{
+			ForceDeleteGracePeriodAnnotation: "24h",
+		}, PodPolicy{}},
+	}
+	for caseNum, acase := range cases {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod", Annotations: acase.annotations}}
+		policy := getPodPolicy(pod)
+		if policy != acase.expected {
+			t.Errorf("Case %d: Expected %+v got %+v", caseNum, acase.expected, policy)
+		}
+	}
+}
+
+func TestIsStorageError(t *testing.T) {
+	cases := []struct {
+		message      string
+		storageError bool
+	}{
+		{"MountVolume.SetUp failed for volume \"pvc-1\" : rpc error", true},
+		{"mountvolume.setup failed for volume \"pvc-1\"", true},
+		{"open /data/file: input/output error", true},
+		{"write /data/file: Input/output error", true},
+		{"stat /data: stale file handle", true},
+		{"stat /data: Stale file handle", true},
+		{"Back-off restarting failed container", false},
+		{"", false},
+	}
+	for caseNum, acase := range cases {
+		if storageError := isStorageError(acase.message); storageError != acase.storageError {
+			t.Errorf("Case %d: Expected %t got %t for %s", caseNum, acase.storageError, storageError, acase.message)
+		}
+	}
+}
+
+func TestSortPodKeysByCleanupPriority(t *testing.T) {
+	pm := &PodMonitorType{}
+	priorities := map[string]int{"ns/low": -1, "ns/default1": 0, "ns/high": 10, "ns/default2": 0, "ns/medium": 5}
+	for podKey, priority := range priorities {
+		pm.PodKeyToControllerPodInfo.Store(podKey, &ControllerPodInfo{PodKey: podKey, CleanupPriority: priority})
+	}
+	podKeys := []string{"ns/low", "ns/default1", "ns/unknown", "ns/high", "ns/default2", "ns/medium"}
+	pm.sortPodKeysByCleanupPriority(podKeys)
+	expected := []string{"ns/high", "ns/medium", "ns/default1", "ns/unknown", "ns/default2", "ns/low"}
+	for i := range expected {
+		if podKeys[i] != expected[i] {
+			t.Errorf("Expected order %v got %v", expected, podKeys)
+			break
+		}
+	}
+}
+
+func TestPodCleanupPriority(t *testing.T) {
+	classPriority := int32(1000)
+	cases := []struct {
+		priority    *int32
+		annotations map[string]string
+		expected    int
+	}{
+		{nil, nil, 0},
+		{&classPriority, nil, 1000},
+		{&classPriority, map[string]string{CleanupPriorityAnnotation: "5"}, 5},
+		{&classPriority, map[string]string{CleanupPriorityAnnotation: "bad"}, 1000},
+		{nil, map[string]string{CleanupPriorityAnnotation: "-3"}, -3},
+	}
+	for caseNum, acase := range cases {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod", Annotations: acase.annotations}}
+		pod.Spec.Priority = acase.priority
+		if priority := podCleanupPriority(pod, getPodPolicy(pod)); priority != acase.expected {
+			t.Errorf("Case %d: Expected priority %d got %d", caseNum, acase.expected, priority)
+		}
+	}
+}
+
+func TestCleanupScheduler(t *testing.T) {
+	defer SetCleanupConcurrency(GetCleanupConcurrency())
+	SetCleanupConcurrency(1)
+	scheduler := &CleanupScheduler{}
+	// Block the only slot so the other cleanups queue up behind it.
+	release := make(chan struct{})
+	scheduler.submit([]string{"blocker"}, 0, func() error {
+		<-release
+		return nil
+	})
+	waitForCleanupRunning(scheduler, "blocker")
+	var mutex sync.Mutex
+	order := make([]string, 0)
+	record := func(name string) func() error {
+		return func() error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			order = append(order, name)
+			return nil
+		}
+	}
+	scheduler.submit([]string{"low"}, -1, record("low"))
+	scheduler.submit([]string{"default1"}, 0, record("default1"))
+	scheduler.submit([]string{"high"}, 100, record("high"))
+	scheduler.submit([]string{"default2"}, 0, record("default2"))
+	close(release)
+	waitForCleanups(scheduler, 5*time.Second)
+	expected := []string{"high", "default1", "default2", "low"}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected order %v got %v", expected, order)
+	}
+
+	// Parallelism is bounded by the cleanup concurrency.
+	SetCleanupConcurrency(3)
+	var running, maxRunning int
+	for i := 0; i < 10; i++ {
+		scheduler.submit([]string{fmt.Sprintf("pod%d", i)}, 0, func() error {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			return nil
+		})
+	}
+	waitForCleanups(scheduler, 5*time.Second)
+	if maxRunning != 3 {
+		t.Errorf("Expected a maximum of 3 cleanups running got %d", maxRunning)
+	}
+}
+
+func TestCleanupSchedulerDeduplicatesAndRetries(t *testing.T) {
+	defer SetCleanupConcurrency(GetCleanupConcurrency())
+	maxRetries, baseDelay, maxDelay := GetCleanupRetryLimits()
+	defer SetCleanupRetryLimits(maxRetries, baseDelay, maxDelay)
+	SetCleanupConcurrency(1)
+	SetCleanupRetryLimits(2, time.Millisecond, 4*time.Millisecond)
+	scheduler := &CleanupScheduler{}
+	var mutex sync.Mutex
+	runs := make(map[string]int)
+	count := func(name string, err error) func() error {
+		return func() error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			runs[name]++
+			return err
+		}
+	}
+	waiting := func() string {
+		names := make([]string, 0)
+		for _, task := range scheduler.status().Waiting {
+			names = append(names, task.Name)
+		}
+		return strings.Join(names, "|")
+	}
+
+	// A cleanup submitted while the same key is waiting replaces it.
+	release := make(chan struct{})
+	scheduler.submit([]string{"blocker"}, 0, func() error {
+		<-release
+		return nil
+	})
+	waitForCleanupRunning(scheduler, "blocker")
+	scheduler.submit([]string{"ns/pod1"}, 0, count("first", nil))
+	scheduler.submit([]string{"ns/pod1"}, 0, count("second", nil))
+	if names := waiting(); names != "ns/pod1" {
+		t.Errorf("Expected one waiting cleanup of ns/pod1 got %s", names)
+	}
+	close(release)
+	waitForCleanups(scheduler, 5*time.Second)
+	if runs["first"] != 0 || runs["second"] != 1 {
+		t.Errorf("Expected only the second cleanup to run once, got %v", runs)
+	}
+
+	// A cleanup of more pods replaces the waiting cleanups of its pods, and a cleanup of pods it includes isn't queued.
+	release = make(chan struct{})
+	scheduler.submit([]string{"blocker"}, 0, func() error {
+		<-release
+		return nil
+	})
+	waitForCleanupRunning(scheduler, "blocker")
+	scheduler.submit([]string{"ns/pod4"}, 0, count("single", nil))
+	scheduler.submit([]string{"ns/pod4", "ns/pod5"}, 0, count("group", nil))
+	scheduler.submit([]string{"ns/pod5"}, 0, count("included", nil))
+	if names := waiting(); names != "ns/pod4,ns/pod5" {
+		t.Errorf("Expected only the group cleanup to be waiting got %s", names)
+	}
+	close(release)
+	waitForCleanups(scheduler, 5*time.Second)
+	if runs["single"] != 0 || runs["group"] != 1 || runs["included"] != 0 {
+		t.Errorf("Expected only the group cleanup to run once, got %v", runs)
+	}
+
+	// A cleanup sharing a pod with a running cleanup waits for it to finish.
+	SetCleanupConcurrency(2)
+	release = make(chan struct{})
+	scheduler.submit([]string{"ns/pod6"}, 0, func() error {
+		<-release
+		return nil
+	})
+	waitForCleanupRunning(scheduler, "ns/pod6")
+	scheduler.submit([]string{"ns/pod6", "ns/pod7"}, 0, count("overlapping", nil))
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	if runs["overlapping"] != 0 {
+		t.Errorf("Expected the overlapping cleanup to wait for the running cleanup")
+	}
+	mutex.Unlock()
+	close(release)
+	waitForCleanups(scheduler, 5*time.Second)
+	if runs["overlapping"] != 1 {
+		t.Errorf("Expected the overlapping cleanup to run once after the running cleanup got %d", runs["overlapping"])
+	}
+	SetCleanupConcurrency(1)
+
+	// A failing cleanup is retried up to the retry limit and then given up.
+	scheduler.submit([]string{"ns/pod2"}, 0, count("failing", errors.New("induced cleanup error")))
+	waitForCleanups(scheduler, 5*time.Second)
+	if runs["failing"] != 3 {
+		t.Errorf("Expected the failing cleanup to run 3 times got %d", runs["failing"])
+	}
+	if scheduler.queue.NumRequeues("ns/pod2") != 0 {
+		t.Errorf("Expected the retries to be forgotten after giving up")
+	}
+
+	// A cleanup that fails and then succeeds stops being retried.
+	attempts := 0
+	scheduler.submit([]string{"ns/pod3"}, 0, func() error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("induced cleanup error")
+		}
+		return nil
+	})
+	waitForCleanups(scheduler, 5*time.Second)
+	if attempts != 2 {
+		t.Errorf("Expected the cleanup to succeed on the second attempt got %d attempts", attempts)
+	}
+}
+
+func TestCleanupSchedulerDelays(t *testing.T) {
+	scheduler := &CleanupScheduler{}
+	var mutex sync.Mutex
+	runs := make(map[string]time.Time)
+	record := func(name string) func() error {
+		return func() error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			runs[name] = time.Now()
+			return nil
+		}
+	}
+	start := time.Now()
+	scheduler.submitAfter([]string{"ns/pod1"}, 0, 100*time.Millisecond, record("delayed"))
+	// A cleanup of the same pod doesn't replace the delayed one, and other cleanups aren't held up by it.
+	scheduler.submit([]string{"ns/pod1"}, 0, record("replacement"))
+	scheduler.submit([]string{"ns/pod2"}, 0, record("other"))
+	waitForCleanups(scheduler, 5*time.Second)
+	if _, ok := runs["replacement"]; ok {
+		t.Errorf("Expected the delayed cleanup not to be replaced")
+	}
+	if ran, ok := runs["delayed"]; !ok || ran.Sub(start) < 100*time.Millisecond {
+		t.Errorf("Expected the delayed cleanup to run after 100ms, got %v", runs)
+	}
+	if ran, ok := runs["other"]; !ok || !ran.Before(runs["delayed"]) {
+		t.Errorf("Expected the other cleanup to run before the delayed cleanup, got %v", runs)
+	}
+}
+
+// waitForCleanupRunning waits until the scheduler has started the cleanup.
+func waitForCleanupRunning(scheduler *CleanupScheduler, name string) {
+	for i := 0; i < 200; i++ {
+		scheduler.mutex.Lock()
+		_, running := scheduler.active[name]
+		scheduler.mutex.Unlock()
+		if running {
+			return
 		}
+		time.Sleep(5 * time.Millisecond)
 	}
 }
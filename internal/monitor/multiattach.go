@@ -0,0 +1,193 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"context"
+	"podmon/internal/k8sapi"
+	"podmon/internal/metrics"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// A replacement pod scheduled while its volume is still attached to the old node gets stuck in ContainerCreating
+// with a FailedAttachVolume "Multi-Attach error" Event. Unless the old node was tainted, podmon would not clean up
+// the stale VolumeAttachment. The Multi-Attach monitor watches those Events for protected pods, and finds the
+// VolumeAttachments of the volume on other nodes. If no pod on the old node still uses the volume and the driver
+// confirms the old node has no connectivity to it, the volume is fenced from the old node with ControllerUnpublishVolume
+// and the VolumeAttachment is deleted, so the attach on the new node can proceed.
+
+const (
+	// failedAttachVolumeReason is the reason of the Kubernetes Events reporting attach failures.
+	failedAttachVolumeReason = "FailedAttachVolume"
+	// multiAttachErrorMessage identifies the attach failures caused by the volume being attached to another node.
+	multiAttachErrorMessage = "Multi-Attach error"
+	// multiAttachRepairedReason is the Event reason used when podmon deletes a stale VolumeAttachment.
+	multiAttachRepairedReason = "MultiAttachRepaired"
+)
+
+// multiAttachVolumeRegexp extracts the PV name from a Multi-Attach error message.
+var multiAttachVolumeRegexp = regexp.MustCompile(`Multi-Attach error for volume "([^"]+)"`)
+
+// StartMultiAttachMonitor starts watching the FailedAttachVolume Events about pods, repairing the Multi-Attach errors
+// of the pods with the labelKey and labelValue. The Events are delivered by a shared informer, which resyncs every InformerResyncPeriod.
+func StartMultiAttachMonitor(api k8sapi.K8sAPI, labelKey, labelValue string, restartDelay time.Duration) {
+	log.Infof("attempting to start MultiAttachMonitor\n")
+	selector := labels.Everything()
+	if labelKey != "" {
+		selector = labels.SelectorFromSet(labels.Set{labelKey: labelValue})
+	}
+	fieldSelector := fields.Set{"involvedObject.kind": "Pod", "reason": failedAttachVolumeReason}.AsSelector().String()
+	handler := func(eventType watch.EventType, object interface{}) {
+		event, ok := object.(*v1.Event)
+		if !ok || event == nil || eventType == watch.Deleted {
+			return
+		}
+		PodMonitor.multiAttachHandler(event, selector)
+	}
+	for {
+		err := api.AddPodEventsHandler(context.Background(), fieldSelector, InformerResyncPeriod, handler)
+		if err == nil {
+			break
+		}
+		// The following check excludes unit testing, to avoid polluting the log messages captured
+		if restartDelay > 10*time.Millisecond {
+			log.Errorf("Could not create MultiAttachWatcher: %s - will retry\n", err)
+		}
+		metrics.RecordWatchRestart("MultiAttachWatcher", "SetupFailed")
+		time.Sleep(restartDelay)
+	}
+	log.Infof("Setup of MultiAttachWatcher complete\n")
+}
+
+// multiAttachHandler queues the repair of the Multi-Attach error reported by the Event if it is about a pod matching the
+// selector. The repair is run by the cleanup scheduler, so it isn't run at the same time as a cleanup of the pod and
+// doesn't hold up the delivery of the Events. It isn't queued if a cleanup of the pod is already waiting, the Event is
+// delivered again when the informer resyncs.
+func (cm *PodMonitorType) multiAttachHandler(event *v1.Event, selector labels.Selector) {
+	if event.Reason != failedAttachVolumeReason || !strings.Contains(event.Message, multiAttachErrorMessage) {
+		return
+	}
+	namespace, name := event.InvolvedObject.Namespace, event.InvolvedObject.Name
+	match := multiAttachVolumeRegexp.FindStringSubmatch(event.Message)
+	if match == nil {
+		log.Infof("Couldn't determine the volume of Multi-Attach error for pod %s/%s: %s", namespace, name, event.Message)
+		return
+	}
+	pvName := match[1]
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	pod, err := K8sAPI.GetPod(ctx, namespace, name)
+	if err != nil {
+		log.Errorf("Multi-Attach error GetPod failed: %s/%s: %s", namespace, name, err)
+		return
+	}
+	if !selector.Matches(labels.Set(pod.ObjectMeta.Labels)) || pod.Spec.NodeName == "" {
+		return
+	}
+	fields := map[string]interface{}{"namespace": namespace, "pod": name, "node": pod.Spec.NodeName, "pv": pvName}
+	log.WithFields(fields).Infof("Multi-Attach error for protected pod")
+	podKey := getPodKey(pod)
+	if cm.Scheduler.isWaiting(podKey) {
+		log.WithFields(fields).Infof("Not queuing Multi-Attach repair as a cleanup of the pod is already queued")
+		return
+	}
+	cm.Scheduler.submit([]string{podKey}, podCleanupPriority(pod, getPodPolicy(pod)), func() error {
+		cm.repairMultiAttachVolume(pod, pvName, fields)
+		return nil
+	})
+}
+
+// repairMultiAttachVolume repairs the Multi-Attach error of the pod's volume by deleting its stale VolumeAttachments on other nodes.
+func (cm *PodMonitorType) repairMultiAttachVolume(pod *v1.Pod, pvName string, fields map[string]interface{}) {
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	pv, err := K8sAPI.GetPersistentVolume(ctx, pvName)
+	if err != nil || pv == nil || pv.Spec.CSI == nil {
+		log.WithFields(fields).Errorf("Not repairing Multi-Attach error as the CSI volume could not be determined: %v", err)
+		return
+	}
+	if !cm.csiDriverForPV(pv).ExtensionsPresent {
+		log.WithFields(fields).Info("Not repairing Multi-Attach error as fencing cannot be confirmed without the CSI extensions")
+		return
+	}
+	vaList, err := K8sAPI.GetVolumeAttachmentsForPV(ctx, pvName)
+	if err != nil {
+		log.WithFields(fields).Errorf("Couldn't get VolumeAttachments of the volume: %s", err)
+		return
+	}
+	for i := range vaList.Items {
+		va := &vaList.Items[i]
+		if va.Spec.NodeName == pod.Spec.NodeName || va.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		cm.repairMultiAttach(ctx, pod, pv, va, fields)
+	}
+}
+
+// repairMultiAttach fences the pod's volume from another node and deletes its stale VolumeAttachment there, if no pod
+// on that node still uses the volume and the driver confirms the node has no connectivity to it, and records an Event
+// on the pod.
+func (cm *PodMonitorType) repairMultiAttach(ctx context.Context, pod *v1.Pod, pv *v1.PersistentVolume, va *storagev1.VolumeAttachment, fields map[string]interface{}) {
+	oldNodeName := va.Spec.NodeName
+	vaLog := log.WithFields(fields).WithField("oldNode", oldNodeName).WithField("volumeattachment", va.ObjectMeta.Name)
+	oldNode, err := K8sAPI.GetNode(ctx, oldNodeName)
+	if err != nil {
+		vaLog.Errorf("Not deleting stale VolumeAttachment, GetNode failed: %s", err)
+		return
+	}
+	oldPods, err := K8sAPI.GetPodsOnNode(ctx, oldNodeName)
+	if err != nil {
+		vaLog.Errorf("Not deleting stale VolumeAttachment, GetPodsOnNode failed: %s", err)
+		return
+	}
+	if podName := podUsingClaim(oldPods, pv.Spec.ClaimRef); podName != "" {
+		vaLog.Infof("Not deleting stale VolumeAttachment as pod %s/%s on the old node still uses the volume",
+			pv.Spec.ClaimRef.Namespace, podName)
+		return
+	}
+	connected, iosInProgress, err := cm.callValidateVolumeHostConnectivity(oldNode, []string{pv.Spec.CSI.VolumeHandle}, cm.pvToArrayID(pv), false)
+	if err != nil || connected || iosInProgress {
+		vaLog.Infof("Not deleting stale VolumeAttachment as the old node is not confirmed fenced: connected %t iosInProgress %t err %v",
+			connected, iosInProgress, err)
+		return
+	}
+	if GetDryRun() {
+		reportDryRun(pod, fields, dryRunDeleteVA, va.ObjectMeta.Name)
+		return
+	}
+	if err = callControllerUnpublishVolume(ctx, cm.csiDriverForPV(pv), oldNode, pv.Spec.CSI.VolumeHandle); err != nil {
+		vaLog.Errorf("Not deleting stale VolumeAttachment as fencing failed: %s", err)
+		return
+	}
+	if err = K8sAPI.DeleteVolumeAttachment(ctx, va.ObjectMeta.Name); err != nil && !strings.Contains(err.Error(), notFound) {
+		vaLog.Errorf("Couldn't delete stale VolumeAttachment: %s", err)
+		return
+	}
+	vaLog.Infof("Deleted stale VolumeAttachment to repair Multi-Attach error")
+	if err = K8sAPI.CreateEvent(podmon, pod, k8sapi.EventTypeWarning, multiAttachRepairedReason,
+		"podmon deleted stale VolumeAttachment %s of volume %s on fenced node %s",
+		va.ObjectMeta.Name, pv.ObjectMeta.Name, oldNodeName); err != nil {
+		log.Errorf("Failed to send %s event: %s", multiAttachRepairedReason, err.Error())
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"os"
 	"podmon/internal/criapi"
 	"podmon/internal/k8sapi"
+	"podmon/internal/metrics"
 	"podmon/internal/tools"
 	"strings"
 	"time"
@@ -202,6 +203,7 @@ func (pm *PodMonitorType) nodeModePodHandler(pod *v1.Pod, eventType watch.EventT
 						Path:     mountPath,
 						VolumeID: volumeID,
 						PVName:   pvName,
+						ArrayID:  pm.pvToArrayID(pv),
 					}
 					log.WithFields(fields).Infof("Adding mountPathVolumeInfo %v", mountPathVolumeInfo)
 					podInfo.Mounts = append(podInfo.Mounts, mountPathVolumeInfo)
@@ -229,6 +231,7 @@ func (pm *PodMonitorType) nodeModePodHandler(pod *v1.Pod, eventType watch.EventT
 						Path:     mountPath,
 						VolumeID: volumeID,
 						PVName:   pvName,
+						ArrayID:  pm.pvToArrayID(pv),
 					}
 					log.WithFields(fields).Infof("Add blockPathVolumeInfo %v", blockPathVolumeInfo)
 					podInfo.Devices = append(podInfo.Devices, blockPathVolumeInfo)
@@ -262,6 +265,7 @@ type MountPathVolumeInfo struct {
 	Path     string
 	VolumeID string
 	PVName   string
+	ArrayID  string
 }
 
 // BlockPathVolumeInfo holds the block path and volume information
@@ -269,6 +273,7 @@ type BlockPathVolumeInfo struct {
 	Path     string
 	VolumeID string
 	PVName   string
+	ArrayID  string
 }
 
 // NodePodInfo information used for monitoring a node
@@ -375,6 +380,15 @@ func (pm *PodMonitorType) nodeModeCleanupPods(node *v1.Node) bool {
 	pm.PodKeyMap.Range(fn)
 	log.Infof("pods skipped for cleanup because still present or container executing: %v", podKeysSkipped)
 	log.Infof("pods to be cleaned up: %v", podKeys)
+	if GetDryRun() {
+		for i := 0; i < len(podKeys); i++ {
+			pm.reportNodeModeCleanupPod(node, podKeys[i], podInfos[i])
+		}
+		if len(podKeysSkipped) == 0 {
+			reportDryRun(node, map[string]interface{}{"node": node.ObjectMeta.Name}, dryRunUntaintNode, node.ObjectMeta.Name)
+		}
+		return false
+	}
 	for i := 0; i < len(podKeys); i++ {
 		err := pm.nodeModeCleanupPod(podKeys[i], podInfos[i])
 		if err != nil {
@@ -389,6 +403,13 @@ func (pm *PodMonitorType) nodeModeCleanupPods(node *v1.Node) bool {
 	// Don't remove the taint if we had an error cleaning up a pod, or we skipped a pod because
 	// it was still present. Instead we will do another cleanup cycle.
 	if removeTaint && len(podKeysSkipped) == 0 && len(podKeysWithError) == 0 {
+		// Remove the out-of-service taint the controller applied first, as the podmon taint is what brings us back here on failure.
+		if nodeHasTaint(node, outOfServiceTaint, v1.TaintEffectNoExecute) {
+			if err := callK8sAPITaint("untainting ", node.ObjectMeta.Name, outOfServiceTaint, v1.TaintEffectNoExecute, true); err != nil {
+				log.Errorf("Failed to remove out-of-service taint against %s node: %v", node.ObjectMeta.Name, err)
+				return false
+			}
+		}
 		if err := taintNode(node.ObjectMeta.Name, PodmonTaintKey, true); err != nil {
 			log.Errorf("Failed to remove taint against %s node: %v", node.ObjectMeta.Name, err)
 			return false
@@ -409,8 +430,26 @@ var RemoveDir = os.Remove
 // RemoveDev reference to a function used to remove devices
 var RemoveDev = os.Remove
 
+// reportNodeModeCleanupPod reports the volumes nodeModeCleanupPod would unpublish and unstage in dry-run mode.
+func (pm *PodMonitorType) reportNodeModeCleanupPod(node *v1.Node, podKey string, podInfo *NodePodInfo) {
+	fields := make(map[string]interface{})
+	fields["podKey"] = podKey
+	fields["podUid"] = podInfo.PodUID
+	fields["node"] = node.ObjectMeta.Name
+	for _, mntInfo := range podInfo.Mounts {
+		reportDryRun(node, fields, dryRunNodeUnpublishVolume, fmt.Sprintf("%s at %s", mntInfo.VolumeID, mntInfo.Path))
+	}
+	for _, devInfo := range podInfo.Devices {
+		reportDryRun(node, fields, dryRunNodeUnpublishVolume, fmt.Sprintf("%s at %s", devInfo.VolumeID, devInfo.Path))
+	}
+}
+
 func (pm *PodMonitorType) nodeModeCleanupPod(podKey string, podInfo *NodePodInfo) error {
 	var returnErr error
+	start := time.Now()
+	defer func() {
+		metrics.ObserveNodeCleanup(returnErr, start)
+	}()
 	fields := make(map[string]interface{})
 	fields["podKey"] = podKey
 	podUID := podInfo.PodUID
@@ -522,7 +561,9 @@ func (pm *PodMonitorType) callNodeUnpublishVolume(fields map[string]interface{},
 			TargetPath: targetPath,
 			VolumeId:   volumeID,
 		}
+		start := time.Now()
 		_, err = CSIApi.NodeUnpublishVolume(context.Background(), req)
+		metrics.ObserveCSICall("NodeUnpublishVolume", start, err)
 		if err == nil {
 			break
 		}
@@ -545,7 +586,9 @@ func (pm *PodMonitorType) callNodeUnstageVolume(fields map[string]interface{}, t
 			StagingTargetPath: targetPath,
 			VolumeId:          volumeID,
 		}
+		start := time.Now()
 		_, err = CSIApi.NodeUnstageVolume(context.Background(), req)
+		metrics.ObserveCSICall("NodeUnstageVolume", start, err)
 		if err == nil {
 			break
 		}
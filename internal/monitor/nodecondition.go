@@ -0,0 +1,139 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// After each poll, the ArrayConnectivityMonitor publishes its view of each node's connectivity to the arrays of each
+// driver, so it can be seen with kubectl describe node. The node gets a condition per driver, of type
+// <podmon taint key>/StorageArrayConnectivity, which is True if the node is connected to all the driver's arrays its
+// protected pods use, and False if it lost connectivity to any of them. The array IDs the node is connected to are
+// put in the <podmon taint key>/connected-arrays annotation, separated by commas. Pairs that weren't sampled in the
+// poll are left out, and a node with no sampled pairs for a driver isn't updated.
+
+const (
+	// arrayConnectivityConditionSuffix is appended to a driver's podmon taint key to form its node condition type.
+	arrayConnectivityConditionSuffix = "/StorageArrayConnectivity"
+	// connectedArraysAnnotationSuffix is appended to a driver's podmon taint key to form its connected arrays annotation key.
+	connectedArraysAnnotationSuffix = "/connected-arrays"
+	// arrayConnectedReason is the condition reason when the node is connected to all its arrays.
+	arrayConnectedReason = "ArrayConnected"
+	// arrayConnectivityLostReason is the condition reason when the node lost connectivity to an array.
+	arrayConnectivityLostReason = "ArrayConnectivityLost"
+)
+
+var publishArrayConnectivity = true
+
+// GetPublishArrayConnectivity returns true if the array connectivity is published as node conditions and annotations.
+func GetPublishArrayConnectivity() bool {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return publishArrayConnectivity
+}
+
+// SetPublishArrayConnectivity enables or disables publishing the array connectivity as node conditions and annotations.
+func SetPublishArrayConnectivity(enabled bool) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	publishArrayConnectivity = enabled
+}
+
+// nodeDriverConnectivity is the connectivity of a node to the arrays of a driver sampled in a poll.
+type nodeDriverConnectivity struct {
+	driver    *CSIDriver
+	connected []string
+	lost      []string
+}
+
+// publishArrayConnectivity sets the array connectivity condition and connected arrays annotation of each driver on
+// the nodes of the sampled node:array pairs.
+func (cm *PodMonitorType) publishArrayConnectivity(pairs []nodeArrayPair) {
+	if !GetPublishArrayConnectivity() {
+		return
+	}
+	nodeToDrivers := make(map[string]map[string]*nodeDriverConnectivity)
+	for _, pair := range pairs {
+		nodeName := pair.node.ObjectMeta.Name
+		connected, sampled := connectivityCache.sampledConnectivity(nodeArrayKey(nodeName, pair.arrayID))
+		if !sampled {
+			continue
+		}
+		driver, arrayID := cm.csiDriverForArray(pair.arrayID)
+		if nodeToDrivers[nodeName] == nil {
+			nodeToDrivers[nodeName] = make(map[string]*nodeDriverConnectivity)
+		}
+		view := nodeToDrivers[nodeName][driver.TaintKey]
+		if view == nil {
+			view = &nodeDriverConnectivity{driver: driver}
+			nodeToDrivers[nodeName][driver.TaintKey] = view
+		}
+		if connected {
+			view.connected = append(view.connected, arrayID)
+		} else {
+			view.lost = append(view.lost, arrayID)
+		}
+	}
+	for nodeName, drivers := range nodeToDrivers {
+		for _, view := range drivers {
+			sort.Strings(view.connected)
+			sort.Strings(view.lost)
+			cm.publishNodeDriverConnectivity(nodeName, view)
+		}
+	}
+}
+
+// publishNodeDriverConnectivity sets the node's array connectivity condition and connected arrays annotation of the driver.
+func (cm *PodMonitorType) publishNodeDriverConnectivity(nodeName string, view *nodeDriverConnectivity) {
+	condition := v1.NodeCondition{
+		Type:    v1.NodeConditionType(view.driver.TaintKey + arrayConnectivityConditionSuffix),
+		Status:  v1.ConditionTrue,
+		Reason:  arrayConnectedReason,
+		Message: fmt.Sprintf("podmon found node %s connected to arrays %s", nodeName, strings.Join(view.connected, ", ")),
+	}
+	if len(view.lost) > 0 {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = arrayConnectivityLostReason
+		condition.Message = fmt.Sprintf("podmon found node %s lost connectivity to arrays %s", nodeName, strings.Join(view.lost, ", "))
+		if len(view.connected) > 0 {
+			condition.Message += fmt.Sprintf(", connected to arrays %s", strings.Join(view.connected, ", "))
+		}
+	}
+	ctx, cancel := K8sAPI.GetContext(ShortTimeout)
+	defer cancel()
+	if err := K8sAPI.SetNodeCondition(ctx, nodeName, condition); err != nil {
+		log.Errorf("Couldn't set the %s condition of node %s: %s", condition.Type, nodeName, err)
+	}
+
+	key := view.driver.TaintKey + connectedArraysAnnotationSuffix
+	value := strings.Join(view.connected, ",")
+	node, err := K8sAPI.GetNode(ctx, nodeName)
+	if err != nil {
+		log.Errorf("Couldn't get node %s to annotate its connected arrays: %s", nodeName, err)
+		return
+	}
+	if current, ok := node.ObjectMeta.Annotations[key]; ok && current == value {
+		return
+	}
+	if err := K8sAPI.AnnotateNode(ctx, nodeName, key, value); err != nil {
+		log.Errorf("Couldn't annotate node %s with its connected arrays: %s", nodeName, err)
+	}
+}
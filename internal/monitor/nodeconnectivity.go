@@ -0,0 +1,186 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// The controller judges array connectivity with ValidateVolumeHostConnectivity calls to the driver's controller
+// plugin, so a problem on the controller side can look like a connectivity loss of the nodes. As a second signal,
+// the node agent periodically checks the connectivity of its node to the arrays of its protected pods through the
+// local CSI socket, and publishes the result with the time of the check in a node annotation. When the controller
+// samples a node as disconnected from an array, the sample only counts towards the connection loss threshold if the
+// node agent agrees, or if the node's report is missing, stale, or doesn't cover the array, since a node that lost
+// its connectivity may not be able to report it.
+
+// arrayConnectivityAnnotationSuffix is appended to a driver's podmon taint key to form its report annotation key.
+const arrayConnectivityAnnotationSuffix = "/array-connectivity"
+
+// nodeConnectivityReportStaleIntervals is the number of report intervals after which a node's report is stale.
+const nodeConnectivityReportStaleIntervals = 3
+
+// NodeConnectivityReportIdleInterval is how often the node connectivity reporter checks whether it was enabled.
+var NodeConnectivityReportIdleInterval = time.Minute
+
+var nodeConnectivityReportInterval time.Duration
+
+// GetNodeConnectivityReportInterval returns how often the node agent reports its array connectivity, 0 if disabled.
+func GetNodeConnectivityReportInterval() time.Duration {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return nodeConnectivityReportInterval
+}
+
+// SetNodeConnectivityReportInterval sets how often the node agent reports its array connectivity. 0 disables the
+// reports, and the controller then ignores them.
+func SetNodeConnectivityReportInterval(interval time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	nodeConnectivityReportInterval = interval
+}
+
+// nodeConnectivityReport is the node agent's view of its array connectivity, published in the node annotation.
+type nodeConnectivityReport struct {
+	Time   time.Time       `json:"time"`   // when the node agent checked the connectivity
+	Arrays map[string]bool `json:"arrays"` // array ID to true if the node is connected to it
+}
+
+// arrayConnectivityAnnotation returns the key of the report annotation of the driver with the taint key.
+func arrayConnectivityAnnotation(taintKey string) string {
+	return taintKey + arrayConnectivityAnnotationSuffix
+}
+
+// getNodeConnectivityReport returns the node's report for the driver with the taint key, or nil if there is none.
+func getNodeConnectivityReport(node *v1.Node, taintKey string) *nodeConnectivityReport {
+	value := node.ObjectMeta.Annotations[arrayConnectivityAnnotation(taintKey)]
+	if value == "" {
+		return nil
+	}
+	report := &nodeConnectivityReport{}
+	if err := json.Unmarshal([]byte(value), report); err != nil {
+		log.Errorf("could not unmarshal array connectivity report %s of node %s: %s", value, node.ObjectMeta.Name, err)
+		return nil
+	}
+	return report
+}
+
+// NodeConnectivityReporter -- periodically publishes the node's connectivity to the arrays of its protected pods.
+// This is a never ending function, intended to be called as Go routine in node mode.
+func (pm *PodMonitorType) NodeConnectivityReporter() {
+	nodeName := os.Getenv("KUBE_NODE_NAME")
+	for {
+		interval := GetNodeConnectivityReportInterval()
+		if interval > 0 {
+			pm.reportNodeConnectivity(nodeName, time.Now())
+		} else {
+			interval = NodeConnectivityReportIdleInterval
+		}
+		time.Sleep(interval)
+		if interval < 10*time.Millisecond {
+			// unit testing exit
+			return
+		}
+	}
+}
+
+// nodeArrayIDs returns the array IDs of the volumes of the protected pods on the node, sorted.
+func (pm *PodMonitorType) nodeArrayIDs() []string {
+	seen := make(map[string]bool)
+	pm.PodKeyMap.Range(func(_, value interface{}) bool {
+		podInfo := value.(*NodePodInfo)
+		for _, mount := range podInfo.Mounts {
+			seen[mount.ArrayID] = true
+		}
+		for _, device := range podInfo.Devices {
+			seen[device.ArrayID] = true
+		}
+		return true
+	})
+	arrayIDs := make([]string, 0, len(seen))
+	for arrayID := range seen {
+		if arrayID != "" {
+			arrayIDs = append(arrayIDs, arrayID)
+		}
+	}
+	sort.Strings(arrayIDs)
+	return arrayIDs
+}
+
+// reportNodeConnectivity checks the node's connectivity to each of its arrays through the local CSI socket
+// and publishes it in the node's report annotation. The arrays whose connectivity couldn't be determined
+// are left out of the report.
+func (pm *PodMonitorType) reportNodeConnectivity(nodeName string, now time.Time) {
+	node, err := K8sAPI.GetNodeWithTimeout(MediumTimeout, nodeName)
+	if err != nil {
+		log.Errorf("Couldn't get node %s to report its array connectivity: %s", nodeName, err)
+		return
+	}
+	report := nodeConnectivityReport{Time: now.UTC(), Arrays: make(map[string]bool)}
+	driver := pm.primaryCSIDriver()
+	for _, arrayID := range pm.nodeArrayIDs() {
+		connected, _, err := callDriverValidateVolumeHostConnectivity(driver, node, nil, arrayID, false)
+		if err != nil {
+			log.Infof("Could not determine connectivity of node %s to array %s, leaving it out of the report: %s", nodeName, arrayID, err)
+			continue
+		}
+		report.Arrays[arrayID] = connected
+	}
+	value, err := json.Marshal(report)
+	if err != nil {
+		log.Errorf("Couldn't marshal the array connectivity report of node %s: %s", nodeName, err)
+		return
+	}
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	if err = K8sAPI.AnnotateNode(ctx, nodeName, arrayConnectivityAnnotation(driver.TaintKey), string(value)); err != nil {
+		log.Errorf("Couldn't publish the array connectivity report of node %s: %s", nodeName, err)
+		return
+	}
+	log.Infof("Node %s reported array connectivity %v", nodeName, report.Arrays)
+}
+
+// nodeDisagreesWithLoss returns true if the node's own fresh report says it is connected to the array
+// the controller found it disconnected from.
+func (cm *PodMonitorType) nodeDisagreesWithLoss(nodeName, arrayID string, now time.Time) bool {
+	interval := GetNodeConnectivityReportInterval()
+	if interval <= 0 {
+		return false
+	}
+	ctx, cancel := K8sAPI.GetContext(ShortTimeout)
+	defer cancel()
+	node, err := K8sAPI.GetNode(ctx, nodeName)
+	if err != nil {
+		log.Infof("Couldn't get node %s for its array connectivity report, using the controller's view: %s", nodeName, err)
+		return false
+	}
+	driver, driverArrayID := cm.csiDriverForArray(arrayID)
+	report := getNodeConnectivityReport(node, driver.TaintKey)
+	if report == nil {
+		return false
+	}
+	if age := now.Sub(report.Time); age > nodeConnectivityReportStaleIntervals*interval {
+		log.Infof("Array connectivity report of node %s is stale (%v old), using the controller's view", nodeName, age.Round(time.Second))
+		return false
+	}
+	connected, ok := report.Arrays[driverArrayID]
+	return ok && connected
+}
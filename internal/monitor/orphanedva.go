@@ -0,0 +1,306 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"podmon/internal/k8sapi"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// A partial cleanup, such as one interrupted by a controller restart or a failed API call, can leave a
+// VolumeAttachment behind on a node that is gone, has been NotReady for a long time, or carries the podmon taint.
+// Such a VolumeAttachment keeps the volume from being attached elsewhere. The orphaned VolumeAttachment reconciler
+// periodically lists the VolumeAttachments of the driver and, for each one on such a node whose volume isn't used
+// by a running pod on the node, sends an Event on the PV. In delete mode, which must be opted into, it instead fences
+// the volume from the node with ControllerUnpublishVolume and deletes the VolumeAttachment.
+//
+// The VolumeAttachments of a node that is gone are only reported, even in delete mode. Without the Node object the
+// CSI node ID isn't known, so the volume can't be fenced, and the host may still be running and writing to it if it
+// was only removed from the cluster. Deleting the VolumeAttachment would let the volume be attached to another node
+// at the same time and corrupt it, so an administrator must confirm the host is down and delete it.
+
+const (
+	// OrphanedVAModeDelete fences and deletes orphaned VolumeAttachments.
+	OrphanedVAModeDelete = "delete"
+	// OrphanedVAModeReport only reports orphaned VolumeAttachments with Events on their PVs.
+	OrphanedVAModeReport = "report"
+	// OrphanedVAModeDisabled disables the orphaned VolumeAttachment reconciler.
+	OrphanedVAModeDisabled = "disabled"
+)
+
+const (
+	// orphanedVAReason is the Event reason used when an orphaned VolumeAttachment is found in report mode.
+	orphanedVAReason = "OrphanedVolumeAttachment"
+	// orphanedVADeletedReason is the Event reason used when an orphaned VolumeAttachment is deleted.
+	orphanedVADeletedReason = "OrphanedVolumeAttachmentDeleted"
+)
+
+// Why a VolumeAttachment's node makes it an orphan.
+const (
+	orphanedNodeGone     = "node is gone"
+	orphanedNodeNotReady = "node has been NotReady for more than %v"
+	orphanedNodeTainted  = "node has the podmon taint"
+	// orphanedNodeGoneNotFenced is the reason reported in delete mode for the VolumeAttachments of a gone node.
+	orphanedNodeGoneNotFenced = "node is gone, not deleting it as the volume can't be fenced, delete it once the host is confirmed down"
+)
+
+// OrphanedVAInterval is the time between the orphaned VolumeAttachment reconciler's passes.
+var OrphanedVAInterval = 5 * time.Minute
+
+var (
+	orphanedVAMode           = OrphanedVAModeReport
+	orphanedVANotReadyPeriod = 10 * time.Minute
+)
+
+// GetOrphanedVAMode returns what the orphaned VolumeAttachment reconciler does with the orphans it finds.
+func GetOrphanedVAMode() string {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return orphanedVAMode
+}
+
+// SetOrphanedVAMode sets what the orphaned VolumeAttachment reconciler does with the orphans it finds:
+// OrphanedVAModeDelete, OrphanedVAModeReport or OrphanedVAModeDisabled.
+func SetOrphanedVAMode(mode string) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	orphanedVAMode = mode
+}
+
+// GetOrphanedVANotReadyPeriod returns how long a node must be NotReady before its VolumeAttachments are orphans.
+func GetOrphanedVANotReadyPeriod() time.Duration {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return orphanedVANotReadyPeriod
+}
+
+// SetOrphanedVANotReadyPeriod sets how long a node must be NotReady before its VolumeAttachments are orphans.
+func SetOrphanedVANotReadyPeriod(period time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	orphanedVANotReadyPeriod = period
+}
+
+// OrphanedVAReconciler remembers the orphaned VolumeAttachments already reported, so that each is reported
+// with one Event rather than on every pass. The zero value is ready to use.
+type OrphanedVAReconciler struct {
+	mutex    sync.Mutex
+	reported map[string]string // VolumeAttachment name to the reason it was reported for
+}
+
+// report records that the VolumeAttachment was found orphaned for the reason, returning true if it wasn't already reported for it.
+func (r *OrphanedVAReconciler) report(vaName, reason string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.reported == nil {
+		r.reported = make(map[string]string)
+	}
+	if r.reported[vaName] == reason {
+		return false
+	}
+	r.reported[vaName] = reason
+	return true
+}
+
+// retain forgets the reported VolumeAttachments that are no longer orphans.
+func (r *OrphanedVAReconciler) retain(orphans map[string]bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for vaName := range r.reported {
+		if !orphans[vaName] {
+			delete(r.reported, vaName)
+		}
+	}
+}
+
+// nodeNotReadySince returns when the node's Ready condition last became other than True, or the zero time if the node is Ready
+// or has no Ready condition.
+func nodeNotReadySince(node *v1.Node) time.Time {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady && condition.Status != v1.ConditionTrue {
+			return condition.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+// orphanedVANodeReason returns why the VolumeAttachments on the named node are orphans, or "" if they are not.
+// The node is nil if it is gone.
+func (cm *PodMonitorType) orphanedVANodeReason(ctx context.Context, nodeName string, now time.Time) (*v1.Node, string, error) {
+	node, err := K8sAPI.GetNode(ctx, nodeName)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, orphanedNodeGone, nil
+		}
+		return nil, "", err
+	}
+	if cm.nodeHasPodmonTaint(node) {
+		return node, orphanedNodeTainted, nil
+	}
+	period := GetOrphanedVANotReadyPeriod()
+	if since := nodeNotReadySince(node); !since.IsZero() && now.Sub(since) > period {
+		return node, fmt.Sprintf(orphanedNodeNotReady, period), nil
+	}
+	return node, "", nil
+}
+
+// podUsingClaim returns the name of a pod on the node using the PVC that isn't terminated or being deleted, or "" if there is none.
+func podUsingClaim(pods *v1.PodList, claim *v1.ObjectReference) string {
+	if claim == nil {
+		return ""
+	}
+	for _, pod := range pods.Items {
+		if pod.ObjectMeta.Namespace != claim.Namespace || pod.ObjectMeta.DeletionTimestamp != nil ||
+			pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claim.Name {
+				return pod.ObjectMeta.Name
+			}
+		}
+	}
+	return ""
+}
+
+// reconcileOrphanedVAs makes a pass over the driver's VolumeAttachments, fencing and deleting the orphans, or
+// only reporting them in report mode.
+func (cm *PodMonitorType) reconcileOrphanedVAs(now time.Time) {
+	mode := GetOrphanedVAMode()
+	if mode == OrphanedVAModeDisabled {
+		return
+	}
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	vaList, err := K8sAPI.GetVolumeAttachments(ctx)
+	if err != nil {
+		log.Errorf("Orphaned VolumeAttachment reconciler couldn't list VolumeAttachments: %s", err)
+		return
+	}
+	// the nodes and their pods are looked up once per pass
+	type nodeInfo struct {
+		node   *v1.Node
+		reason string
+		pods   *v1.PodList
+		err    error
+	}
+	nodes := make(map[string]*nodeInfo)
+	orphans := make(map[string]bool)
+	for i := range vaList.Items {
+		va := &vaList.Items[i]
+		pvName := va.Spec.Source.PersistentVolumeName
+		if pvName == nil || va.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		nodeName := va.Spec.NodeName
+		info, ok := nodes[nodeName]
+		if !ok {
+			info = &nodeInfo{}
+			info.node, info.reason, info.err = cm.orphanedVANodeReason(ctx, nodeName, now)
+			if info.err == nil && info.reason != "" {
+				info.pods, info.err = K8sAPI.GetPodsOnNode(ctx, nodeName)
+			}
+			nodes[nodeName] = info
+		}
+		if info.err != nil {
+			log.Errorf("Orphaned VolumeAttachment reconciler couldn't check node %s: %s", nodeName, info.err)
+			continue
+		}
+		if info.reason == "" {
+			continue
+		}
+		pv, err := K8sAPI.GetPersistentVolume(ctx, *pvName)
+		if err != nil {
+			log.Errorf("Orphaned VolumeAttachment reconciler couldn't get PV %s of VolumeAttachment %s: %s", *pvName, va.ObjectMeta.Name, err)
+			continue
+		}
+		if pv == nil || pv.Spec.CSI == nil || cm.managedCSIDriver(pv.Spec.CSI.Driver) == nil {
+			continue
+		}
+		fields := map[string]interface{}{"volumeattachment": va.ObjectMeta.Name, "pv": pv.ObjectMeta.Name, "node": nodeName}
+		if podName := podUsingClaim(info.pods, pv.Spec.ClaimRef); podName != "" {
+			log.WithFields(fields).Infof("Not deleting VolumeAttachment as %s but pod %s/%s still uses the volume",
+				info.reason, pv.Spec.ClaimRef.Namespace, podName)
+			continue
+		}
+		orphans[va.ObjectMeta.Name] = true
+		cm.handleOrphanedVA(ctx, va, pv, info.node, info.reason, mode, fields)
+	}
+	cm.OrphanedVAs.retain(orphans)
+}
+
+// handleOrphanedVA reports the orphaned VolumeAttachment, or fences its volume from the node, if it still exists, and deletes it.
+func (cm *PodMonitorType) handleOrphanedVA(ctx context.Context, va *storagev1.VolumeAttachment, pv *v1.PersistentVolume, node *v1.Node,
+	reason, mode string, fields map[string]interface{},
+) {
+	vaLog := log.WithFields(fields)
+	vaName := va.ObjectMeta.Name
+	if node == nil {
+		// The volume can't be fenced from a gone node, see above.
+		mode, reason = OrphanedVAModeReport, orphanedNodeGoneNotFenced
+	}
+	if mode == OrphanedVAModeReport {
+		if !cm.OrphanedVAs.report(vaName, reason) {
+			return
+		}
+		vaLog.Infof("Found orphaned VolumeAttachment: %s", reason)
+		if err := K8sAPI.CreateEvent(podmon, pv, k8sapi.EventTypeWarning, orphanedVAReason,
+			"podmon found orphaned VolumeAttachment %s on node %s: %s", vaName, va.Spec.NodeName, reason); err != nil {
+			log.Errorf("Failed to send %s event: %s", orphanedVAReason, err.Error())
+		}
+		return
+	}
+	if GetDryRun() {
+		if cm.OrphanedVAs.report(vaName, reason) {
+			reportDryRun(pv, fields, dryRunDeleteVA, vaName)
+		}
+		return
+	}
+	if err := callControllerUnpublishVolume(ctx, cm.csiDriverForPV(pv), node, pv.Spec.CSI.VolumeHandle); err != nil {
+		vaLog.Errorf("Not deleting orphaned VolumeAttachment as fencing failed: %s", err)
+		return
+	}
+	if err := K8sAPI.DeleteVolumeAttachment(ctx, vaName); err != nil && !strings.Contains(err.Error(), notFound) {
+		vaLog.Errorf("Couldn't delete orphaned VolumeAttachment: %s", err)
+		return
+	}
+	vaLog.Infof("Deleted orphaned VolumeAttachment: %s", reason)
+	if err := K8sAPI.CreateEvent(podmon, pv, k8sapi.EventTypeWarning, orphanedVADeletedReason,
+		"podmon deleted orphaned VolumeAttachment %s on node %s: %s", vaName, va.Spec.NodeName, reason); err != nil {
+		log.Errorf("Failed to send %s event: %s", orphanedVADeletedReason, err.Error())
+	}
+}
+
+// OrphanedVolumeAttachmentReconciler -- periodically fences and deletes, or reports, orphaned VolumeAttachments.
+// This is a never ending function, intended to be called as Go routine.
+func (cm *PodMonitorType) OrphanedVolumeAttachmentReconciler() {
+	for {
+		cm.reconcileOrphanedVAs(time.Now())
+		time.Sleep(OrphanedVAInterval)
+		if OrphanedVAInterval < 10*time.Millisecond {
+			// unit testing exit
+			return
+		}
+	}
+}
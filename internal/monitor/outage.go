@@ -0,0 +1,185 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"podmon/internal/k8sapi"
+	"podmon/internal/metrics"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// When an array goes down, every node using it loses connectivity at the same time, and failing the nodes over
+// can't help because no node can reach the array. After each poll, the ArrayConnectivityMonitor counts the nodes
+// that lost connectivity to each array among the nodes sampled for it. If at least two nodes use the array and more
+// than ArrayOutageNodesPercent of them lost it, the array has an outage: the loss of the array doesn't taint the
+// nodes or clean up their pods, a Warning Event is sent on the driver's CSIDriver object, and the array outage metric
+// is set. The outage ends, and failover resumes as normal, once no more than the percentage of nodes have lost it.
+
+const (
+	// arrayOutageReason is the Event reason used when an array outage is detected.
+	arrayOutageReason = "ArrayOutage"
+	// arrayOutageRecoveredReason is the Event reason used when an array outage ends.
+	arrayOutageRecoveredReason = "ArrayOutageRecovered"
+	// arrayOutageMinNodes is the minimum number of sampled nodes using an array for its loss to be an outage.
+	arrayOutageMinNodes = 2
+)
+
+// arrayOutageNodesPercent is the percentage of the nodes using an array that must lose it for an array outage, 0 disables.
+var arrayOutageNodesPercent = 0
+
+// GetArrayOutageNodesPercent returns the percentage of the nodes using an array that must lose it for an array outage.
+func GetArrayOutageNodesPercent() int {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return arrayOutageNodesPercent
+}
+
+// SetArrayOutageNodesPercent sets the percentage of the nodes using an array that must lose it for an array outage.
+// A percentage of 0 disables array outage detection.
+func SetArrayOutageNodesPercent(percent int) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	arrayOutageNodesPercent = percent
+}
+
+// arrayOutage is an ongoing outage of an array.
+type arrayOutage struct {
+	since time.Time // when the outage was detected
+	lost  int       // number of nodes that lost the array in the last poll
+	nodes int       // number of nodes sampled for the array in the last poll
+}
+
+// ArrayOutageDetector classifies the arrays lost by most of the nodes using them as having an outage.
+// The zero value is ready to use.
+type ArrayOutageDetector struct {
+	mutex   sync.Mutex
+	outages map[string]*arrayOutage // array ID to the outage of the array
+}
+
+// update classifies the arrays from the connectivity of their nodes sampled in a poll, given as array ID to node
+// name to connected. Arrays with no sampled nodes keep their classification. It returns the array IDs whose outage
+// started, and those whose outage ended, sorted.
+func (d *ArrayOutageDetector) update(arrayNodes map[string]map[string]bool, now time.Time) ([]string, []string) {
+	percent := GetArrayOutageNodesPercent()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.outages == nil {
+		d.outages = make(map[string]*arrayOutage)
+	}
+	started := make([]string, 0)
+	ended := make([]string, 0)
+	for arrayID, nodes := range arrayNodes {
+		if len(nodes) == 0 {
+			continue
+		}
+		lost := lostNodes(nodes)
+		outage := percent > 0 && len(nodes) >= arrayOutageMinNodes && lost*100 > percent*len(nodes)
+		current := d.outages[arrayID]
+		switch {
+		case outage && current == nil:
+			d.outages[arrayID] = &arrayOutage{since: now, lost: lost, nodes: len(nodes)}
+			started = append(started, arrayID)
+		case outage:
+			current.lost = lost
+			current.nodes = len(nodes)
+		case current != nil:
+			delete(d.outages, arrayID)
+			ended = append(ended, arrayID)
+		}
+	}
+	if percent == 0 {
+		// Detection was disabled, so end the outages of arrays that weren't sampled too.
+		for arrayID := range d.outages {
+			if _, ok := arrayNodes[arrayID]; !ok {
+				delete(d.outages, arrayID)
+				ended = append(ended, arrayID)
+			}
+		}
+	}
+	sort.Strings(started)
+	sort.Strings(ended)
+	return started, ended
+}
+
+// lostNodes returns the number of nodes that lost connectivity, given node name to connected.
+func lostNodes(nodes map[string]bool) int {
+	lost := 0
+	for _, connected := range nodes {
+		if !connected {
+			lost++
+		}
+	}
+	return lost
+}
+
+// inOutage returns true if the array has an outage.
+func (d *ArrayOutageDetector) inOutage(arrayID string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.outages[arrayID] != nil
+}
+
+// detectArrayOutages classifies the arrays of the sampled node:array pairs, and reports the outages that started or ended.
+func (cm *PodMonitorType) detectArrayOutages(pairs []nodeArrayPair) {
+	arrayNodes := make(map[string]map[string]bool)
+	for _, pair := range pairs {
+		nodeName := pair.node.ObjectMeta.Name
+		connected, sampled := connectivityCache.sampledConnectivity(nodeArrayKey(nodeName, pair.arrayID))
+		if !sampled {
+			continue
+		}
+		if arrayNodes[pair.arrayID] == nil {
+			arrayNodes[pair.arrayID] = make(map[string]bool)
+		}
+		arrayNodes[pair.arrayID][nodeName] = connected
+	}
+	started, ended := cm.Outages.update(arrayNodes, time.Now())
+	for _, arrayID := range started {
+		nodes := arrayNodes[arrayID]
+		lost := lostNodes(nodes)
+		log.WithFields(map[string]interface{}{
+			"array":        arrayID,
+			"lostNodes":    lost,
+			"nodes":        len(nodes),
+			"nodesPercent": GetArrayOutageNodesPercent(),
+		}).Error("********** Array outage detected- not failing over the nodes that lost connectivity to the array **********")
+		cm.reportArrayOutage(arrayID, true, "podmon detected an outage of array %s: %d of %d nodes lost connectivity to it, not failing them over", lost, len(nodes))
+	}
+	for _, arrayID := range ended {
+		log.Infof("Array %s outage ended, resuming failover of the nodes that lost connectivity to it", arrayID)
+		cm.reportArrayOutage(arrayID, false, "podmon found the outage of array %s ended, resuming failover")
+	}
+}
+
+// reportArrayOutage sets the array outage metric, and sends an Event on the CSIDriver of the array. The first
+// message argument is the array ID.
+func (cm *PodMonitorType) reportArrayOutage(arrayID string, outage bool, messageFmt string, args ...interface{}) {
+	metrics.SetArrayOutage(arrayID, outage)
+	driver, driverArrayID := cm.csiDriverForArray(arrayID)
+	csiDriver := &storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: driver.Path}}
+	eventType, reason := k8sapi.EventTypeWarning, arrayOutageReason
+	if !outage {
+		eventType, reason = k8sapi.EventTypeNormal, arrayOutageRecoveredReason
+	}
+	if err := K8sAPI.CreateEvent(podmon, csiDriver, eventType, reason, messageFmt, append([]interface{}{driverArrayID}, args...)...); err != nil {
+		log.Errorf("Failed to send %s event: %s", reason, err.Error())
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Pod annotations that override the resiliency behavior for an individual pod.
+const (
+	// SkipArrayConnectivityCleanupAnnotation set to "true" keeps the pod from being cleaned up on array connectivity loss.
+	SkipArrayConnectivityCleanupAnnotation = "podmon.dellemc.com/skip-array-connectivity-cleanup"
+	// SkipCrashLoopBackOffCleanupAnnotation set to "true" keeps the pod from being deleted when in CrashLoopBackOff.
+	SkipCrashLoopBackOffCleanupAnnotation = "podmon.dellemc.com/skip-crashloopbackoff-cleanup"
+	// IgnoreIOsInProgressAnnotation set to "true" ignores recent I/O on the pod's volumes when deciding to clean it up.
+	IgnoreIOsInProgressAnnotation = "podmon.dellemc.com/ignore-ios-in-progress"
+	// ForceDeleteGracePeriodAnnotation is extra time (a duration like "30s") to wait before force deleting the pod.
+	ForceDeleteGracePeriodAnnotation = "podmon.dellemc.com/force-delete-grace-period"
+	// CleanupPriorityAnnotation is an integer priority overriding the pod's PriorityClass value, higher priority pods are cleaned up first.
+	CleanupPriorityAnnotation = "podmon.dellemc.com/cleanup-priority"
+)
+
+// maxForceDeleteGracePeriod is the largest extra time the ForceDeleteGracePeriodAnnotation may request, larger values are ignored.
+var maxForceDeleteGracePeriod = 10 * time.Minute
+
+// GetMaxForceDeleteGracePeriod returns the largest extra time a pod may request before it is force deleted.
+func GetMaxForceDeleteGracePeriod() time.Duration {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return maxForceDeleteGracePeriod
+}
+
+// SetMaxForceDeleteGracePeriod sets the largest extra time a pod may request before it is force deleted.
+func SetMaxForceDeleteGracePeriod(period time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	maxForceDeleteGracePeriod = period
+}
+
+// PodPolicy is the resiliency behavior requested by a pod's annotations.
+type PodPolicy struct {
+	SkipArrayConnectivityCleanup bool          // don't clean up the pod on array connectivity loss
+	SkipCrashLoopBackOffCleanup  bool          // don't delete the pod when in CrashLoopBackOff
+	IgnoreIOsInProgress          bool          // don't abort the cleanup if the volumes recently did I/O
+	ForceDeleteGracePeriod       time.Duration // extra time to wait before force deleting the pod
+	CleanupPriority              int           // higher priority pods are cleaned up first
+	CleanupPrioritySet           bool          // CleanupPriority was set, overriding the pod's PriorityClass value
+}
+
+// getPodPolicy returns the PodPolicy from the pod's annotations. Invalid values are logged and ignored.
+func getPodPolicy(pod *v1.Pod) PodPolicy {
+	policy := PodPolicy{}
+	annotations := pod.ObjectMeta.Annotations
+	if len(annotations) == 0 {
+		return policy
+	}
+	podKey := getPodKey(pod)
+	parseBool := func(key string) bool {
+		value, ok := annotations[key]
+		if !ok {
+			return false
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Warnf("Ignoring pod %s annotation %s invalid value %s: %s", podKey, key, value, err)
+			return false
+		}
+		return enabled
+	}
+	policy.SkipArrayConnectivityCleanup = parseBool(SkipArrayConnectivityCleanupAnnotation)
+	policy.SkipCrashLoopBackOffCleanup = parseBool(SkipCrashLoopBackOffCleanupAnnotation)
+	policy.IgnoreIOsInProgress = parseBool(IgnoreIOsInProgressAnnotation)
+	if value, ok := annotations[ForceDeleteGracePeriodAnnotation]; ok {
+		gracePeriod, err := time.ParseDuration(value)
+		if err != nil || gracePeriod < 0 {
+			log.Warnf("Ignoring pod %s annotation %s invalid value %s", podKey, ForceDeleteGracePeriodAnnotation, value)
+		} else if maxGracePeriod := GetMaxForceDeleteGracePeriod(); gracePeriod > maxGracePeriod {
+			log.Warnf("Ignoring pod %s annotation %s value %s, it exceeds the maximum of %v", podKey, ForceDeleteGracePeriodAnnotation, value, maxGracePeriod)
+		} else {
+			policy.ForceDeleteGracePeriod = gracePeriod
+		}
+	}
+	if value, ok := annotations[CleanupPriorityAnnotation]; ok {
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			log.Warnf("Ignoring pod %s annotation %s invalid value %s: %s", podKey, CleanupPriorityAnnotation, value, err)
+		} else {
+			policy.CleanupPriority = priority
+			policy.CleanupPrioritySet = true
+		}
+	}
+	return policy
+}
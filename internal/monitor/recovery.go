@@ -0,0 +1,344 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"fmt"
+	"podmon/internal/k8sapi"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// The recovery reconciler removes the podmon taint from nodes in the controller, so that a node whose podmon
+// node pod never comes back to remove the taint itself is not left tainted forever. A tainted node is only
+// untainted once all of these hold: its UID and bootID have not changed for the recovery stable period, the
+// driver reports array connectivity from the node, no VolumeAttachments remain on the node for the volumes of
+// the pods podmon cleaned up from it, and the driver node pod on the node is Ready.
+
+const (
+	// nodeRecoveredReason is the Event reason used when the reconciler removes the podmon taint.
+	nodeRecoveredReason = "NodeRecovered"
+	// nodeRecoveryPendingReason is the Event reason used when the reconciler keeps the podmon taint.
+	nodeRecoveryPendingReason = "NodeRecoveryPending"
+)
+
+// The checks that can keep the podmon taint on a node.
+const (
+	recoveryNodeNotStable        = "NodeNotStable"
+	recoveryArrayNotConnected    = "ArrayNotConnected"
+	recoveryStaleVA              = "StaleVolumeAttachment"
+	recoveryDriverNodePodMissing = "DriverNodePodNotReady"
+)
+
+// NodeRecoveryInterval is the time between the recovery reconciler's passes over the tainted nodes.
+var NodeRecoveryInterval = 30 * time.Second
+
+// recoveryStablePeriod is how long a tainted node's UID and bootID must be unchanged before it can be untainted, 0 disables the reconciler.
+var recoveryStablePeriod = 5 * time.Minute
+
+// GetRecoveryStablePeriod returns how long a tainted node's UID and bootID must be unchanged before it can be untainted.
+func GetRecoveryStablePeriod() time.Duration {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return recoveryStablePeriod
+}
+
+// SetRecoveryStablePeriod sets how long a tainted node's UID and bootID must be unchanged before it can be untainted.
+// A period of 0 disables the recovery reconciler.
+func SetRecoveryStablePeriod(period time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	recoveryStablePeriod = period
+}
+
+// nodeRecovery is what the reconciler knows about a node with the podmon taint.
+type nodeRecovery struct {
+	uid         string          // the node UID when last seen
+	bootID      string          // the node bootID when last seen
+	stableSince time.Time       // when the UID or bootID last changed
+	cleanedPVs  map[string]bool // the PVs of the pods cleaned up from the node
+	arrayIDs    map[string]bool // the arrays of the cleaned up PVs
+	pending     string          // the check that last kept the taint, an Event is only sent when it changes
+}
+
+// RecoveryReconciler tracks the nodes with the podmon taint until they can be safely untainted. The zero value is ready to use.
+type RecoveryReconciler struct {
+	mutex          sync.Mutex
+	nodes          map[string]*nodeRecovery // node name to its recovery state
+	driverPodReady map[string]bool          // node name to the readiness of the driver node pod on it
+}
+
+// node returns the recovery state of the named node, creating it if needed. The mutex must be held.
+func (r *RecoveryReconciler) node(nodeName string) *nodeRecovery {
+	if r.nodes == nil {
+		r.nodes = make(map[string]*nodeRecovery)
+	}
+	state, ok := r.nodes[nodeName]
+	if !ok {
+		state = &nodeRecovery{cleanedPVs: make(map[string]bool), arrayIDs: make(map[string]bool)}
+		r.nodes[nodeName] = state
+	}
+	return state
+}
+
+// observeNode starts or stops tracking the node depending on whether it has a podmon taint, restarting
+// its stable period if the UID or bootID changed. A node only recorded by recordCleanedPVs is kept until
+// it has been seen with the taint, as the informer may not have delivered the tainted node yet.
+func (r *RecoveryReconciler) observeNode(node *v1.Node, tainted bool, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	nodeName := node.ObjectMeta.Name
+	if !tainted {
+		if state, ok := r.nodes[nodeName]; ok && !state.stableSince.IsZero() {
+			delete(r.nodes, nodeName)
+		}
+		return
+	}
+	state := r.node(nodeName)
+	uid, bootID := string(node.ObjectMeta.UID), node.Status.NodeInfo.BootID
+	if state.stableSince.IsZero() || state.uid != uid || state.bootID != bootID {
+		if !state.stableSince.IsZero() {
+			log.Infof("Node %s changed uid %s bootID %s, restarting recovery stable period", nodeName, uid, bootID)
+		}
+		state.uid, state.bootID, state.stableSince = uid, bootID, now
+	}
+}
+
+// forgetNode stops tracking the node.
+func (r *RecoveryReconciler) forgetNode(nodeName string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.nodes, nodeName)
+}
+
+// recordCleanedPVs records the PVs of a pod cleaned up from the node, whose VolumeAttachments must be gone before the node is
+// untainted, and the arrays they are on, each of which must be connected to the node again.
+func (r *RecoveryReconciler) recordCleanedPVs(nodeName string, pvlist []*v1.PersistentVolume, arrayIDs []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	state := r.node(nodeName)
+	for _, pv := range pvlist {
+		state.cleanedPVs[pv.ObjectMeta.Name] = true
+	}
+	for _, arrayID := range arrayIDs {
+		state.arrayIDs[arrayID] = true
+	}
+}
+
+// setDriverPodReady records the readiness of the driver node pod on the node.
+func (r *RecoveryReconciler) setDriverPodReady(nodeName string, ready bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.driverPodReady == nil {
+		r.driverPodReady = make(map[string]bool)
+	}
+	r.driverPodReady[nodeName] = ready
+}
+
+// snapshot returns the names of the tracked nodes.
+func (r *RecoveryReconciler) snapshot() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := make([]string, 0, len(r.nodes))
+	for name := range r.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recoveryChecks returns what the reconciler needs to check the node: when its stable period started, the
+// PVs whose VolumeAttachments must be gone, the arrays that must be connected, and whether the driver node pod
+// is Ready. The last bool is false if the node isn't tracked.
+func (r *RecoveryReconciler) recoveryChecks(nodeName string) (time.Time, []string, []string, bool, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	state, ok := r.nodes[nodeName]
+	if !ok {
+		return time.Time{}, nil, nil, false, false
+	}
+	return state.stableSince, sortedKeys(state.cleanedPVs), sortedKeys(state.arrayIDs), r.driverPodReady[nodeName], true
+}
+
+// sortedKeys returns the keys of the set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setPending records the check keeping the taint on the node, returning true if it changed.
+func (r *RecoveryReconciler) setPending(nodeName, check string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	state, ok := r.nodes[nodeName]
+	if !ok || state.pending == check {
+		return false
+	}
+	state.pending = check
+	return true
+}
+
+// nodeRecoveryCheck returns the first check keeping the podmon taint on the node and an explanation, or "" if it can be untainted.
+func (cm *PodMonitorType) nodeRecoveryCheck(node *v1.Node, now time.Time) (string, string) {
+	nodeName := node.ObjectMeta.Name
+	stableSince, pvNames, arrayIDs, driverPodReady, ok := cm.Recovery.recoveryChecks(nodeName)
+	if !ok || stableSince.IsZero() {
+		return recoveryNodeNotStable, "node has not been seen with the podmon taint"
+	}
+	if stablePeriod := GetRecoveryStablePeriod(); now.Sub(stableSince) < stablePeriod {
+		return recoveryNodeNotStable, fmt.Sprintf("node UID and bootID have been stable for %v of %v",
+			now.Sub(stableSince).Truncate(time.Second), stablePeriod)
+	}
+	// Check the connectivity with each array of the cleaned up PVs, and with the default array of each
+	// other driver whose taint is on the node.
+	checked := make(map[string]bool)
+	for _, id := range arrayIDs {
+		driver, arrayID := cm.csiDriverForArray(id)
+		if !nodeHasTaint(node, driver.TaintKey, v1.TaintEffectNoSchedule) {
+			continue
+		}
+		checked[driver.Path] = true
+		if check, explanation := checkArrayRecovered(driver, node, arrayID); check != "" {
+			return check, explanation
+		}
+	}
+	for _, driver := range cm.csiDrivers() {
+		if checked[driver.Path] || !nodeHasTaint(node, driver.TaintKey, v1.TaintEffectNoSchedule) {
+			continue
+		}
+		if check, explanation := checkArrayRecovered(driver, node, defaultArray); check != "" {
+			return check, explanation
+		}
+	}
+	ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+	defer cancel()
+	for _, pvName := range pvNames {
+		va, err := K8sAPI.GetCachedVolumeAttachment(ctx, pvName, nodeName)
+		if err != nil {
+			return recoveryStaleVA, fmt.Sprintf("couldn't check VolumeAttachments: %s", err)
+		}
+		if va != nil {
+			return recoveryStaleVA, fmt.Sprintf("VolumeAttachment %s for cleaned up PV %s remains", va.ObjectMeta.Name, pvName)
+		}
+	}
+	if !driverPodReady {
+		return recoveryDriverNodePodMissing, "driver node pod is not Ready"
+	}
+	return "", ""
+}
+
+// checkArrayRecovered returns recoveryArrayNotConnected and an explanation unless the driver reports the node connected to the array.
+func checkArrayRecovered(driver *CSIDriver, node *v1.Node, arrayID string) (string, string) {
+	connected, _, err := callDriverValidateVolumeHostConnectivity(driver, node, []string{}, arrayID, false)
+	if err != nil {
+		return recoveryArrayNotConnected, fmt.Sprintf("couldn't validate connectivity to array %s: %s", arrayID, err)
+	}
+	if !connected {
+		return recoveryArrayNotConnected, fmt.Sprintf("ValidateVolumeHostConnectivity reports the node is not connected to array %s", arrayID)
+	}
+	return "", ""
+}
+
+// reconcileNodeRecovery makes a pass over the tainted nodes, removing the podmon taint from those that have recovered.
+func (cm *PodMonitorType) reconcileNodeRecovery(now time.Time) {
+	for _, nodeName := range cm.Recovery.snapshot() {
+		ctx, cancel := K8sAPI.GetContext(MediumTimeout)
+		node, err := K8sAPI.GetNode(ctx, nodeName)
+		cancel()
+		if err != nil {
+			log.Errorf("Recovery reconciler couldn't get node %s: %s", nodeName, err)
+			continue
+		}
+		taintKeys := cm.nodePodmonTaintKeys(node)
+		cm.Recovery.observeNode(node, len(taintKeys) > 0, now)
+		if len(taintKeys) == 0 {
+			continue
+		}
+		fields := map[string]interface{}{"node": nodeName}
+		check, explanation := cm.nodeRecoveryCheck(node, now)
+		if check != "" {
+			fields["check"] = check
+			log.WithFields(fields).Infof("Keeping taint on node: %s", explanation)
+			if cm.Recovery.setPending(nodeName, check) {
+				if err = K8sAPI.CreateEvent(podmon, node, k8sapi.EventTypeNormal, nodeRecoveryPendingReason,
+					"podmon kept taint on node %s: %s", nodeName, explanation); err != nil {
+					log.Errorf("Failed to send %s event: %s", nodeRecoveryPendingReason, err.Error())
+				}
+			}
+			continue
+		}
+		if GetDryRun() {
+			reportDryRun(node, fields, dryRunUntaintNode, nodeName)
+			continue
+		}
+		if nodeHasTaint(node, outOfServiceTaint, v1.TaintEffectNoExecute) {
+			if err = callK8sAPITaint("untainting ", nodeName, outOfServiceTaint, v1.TaintEffectNoExecute, true); err != nil {
+				log.WithFields(fields).Errorf("Recovery reconciler failed to remove out-of-service taint: %s", err)
+				continue
+			}
+		}
+		untainted := true
+		for _, taintKey := range taintKeys {
+			if err = taintNode(nodeName, taintKey, true); err != nil {
+				log.WithFields(fields).Errorf("Recovery reconciler failed to remove taint: %s", err)
+				untainted = false
+				break
+			}
+		}
+		if !untainted {
+			continue
+		}
+		cm.Recovery.forgetNode(nodeName)
+		log.WithFields(fields).Infof("Removed taint from recovered node")
+		if err = K8sAPI.CreateEvent(podmon, node, k8sapi.EventTypeNormal, nodeRecoveredReason,
+			"podmon removed taint from node %s: stable for %v, array connected, no stale VolumeAttachments, driver node pod Ready",
+			nodeName, GetRecoveryStablePeriod()); err != nil {
+			log.Errorf("Failed to send %s event: %s", nodeRecoveredReason, err.Error())
+		}
+	}
+}
+
+// NodeRecoveryReconciler -- periodically removes the podmon taint from nodes that have recovered.
+// This is a never ending function, intended to be called as Go routine.
+func (cm *PodMonitorType) NodeRecoveryReconciler() {
+	for {
+		if GetRecoveryStablePeriod() > 0 {
+			cm.reconcileNodeRecovery(time.Now())
+		}
+		time.Sleep(NodeRecoveryInterval)
+		if NodeRecoveryInterval < 10*time.Millisecond {
+			// unit testing exit
+			return
+		}
+	}
+}
+
+// nodeRecoveryHandler keeps the recovery reconciler's view of the node up to date.
+func (cm *PodMonitorType) nodeRecoveryHandler(node *v1.Node, eventType watch.EventType) {
+	if eventType == watch.Deleted {
+		cm.Recovery.forgetNode(node.ObjectMeta.Name)
+		return
+	}
+	cm.Recovery.observeNode(node, cm.nodeHasPodmonTaint(node), time.Now())
+}
@@ -0,0 +1,364 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"podmon/internal/metrics"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// cleanupConcurrency is the maximum number of pod cleanups run at the same time.
+var cleanupConcurrency = 10
+
+// cleanupMaxRetries is the number of times a failed cleanup is retried. The retries back off exponentially
+// from cleanupRetryBaseDelay to cleanupRetryMaxDelay.
+var (
+	cleanupMaxRetries     = 5
+	cleanupRetryBaseDelay = 5 * time.Second
+	cleanupRetryMaxDelay  = 5 * time.Minute
+)
+
+// GetCleanupConcurrency returns the maximum number of pod cleanups run at the same time.
+func GetCleanupConcurrency() int {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return cleanupConcurrency
+}
+
+// SetCleanupConcurrency sets the maximum number of pod cleanups run at the same time.
+func SetCleanupConcurrency(concurrency int) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	cleanupConcurrency = concurrency
+}
+
+// GetCleanupRetryLimits returns the number of times a failed cleanup is retried, and the first and maximum retry delay.
+func GetCleanupRetryLimits() (int, time.Duration, time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	return cleanupMaxRetries, cleanupRetryBaseDelay, cleanupRetryMaxDelay
+}
+
+// SetCleanupRetryLimits sets the number of times a failed cleanup is retried, and the first and maximum retry delay.
+// The delays are read when a CleanupScheduler is first used.
+func SetCleanupRetryLimits(maxRetries int, baseDelay, maxDelay time.Duration) {
+	dynamicConfigUpdateMutex.Lock()
+	defer dynamicConfigUpdateMutex.Unlock()
+	cleanupMaxRetries = maxRetries
+	cleanupRetryBaseDelay = baseDelay
+	cleanupRetryMaxDelay = maxDelay
+}
+
+// podCleanupPriority returns the priority used to order the pod's cleanup: the cleanup priority annotation if set,
+// otherwise the pod's PriorityClass value, otherwise 0.
+func podCleanupPriority(pod *v1.Pod, policy PodPolicy) int {
+	if policy.CleanupPrioritySet {
+		return policy.CleanupPriority
+	}
+	if pod.Spec.Priority != nil {
+		return int(*pod.Spec.Priority)
+	}
+	return 0
+}
+
+// cleanupQueueName is the name of the cleanup work queue, used to label its metrics.
+const cleanupQueueName = "pod_cleanup"
+
+// cleanupTask is a cleanup waiting to be run by the CleanupScheduler.
+type cleanupTask struct {
+	name      string       // the pod keys joined by commas, the work queue key
+	pods      []string     // the keys of the pods being cleaned
+	priority  int          // higher priority tasks run first
+	seq       uint64       // submission order, used to run equal priority tasks first come first served
+	run       func() error // the cleanup, an error causes it to be retried
+	notBefore time.Time    // the cleanup is delayed until then
+	start     time.Time    // when the cleanup last started running
+}
+
+// CleanupScheduler runs pod cleanups from a keyed, rate limited work queue with bounded parallelism, highest priority first.
+// Cleanups are deduplicated on the pods they clean up: a cleanup submitted for the same pods as a waiting one replaces it,
+// one submitted for pods that a waiting cleanup already includes shares it, and one submitted for more pods replaces the
+// waiting cleanups of its pods. A cleanup sharing a pod with a running cleanup is run after it finishes, so a pod is never
+// cleaned up by two workers at once. Failed cleanups are retried with exponential backoff up to the cleanup retry limit.
+// The zero value is ready to use.
+type CleanupScheduler struct {
+	initOnce sync.Once
+	queue    workqueue.TypedRateLimitingInterface[string]
+	mutex    sync.Mutex
+	slotFree *sync.Cond              // signaled when a running cleanup finishes
+	tasks    map[string]*cleanupTask // the cleanup waiting to run for each key
+	active   map[string]*cleanupTask // the running cleanup of each key
+	blocked  map[string]bool         // the waiting keys taken off the work queue until a cleanup sharing their pods finishes
+	running  int
+	seq      uint64 // number of tasks submitted
+	started  uint64 // number of tasks started, used to log the processing order
+}
+
+// cleanupPriorityQueue orders the keys waiting in the cleanup work queue by the priority of their cleanups, and then
+// by submission order. It is called with the work queue lock held.
+type cleanupPriorityQueue struct {
+	scheduler *CleanupScheduler
+	keys      []string
+}
+
+// Touch is called when a waiting key is added again, the priority is looked up when popping so nothing is needed.
+func (q *cleanupPriorityQueue) Touch(_ string) {}
+
+// Push adds a key.
+func (q *cleanupPriorityQueue) Push(key string) {
+	q.keys = append(q.keys, key)
+}
+
+// Len returns the number of keys waiting.
+func (q *cleanupPriorityQueue) Len() int {
+	return len(q.keys)
+}
+
+// Pop removes and returns the key of the highest priority cleanup.
+func (q *cleanupPriorityQueue) Pop() string {
+	s := q.scheduler
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	next := 0
+	for i := 1; i < len(q.keys); i++ {
+		task, best := s.tasks[q.keys[i]], s.tasks[q.keys[next]]
+		if task == nil || best == nil {
+			continue
+		}
+		if task.priority > best.priority || (task.priority == best.priority && task.seq < best.seq) {
+			next = i
+		}
+	}
+	key := q.keys[next]
+	q.keys = append(q.keys[:next], q.keys[next+1:]...)
+	return key
+}
+
+// init creates the work queue and starts dispatching from it.
+func (s *CleanupScheduler) init() {
+	s.initOnce.Do(func() {
+		s.tasks = make(map[string]*cleanupTask)
+		s.active = make(map[string]*cleanupTask)
+		s.blocked = make(map[string]bool)
+		s.slotFree = sync.NewCond(&s.mutex)
+		_, baseDelay, maxDelay := GetCleanupRetryLimits()
+		queue := workqueue.NewTypedWithConfig(workqueue.TypedQueueConfig[string]{
+			Name:            cleanupQueueName,
+			MetricsProvider: metrics.WorkQueueMetricsProvider{},
+			Queue:           &cleanupPriorityQueue{scheduler: s},
+		})
+		s.queue = workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.NewTypedItemExponentialFailureRateLimiter[string](baseDelay, maxDelay),
+			workqueue.TypedRateLimitingQueueConfig[string]{
+				Name:            cleanupQueueName,
+				MetricsProvider: metrics.WorkQueueMetricsProvider{},
+				DelayingQueue: workqueue.NewTypedDelayingQueueWithConfig(workqueue.TypedDelayingQueueConfig[string]{
+					Name:            cleanupQueueName,
+					MetricsProvider: metrics.WorkQueueMetricsProvider{},
+					Queue:           queue,
+				}),
+			})
+		go s.dispatch()
+	})
+}
+
+// submit queues the cleanup of the pods to be run when there is capacity. If a cleanup of the same pods is already
+// waiting it is replaced. If a waiting cleanup already includes the pods, the cleanup isn't queued.
+func (s *CleanupScheduler) submit(podKeys []string, priority int, run func() error) {
+	s.submitAfter(podKeys, priority, 0, run)
+}
+
+// submitAfter queues the cleanup of the pods to be run when there is capacity once delay has passed, without
+// holding a worker while it waits. A delayed cleanup is not replaced by a cleanup of the same pods submitted
+// before the delay has passed.
+func (s *CleanupScheduler) submitAfter(podKeys []string, priority int, delay time.Duration, run func() error) {
+	s.init()
+	name := strings.Join(podKeys, ",")
+	s.mutex.Lock()
+	task, ok := s.tasks[name]
+	if ok && time.Now().Before(task.notBefore) {
+		log.Debugf("Cleanup of %s already queued until %v", name, task.notBefore)
+		s.mutex.Unlock()
+		return
+	} else if ok {
+		task.priority = priority
+		task.run = run
+		task.notBefore = time.Now().Add(delay)
+		log.Debugf("Cleanup of %s already queued, updated priority %d", name, priority)
+	} else if task = s.waitingCleanupOf(podKeys); task != nil {
+		task.priority = max(task.priority, priority)
+		log.Debugf("Cleanup of %s already queued with %s, priority %d", name, task.name, task.priority)
+		s.mutex.Unlock()
+		return
+	} else {
+		s.seq++
+		task = &cleanupTask{name: name, pods: podKeys, priority: priority, seq: s.seq, run: run, notBefore: time.Now().Add(delay)}
+		for otherName, other := range s.tasks {
+			if containsAll(podKeys, other.pods) {
+				log.Debugf("Cleanup of %s replaces the queued cleanup of %s", name, otherName)
+				delete(s.tasks, otherName)
+				delete(s.blocked, otherName)
+			}
+		}
+		s.tasks[name] = task
+		log.Debugf("Queued cleanup of %s priority %d, %d pending", name, priority, len(s.tasks))
+	}
+	s.mutex.Unlock()
+	s.queue.AddAfter(name, delay)
+}
+
+// waitingCleanupOf returns a waiting cleanup that includes all the pods, or nil. It is called with the mutex held.
+func (s *CleanupScheduler) waitingCleanupOf(podKeys []string) *cleanupTask {
+	for _, task := range s.tasks {
+		if containsAll(task.pods, podKeys) {
+			return task
+		}
+	}
+	return nil
+}
+
+// isWaiting returns true if a waiting cleanup includes the pod.
+func (s *CleanupScheduler) isWaiting(podKey string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.waitingCleanupOf([]string{podKey}) != nil
+}
+
+// runningCleanupOfAny returns true if a running cleanup includes any of the pods. It is called with the mutex held.
+func (s *CleanupScheduler) runningCleanupOfAny(podKeys []string) bool {
+	for _, task := range s.active {
+		for _, podKey := range podKeys {
+			if containsAll(task.pods, []string{podKey}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsAll returns true if all of the keys are in the set of keys.
+func containsAll(set, keys []string) bool {
+	for _, key := range keys {
+		found := false
+		for _, member := range set {
+			if member == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// dispatch starts the highest priority waiting cleanup whenever there is capacity. It never returns.
+func (s *CleanupScheduler) dispatch() {
+	for {
+		s.mutex.Lock()
+		for s.running >= max(GetCleanupConcurrency(), 1) {
+			s.slotFree.Wait()
+		}
+		s.mutex.Unlock()
+		key, shutdown := s.queue.Get()
+		if shutdown {
+			return
+		}
+		s.mutex.Lock()
+		task, ok := s.tasks[key]
+		if !ok {
+			// a delayed retry of a cleanup that has since been run
+			s.mutex.Unlock()
+			s.queue.Done(key)
+			continue
+		}
+		if wait := time.Until(task.notBefore); wait > 0 {
+			// a delayed cleanup queued again before its delay has passed
+			s.mutex.Unlock()
+			s.queue.Done(key)
+			s.queue.AddAfter(key, wait)
+			continue
+		}
+		if s.runningCleanupOfAny(task.pods) {
+			// another cleanup of some of its pods is running, so take it off the queue until that finishes
+			s.blocked[key] = true
+			s.mutex.Unlock()
+			s.queue.Done(key)
+			continue
+		}
+		delete(s.tasks, key)
+		s.running++
+		s.started++
+		task.start = time.Now()
+		s.active[key] = task
+		log.WithFields(map[string]interface{}{
+			"order":    s.started,
+			"priority": task.priority,
+			"pending":  len(s.tasks),
+			"running":  s.running,
+			"retry":    s.queue.NumRequeues(key),
+		}).Infof("Starting cleanup of %s", task.name)
+		s.mutex.Unlock()
+		go s.runTask(task)
+	}
+}
+
+// runTask runs the task, requeuing it with backoff if it failed and has retries left.
+func (s *CleanupScheduler) runTask(task *cleanupTask) {
+	err := task.run()
+	retries := s.queue.NumRequeues(task.name)
+	maxRetries, _, _ := GetCleanupRetryLimits()
+	retry := err != nil && retries < maxRetries
+	s.mutex.Lock()
+	s.running--
+	delete(s.active, task.name)
+	if retry {
+		if s.waitingCleanupOf(task.pods) != nil {
+			// a newer cleanup of these pods is waiting, it replaces the retry
+			retry = false
+		} else {
+			s.tasks[task.name] = task
+		}
+	}
+	if !retry {
+		// forget the retries before the cleanup stops being reported as running
+		if err != nil && maxRetries > 0 {
+			log.Errorf("Cleanup of %s failed after %d retries: %s", task.name, retries, err)
+		}
+		s.queue.Forget(task.name)
+	}
+	unblocked := make([]string, 0, len(s.blocked))
+	for key := range s.blocked {
+		unblocked = append(unblocked, key)
+	}
+	clear(s.blocked)
+	s.slotFree.Signal()
+	s.mutex.Unlock()
+	for _, key := range unblocked {
+		s.queue.Add(key)
+	}
+	if retry {
+		log.Warnf("Cleanup of %s failed, retry %d of %d: %s", task.name, retries+1, maxRetries, err)
+		s.queue.AddRateLimited(task.name)
+	}
+	s.queue.Done(task.name)
+}
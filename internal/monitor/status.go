@@ -0,0 +1,293 @@
+// Copyright © 2021-2023 Dell Inc. or its subsidiaries. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The status API serves a read-only JSON snapshot of what podmon currently believes at /status, so the state that
+// led to a failover decision can be inspected. It is served by both the controller and the node agents.
+
+// StatusPath is the path the status API is served at.
+const StatusPath = "/status"
+
+// Status is the snapshot of podmon's internal state returned by the status API.
+type Status struct {
+	Mode                      string                        `json:"mode"`
+	Time                      time.Time                     `json:"time"`
+	APIConnected              bool                          `json:"apiConnected"`
+	ArrayConnected            bool                          `json:"arrayConnected"`
+	ControllerPods            []ControllerPodStatus         `json:"controllerPods"`
+	NodePods                  []NodePodStatus               `json:"nodePods"`
+	NodeUIDs                  map[string]string             `json:"nodeUIDs"`
+	Connectivity              []NodeArrayConnectivityStatus `json:"connectivity"`
+	ArrayOutages              []ArrayOutageStatus           `json:"arrayOutages"`
+	CrashLoopBackOffDeletions map[string][]time.Time        `json:"crashLoopBackOffDeletions"`
+	Cleanups                  CleanupStatus                 `json:"cleanups"`
+	Configuration             map[string]interface{}        `json:"configuration"`
+}
+
+// ControllerPodStatus is the status of a pod in PodKeyToControllerPodInfo.
+type ControllerPodStatus struct {
+	PodKey          string    `json:"podKey"`
+	PodUID          string    `json:"podUID"`
+	Node            string    `json:"node"`
+	ArrayIDs        []string  `json:"arrayIDs"`
+	Policy          PodPolicy `json:"policy"`
+	CleanupPriority int       `json:"cleanupPriority"`
+}
+
+// NodePodStatus is the status of a pod in PodKeyMap.
+type NodePodStatus struct {
+	PodKey  string                `json:"podKey"`
+	PodUID  string                `json:"podUID"`
+	Mounts  []MountPathVolumeInfo `json:"mounts"`
+	Devices []BlockPathVolumeInfo `json:"devices"`
+}
+
+// NodeArrayConnectivityStatus is the connectivity state of a node:array pair in the connectivity cache.
+type NodeArrayConnectivityStatus struct {
+	Key         string    `json:"key"`
+	Connected   bool      `json:"connected"`
+	LossCount   int       `json:"lossCount"`
+	GoodCount   int       `json:"goodCount"`
+	FlapCount   int       `json:"flapCount"`
+	LastSampled time.Time `json:"lastSampled"`
+}
+
+// ArrayOutageStatus is an ongoing array outage.
+type ArrayOutageStatus struct {
+	ArrayID   string    `json:"arrayID"`
+	Since     time.Time `json:"since"`
+	LostNodes int       `json:"lostNodes"`
+	Nodes     int       `json:"nodes"`
+}
+
+// CleanupStatus is the state of the cleanup scheduler.
+type CleanupStatus struct {
+	Running []CleanupTaskStatus `json:"running"`
+	Waiting []CleanupTaskStatus `json:"waiting"`
+}
+
+// CleanupTaskStatus is a running or waiting cleanup.
+type CleanupTaskStatus struct {
+	Name     string     `json:"name"`
+	Priority int        `json:"priority"`
+	Started  *time.Time `json:"started,omitempty"`
+}
+
+// GetStatus returns a snapshot of the pod monitor's state.
+func (pm *PodMonitorType) GetStatus() Status {
+	status := Status{
+		Mode:                      pm.Mode,
+		Time:                      time.Now(),
+		APIConnected:              pm.APIConnected,
+		ArrayConnected:            pm.ArrayConnected,
+		ControllerPods:            make([]ControllerPodStatus, 0),
+		NodePods:                  make([]NodePodStatus, 0),
+		NodeUIDs:                  make(map[string]string),
+		CrashLoopBackOffDeletions: make(map[string][]time.Time),
+		Connectivity:              connectivityCache.status(),
+		ArrayOutages:              pm.Outages.status(),
+		Cleanups:                  pm.Scheduler.status(),
+		Configuration:             dynamicConfiguration(),
+	}
+	pm.PodKeyToControllerPodInfo.Range(func(_, value interface{}) bool {
+		info := value.(*ControllerPodInfo)
+		podStatus := ControllerPodStatus{
+			PodKey:          info.PodKey,
+			PodUID:          info.PodUID,
+			ArrayIDs:        info.ArrayIDs,
+			Policy:          info.Policy,
+			CleanupPriority: info.CleanupPriority,
+		}
+		if info.Node != nil {
+			podStatus.Node = info.Node.ObjectMeta.Name
+		}
+		status.ControllerPods = append(status.ControllerPods, podStatus)
+		return true
+	})
+	sort.Slice(status.ControllerPods, func(i, j int) bool {
+		return status.ControllerPods[i].PodKey < status.ControllerPods[j].PodKey
+	})
+	pm.PodKeyMap.Range(func(key, value interface{}) bool {
+		info := value.(*NodePodInfo)
+		status.NodePods = append(status.NodePods, NodePodStatus{
+			PodKey:  key.(string),
+			PodUID:  info.PodUID,
+			Mounts:  info.Mounts,
+			Devices: info.Devices,
+		})
+		return true
+	})
+	sort.Slice(status.NodePods, func(i, j int) bool {
+		return status.NodePods[i].PodKey < status.NodePods[j].PodKey
+	})
+	pm.NodeNameToUID.Range(func(key, value interface{}) bool {
+		status.NodeUIDs[key.(string)] = fmt.Sprintf("%v", value)
+		return true
+	})
+	pm.PodKeyToCrashLoopBackOffDeletions.Range(func(key, value interface{}) bool {
+		status.CrashLoopBackOffDeletions[key.(string)] = value.(*crashLoopBackOffDeletions).deletionTimes()
+		return true
+	})
+	return status
+}
+
+// status returns the connectivity state of the node:array pairs, sorted by key.
+func (nacc *nodeArrayConnectivityCache) status() []NodeArrayConnectivityStatus {
+	flapPolicy := GetArrayConnectivityFlapPolicy()
+	nacc.mutex.Lock()
+	defer nacc.mutex.Unlock()
+	result := make([]NodeArrayConnectivityStatus, 0, len(nacc.nodeArrayConnectivityLossCount))
+	for key, lossCount := range nacc.nodeArrayConnectivityLossCount {
+		result = append(result, NodeArrayConnectivityStatus{
+			Key:         key,
+			Connected:   nacc.connected(key, flapPolicy),
+			LossCount:   lossCount,
+			GoodCount:   nacc.nodeArrayConnectivityGoodCount[key],
+			FlapCount:   nacc.nodeArrayConnectivityFlapCount[key],
+			LastSampled: nacc.nodeArrayConnectivitySampledAt[key],
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// status returns the ongoing array outages, sorted by array ID.
+func (d *ArrayOutageDetector) status() []ArrayOutageStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	result := make([]ArrayOutageStatus, 0, len(d.outages))
+	for arrayID, outage := range d.outages {
+		result = append(result, ArrayOutageStatus{ArrayID: arrayID, Since: outage.since, LostNodes: outage.lost, Nodes: outage.nodes})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ArrayID < result[j].ArrayID })
+	return result
+}
+
+// status returns the running and waiting cleanups, sorted by name.
+func (s *CleanupScheduler) status() CleanupStatus {
+	result := CleanupStatus{Running: make([]CleanupTaskStatus, 0), Waiting: make([]CleanupTaskStatus, 0)}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for name, task := range s.active {
+		started := task.start
+		result.Running = append(result.Running, CleanupTaskStatus{Name: name, Priority: task.priority, Started: &started})
+	}
+	for name, task := range s.tasks {
+		result.Waiting = append(result.Waiting, CleanupTaskStatus{Name: name, Priority: task.priority})
+	}
+	sort.Slice(result.Running, func(i, j int) bool { return result.Running[i].Name < result.Running[j].Name })
+	sort.Slice(result.Waiting, func(i, j int) bool { return result.Waiting[i].Name < result.Waiting[j].Name })
+	return result
+}
+
+// deletionTimes returns a copy of the times the pod was deleted because of CrashLoopBackOff.
+func (d *crashLoopBackOffDeletions) deletionTimes() []time.Time {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]time.Time{}, d.times...)
+}
+
+// dynamicConfiguration returns the current values of the parameters that can be changed in the driver ConfigMap.
+// Durations are returned as strings.
+func dynamicConfiguration() map[string]interface{} {
+	maxNodes, maxPercent, failoverWindow := GetFailoverLimits()
+	fencingConcurrency, cleanupDeadline := GetFencingLimits()
+	crashLoopRetries, crashLoopBackoff, crashLoopWindow := GetCrashLoopBackOffLimits()
+	driverPodGrace, driverPodEscalation := GetDriverPodLimits()
+	driverPodFlaps, driverPodWindow := GetDriverPodFlapLimits()
+	flapThreshold, flapWindow := GetArrayConnectivityFlapLimits()
+	pollConcurrency, pollDeadline := GetArrayConnectivityPollLimits()
+	return map[string]interface{}{
+		"LogLevel":                  log.GetLevel().String(),
+		"ArrayConnectivityPollRate": GetArrayConnectivityPollRate().String(),
+		"ArrayConnectivityConnectionLossThreshold": ArrayConnectivityConnectionLossThreshold,
+		"ArrayConnectivityRecoveryThreshold":       GetArrayConnectivityRecoveryThreshold(),
+		"ArrayConnectivityFlapThreshold":           flapThreshold,
+		"ArrayConnectivityFlapWindow":              flapWindow,
+		"ArrayConnectivityFlapPolicy":              GetArrayConnectivityFlapPolicy(),
+		"ArrayConnectivityPollConcurrency":         pollConcurrency,
+		"ArrayConnectivityPollDeadline":            pollDeadline.String(),
+		"SkipArrayConnectionValidation":            PodMonitor.SkipArrayConnectionValidation,
+		"DryRun":                                   GetDryRun(),
+		"MaxFailoverNodes":                         maxNodes,
+		"MaxFailoverNodesPercent":                  maxPercent,
+		"FailoverWindow":                           failoverWindow.String(),
+		"FencingConcurrency":                       fencingConcurrency,
+		"CleanupDeadline":                          cleanupDeadline.String(),
+		"CleanupConcurrency":                       GetCleanupConcurrency(),
+		"FencingMode":                              GetFencingMode(),
+		"RecoveryStablePeriod":                     GetRecoveryStablePeriod().String(),
+		"MaxForceDeleteGracePeriod":                GetMaxForceDeleteGracePeriod().String(),
+		"CrashLoopBackOffMaxRetries":               crashLoopRetries,
+		"CrashLoopBackOffBackoff":                  crashLoopBackoff.String(),
+		"CrashLoopBackOffWindow":                   crashLoopWindow.String(),
+		"CrashLoopBackOffStorageErrorsOnly":        GetCrashLoopBackOffStorageErrorsOnly(),
+		"OrphanedVAMode":                           GetOrphanedVAMode(),
+		"OrphanedVANotReadyPeriod":                 GetOrphanedVANotReadyPeriod().String(),
+		"DriverPodGracePeriod":                     driverPodGrace.String(),
+		"DriverPodEscalationPeriod":                driverPodEscalation.String(),
+		"DriverPodFlapLimit":                       driverPodFlaps,
+		"DriverPodFlapWindow":                      driverPodWindow.String(),
+		"NodeConnectivityReportInterval":           GetNodeConnectivityReportInterval().String(),
+		"PublishArrayConnectivity":                 GetPublishArrayConnectivity(),
+		"ArrayOutageNodesPercent":                  GetArrayOutageNodesPercent(),
+	}
+}
+
+// StatusHandler returns the http handler serving the status API.
+func (pm *PodMonitorType) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodHead}, ", "))
+			http.Error(w, "the status API is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(pm.GetStatus()); err != nil {
+			log.Errorf("Couldn't encode the status: %s", err)
+		}
+	})
+}
+
+// ListenAndServeStatus serves the status API at StatusPath on the given address.
+// It is intended to be called as a Go routine and only returns on error.
+func (pm *PodMonitorType) ListenAndServeStatus(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle(StatusPath, pm.StatusHandler())
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Infof("Serving status at %s%s", address, StatusPath)
+	err := server.ListenAndServe()
+	if err != nil {
+		log.Errorf("status server stopped: %s", err)
+	}
+	return err
+}